@@ -1,7 +1,10 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
+	"log"
 	"mexemexe/internal/client"
 	"mexemexe/internal/engine"
 	"os"
@@ -22,40 +25,83 @@ func SigtermListener(signalChan chan os.Signal, stopChan chan struct{}) {
 
 func main() {
 
-	serverIP := "127.0.0.1"
+	config, err := client.LoadClientConfig(os.Args[1:], os.LookupEnv)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	// Instantiate a client
-	client := client.NewClient(serverIP, "8888")
-	defer client.Close()
+	gameClient := client.NewClient(config)
 
-	// Set username
-	client.SetUsername()
+	// Set username, unless logging in again with a session
+	if gameClient.NeedsUsername() {
+		gameClient.SetUsername()
+	}
+	err = gameClient.SetPassword()
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	// Establish websocket connection
-	client.SetWebsocketConnection()
+	err = gameClient.Connect()
+	if err != nil {
+		log.Fatalf("Could not connect to the server: %v", err)
+	}
+	defer gameClient.Close()
 
 	// Send join message - Here should enter authentication
-	client.SendJoinMessage()
+	gameClient.SendJoinMessage()
 
 	// Read join response from server
-	client.ReceiveWelcomeMessage()
-
-	// Send start game message to server -- TODO with game options
-	client.SendStartGameMessage()
+	err = gameClient.WaitForWelcome()
+	if err != nil {
+		log.Fatalf("Could not join the server: %v", err)
+	}
 
-	// Read Join game response from server
-	client.ReceiveJoinedGameRoomMessage()
+	if config.Lobby {
+		err = gameClient.ShowLobby()
+		if err != nil {
+			log.Fatalf("Could not read the lobby: %v", err)
+		}
+		return
+	}
 
-	// Read Game started message from server
-	client.ReceiveGameStartedMessage()
+	// The rating is shown while waiting for the game
+	gameClient.RequestRating()
 
-	// Set renderer
-	renderer := engine.NewRenderer(client.Username)
-	client.SetRenderer(renderer)
+	// Send start game message to server -- TODO with game options
+	gameClient.SendStartGameMessage()
 
-	// Setup signal and stop channels
+	// Interrupting the search leaves the queue instead of dropping the connection
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
+	waiting := make(chan struct{})
+	go func() {
+		select {
+		case <-signalChan:
+			gameClient.CancelSearch()
+		case <-waiting:
+		}
+	}()
+
+	// Wait in the queue until the first game state arrives
+	firstState, err := gameClient.WaitForGameStart()
+	close(waiting)
+	if errors.Is(err, client.ErrSearchCancelled) {
+		return
+	}
+	if err != nil {
+		log.Fatalf("Could not start a game: %v", err)
+	}
+
+	// Set renderer
+	renderer := engine.NewRenderer(gameClient.Username)
+	gameClient.SetRenderer(renderer)
+
+	// Setup stop channel
 	stopChan := make(chan struct{})
 
 	// Start signal listener
@@ -65,6 +111,6 @@ func main() {
 	stopDisplay := make(chan bool)
 
 	// Start the game!
-	client.StartGame(stopDisplay)
+	gameClient.StartGame(firstState, stopDisplay)
 
 }
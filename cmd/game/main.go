@@ -1,23 +1,122 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"io"
+	"log"
 	"mexemexe/internal/engine"
 	"mexemexe/internal/service"
+	"os"
+	"strings"
 )
 
+// Offline mexe-mexe: humans take turns on the same terminal, optionally against bots.
 func main() {
 
-	gameConfig := engine.GameConfig{
-		Seed:              engine.UNIQUE_SHUFFLE_SEED,
-		PlayersName:       []string{"Gui", "Mi"},
-		NumPlayers:        2,
-		NumCards:          21,
-		RandomPlayerOrder: true,
-		TotalCards:        uint8(engine.TOTAL_DECK_SIZE),
+	playersFlag := flag.String("players", "Player1,Player2", "comma separated names of the human players sharing this terminal")
+	numBots := flag.Int("bots", 0, "number of computer players")
+	numCards := flag.Int("cards", engine.NUM_CARDS, "number of cards dealt to each player")
+	seed := flag.Uint64("seed", engine.UNIQUE_SHUFFLE_SEED, "deck shuffle seed (1 shuffles with the current time)")
+	opening := flag.Uint("opening", 0, "minimum points of each player's first meld, made only from their hand (0 disables)")
+	discardPile := flag.Bool("discard-pile", false, "end each turn by discarding a card, which the next player may take instead of drawing")
+	flag.Parse()
+
+	humans := []string{}
+	for _, name := range strings.Split(*playersFlag, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			humans = append(humans, name)
+		}
+	}
+
+	playersName := append([]string{}, humans...)
+	for i := range *numBots {
+		playersName = append(playersName, fmt.Sprintf("Bot%d", i+1))
+	}
+
+	numPlayers := len(playersName)
+	if numPlayers < 2 {
+		log.Fatal("A game needs at least 2 players. Add more players or bots.")
+	}
+	if *numCards < engine.MIN_MELD_SIZE || numPlayers*(*numCards) >= int(engine.TOTAL_DECK_SIZE) {
+		log.Fatalf("Cannot deal %d cards to %d players from a deck of %d cards.", *numCards, numPlayers, engine.TOTAL_DECK_SIZE)
+	}
+
+	playersUUID := make([]string, numPlayers)
+	for i := range playersUUID {
+		playersUUID[i] = fmt.Sprintf("local-%d", i)
+	}
+
+	gameConfig := engine.NewGameConfig(playersName, playersUUID)
+	gameConfig.NumCards = uint8(*numCards)
+	gameConfig.Seed = *seed
+	gameConfig.Rules.OpeningMinPoints = uint32(*opening)
+	gameConfig.Rules.DiscardPile = *discardPile
+
+	// Engine debug output would be drawn over the game screen
+	log.SetOutput(io.Discard)
+	logger := service.NewLogger(service.LEVEL_ERROR, "local")
+	game := engine.NewGame(gameConfig, logger)
+
+	isBot := make(map[string]bool)
+	for i := len(humans); i < numPlayers; i++ {
+		isBot[playersUUID[i]] = true
+	}
+
+	// Several humans on one keyboard must not see each other's hands
+	var hotSeat *engine.HotSeat
+	if len(humans) > 1 {
+		hotSeat = engine.NewHotSeat()
 	}
 
-	logger := service.NewLogger(0, "test")
-	game := engine.NewGame(&gameConfig, logger)
-	fmt.Println(game)
+	// Providers are indexed like game.Players, which were shuffled by NewGame
+	inputProviders := make([]engine.InputProvider, numPlayers)
+	outputProviders := make([]engine.OutputProvider, numPlayers)
+	for i, player := range game.Players {
+		if isBot[player.UUID] {
+			bot := engine.NewBotProvider(player.UUID)
+			inputProviders[i] = bot
+			outputProviders[i] = bot
+			continue
+		}
+		renderer := engine.NewRenderer(player.Name)
+		inputProviders[i] = engine.NewTerminalInputProvider(player.UUID, renderer, hotSeat)
+		outputProviders[i] = engine.NewTerminalOutputProvider(player.UUID, renderer)
+	}
+
+	finished := game.Start(inputProviders, outputProviders, game.Players[0].UUID)
+	fmt.Print("\033[H\033[2J")
+
+	if !finished {
+		fmt.Println("Game aborted.")
+		os.Exit(0)
+	}
+
+	// The hand of a player who left may be empty too, so the result tells who won
+	result := game.Result()
+	winner := ""
+	for _, player := range result.Players {
+		if player.UUID == result.WinnerUUID {
+			winner = player.Name
+		}
+	}
+
+	switch result.Outcome {
+	case engine.OUTCOME_WON:
+		fmt.Printf("%s wins!\n", winner)
+	case engine.OUTCOME_RESIGNED:
+		fmt.Printf("Everyone else left the game. %s wins!\n", winner)
+	default:
+		fmt.Println("Deck is empty! Game over!")
+		for _, player := range result.Players {
+			if player.Left {
+				fmt.Printf("%s: left the game\n", player.Name)
+				continue
+			}
+			fmt.Printf("%s: %d cards left\n", player.Name, player.CardsLeft)
+		}
+		if winner != "" {
+			fmt.Printf("%s wins!\n", winner)
+		}
+	}
 }
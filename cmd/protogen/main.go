@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"mexemexe/internal/protogen"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Writes the JSON Schema and TypeScript definitions of the wire protocol.
+// With -check it only reports files that are out of date, for CI.
+func main() {
+
+	outDir := flag.String("out", "schema", "directory of the generated files")
+	check := flag.Bool("check", false, "fail if the generated files differ from the ones in -out instead of writing them")
+	flag.Parse()
+
+	files, err := protogen.Generate()
+	if err != nil {
+		log.Fatalf("Could not generate the protocol definitions: %v", err)
+	}
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	stale := 0
+	for _, name := range names {
+		path := filepath.Join(*outDir, name)
+		if *check {
+			current, err := os.ReadFile(path)
+			if err != nil || !bytes.Equal(current, files[name]) {
+				fmt.Printf("%s is out of date\n", path)
+				stale++
+			}
+			continue
+		}
+
+		err := os.MkdirAll(*outDir, 0o755)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = os.WriteFile(path, files[name], 0o644)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("wrote %s\n", path)
+	}
+
+	if stale > 0 {
+		fmt.Println("Run `go run ./cmd/protogen` and commit the result.")
+		os.Exit(1)
+	}
+}
@@ -1,23 +1,120 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"log"
 	"mexemexe/internal/server"
-	"mexemexe/internal/service"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
-func main() {
+// HTTP_SHUTDOWN_TIMEOUT is how long the HTTP server waits for open requests once the games are drained
+const HTTP_SHUTDOWN_TIMEOUT = 10 * time.Second
+
+// REDIRECT_READ_HEADER_TIMEOUT drops plain HTTP clients that are slow to send their request
+const REDIRECT_READ_HEADER_TIMEOUT = 10 * time.Second
 
-	serverConfig := server.NewServerConfig(service.LEVEL_DEBUG)
+func main() {
 
-	server := server.NewServer(serverConfig)
-	http.HandleFunc("/ws", server.HandleConnections)
+	serverConfig, err := server.LoadServerConfig(os.Args[1:], os.LookupEnv)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Effective configuration:\n%s", serverConfig.Dump())
 
-	log.Println("HTTP server started on :8888")
-	err := http.ListenAndServe(":8888", nil)
+	gameServer := server.NewServer(serverConfig)
+	restored, err := gameServer.RestoreRooms()
 	if err != nil {
+		log.Printf("Some saved games could not be restored: %v", err)
+	}
+	if restored > 0 {
+		log.Printf("Restored %d games, waiting for their players to rejoin", restored)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", gameServer.HandleConnections)
+	httpServer := &http.Server{
+		Addr:    serverConfig.Addr(),
+		Handler: mux,
+	}
+
+	// Servers to stop on shutdown, the redirect one only with TLS
+	httpServers := []*http.Server{httpServer}
+	if serverConfig.TLS.Enabled() {
+		tlsConfig, err := server.NewTLSConfig(serverConfig.TLS, []string{serverConfig.Host})
+		if err != nil {
+			log.Fatal(err)
+		}
+		if serverConfig.TLS.SelfSigned {
+			log.Printf("Serving a self-signed development certificate, SHA-256 fingerprint %s. Save it for the client -ca flag:\n%s",
+				server.CertificateFingerprint(tlsConfig), server.CertificatePEM(tlsConfig))
+		}
+		httpServer.TLSConfig = tlsConfig
+		httpServer.Handler = server.WithHSTS(mux, serverConfig.TLS.HSTSMaxAge)
+
+		if serverConfig.TLS.RedirectPort != 0 {
+			httpServers = append(httpServers, &http.Server{
+				Addr:              serverConfig.RedirectAddr(),
+				Handler:           server.RedirectToHTTPS(serverConfig.Port),
+				ReadHeaderTimeout: REDIRECT_READ_HEADER_TIMEOUT,
+			})
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	serverErr := make(chan error, len(httpServers))
+	for _, srv := range httpServers {
+		go func() {
+			if srv.TLSConfig != nil {
+				log.Printf("HTTPS server started on %s", srv.Addr)
+				serverErr <- srv.ListenAndServeTLS("", "")
+				return
+			}
+			if srv != httpServer {
+				log.Printf("Redirecting HTTP on %s to HTTPS", srv.Addr)
+			} else {
+				log.Printf("HTTP server started on %s", srv.Addr)
+			}
+			serverErr <- srv.ListenAndServe()
+		}()
+	}
+
+	select {
+	case err := <-serverErr:
 		log.Fatal("ListenAndServe: ", err)
+	case <-ctx.Done():
 	}
+	stop()
 
+	log.Printf("Shutting down, waiting up to %v for games in progress", serverConfig.DrainTimeout)
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), serverConfig.DrainTimeout)
+	defer cancelDrain()
+	err = gameServer.Shutdown(drainCtx)
+	if err != nil {
+		log.Printf("Some games were cut short: %v", err)
+	}
+
+	// Websocket connections are hijacked, so this only waits for plain HTTP requests
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), HTTP_SHUTDOWN_TIMEOUT)
+	defer cancelShutdown()
+	for _, srv := range httpServers {
+		err = srv.Shutdown(shutdownCtx)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("HTTP server shutdown: %v", err)
+		}
+	}
+	err = gameServer.Close()
+	if err != nil {
+		log.Printf("Closing storage: %v", err)
+	}
+	log.Println("Server stopped")
 }
@@ -0,0 +1,75 @@
+package auth
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+// MIN_USERNAME_LENGTH and MAX_USERNAME_LENGTH bound the length of usernames
+const MIN_USERNAME_LENGTH = 2
+const MAX_USERNAME_LENGTH = 30
+
+var usernamePattern = regexp.MustCompile("^[a-zA-Z0-9_]+$")
+
+var (
+	ErrInvalidUsername    = errors.New("usernames are 2 to 30 letters, digits or underscores")
+	ErrInvalidCredentials = errors.New("wrong username or password")
+	ErrPasswordRequired   = errors.New("this server requires an account")
+	ErrUsernameTaken      = errors.New("username already registered")
+	ErrWeakPassword       = errors.New("passwords must have at least 8 characters")
+	ErrRegistrationClosed = errors.New("this server does not accept new accounts")
+)
+
+// Credentials are what a joining client presents to prove who it is
+type Credentials struct {
+	Username string
+	Password string
+}
+
+// Identity is who an authenticated client is. Guests have no UserID.
+type Identity struct {
+	UserID   string `json:"uid,omitempty"`
+	Username string `json:"name"`
+}
+
+// IsGuest tells whether the identity has no account behind it
+func (i Identity) IsGuest() bool {
+	return i.UserID == ""
+}
+
+// Authenticator checks the credentials of the clients joining the server
+type Authenticator interface {
+	Authenticate(credentials Credentials) (Identity, error)
+}
+
+// Registrar is implemented by authenticators that can create accounts
+type Registrar interface {
+	Register(credentials Credentials) (Identity, error)
+}
+
+// ValidateUsername checks a username can be displayed and typed by everyone
+func ValidateUsername(username string) error {
+	if len(strings.TrimSpace(username)) < MIN_USERNAME_LENGTH || len(username) > MAX_USERNAME_LENGTH {
+		return ErrInvalidUsername
+	}
+	if !usernamePattern.MatchString(username) {
+		return ErrInvalidUsername
+	}
+	return nil
+}
+
+// GuestAuthenticator lets anyone in under any valid username, without password
+type GuestAuthenticator struct{}
+
+func NewGuestAuthenticator() *GuestAuthenticator {
+	return &GuestAuthenticator{}
+}
+
+func (a *GuestAuthenticator) Authenticate(credentials Credentials) (Identity, error) {
+	err := ValidateUsername(credentials.Username)
+	if err != nil {
+		return Identity{}, err
+	}
+	return Identity{Username: credentials.Username}, nil
+}
@@ -0,0 +1,137 @@
+package auth
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// mapAccountStore keeps accounts in a map, keyed by lowercase username
+type mapAccountStore map[string]Account
+
+func (m mapAccountStore) GetAccount(username string) (Account, error) {
+	account, ok := m[strings.ToLower(username)]
+	if !ok {
+		return Account{}, ErrAccountNotFound
+	}
+	return account, nil
+}
+
+func (m mapAccountStore) CreateAccount(account Account) error {
+	key := strings.ToLower(account.Username)
+	if _, ok := m[key]; ok {
+		return ErrUsernameTaken
+	}
+	m[key] = account
+	return nil
+}
+
+// newTestAuthenticator returns a LocalAuthenticator over the accounts,
+// hashing with the lowest cost to keep the tests fast
+func newTestAuthenticator(accounts AccountStore, allowRegistration bool) *LocalAuthenticator {
+	authenticator := NewLocalAuthenticator(accounts, allowRegistration)
+	authenticator.cost = bcrypt.MinCost
+	return authenticator
+}
+
+func TestGuestAuthenticator(t *testing.T) {
+	authenticator := NewGuestAuthenticator()
+	identity, err := authenticator.Authenticate(Credentials{Username: "alice"})
+	if err != nil || identity.Username != "alice" || !identity.IsGuest() {
+		t.Errorf("Authenticate(alice) = %+v, %v", identity, err)
+	}
+
+	for _, username := range []string{"", "a", "not valid", strings.Repeat("x", MAX_USERNAME_LENGTH+1)} {
+		if _, err := authenticator.Authenticate(Credentials{Username: username}); !errors.Is(err, ErrInvalidUsername) {
+			t.Errorf("Authenticate(%q) error = %v, want ErrInvalidUsername", username, err)
+		}
+	}
+}
+
+func TestLocalAuthenticator(t *testing.T) {
+	accounts := mapAccountStore{}
+	authenticator := newTestAuthenticator(accounts, true)
+
+	registered, err := authenticator.Register(Credentials{Username: "Alice", Password: "correct horse"})
+	if err != nil || registered.IsGuest() || registered.Username != "Alice" {
+		t.Fatalf("Register() = %+v, %v", registered, err)
+	}
+
+	tests := []struct {
+		name        string
+		credentials Credentials
+		want        error
+	}{
+		{"right password", Credentials{Username: "Alice", Password: "correct horse"}, nil},
+		{"username in another case", Credentials{Username: "alice", Password: "correct horse"}, nil},
+		{"wrong password", Credentials{Username: "Alice", Password: "battery staple"}, ErrInvalidCredentials},
+		{"unknown username", Credentials{Username: "bob", Password: "correct horse"}, ErrInvalidCredentials},
+		{"no password", Credentials{Username: "Alice"}, ErrPasswordRequired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			identity, err := authenticator.Authenticate(tt.credentials)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("Authenticate() error = %v, want %v", err, tt.want)
+			}
+			if err == nil && identity != registered {
+				t.Errorf("Authenticate() = %+v, want %+v", identity, registered)
+			}
+		})
+	}
+
+	if _, err := authenticator.Register(Credentials{Username: "ALICE", Password: "another password"}); !errors.Is(err, ErrUsernameTaken) {
+		t.Errorf("registering a taken username in another case: %v", err)
+	}
+	if _, err := authenticator.Register(Credentials{Username: "bob", Password: "short"}); !errors.Is(err, ErrWeakPassword) {
+		t.Errorf("registering a short password: %v", err)
+	}
+
+	// Registration can be closed, leaving the existing accounts usable
+	reloaded := newTestAuthenticator(accounts, false)
+	if identity, err := reloaded.Authenticate(Credentials{Username: "Alice", Password: "correct horse"}); err != nil || identity != registered {
+		t.Errorf("Authenticate() after reload = %+v, %v", identity, err)
+	}
+	if _, err := reloaded.Register(Credentials{Username: "bob", Password: "long enough"}); !errors.Is(err, ErrRegistrationClosed) {
+		t.Errorf("registering with registration closed: %v", err)
+	}
+}
+
+func TestSessionSigner(t *testing.T) {
+	signer, err := NewSessionSigner([]byte(strings.Repeat("s", MIN_SESSION_SECRET_LENGTH)), time.Hour)
+	if err != nil {
+		t.Fatalf("NewSessionSigner() error: %v", err)
+	}
+	identity := Identity{UserID: "user-1", Username: "alice"}
+	now := time.Now()
+	token := signer.Issue(identity, now)
+
+	if got, err := signer.Verify(token, now.Add(59*time.Minute)); err != nil || got != identity {
+		t.Errorf("Verify() = %+v, %v", got, err)
+	}
+	if _, err := signer.Verify(token, now.Add(time.Hour)); !errors.Is(err, ErrSessionExpired) {
+		t.Errorf("Verify() of an expired token: %v", err)
+	}
+
+	payload, signature, _ := strings.Cut(token, ".")
+	forged := NewRandomSessionSigner(time.Hour).Issue(Identity{UserID: "user-2", Username: "mallory"}, now)
+	forgedPayload, _, _ := strings.Cut(forged, ".")
+	for name, bad := range map[string]string{
+		"no signature":     payload,
+		"other payload":    forgedPayload + "." + signature,
+		"other secret":     forged,
+		"not base64":       payload + ".!!!",
+		"truncated secret": payload + "." + signature[:10],
+	} {
+		if _, err := signer.Verify(bad, now); !errors.Is(err, ErrInvalidSession) {
+			t.Errorf("Verify() of a token with %s: %v", name, err)
+		}
+	}
+
+	if _, err := NewSessionSigner([]byte("short"), time.Hour); err == nil {
+		t.Error("NewSessionSigner() accepted a short secret")
+	}
+}
@@ -0,0 +1,102 @@
+package auth
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// MIN_PASSWORD_LENGTH is the shortest password accepted for a new account
+const MIN_PASSWORD_LENGTH = 8
+
+// ErrAccountNotFound is returned by an AccountStore that has no account under a username
+var ErrAccountNotFound = errors.New("account not found")
+
+// Account is a registered user. The password is only kept as a bcrypt hash.
+type Account struct {
+	ID           string    `json:"id"`
+	Username     string    `json:"username"`
+	PasswordHash []byte    `json:"password_hash"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// AccountStore keeps the accounts of a LocalAuthenticator. Usernames are
+// unique regardless of case. The store package has the implementations.
+type AccountStore interface {
+	GetAccount(username string) (Account, error)
+	// CreateAccount fails with ErrUsernameTaken when the username is in use
+	CreateAccount(account Account) error
+}
+
+// LocalAuthenticator checks passwords against the accounts of an AccountStore
+type LocalAuthenticator struct {
+	accounts          AccountStore
+	allowRegistration bool
+	cost              int
+}
+
+func NewLocalAuthenticator(accounts AccountStore, allowRegistration bool) *LocalAuthenticator {
+	return &LocalAuthenticator{
+		accounts:          accounts,
+		allowRegistration: allowRegistration,
+		cost:              bcrypt.DefaultCost,
+	}
+}
+
+func (a *LocalAuthenticator) Authenticate(credentials Credentials) (Identity, error) {
+	if credentials.Password == "" {
+		return Identity{}, ErrPasswordRequired
+	}
+	account, err := a.accounts.GetAccount(credentials.Username)
+	if errors.Is(err, ErrAccountNotFound) {
+		// Spend the time of a hash check, so unknown usernames can't be told apart
+		bcrypt.CompareHashAndPassword(dummyHash(), []byte(credentials.Password))
+		return Identity{}, ErrInvalidCredentials
+	}
+	if err != nil {
+		return Identity{}, err
+	}
+	err = bcrypt.CompareHashAndPassword(account.PasswordHash, []byte(credentials.Password))
+	if err != nil {
+		return Identity{}, ErrInvalidCredentials
+	}
+	return Identity{UserID: account.ID, Username: account.Username}, nil
+}
+
+func (a *LocalAuthenticator) Register(credentials Credentials) (Identity, error) {
+	if !a.allowRegistration {
+		return Identity{}, ErrRegistrationClosed
+	}
+	err := ValidateUsername(credentials.Username)
+	if err != nil {
+		return Identity{}, err
+	}
+	if len(credentials.Password) < MIN_PASSWORD_LENGTH {
+		return Identity{}, ErrWeakPassword
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(credentials.Password), a.cost)
+	if err != nil {
+		return Identity{}, err
+	}
+	account := Account{
+		ID:           uuid.New().String(),
+		Username:     credentials.Username,
+		PasswordHash: hash,
+		CreatedAt:    time.Now().UTC(),
+	}
+	err = a.accounts.CreateAccount(account)
+	if err != nil {
+		return Identity{}, err
+	}
+	return Identity{UserID: account.ID, Username: account.Username}, nil
+}
+
+// dummyHash is compared against when the username is unknown
+var dummyHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("mexe-mexe"), bcrypt.DefaultCost)
+	return hash
+})
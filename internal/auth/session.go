@@ -0,0 +1,100 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// MIN_SESSION_SECRET_LENGTH is the shortest secret accepted to sign session tokens
+const MIN_SESSION_SECRET_LENGTH = 32
+
+var (
+	ErrInvalidSession = errors.New("invalid session token")
+	ErrSessionExpired = errors.New("session expired")
+)
+
+// sessionClaims is the signed content of a session token
+type sessionClaims struct {
+	Identity
+	ExpiresAt int64 `json:"exp"`
+}
+
+// SessionSigner issues and checks the session tokens that let a client log in
+// again without its password. Tokens are the base64 claims and their HMAC-SHA256.
+type SessionSigner struct {
+	secret []byte
+	ttl    time.Duration
+}
+
+func NewSessionSigner(secret []byte, ttl time.Duration) (*SessionSigner, error) {
+	if len(secret) < MIN_SESSION_SECRET_LENGTH {
+		return nil, fmt.Errorf("session secret must have at least %d bytes, got %d", MIN_SESSION_SECRET_LENGTH, len(secret))
+	}
+	return &SessionSigner{
+		secret: secret,
+		ttl:    ttl,
+	}, nil
+}
+
+// NewRandomSessionSigner signs with a secret of its own, so its tokens don't
+// survive a restart of the server
+func NewRandomSessionSigner(ttl time.Duration) *SessionSigner {
+	secret := make([]byte, MIN_SESSION_SECRET_LENGTH)
+	_, err := rand.Read(secret)
+	if err != nil {
+		panic(fmt.Sprintf("reading random session secret: %v", err))
+	}
+	return &SessionSigner{
+		secret: secret,
+		ttl:    ttl,
+	}
+}
+
+// Issue returns a token for the identity, valid for the signer TTL from now
+func (s *SessionSigner) Issue(identity Identity, now time.Time) string {
+	claims, _ := json.Marshal(sessionClaims{
+		Identity:  identity,
+		ExpiresAt: now.Add(s.ttl).Unix(),
+	})
+	payload := base64.RawURLEncoding.EncodeToString(claims)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(s.sign(payload))
+}
+
+// Verify returns the identity a token was issued for
+func (s *SessionSigner) Verify(token string, now time.Time) (Identity, error) {
+	payload, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return Identity{}, ErrInvalidSession
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(mac, s.sign(payload)) {
+		return Identity{}, ErrInvalidSession
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return Identity{}, ErrInvalidSession
+	}
+	var claims sessionClaims
+	err = json.Unmarshal(data, &claims)
+	if err != nil {
+		return Identity{}, ErrInvalidSession
+	}
+	if now.Unix() >= claims.ExpiresAt {
+		return Identity{}, ErrSessionExpired
+	}
+	return claims.Identity, nil
+}
+
+func (s *SessionSigner) sign(payload string) []byte {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
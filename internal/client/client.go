@@ -1,37 +1,117 @@
 package client
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"mexemexe/internal/engine"
+	"mexemexe/internal/protocol"
 	"mexemexe/internal/server"
-	"net/url"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/websocket"
+	"golang.org/x/term"
 )
 
+// ErrSearchCancelled is returned while waiting for a game once the server confirms the search was cancelled
+var ErrSearchCancelled = errors.New("search cancelled")
+
+// errBackToLobby stops reading the game messages once the room is over
+var errBackToLobby = errors.New("back to the lobby")
+
+// DIAL_TIMEOUT bounds the connection and websocket handshake with the server
+const DIAL_TIMEOUT = 10 * time.Second
+
 // Client defines a connected client
 type Client struct {
-	ServerIP   string
-	ServerPort string
-	Renderer   *engine.Renderer
-	Username   string
-	UUID       string
-	Conn       *websocket.Conn
+	Config   *ClientConfig
+	Renderer *engine.Renderer
+	Username string
+	UUID     string
+	Conn     *protocol.Conn
+	// RejoinToken lets the player take its seat back if the server restarts
+	RejoinToken string
+	// SessionToken logs the player in again without its password
+	SessionToken string
+	password     string
+	rejoining    bool
+	welcomed     bool
+	gameOver     bool
+	// lastState is the latest game state, shown again once the game is over
+	lastState server.GameStateMessage
+	// backToLobby gets the message of the server once the room is over
+	backToLobby chan string
 }
 
 // NewClient is Client constructor
-func NewClient(ip string, port string) *Client {
+func NewClient(config *ClientConfig) *Client {
 	client := Client{
-		ServerIP:   ip,
-		ServerPort: port,
+		Config:      config,
+		backToLobby: make(chan string, 1),
 	}
+	if config.RejoinUUID != "" {
+		client.SetRejoin(config.RejoinUUID, config.RejoinToken)
+	}
+	client.SessionToken = config.SessionToken
+	client.password = config.Password
 	return &client
 }
 
-// SetUsername sets the username for the client from the user input
+// NeedsUsername tells whether the player must say who they are, or has a session to log in with
+func (c *Client) NeedsUsername() bool {
+	return c.SessionToken == ""
+}
+
+// SetPassword asks for the password of the account when logging in or registering without one
+func (c *Client) SetPassword() error {
+	if c.password != "" || !(c.Config.Login || c.Config.Register) || c.SessionToken != "" {
+		return nil
+	}
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return fmt.Errorf("no password to log in with, set %sPASSWORD", ENV_PREFIX)
+	}
+
+	password, err := readPassword("Password: ")
+	if err != nil {
+		return err
+	}
+	if c.Config.Register {
+		again, err := readPassword("Repeat the password: ")
+		if err != nil {
+			return err
+		}
+		if again != password {
+			return errors.New("the passwords don't match")
+		}
+	}
+	c.password = password
+	return nil
+}
+
+func readPassword(prompt string) (string, error) {
+	fmt.Print(prompt)
+	password, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Println()
+	if err != nil {
+		return "", fmt.Errorf("reading password: %w", err)
+	}
+	return string(password), nil
+}
+
+// SetUsername sets the username for the client from the configuration, or else from the user input
 func (c *Client) SetUsername() {
+	if c.Config.Username != "" {
+		c.Username = c.Config.Username
+		return
+	}
 	var username string
 	fmt.Println("Lets play mexe-mexe!")
 	fmt.Println("To join a game room, please enter your username:")
@@ -39,114 +119,490 @@ func (c *Client) SetUsername() {
 	c.Username = username
 }
 
-// SetWebsocketConnection establishes a websocket connection to the server
-func (c *Client) SetWebsocketConnection() {
-	url := url.URL{Scheme: "ws", Host: c.ServerIP + ":" + c.ServerPort, Path: "/ws"}
-	log.Printf("connecting to %s\n", url.String())
+// Connect establishes a websocket connection to the server
+func (c *Client) Connect() error {
+	tlsConfig, err := c.Config.tlsConfig()
+	if err != nil {
+		return err
+	}
+	dialer := websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: DIAL_TIMEOUT,
+		TLSClientConfig:  tlsConfig,
+	}
 
-	// Stablish websocket connection
-	ws, _, err := websocket.DefaultDialer.Dial(url.String(), nil)
+	serverURL := c.Config.URL()
+	log.Printf("connecting to %s\n", serverURL)
+	ws, resp, err := dialer.Dial(serverURL, nil)
 	if err != nil {
-		log.Fatal("dial:", err)
+		return describeDialError(serverURL, resp, err)
 	}
-	c.Conn = ws
+	c.Conn = protocol.NewConn(ws)
+	return nil
+}
+
+// describeDialError explains why the server could not be reached, and what to check
+func describeDialError(serverURL string, resp *http.Response, err error) error {
+	if resp != nil {
+		switch resp.StatusCode {
+		case http.StatusNotFound:
+			return fmt.Errorf("%s answered 404 Not Found, check the -path of the websocket endpoint", serverURL)
+		case http.StatusForbidden:
+			return fmt.Errorf("%s refused the connection (403 Forbidden), the origin may not be allowed", serverURL)
+		default:
+			return fmt.Errorf("%s answered %s instead of opening a websocket", serverURL, resp.Status)
+		}
+	}
+
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var recordHeaderErr tls.RecordHeaderError
+	var dnsErr *net.DNSError
+	switch {
+	case errors.As(err, &unknownAuthority):
+		return fmt.Errorf("the certificate of %s is not signed by a trusted CA, pass the CA certificate with -ca: %w", serverURL, err)
+	case errors.As(err, &hostnameErr):
+		return fmt.Errorf("the certificate of %s is not valid for this host name: %w", serverURL, err)
+	case errors.As(err, &recordHeaderErr):
+		return fmt.Errorf("%s does not speak TLS, try -scheme ws", serverURL)
+	case errors.As(err, &dnsErr):
+		return fmt.Errorf("cannot resolve the server host %q: %w", dnsErr.Name, err)
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return fmt.Errorf("nothing is listening at %s, is the server running and the -host and -port right?", serverURL)
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return fmt.Errorf("%s did not answer within %v", serverURL, DIAL_TIMEOUT)
+	case errors.Is(err, websocket.ErrBadHandshake):
+		return fmt.Errorf("%s is not a mexe-mexe websocket endpoint: %w", serverURL, err)
+	}
+	return fmt.Errorf("cannot connect to %s: %w", serverURL, err)
 }
 
 func (c *Client) SendJoinMessage() {
 	joinMessage := server.JoinServerMessage{
-		Username: c.Username,
+		Username:     c.Username,
+		Password:     c.password,
+		Register:     c.Config.Register,
+		SessionToken: c.SessionToken,
 	}
-	err := c.Conn.WriteJSON(joinMessage)
+	err := c.Conn.Send(protocol.JOIN, joinMessage)
 	if err != nil {
 		log.Printf("error writing to websocket: %v", err)
 		return
 	}
 }
 
-func (c *Client) ReceiveWelcomeMessage() {
-	var welcomeMsg server.WelcomeMessage
+// handshakeDispatcher handles the messages the server sends before the game starts
+func (c *Client) handshakeDispatcher(firstState *server.GameStateMessage, started *bool) *protocol.Dispatcher {
+	dispatcher := protocol.NewDispatcher()
+	dispatcher.Handle(protocol.WELCOME, func(envelope protocol.Envelope) error {
+		var welcomeMsg server.WelcomeMessage
+		err := envelope.Decode(&welcomeMsg)
+		if err != nil {
+			return err
+		}
+		fmt.Println(welcomeMsg.Message)
+		c.welcomed = true
+		c.SessionToken = welcomeMsg.SessionToken
+		if welcomeMsg.Username != "" {
+			c.Username = welcomeMsg.Username
+		}
+		// A rejoining client keeps playing as the player it was
+		if c.rejoining {
+			return nil
+		}
+		c.UUID = welcomeMsg.PlayerUUID
+		c.RejoinToken = welcomeMsg.RejoinToken
+		return nil
+	})
+	dispatcher.Handle(protocol.JOINED_GAME_ROOM, func(envelope protocol.Envelope) error {
+		var joinMsg server.JoinedGameRoomMessage
+		err := envelope.Decode(&joinMsg)
+		if err != nil {
+			return err
+		}
+		fmt.Println(joinMsg.Message)
+		return nil
+	})
+	dispatcher.Handle(protocol.MAX_CAPACITY, func(envelope protocol.Envelope) error {
+		var maxMsg server.MaxCapacityMessage
+		err := envelope.Decode(&maxMsg)
+		if err != nil {
+			return err
+		}
+		return errors.New(maxMsg.Message)
+	})
+	dispatcher.Handle(protocol.ERROR, func(envelope protocol.Envelope) error {
+		var errorMsg server.ErrorMessage
+		err := envelope.Decode(&errorMsg)
+		if err != nil {
+			return err
+		}
+		return errors.New(errorMsg.Message)
+	})
+	dispatcher.Handle(protocol.SERVER_NOTICE, func(envelope protocol.Envelope) error {
+		var noticeMsg server.ServerNoticeMessage
+		err := envelope.Decode(&noticeMsg)
+		if err != nil {
+			return err
+		}
+		fmt.Println(noticeMsg.Message)
+		return nil
+	})
+	dispatcher.Handle(protocol.RATING, func(envelope protocol.Envelope) error {
+		var ratingMsg server.RatingMessage
+		err := envelope.Decode(&ratingMsg)
+		if err != nil {
+			return err
+		}
+		if ratingMsg.Rated {
+			fmt.Println(describeRating(ratingMsg))
+		}
+		return nil
+	})
+	dispatcher.Handle(protocol.QUEUE_UPDATE, func(envelope protocol.Envelope) error {
+		var updateMsg server.QueueUpdateMessage
+		err := envelope.Decode(&updateMsg)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Waiting for a %d player %s game: #%d of %d in the queue.\n",
+			updateMsg.Players, updateMsg.Mode, updateMsg.Position, updateMsg.Queued)
+		return nil
+	})
+	dispatcher.Handle(protocol.SEARCH_CANCELLED, func(envelope protocol.Envelope) error {
+		var cancelledMsg server.SearchCancelledMessage
+		err := envelope.Decode(&cancelledMsg)
+		if err != nil {
+			return err
+		}
+		fmt.Println(cancelledMsg.Message)
+		return ErrSearchCancelled
+	})
+	// Lobby updates of an earlier subscription are of no use while waiting
+	dispatcher.Handle(protocol.LOBBY_UPDATE, func(envelope protocol.Envelope) error {
+		return nil
+	})
+	// The first game state tells the game has started
+	dispatcher.Handle(protocol.GAME_STATE, func(envelope protocol.Envelope) error {
+		*started = true
+		return envelope.Decode(firstState)
+	})
+	return dispatcher
+}
+
+// WaitForWelcome reads server messages until the server welcomes the client
+func (c *Client) WaitForWelcome() error {
+	var firstState server.GameStateMessage
+	started := false
+	dispatcher := c.handshakeDispatcher(&firstState, &started)
 
-	err := c.Conn.ReadJSON(&welcomeMsg)
+	for !c.welcomed {
+		envelope, err := c.Conn.Receive()
+		if err != nil {
+			return err
+		}
+		err = dispatcher.Dispatch(envelope)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RequestRating asks the server for the rating of the player, shown while waiting for the game
+func (c *Client) RequestRating() {
+	err := c.Conn.Send(protocol.RATING_REQUEST, server.RatingRequestMessage{})
 	if err != nil {
-		log.Printf("error: %v", err)
-		return
+		log.Printf("error writing to websocket: %v", err)
+	}
+}
+
+// describeRating tells the rating of an account in a line
+func describeRating(ratingMsg server.RatingMessage) string {
+	if ratingMsg.Position == 0 {
+		return fmt.Sprintf("%s is rated %.0f and has no finished game yet.", ratingMsg.Username, ratingMsg.Rating)
 	}
-	c.UUID = welcomeMsg.PlayerUUID
-	fmt.Println(welcomeMsg.Message)
+	return fmt.Sprintf("%s is rated %.0f, #%d of %d players (%d games: %d won, %d lost, %d left).",
+		ratingMsg.Username, ratingMsg.Rating, ratingMsg.Position, ratingMsg.Of,
+		ratingMsg.Played, ratingMsg.Won, ratingMsg.Lost, ratingMsg.Left)
 }
 
+// SetRejoin makes the client take back its seat in a game it lost its
+// connection to, or that the server restored after a restart
+func (c *Client) SetRejoin(playerUUID string, rejoinToken string) {
+	c.UUID = playerUUID
+	c.RejoinToken = rejoinToken
+	c.rejoining = true
+}
+
+// SendStartGameMessage asks to queue for a game, or to create, join or watch a
+// room of the lobby, as configured
 func (c *Client) SendStartGameMessage() {
 	startGameMessage := server.StartGameMessage{
-		Action: "start",
+		Action:  "start",
+		Mode:    c.Config.Mode,
+		Players: c.Config.Players,
+	}
+	switch {
+	case c.Config.Create:
+		startGameMessage.Action = "create"
+	case c.Config.JoinRoom != "":
+		startGameMessage = server.StartGameMessage{Action: "join", RoomUUID: c.Config.JoinRoom}
+	case c.Config.SpectateRoom != "":
+		startGameMessage = server.StartGameMessage{Action: "spectate", RoomUUID: c.Config.SpectateRoom}
+	}
+	if c.rejoining {
+		startGameMessage = server.StartGameMessage{
+			Action:      "rejoin",
+			PlayerUUID:  c.UUID,
+			RejoinToken: c.RejoinToken,
+		}
 	}
-	err := c.Conn.WriteJSON(startGameMessage)
+	err := c.Conn.Send(protocol.START_GAME, startGameMessage)
 	if err != nil {
 		log.Printf("error writing to websocket: %v", err)
 		return
 	}
 }
 
-func (c *Client) ReceiveJoinedGameRoomMessage() {
-	var joinMsg server.JoinedGameRoomMessage
-	err := c.Conn.ReadJSON(&joinMsg)
+// ShowLobby prints the rooms and players online
+func (c *Client) ShowLobby() error {
+	err := c.Conn.Send(protocol.LOBBY_SUBSCRIBE, server.LobbySubscribeMessage{})
 	if err != nil {
-		log.Printf("error: %v", err)
-		return
+		return err
+	}
+	for {
+		envelope, err := c.Conn.Receive()
+		if err != nil {
+			return err
+		}
+		if envelope.Type != protocol.LOBBY {
+			continue
+		}
+		var lobbyMsg server.LobbyMessage
+		err = envelope.Decode(&lobbyMsg)
+		if err != nil {
+			return err
+		}
+		fmt.Print(describeLobby(lobbyMsg))
+		return c.Conn.Send(protocol.LOBBY_UNSUBSCRIBE, server.LobbyUnsubscribeMessage{})
+	}
+}
+
+// describeLobby lists the rooms and players of the lobby, a line each
+func describeLobby(lobbyMsg server.LobbyMessage) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Rooms (%d):\n", len(lobbyMsg.Rooms))
+	for _, room := range lobbyMsg.Rooms {
+		fmt.Fprintf(&b, "  %s  %-8s %-9s %d/%d players %v, %d watching\n",
+			room.UUID, room.Mode, room.Status, len(room.Players), room.Capacity, room.Players, room.Spectators)
+	}
+	fmt.Fprintf(&b, "Players online (%d):\n", len(lobbyMsg.Players))
+	for _, player := range lobbyMsg.Players {
+		fmt.Fprintf(&b, "  %s (%s)\n", player.Username, player.Status)
 	}
-	fmt.Println(joinMsg.Message)
+	return b.String()
 }
 
-func (c *Client) ReceiveGameStartedMessage() {
-	var gameStartedMsg server.GameStartedMessage
-	err := c.Conn.ReadJSON(&gameStartedMsg)
+// CancelSearch asks the server to take the player out of the matchmaking queue, or out of its open room
+func (c *Client) CancelSearch() {
+	err := c.Conn.Send(protocol.START_GAME, server.StartGameMessage{Action: "cancel"})
 	if err != nil {
-		log.Printf("error: %v", err)
-		return
+		log.Printf("error writing to websocket: %v", err)
 	}
-	fmt.Println(gameStartedMsg.Message)
+}
+
+// WaitForGameStart reads server messages until the first game state arrives and returns it
+func (c *Client) WaitForGameStart() (server.GameStateMessage, error) {
+	var firstState server.GameStateMessage
+	started := false
+	dispatcher := c.handshakeDispatcher(&firstState, &started)
+
+	for !started {
+		envelope, err := c.Conn.Receive()
+		if err != nil {
+			return firstState, err
+		}
+		err = dispatcher.Dispatch(envelope)
+		if err != nil {
+			return firstState, err
+		}
+	}
+	return firstState, nil
 }
 
 func (c *Client) SetRenderer(renderer *engine.Renderer) {
 	c.Renderer = renderer
+	renderer.OnEmote = c.SendEmote
+	renderer.OnRematch = c.AnswerRematch
 }
 
-func (c *Client) ReceiveGameState() server.GameStateMessage {
-	var gameState server.GameStateMessage
-	err := c.Conn.ReadJSON(&gameState)
+// AnswerRematch accepts or declines the rematch offered once the game is over
+func (c *Client) AnswerRematch(accept bool) {
+	err := c.Conn.Send(protocol.REMATCH, server.RematchMessage{Accept: accept})
 	if err != nil {
-		log.Fatalf("error reading game state: %v", err)
+		log.Printf("error writing to websocket: %v", err)
 	}
+}
 
-	// fmt.Println("DEBUG: Received game state: \n\r")
-	// log.Print("DEBUG: Game state: gameState.Hand: \n\r")
-	// gameState.Hand.Print()
-	// log.Print("DEBUG: Game state: gameState.Table: \n\r")
-	// gameState.Table.Print()
-	// log.Print("DEBUG: Turn state: turnState.HasDrawedCard: \n\r", gameState.Turn.HasDrawedCard)
-	// log.Print("DEBUG: Turn state: turnState.HasPlayedMeld: \n\r", gameState.Turn.HasPlayedMeld)
-	// log.Print("DEBUG: Turn state: turnState.PlayerUUID: \n\r", gameState.Turn.PlayerUUID)
-	return gameState
+// describeResult tells how a game ended, from the point of view of the player
+func describeResult(result engine.GameResult, playerUUID string) string {
+	name := func(uuid string) string {
+		for _, player := range result.Players {
+			if player.UUID == uuid {
+				return player.Name
+			}
+		}
+		return uuid
+	}
+	switch {
+	case result.Outcome == engine.OUTCOME_ABANDONED:
+		return fmt.Sprintf("%s left the game.", name(result.QuitterUUID))
+	case result.Outcome == engine.OUTCOME_RESIGNED && result.WinnerUUID == playerUUID:
+		return fmt.Sprintf("%s left the game. You win!", name(result.QuitterUUID))
+	case result.Outcome == engine.OUTCOME_RESIGNED:
+		return fmt.Sprintf("%s left the game. %s wins.", name(result.QuitterUUID), name(result.WinnerUUID))
+	case result.WinnerUUID == playerUUID:
+		return "You win!"
+	case result.WinnerUUID != "":
+		return fmt.Sprintf("%s wins.", name(result.WinnerUUID))
+	default:
+		return "The deck ran out with a tie."
+	}
 }
-func (c *Client) ReadFromWebSocket(gameStateChan chan server.GameStateMessage, stopChan chan bool) {
-	for {
-		gameState := c.ReceiveGameState()
-		// log.Print("DEBUG: Received game state. \n\r")
+
+// SendEmote says one of the quick predefined messages in the game room chat
+func (c *Client) SendEmote(emote engine.Emote) {
+	err := c.Conn.Send(protocol.CHAT, server.ChatMessage{Emote: emote.Code})
+	if err != nil {
+		log.Printf("error writing to websocket: %v", err)
+	}
+}
+
+// gameDispatcher handles the messages the server sends during the game
+func (c *Client) gameDispatcher(gameStateChan chan server.GameStateMessage, stopChan chan bool) *protocol.Dispatcher {
+	dispatcher := protocol.NewDispatcher()
+	dispatcher.Handle(protocol.GAME_STATE, func(envelope protocol.Envelope) error {
+		var gameState server.GameStateMessage
+		err := envelope.Decode(&gameState)
+		if err != nil {
+			return err
+		}
+		// A state after the game is over starts a rematch
+		if c.gameOver {
+			c.Renderer.ShowGameOver("", false)
+		}
+		c.gameOver = gameState.Turn.GameEnded
+		c.lastState = gameState
 		gameStateChan <- gameState
-		// log.Print("DEBUG: sent game state to channel. \n\r")
 		stopChan <- true
+		return nil
+	})
+	dispatcher.Handle(protocol.GAME_OVER, func(envelope protocol.Envelope) error {
+		var gameOverMsg server.GameOverMessage
+		err := envelope.Decode(&gameOverMsg)
+		if err != nil {
+			return err
+		}
+		c.gameOver = true
+		c.Renderer.ShowGameOver(describeResult(gameOverMsg.Result, c.UUID), gameOverMsg.Rematch)
+		// Show the final table, whoever's turn it was
+		finalState := c.lastState
+		finalState.Turn.GameEnded = true
+		gameStateChan <- finalState
+		stopChan <- true
+		return nil
+	})
+	dispatcher.Handle(protocol.BACK_TO_LOBBY, func(envelope protocol.Envelope) error {
+		var lobbyMsg server.BackToLobbyMessage
+		err := envelope.Decode(&lobbyMsg)
+		if err != nil {
+			return err
+		}
+		c.backToLobby <- lobbyMsg.Message
+		select {
+		case stopChan <- true:
+		default:
+		}
+		return errBackToLobby
+	})
+	dispatcher.Handle(protocol.GAME_MESSAGE, func(envelope protocol.Envelope) error {
+		var gameMsg server.GameMessage
+		err := envelope.Decode(&gameMsg)
+		if err != nil {
+			return err
+		}
+		c.Renderer.SetStatusMessage(gameMsg.Message)
+		return nil
+	})
+	dispatcher.Handle(protocol.SERVER_NOTICE, func(envelope protocol.Envelope) error {
+		var noticeMsg server.ServerNoticeMessage
+		err := envelope.Decode(&noticeMsg)
+		if err != nil {
+			return err
+		}
+		c.Renderer.SetStatusMessage(noticeMsg.Message)
+		return nil
+	})
+	dispatcher.Handle(protocol.CHAT_POSTED, func(envelope protocol.Envelope) error {
+		var chatMsg server.ChatPostedMessage
+		err := envelope.Decode(&chatMsg)
+		if err != nil {
+			return err
+		}
+		c.Renderer.AddChatLine(engine.ChatLine{From: chatMsg.Username, Text: chatMsg.Text})
+		return nil
+	})
+	dispatcher.Handle(protocol.ERROR, func(envelope protocol.Envelope) error {
+		var errorMsg server.ErrorMessage
+		err := envelope.Decode(&errorMsg)
+		if err != nil {
+			return err
+		}
+		return errors.New(errorMsg.Message)
+	})
+	return dispatcher
+}
+
+func (c *Client) ReadFromWebSocket(gameStateChan chan server.GameStateMessage, stopChan chan bool) {
+	dispatcher := c.gameDispatcher(gameStateChan, stopChan)
+	for {
+		envelope, err := c.Conn.Receive()
+		if err != nil && c.gameOver {
+			// The server hangs up once the game is over
+			fmt.Print("Game over!\r\n")
+			os.Exit(0)
+		}
+		if err != nil {
+			log.Fatalf("connection to the server lost: %v\r\nRejoin your game before your seat is given up, or once the server restarted, with: -session %s -rejoin %s -token %s", err, c.SessionToken, c.UUID, c.RejoinToken)
+		}
+		err = dispatcher.Dispatch(envelope)
+		if errors.Is(err, errBackToLobby) {
+			return
+		}
+		if err != nil {
+			log.Fatalf("error handling %s message: %v", envelope.Type, err)
+		}
 	}
 }
 
-func (c *Client) StartGame(stopSignal chan bool) {
+func (c *Client) StartGame(firstState server.GameStateMessage, stopSignal chan bool) {
 	gameStateChan := make(chan server.GameStateMessage, 1)
 	stopChan := make(chan bool, 1)
+	gameStateChan <- firstState
 	go c.ReadFromWebSocket(gameStateChan, stopChan)
 
 	for {
 		// fmt.Println("DEBUG: beginning of loop. \n\r")
 
-		// Wait to receive game state from the server
-		gameState := <-gameStateChan
+		// Wait to receive game state from the server, until the room is over
+		var gameState server.GameStateMessage
+		select {
+		case gameState = <-gameStateChan:
+		case message := <-c.backToLobby:
+			fmt.Printf("%s\r\n", message)
+			return
+		}
 
 		select {
 		case <-stopChan:
@@ -154,7 +610,7 @@ func (c *Client) StartGame(stopSignal chan bool) {
 		}
 
 		// Determine if it's the player's turn
-		freeze := gameState.Turn.PlayerUUID != c.UUID
+		freeze := gameState.Turn.PlayerUUID != c.UUID || gameState.Turn.GameEnded
 
 		c.Renderer.UpdateRenderer(gameState.Table, gameState.Hand, gameState.Turn)
 
@@ -177,7 +633,7 @@ func (c *Client) StartGame(stopSignal chan bool) {
 		var gamePlayMsg server.GamePlayMessage
 		gamePlayMsg.Play = play
 
-		err := c.Conn.WriteJSON(&gamePlayMsg)
+		err := c.Conn.Send(protocol.GAME_PLAY, gamePlayMsg)
 		if err != nil {
 			log.Printf("error writing to websocket: %v", err)
 			return
@@ -0,0 +1,185 @@
+package client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"mexemexe/internal/engine"
+	"mexemexe/internal/server"
+	"mexemexe/internal/service"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// DEFAULT_SERVER_HOST and DEFAULT_SERVER_PORT point at a server on this machine
+const DEFAULT_SERVER_HOST = "127.0.0.1"
+const DEFAULT_SERVER_PORT = 8888
+
+// DEFAULT_SERVER_PATH is where the server accepts websocket connections
+const DEFAULT_SERVER_PATH = "/ws"
+
+// ENV_PREFIX prefixes the environment variable of every client flag, e.g. MEXE_CLIENT_HOST for -host
+const ENV_PREFIX = "MEXE_CLIENT_"
+
+// ClientConfig holds how to reach the server and who to play as
+type ClientConfig struct {
+	Scheme string
+	Host   string
+	Port   int
+	Path   string
+	// CAFile is a PEM file with the certificates trusted for wss, on top of the system ones
+	CAFile string
+	// Username skips the username prompt when set
+	Username string
+	// Login and Register ask for a password, unless Password is set from the environment
+	Login    bool
+	Register bool
+	Password string
+	// SessionToken logs in without username and password
+	SessionToken string
+	RejoinUUID   string
+	RejoinToken  string
+	// Mode and Players choose the queue to wait in, the server defaults when empty
+	Mode    string
+	Players int
+	// Lobby prints the rooms and players online instead of playing
+	Lobby bool
+	// Create opens a room in the lobby for the game chosen by Mode and
+	// Players, JoinRoom takes a seat in a room of the lobby and SpectateRoom
+	// watches its game, instead of waiting in the queue
+	Create       bool
+	JoinRoom     string
+	SpectateRoom string
+}
+
+// DefaultClientConfig returns the configuration used when nothing is set
+func DefaultClientConfig() *ClientConfig {
+	return &ClientConfig{
+		Scheme: "ws",
+		Host:   DEFAULT_SERVER_HOST,
+		Port:   DEFAULT_SERVER_PORT,
+		Path:   DEFAULT_SERVER_PATH,
+	}
+}
+
+// LoadClientConfig builds the configuration from the command line arguments and
+// the environment, the arguments taking priority
+func LoadClientConfig(args []string, lookupEnv func(string) (string, bool)) (*ClientConfig, error) {
+	config := DefaultClientConfig()
+	flags := flag.NewFlagSet("client", flag.ContinueOnError)
+	flags.StringVar(&config.Scheme, "scheme", config.Scheme, "ws, or wss for a server behind TLS")
+	flags.StringVar(&config.Host, "host", config.Host, "server host name or IP")
+	flags.IntVar(&config.Port, "port", config.Port, "server port")
+	flags.StringVar(&config.Path, "path", config.Path, "websocket path on the server")
+	flags.StringVar(&config.CAFile, "ca", config.CAFile, "PEM file with extra CA certificates to trust for wss")
+	flags.StringVar(&config.Username, "username", config.Username, "username to play as, instead of asking for it")
+	flags.BoolVar(&config.Login, "login", config.Login, "log in to an account, asking for its password")
+	flags.BoolVar(&config.Register, "register", config.Register, "create an account with the username, asking for its password")
+	flags.StringVar(&config.SessionToken, "session", config.SessionToken, "session token of an earlier login, instead of username and password")
+	flags.StringVar(&config.RejoinUUID, "rejoin", config.RejoinUUID, "player UUID of a game to take back after losing the connection or a server restart")
+	flags.StringVar(&config.RejoinToken, "token", config.RejoinToken, "rejoin token of that player")
+	flags.StringVar(&config.Mode, "mode", config.Mode, "game mode to queue for, the server default when empty")
+	flags.IntVar(&config.Players, "players", config.Players, "number of players of the game to queue for, the server default when 0")
+	flags.BoolVar(&config.Lobby, "lobby", config.Lobby, "list the rooms and players online, then exit")
+	flags.BoolVar(&config.Create, "create", config.Create, "open a room in the lobby for other players to join, instead of queueing")
+	flags.StringVar(&config.JoinRoom, "join", config.JoinRoom, "UUID of a room of the lobby to play in, instead of queueing")
+	flags.StringVar(&config.SpectateRoom, "spectate", config.SpectateRoom, "UUID of a running room of the lobby to watch")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage of client:")
+		flags.PrintDefaults()
+		fmt.Fprintf(flags.Output(), "\nEvery flag can also be set in the environment, e.g. %s for -host. The password is read from %sPASSWORD or asked for.\n",
+			service.EnvName(ENV_PREFIX, "host"), ENV_PREFIX)
+	}
+
+	err := service.SetFlagsFromEnv(flags, ENV_PREFIX, lookupEnv)
+	if err != nil {
+		return nil, err
+	}
+	err = flags.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	// The password is never a flag, where other users could read it
+	config.Password, _ = lookupEnv(ENV_PREFIX + "PASSWORD")
+
+	err = config.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// Validate reports every setting that can't work
+func (c *ClientConfig) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, v ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, v...))
+		}
+	}
+
+	check(c.Scheme == "ws" || c.Scheme == "wss", "scheme must be ws or wss, got %q", c.Scheme)
+	check((c.Host != "" && !strings.ContainsAny(c.Host, "/:?#")) || net.ParseIP(c.Host) != nil, "%q is not a host name or IP, pass the port with -port and the path with -path", c.Host)
+	check(c.Port > 0 && c.Port <= 65535, "port %d is out of range", c.Port)
+	check(strings.HasPrefix(c.Path, "/"), "path %q must start with /", c.Path)
+	check(c.CAFile == "" || c.Scheme == "wss", "a CA file is only used with -scheme wss")
+	check((c.RejoinUUID == "") == (c.RejoinToken == ""), "-rejoin and -token must be given together")
+	check(!(c.Login && c.Register), "-login and -register can't be used together")
+	check(c.Players == 0 || (c.Players >= engine.NUM_PLAYERS && c.Players <= server.MAX_PLAYERS), "players must be between %d and %d, got %d", engine.NUM_PLAYERS, server.MAX_PLAYERS, c.Players)
+	check(c.SessionToken == "" || !c.Register, "-register creates a new account and can't use -session")
+	lobbyActions := 0
+	for _, set := range []bool{c.Lobby, c.Create, c.JoinRoom != "", c.SpectateRoom != "", c.RejoinUUID != ""} {
+		if set {
+			lobbyActions++
+		}
+	}
+	check(lobbyActions <= 1, "only one of -lobby, -create, -join, -spectate and -rejoin can be used")
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid client configuration: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// URL is the websocket address of the server
+func (c *ClientConfig) URL() string {
+	serverURL := url.URL{
+		Scheme: c.Scheme,
+		Host:   net.JoinHostPort(c.Host, strconv.Itoa(c.Port)),
+		Path:   c.Path,
+	}
+	return serverURL.String()
+}
+
+// tlsConfig returns the TLS settings of a wss connection, nil for ws
+func (c *ClientConfig) tlsConfig() (*tls.Config, error) {
+	if c.Scheme != "wss" {
+		return nil, nil
+	}
+	config := &tls.Config{
+		ServerName: c.Host,
+		MinVersion: tls.VersionTLS12,
+	}
+	if c.CAFile == "" {
+		return config, nil
+	}
+
+	pem, err := os.ReadFile(c.CAFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading CA file: %w", err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no PEM certificates found in CA file %s", c.CAFile)
+	}
+	config.RootCAs = pool
+	return config, nil
+}
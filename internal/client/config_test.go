@@ -0,0 +1,105 @@
+package client
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// fakeEnv returns a lookup function over a fixed environment
+func fakeEnv(env map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+}
+
+func TestLoadClientConfig(t *testing.T) {
+	config, err := LoadClientConfig(nil, fakeEnv(nil))
+	if err != nil {
+		t.Fatalf("LoadClientConfig() error: %v", err)
+	}
+	if config.URL() != "ws://127.0.0.1:8888/ws" {
+		t.Errorf("default URL = %s", config.URL())
+	}
+
+	config, err = LoadClientConfig(
+		[]string{"-port", "443", "-username", "alice"},
+		fakeEnv(map[string]string{"MEXE_CLIENT_SCHEME": "wss", "MEXE_CLIENT_HOST": "mexe-mexe.online", "MEXE_CLIENT_PORT": "8443"}),
+	)
+	if err != nil {
+		t.Fatalf("LoadClientConfig() error: %v", err)
+	}
+	if config.URL() != "wss://mexe-mexe.online:443/ws" || config.Username != "alice" {
+		t.Errorf("URL = %s, username = %q", config.URL(), config.Username)
+	}
+}
+
+func TestLoadClientConfigErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"unknown scheme", []string{"-scheme", "https"}, "scheme must be ws or wss"},
+		{"address as host", []string{"-host", "example.com:8888"}, "not a host name"},
+		{"port out of range", []string{"-port", "0"}, "port 0"},
+		{"relative path", []string{"-path", "ws"}, "must start with /"},
+		{"CA without TLS", []string{"-ca", "ca.pem"}, "only used with -scheme wss"},
+		{"rejoin without token", []string{"-rejoin", "uuid-1"}, "given together"},
+		{"login and register", []string{"-login", "-register"}, "can't be used together"},
+		{"too many players", []string{"-players", "9"}, "players must be between"},
+		{"join and spectate", []string{"-join", "room-1", "-spectate", "room-2"}, "only one of -lobby"},
+		{"create and rejoin", []string{"-create", "-rejoin", "uuid-1", "-token", "token-1"}, "only one of -lobby"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadClientConfig(tt.args, fakeEnv(nil))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("LoadClientConfig() error = %v, want it to mention %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestConnectWithCustomCA(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err == nil {
+			ws.Close()
+		}
+	}))
+	defer ts.Close()
+
+	serverURL, _ := url.Parse(ts.URL)
+	port, _ := strconv.Atoi(serverURL.Port())
+	config := DefaultClientConfig()
+	config.Scheme = "wss"
+	config.Port = port
+
+	// The test server certificate is self-signed, so it is not trusted by default
+	err := NewClient(config).Connect()
+	if err == nil || !strings.Contains(err.Error(), "-ca") {
+		t.Fatalf("Connect() to an untrusted server = %v, want a hint about -ca", err)
+	}
+
+	config.CAFile = filepath.Join(t.TempDir(), "ca.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	if err := os.WriteFile(config.CAFile, certPEM, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	client := NewClient(config)
+	if err := client.Connect(); err != nil {
+		t.Fatalf("Connect() with the CA file: %v", err)
+	}
+	client.Close()
+}
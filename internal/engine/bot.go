@@ -0,0 +1,134 @@
+package engine
+
+import "sort"
+
+// BotProvider is a computer player. It is both the InputProvider and the
+// OutputProvider of its seat: the states it receives are the only thing it
+// knows about the game, and it answers with the plays it picks from them.
+type BotProvider struct {
+	uuid    string
+	hand    Hand
+	table   Table
+	updated bool
+	last    AvailablePlay
+	blocked map[AvailablePlay]bool
+}
+
+func NewBotProvider(uuid string) *BotProvider {
+	return &BotProvider{
+		uuid:    uuid,
+		blocked: make(map[AvailablePlay]bool),
+	}
+}
+
+func (b *BotProvider) IsConnected() bool {
+	return true
+}
+
+func (b *BotProvider) GetUUID() string {
+	return b.uuid
+}
+
+func (b *BotProvider) Write(messageType string, data interface{}) {}
+
+func (b *BotProvider) SendState(table Table, hand Hand, turnState TurnState) {
+	b.table = table.Clone()
+	b.hand = hand.Clone()
+	b.updated = true
+
+	if turnState.PlayerUUID != b.uuid {
+		clear(b.blocked)
+	}
+}
+
+// GetPlay plays every meld it can find in its hand, otherwise draws a card, and
+// then ends the turn, discarding its highest card when there is a discard pile.
+func (b *BotProvider) GetPlay(turnState TurnState) Play {
+
+	// Every valid play is answered with a new state, so no update means the last play was refused
+	if !b.updated && b.last != "" {
+		b.blocked[b.last] = true
+	}
+	b.updated = false
+
+	play := b.choosePlay(turnState)
+	b.last = play.GetName()
+	return play
+}
+
+func (b *BotProvider) choosePlay(turnState TurnState) Play {
+	if !b.blocked[PLAY_MELD] {
+		if cards := FindMeldInCards(b.hand.Cards); cards != nil {
+			return NewMeldPlay(cards)
+		}
+	}
+
+	if !turnState.HasDrawedCard && !turnState.HasPlayedMeld && !b.blocked[DRAW_CARD] {
+		return NewDrawCardPlay()
+	}
+
+	if turnState.HasDiscardPile && len(b.hand.Cards) > 0 && !b.blocked[DISCARD] {
+		return NewDiscardPlay(*highestCard(b.hand.Cards))
+	}
+
+	if !b.blocked[END_TURN] {
+		return NewEndTurnPlay()
+	}
+	return NewQuitPlay()
+}
+
+// highestCard returns the card worth the most points, the first one on a tie
+func highestCard(cards []*Card) *Card {
+	highest := cards[0]
+	for _, card := range cards[1:] {
+		if card.Value > highest.Value {
+			highest = card
+		}
+	}
+	return highest
+}
+
+// FindMeldInCards returns the longest valid meld that can be built from cards, or nil if there is none
+func FindMeldInCards(cards []*Card) []Card {
+	var best []Card
+
+	// Books: cards sharing the same value
+	byValue := make(map[CardValue][]Card)
+	for _, card := range cards {
+		byValue[card.Value] = append(byValue[card.Value], *card)
+	}
+	for value := TWO_VALUE; value <= ACE_VALUE; value++ {
+		if book := byValue[value]; len(book) >= MIN_MELD_SIZE && len(book) > len(best) {
+			best = book
+		}
+	}
+
+	// Sequences: consecutive values of the same suit, one card per value
+	for _, suit := range []CardSuit{SPADE, CLUB, HEART, DIAMOND} {
+		suitCards := []Card{}
+		for _, card := range cards {
+			if card.Suit == suit {
+				suitCards = append(suitCards, *card)
+			}
+		}
+		sort.SliceStable(suitCards, func(i, j int) bool {
+			return suitCards[i].Value < suitCards[j].Value
+		})
+
+		run := []Card{}
+		for _, card := range suitCards {
+			if len(run) > 0 && run[len(run)-1].Value == card.Value {
+				continue
+			}
+			if len(run) > 0 && run[len(run)-1].Value != card.Value-1 {
+				run = []Card{}
+			}
+			run = append(run, card)
+			if len(run) >= MIN_MELD_SIZE && len(run) > len(best) {
+				best = append([]Card{}, run...)
+			}
+		}
+	}
+
+	return best
+}
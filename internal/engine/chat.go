@@ -0,0 +1,33 @@
+package engine
+
+// Emote is a predefined chat message, sent with a single key from the terminal
+type Emote struct {
+	Code string `json:"code"`
+	Text string `json:"text"`
+}
+
+// EMOTES are the quick messages every player can send, in the order of their keys
+var EMOTES = []Emote{
+	{Code: "gl", Text: "Good luck, have fun!"},
+	{Code: "gg", Text: "Good game!"},
+	{Code: "nice", Text: "Nice play!"},
+	{Code: "think", Text: "Hmm, let me think..."},
+	{Code: "oops", Text: "Oops!"},
+	{Code: "hurry", Text: "Your turn is taking a while..."},
+}
+
+// FindEmote returns the emote with the given code
+func FindEmote(code string) (Emote, bool) {
+	for _, emote := range EMOTES {
+		if emote.Code == code {
+			return emote, true
+		}
+	}
+	return Emote{}, false
+}
+
+// ChatLine is a chat message as shown in the chat pane of the Renderer
+type ChatLine struct {
+	From string
+	Text string
+}
@@ -0,0 +1,68 @@
+package engine
+
+// TurnCheckpoint is a copy of a player's hand and of the table taken during a turn
+type TurnCheckpoint struct {
+	Hand  Hand
+	Table Table
+}
+
+func NewTurnCheckpoint(hand Hand, table Table) TurnCheckpoint {
+	return TurnCheckpoint{
+		Hand:  hand.Clone(),
+		Table: table.Clone(),
+	}
+}
+
+// Restore puts the hand and table back as they were when the checkpoint was taken
+func (c TurnCheckpoint) Restore(hand *Hand, table *Table) {
+	*hand = c.Hand.Clone()
+	*table = c.Table.Clone()
+}
+
+// TurnHistory keeps the state at the start of a turn and a checkpoint before
+// each meld played in it, so melds can be taken back one at a time.
+type TurnHistory struct {
+	Start       TurnCheckpoint
+	checkpoints []TurnCheckpoint
+}
+
+func NewTurnHistory(hand Hand, table Table) *TurnHistory {
+	return &TurnHistory{
+		Start:       NewTurnCheckpoint(hand, table),
+		checkpoints: []TurnCheckpoint{},
+	}
+}
+
+// Checkpoint records the current hand and table
+func (h *TurnHistory) Checkpoint(hand Hand, table Table) {
+	h.checkpoints = append(h.checkpoints, NewTurnCheckpoint(hand, table))
+}
+
+// CanUndo tells if there is a checkpoint to go back to
+func (h *TurnHistory) CanUndo() bool {
+	return len(h.checkpoints) > 0
+}
+
+// Undo restores the last checkpoint and drops it. It returns false if there was none.
+func (h *TurnHistory) Undo(hand *Hand, table *Table) bool {
+	if !h.CanUndo() {
+		return false
+	}
+	last := h.checkpoints[len(h.checkpoints)-1]
+	h.checkpoints = h.checkpoints[:len(h.checkpoints)-1]
+	last.Restore(hand, table)
+	return true
+}
+
+// Rollback puts the table back as it was at the start of the turn and returns
+// to the hand every card the player moved from it to the table. Cards drawn
+// during the turn stay in the hand.
+func (h *TurnHistory) Rollback(hand *Hand, table *Table) {
+	for _, card := range table.Cards {
+		if !h.Start.Table.Contains(card) {
+			hand.AddCard(card)
+		}
+	}
+	*table = h.Start.Table.Clone()
+	h.checkpoints = []TurnCheckpoint{}
+}
@@ -0,0 +1,40 @@
+package engine
+
+import "testing"
+
+func TestTurnHistoryUndo(t *testing.T) {
+	deck := NewDeck(NO_SHUFFLE_SEED)
+	player := NewPlayer("player0", *NewHandFromDeck(deck, 12), "uuid-0", INITIAL_POINTS)
+	table := Table{}
+	history := NewTurnHistory(player.Hand, table)
+
+	if history.Undo(&player.Hand, &table) {
+		t.Fatal("undid a turn without checkpoints")
+	}
+
+	// Two melds out of 2,2,3,3,...,7,7 of spades: 2-7 twice
+	for range 2 {
+		history.Checkpoint(player.Hand, table)
+		MakePlay(NewMeldPlay(FindMeldInCards(player.Hand.Cards)), deck, &DiscardPile{}, &table, &player)
+	}
+	if player.Hand.Size != 0 || table.Size != 12 {
+		t.Fatalf("after two melds hand has %d cards and table %d", player.Hand.Size, table.Size)
+	}
+
+	if !history.Undo(&player.Hand, &table) || player.Hand.Size != 6 || table.Size != 6 {
+		t.Fatalf("first undo left hand with %d cards and table with %d", player.Hand.Size, table.Size)
+	}
+	if !history.Undo(&player.Hand, &table) || player.Hand.Size != 12 || table.Size != 0 {
+		t.Fatalf("second undo left hand with %d cards and table with %d", player.Hand.Size, table.Size)
+	}
+	if history.CanUndo() {
+		t.Error("history still has checkpoints after undoing every meld")
+	}
+
+	// Restoring must not share slices with the checkpoint
+	history.Start.Restore(&player.Hand, &table)
+	player.Hand.RemoveCard(*player.Hand.Cards[0])
+	if history.Start.Hand.Size != 12 || len(history.Start.Hand.Cards) != 12 {
+		t.Error("changing a restored hand changed the checkpoint")
+	}
+}
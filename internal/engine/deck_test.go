@@ -0,0 +1,100 @@
+package engine
+
+import (
+	"reflect"
+	"testing"
+)
+
+// cardUUIDs lists the UUIDs of cards in order
+func cardUUIDs(cards []*Card) []uint8 {
+	uuids := make([]uint8, len(cards))
+	for i, card := range cards {
+		uuids[i] = card.UUID
+	}
+	return uuids
+}
+
+func TestNewDeckHasEveryCardTwice(t *testing.T) {
+	deck := NewDeck(TEST_SEED)
+
+	if deck.Size != int(TOTAL_DECK_SIZE) {
+		t.Fatalf("deck size is %d, want %d", deck.Size, TOTAL_DECK_SIZE)
+	}
+
+	uuids := map[uint8]bool{}
+	copies := map[CardSymbol]int{}
+	for _, card := range deck.Cards {
+		if uuids[card.UUID] {
+			t.Errorf("UUID %d is used by more than one card", card.UUID)
+		}
+		uuids[card.UUID] = true
+		copies[card.Symbol]++
+	}
+	for symbol, n := range copies {
+		if n != 2 {
+			t.Errorf("%s appears %d times, want 2", symbol, n)
+		}
+	}
+	if len(copies) != int(TOTAL_DECK_SIZE)/2 {
+		t.Errorf("deck has %d distinct cards, want %d", len(copies), TOTAL_DECK_SIZE/2)
+	}
+}
+
+func TestNewDeckSeeds(t *testing.T) {
+	unshuffled := cardUUIDs(NewDeck(NO_SHUFFLE_SEED).Cards)
+	for i, uuid := range unshuffled {
+		if int(uuid) != i+1 {
+			t.Fatalf("unshuffled deck has UUID %d at position %d", uuid, i)
+		}
+	}
+
+	first, second := NewDeck(TEST_SEED), NewDeck(TEST_SEED)
+	if !reflect.DeepEqual(cardUUIDs(first.Cards), cardUUIDs(second.Cards)) {
+		t.Error("two decks with the same seed are shuffled differently")
+	}
+	if reflect.DeepEqual(cardUUIDs(first.Cards), unshuffled) {
+		t.Error("seeded deck was not shuffled")
+	}
+	if reflect.DeepEqual(cardUUIDs(first.Cards), cardUUIDs(NewDeck(TEST_SEED+1).Cards)) {
+		t.Error("different seeds produced the same deck")
+	}
+
+	unique := NewDeck(UNIQUE_SHUFFLE_SEED)
+	if unique.Seed == UNIQUE_SHUFFLE_SEED {
+		t.Error("unique shuffle does not record the seed it used")
+	}
+	if !reflect.DeepEqual(cardUUIDs(unique.Cards), cardUUIDs(NewDeck(unique.Seed).Cards)) {
+		t.Error("recorded seed of a unique shuffle does not reproduce the deck")
+	}
+}
+
+func TestDeckDrawAndRemove(t *testing.T) {
+	deck := NewDeck(NO_SHUFFLE_SEED)
+	top := deck.Cards[0]
+
+	drawn := deck.DrawCard()
+	if drawn != top {
+		t.Fatalf("drew %s, want the top card %s", drawn.Name, top.Name)
+	}
+	if deck.Size != int(TOTAL_DECK_SIZE)-1 || deck.Contains(drawn) {
+		t.Errorf("drawn card still counted in the deck (size %d)", deck.Size)
+	}
+
+	last := deck.Cards[len(deck.Cards)-1]
+	if !deck.RemoveCard(last) || deck.Contains(last) {
+		t.Error("failed to remove the last card")
+	}
+	if deck.RemoveCard(last) {
+		t.Error("removed a card that was not in the deck")
+	}
+	if deck.Size != int(TOTAL_DECK_SIZE)-2 {
+		t.Errorf("deck size is %d, want %d", deck.Size, TOTAL_DECK_SIZE-2)
+	}
+
+	for deck.Size > 0 {
+		deck.DrawCard()
+	}
+	if card := deck.DrawCard(); card != nil {
+		t.Errorf("drew %s from an empty deck", card.Name)
+	}
+}
@@ -0,0 +1,34 @@
+package engine
+
+// DiscardPile holds the cards discarded at the end of the turns when the
+// discard pile rule is on. Only its top card, the last one, may be taken.
+type DiscardPile struct {
+	Cards []*Card
+}
+
+// Size returns the number of cards in the pile
+func (d *DiscardPile) Size() int {
+	return len(d.Cards)
+}
+
+// Top returns the card on top of the pile, or nil if it is empty
+func (d *DiscardPile) Top() *Card {
+	if len(d.Cards) == 0 {
+		return nil
+	}
+	return d.Cards[len(d.Cards)-1]
+}
+
+// Push puts a card on top of the pile
+func (d *DiscardPile) Push(card *Card) {
+	d.Cards = append(d.Cards, card)
+}
+
+// TakeTop removes the card on top of the pile and returns it, or nil if the pile is empty
+func (d *DiscardPile) TakeTop() *Card {
+	card := d.Top()
+	if card != nil {
+		d.Cards = d.Cards[:len(d.Cards)-1]
+	}
+	return card
+}
@@ -5,6 +5,7 @@ import (
 	"log"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"slices"
@@ -12,6 +13,12 @@ import (
 	"golang.org/x/term"
 )
 
+// CHAT_HISTORY is how many chat messages the Renderer keeps
+const CHAT_HISTORY = 50
+
+// CHAT_PANE_LINES is how many of the latest chat messages are on screen
+const CHAT_PANE_LINES = 4
+
 type Renderer struct {
 	Width         int
 	Table         Table
@@ -22,6 +29,17 @@ type Renderer struct {
 	selectedCards []bool
 	turnState     TurnState
 	freeze        bool
+	status        string
+	statusMu      sync.Mutex
+	chat          []ChatLine
+	chatMu        sync.Mutex
+	// OnEmote sends the emote picked with its number key. Nil disables emotes.
+	OnEmote func(emote Emote)
+	// OnRematch answers a rematch offer with the y and n keys
+	OnRematch func(accept bool)
+	// gameOver tells how the game ended, once it is over
+	gameOver       string
+	rematchOffered bool
 }
 
 func NewRenderer(playerName string) *Renderer {
@@ -52,6 +70,147 @@ func (r *Renderer) UpdateRenderer(table Table, hand Hand, turnState TurnState) {
 	}
 }
 
+// SetStatusMessage queues a message to be shown on the next input screen.
+// It may be called from any goroutine.
+func (r *Renderer) SetStatusMessage(message string) {
+	r.statusMu.Lock()
+	defer r.statusMu.Unlock()
+	r.status = message
+}
+
+// takeStatusMessage returns the queued status message and clears it
+func (r *Renderer) takeStatusMessage() string {
+	r.statusMu.Lock()
+	defer r.statusMu.Unlock()
+	message := r.status
+	r.status = ""
+	return message
+}
+
+// AddChatLine adds a message to the chat pane, scrolling the oldest ones out.
+// It may be called from any goroutine.
+func (r *Renderer) AddChatLine(line ChatLine) {
+	r.chatMu.Lock()
+	defer r.chatMu.Unlock()
+	r.chat = append(r.chat, line)
+	if len(r.chat) > CHAT_HISTORY {
+		r.chat = slices.Clone(r.chat[len(r.chat)-CHAT_HISTORY:])
+	}
+}
+
+// chatLines returns the latest n chat messages
+func (r *Renderer) chatLines(n int) []ChatLine {
+	r.chatMu.Lock()
+	defer r.chatMu.Unlock()
+	start := max(len(r.chat)-n, 0)
+	return slices.Clone(r.chat[start:])
+}
+
+// ShowGameOver shows how the game ended under the hand, asking for a rematch
+// if one is offered. An empty summary hides it when a new game starts. It may
+// be called from any goroutine.
+func (r *Renderer) ShowGameOver(summary string, rematch bool) {
+	r.statusMu.Lock()
+	defer r.statusMu.Unlock()
+	r.gameOver = summary
+	r.rematchOffered = rematch
+}
+
+// gameOverLines returns what ShowGameOver shows, empty while the game runs
+func (r *Renderer) gameOverLines() []string {
+	r.statusMu.Lock()
+	defer r.statusMu.Unlock()
+	if r.gameOver == "" {
+		return nil
+	}
+	lines := []string{"GAME OVER: " + r.gameOver}
+	if r.rematchOffered {
+		lines = append(lines, "Rematch? Press 'y' to play again or 'n' to leave.")
+	}
+	return lines
+}
+
+// answerRematch answers the rematch offer with a y or n key, telling if the key did
+func (r *Renderer) answerRematch(key byte) bool {
+	r.statusMu.Lock()
+	offered := r.rematchOffered && r.OnRematch != nil && (key == 'y' || key == 'n')
+	if offered {
+		r.rematchOffered = false
+	}
+	r.statusMu.Unlock()
+
+	if offered {
+		r.OnRematch(key == 'y')
+	}
+	return offered
+}
+
+// sendEmote sends the emote of a number key, telling if the key was one
+func (r *Renderer) sendEmote(key byte) bool {
+	index := int(key) - '1'
+	if r.OnEmote == nil || index < 0 || index >= len(EMOTES) {
+		return false
+	}
+	r.OnEmote(EMOTES[index])
+	return true
+}
+
+// fitWidth cuts a line to the width of the terminal
+func (r *Renderer) fitWidth(line string) string {
+	runes := []rune(line)
+	if r.Width > 0 && len(runes) > r.Width {
+		return string(runes[:r.Width])
+	}
+	return line
+}
+
+// renderChatPane writes the latest chat messages, and the emote keys when emotes can be sent
+func (r *Renderer) renderChatPane(screenBuffer *strings.Builder) {
+	lines := r.chatLines(CHAT_PANE_LINES)
+	if len(lines) == 0 && r.OnEmote == nil {
+		return
+	}
+
+	screenBuffer.WriteString(fmt.Sprintf("\r\n%s\r\n", r.fitWidth("CHAT "+r.CreateHorizontalLine("-"))))
+	for _, line := range lines {
+		screenBuffer.WriteString(fmt.Sprintf("%s\r\n", r.fitWidth(line.From+": "+line.Text)))
+	}
+	// The pane keeps its height, so the screen doesn't jump as messages arrive
+	for range CHAT_PANE_LINES - len(lines) {
+		screenBuffer.WriteString("\r\n")
+	}
+
+	if r.OnEmote != nil {
+		keys := make([]string, len(EMOTES))
+		for i, emote := range EMOTES {
+			keys[i] = fmt.Sprintf("%d: %s", i+1, emote.Text)
+		}
+		screenBuffer.WriteString(fmt.Sprintf("%s\r\n", r.fitWidth(strings.Join(keys, " | "))))
+	}
+}
+
+// discardPileLine shows the top of the discard pile, empty when the game has none
+func (r *Renderer) discardPileLine() string {
+	if !r.turnState.HasDiscardPile {
+		return ""
+	}
+	if r.turnState.DiscardTop == nil {
+		return "Discard pile: empty"
+	}
+	return fmt.Sprintf("Discard pile: %s (%d cards)", r.turnState.DiscardTop.Symbol, r.turnState.DiscardSize)
+}
+
+// selectedHandCards returns the selected cards of the hand
+func (r *Renderer) selectedHandCards() []Card {
+	cards := []Card{}
+	for i, card := range r.Hand.Cards {
+		if i < len(r.selectedCards) && r.selectedCards[i] {
+			cards = append(cards, *card)
+		}
+	}
+	return cards
+}
+
 func (r *Renderer) CreateHorizontalLine(char string) string {
 	line := ""
 	for i := 0; i < r.Width; i++ {
@@ -72,7 +231,10 @@ func (r *Renderer) PrintInstructions(screenBuffer *strings.Builder) {
 	screenBuffer.WriteString(fmt.Sprintf("%s%s%s\r\n", padStr, titleText, padStr))
 
 	// Instructions line
-	instText := "'s': Select | 'p': Play meld | 'q': Quit | 'd': Draw card | 'e': End turn"
+	instText := "'s': Select | 'p': Play meld | 'u': Undo meld | 'q': Quit | 'd': Draw card | 'e': End turn"
+	if r.turnState.HasDiscardPile {
+		instText += " | 't': Take discard | 'x': Discard"
+	}
 	screenBuffer.WriteString(fmt.Sprintf("%s\r\n", instText))
 	screenBuffer.WriteString(fmt.Sprintf("%s\r\n", headerLine[:r.Width]))
 }
@@ -108,7 +270,7 @@ func (r *Renderer) UserInputDisplay(stopSignal chan bool) Play {
 	r.currentPos = 0
 	r.selectedCards = make([]bool, len(allCards))
 	r.selectedCount = 0
-	statusMessage := ""
+	statusMessage := r.takeStatusMessage()
 
 	for {
 		select {
@@ -162,13 +324,58 @@ func (r *Renderer) UserInputDisplay(stopSignal chan bool) Play {
 					continue
 				}
 
+			case 't':
+				if !r.turnState.HasDiscardPile {
+					statusMessage = "There is no discard pile in this game."
+					continue
+				}
+				if r.turnState.HasDrawedCard {
+					statusMessage = "You can't draw a card twice in a turn."
+					continue
+				}
+				if r.turnState.DiscardTop == nil {
+					statusMessage = "The discard pile is empty."
+					continue
+				}
+				return NewTakeDiscardPlay()
+
+			case 'x':
+				if !r.turnState.HasDiscardPile {
+					statusMessage = "There is no discard pile in this game."
+					continue
+				}
+				selected := r.selectedHandCards()
+				if len(selected) != 1 || r.selectedCount != 1 {
+					statusMessage = "Select exactly one card of your hand to discard."
+					continue
+				}
+				return NewDiscardPlay(selected[0])
+
+			case 'u':
+				if r.turnState.HasDrawedCard {
+					statusMessage = "You can't undo after drawing a card."
+					continue
+				}
+				if !r.turnState.HasPlayedMeld {
+					statusMessage = "There is nothing to undo."
+					continue
+				}
+				return NewUndoPlay()
+
 			case 'e':
-				if r.turnState.HasPlayedMeld || r.turnState.HasDrawedCard {
-					return NewEndTurnPlay()
-				} else {
+				if !r.turnState.HasPlayedMeld && !r.turnState.HasDrawedCard {
 					statusMessage = "You must play a meld or draw a card before ending the turn."
 					continue
 				}
+				if r.turnState.HasDiscardPile && len(r.Hand.Cards) > 0 {
+					statusMessage = "You must discard a card to end the turn."
+					continue
+				}
+				if !r.Table.IsValid() {
+					statusMessage = "The table has invalid melds. Fix or undo them before ending the turn."
+					continue
+				}
+				return NewEndTurnPlay()
 
 			case 'p':
 				if r.selectedCount < MIN_MELD_SIZE {
@@ -176,29 +383,11 @@ func (r *Renderer) UserInputDisplay(stopSignal chan bool) Play {
 					continue
 				}
 
+				// Selected table cards are moved out of their melds into the new one (mexe-mexe)
 				var selectedMeldCards []Card
-				var handCardUUIDs = make(map[uint8]bool) // Track hand card UUIDs
-
-				// First, build a map of all hand card UUIDs for quick lookup
-				for _, card := range r.Hand.Cards {
-					handCardUUIDs[card.UUID] = true
-				}
-
-				// Track which selected cards are from hand vs table
-				var handSelectedCards []Card
-				var tableSelectedCards []Card
-
 				for i, isSelected := range r.selectedCards {
 					if isSelected {
-						card := allCards[i]
-						selectedMeldCards = append(selectedMeldCards, *card)
-
-						// Check if this card is from the hand by UUID
-						if handCardUUIDs[card.UUID] {
-							handSelectedCards = append(handSelectedCards, *card)
-						} else {
-							tableSelectedCards = append(tableSelectedCards, *card)
-						}
+						selectedMeldCards = append(selectedMeldCards, *allCards[i])
 					}
 				}
 
@@ -209,11 +398,21 @@ func (r *Renderer) UserInputDisplay(stopSignal chan bool) Play {
 					continue
 				}
 
+				if r.turnState.OpeningMinPoints > 0 {
+					err = CheckOpeningMeld(selectedMeldCards, &r.Hand, r.turnState.OpeningMinPoints)
+					if err != nil {
+						statusMessage = err.Error()
+						continue
+					}
+				}
+
 				fmt.Print("\033[?25h")     // Show cursor before returning
 				fmt.Print("\033[H\033[2J") // Clear screen
 
-				// Only pass the hand cards to be moved
-				return NewMeldPlay(handSelectedCards)
+				return NewMeldPlay(selectedMeldCards)
+
+			default:
+				r.sendEmote(buffer[0])
 			}
 		} else if n == 3 && buffer[0] == 27 && buffer[1] == 91 {
 			switch buffer[2] {
@@ -251,7 +450,7 @@ func (r *Renderer) RenderInputScreen(allCards []*Card, statusMessage string) {
 
 	if len(r.Table.Cards) > 0 {
 		tableOffset := len(r.Hand.Cards)
-		tableOutput := DisplayCardsWithSelectionToString(r.Table.Cards, r.selectedCards[tableOffset:],
+		tableOutput := DisplayTableWithSelectionToString(r.Table, r.selectedCards[tableOffset:],
 			r.currentPos >= tableOffset, r.currentPos-tableOffset)
 		screenBuffer.WriteString(tableOutput)
 		screenBuffer.WriteString("\r\n\r\n")
@@ -260,6 +459,9 @@ func (r *Renderer) RenderInputScreen(allCards []*Card, statusMessage string) {
 	}
 
 	screenBuffer.WriteString(fmt.Sprintf("%s\r\n", r.CreateHorizontalLine("_")[:r.Width]))
+	if line := r.discardPileLine(); line != "" {
+		screenBuffer.WriteString(fmt.Sprintf("%s\r\n", line))
+	}
 
 	// Display hand section
 	handTitle := fmt.Sprintf("%s's hand", r.PlayerName)
@@ -294,6 +496,8 @@ func (r *Renderer) RenderInputScreen(allCards []*Card, statusMessage string) {
 		screenBuffer.WriteString(selectedOutput)
 	}
 
+	r.renderChatPane(&screenBuffer)
+
 	if statusMessage != "" {
 		screenBuffer.WriteString(fmt.Sprintf("\r\n\r\n%s\r\n", statusMessage))
 	}
@@ -333,6 +537,38 @@ func DisplayCardsWithSelectionToString(cards []*Card, selections []bool, isCurre
 	return output.String()
 }
 
+// DisplayTableWithSelectionToString shows the table meld by meld, marking the invalid ones with '!'.
+// selections and currentPosInSection index the cards of the table in order.
+func DisplayTableWithSelectionToString(table Table, selections []bool, isCurrentSection bool, currentPosInSection int) string {
+	var output strings.Builder
+
+	if len(table.Cards) == 0 {
+		output.WriteString("No cards.\r\n")
+		return output.String()
+	}
+
+	invalid := make(map[int]bool)
+	for _, i := range table.InvalidMelds() {
+		invalid[i] = true
+	}
+
+	offset := 0
+	for i, meld := range table.Melds {
+		if i > 0 {
+			output.WriteString("| ")
+		}
+		if invalid[i] {
+			output.WriteString("!")
+		}
+		meldOutput := DisplayCardsWithSelectionToString(meld, selections[offset:offset+len(meld)],
+			isCurrentSection, currentPosInSection-offset)
+		output.WriteString(strings.TrimPrefix(meldOutput, "  "))
+		offset += len(meld)
+	}
+
+	return "  " + output.String()
+}
+
 // Helper function to display cards without selection (for showing selected cards)
 func DisplayCardsToString(cards []Card, highlightPos int) string {
 	var output strings.Builder
@@ -448,6 +684,9 @@ func (r *Renderer) DisplayScreen(stopSignal chan bool) Play {
 						continue
 					}
 				default:
+					if r.sendEmote(buffer[0]) || r.answerRematch(buffer[0]) {
+						continue
+					}
 					statusMessage = "You cannot make a play now. Wait for your turn."
 					continue
 				}
@@ -498,13 +737,13 @@ func (r *Renderer) RenderScreen(statusMessage string) {
 		tableOffset := len(r.Hand.Cards)
 		// Ensure we don't go out of bounds and use proper navigation
 		if tableOffset < len(r.selectedCards) {
-			tableOutput := DisplayCardsWithSelectionToString(r.Table.Cards, r.selectedCards[tableOffset:],
+			tableOutput := DisplayTableWithSelectionToString(r.Table, r.selectedCards[tableOffset:],
 				r.currentPos >= tableOffset, r.currentPos-tableOffset)
 			screenBuffer.WriteString(tableOutput)
 		} else {
 			// Show navigation highlighting even without selection state
 			emptySelections := make([]bool, len(r.Table.Cards))
-			tableOutput := DisplayCardsWithSelectionToString(r.Table.Cards, emptySelections,
+			tableOutput := DisplayTableWithSelectionToString(r.Table, emptySelections,
 				r.currentPos >= tableOffset, r.currentPos-tableOffset)
 			screenBuffer.WriteString(tableOutput)
 		}
@@ -514,6 +753,9 @@ func (r *Renderer) RenderScreen(statusMessage string) {
 	}
 
 	screenBuffer.WriteString(fmt.Sprintf("%s\r\n", r.CreateHorizontalLine("_")[:r.Width]))
+	if line := r.discardPileLine(); line != "" {
+		screenBuffer.WriteString(fmt.Sprintf("%s\r\n", line))
+	}
 
 	// Display hand section
 	handTitle := fmt.Sprintf("%s's hand", r.PlayerName)
@@ -559,7 +801,12 @@ func (r *Renderer) RenderScreen(statusMessage string) {
 		}
 	}
 
-	screenBuffer.WriteString(fmt.Sprintf("\r\n%s\r\n", "Wait for your turn. Press 'q' to quit. Use arrow keys to navigate."))
+	if lines := r.gameOverLines(); lines != nil {
+		screenBuffer.WriteString(fmt.Sprintf("\r\n%s\r\n", strings.Join(lines, "\r\n")))
+	} else {
+		screenBuffer.WriteString(fmt.Sprintf("\r\n%s\r\n", "Wait for your turn. Press 'q' to quit. Use arrow keys to navigate."))
+	}
+	r.renderChatPane(&screenBuffer)
 	if statusMessage != "" {
 		screenBuffer.WriteString(fmt.Sprintf("\r\n\r\n%s\r\n", statusMessage))
 	}
@@ -568,3 +815,27 @@ func (r *Renderer) RenderScreen(statusMessage string) {
 	fmt.Print(screenBuffer.String())
 	fmt.Print("\033[J")
 }
+
+// PassKeyboardDisplay hides the table and hands until the next local player
+// confirms they have the keyboard, so nobody peeks at someone else's hand.
+func (r *Renderer) PassKeyboardDisplay() {
+	fmt.Print("\033[H\033[2J")
+
+	oldState, err := term.MakeRaw(int(os.Stdin.Fd()))
+	if err != nil {
+		log.Fatalf("Error setting up terminal: %s\r\n", err)
+	}
+	defer func() {
+		term.Restore(int(os.Stdin.Fd()), oldState)
+		fmt.Print("\033[H\033[2J")
+	}()
+
+	fmt.Printf("Pass the keyboard to %s.\r\n", r.PlayerName)
+	fmt.Printf("%s, press any key when you are ready.\r\n", r.PlayerName)
+
+	buffer := make([]byte, 3)
+	_, err = os.Stdin.Read(buffer)
+	if err != nil {
+		fmt.Printf("Error reading input: %s\r\n", err)
+	}
+}
@@ -60,6 +60,16 @@ func (h *Hand) updateSize() {
 	h.Size = len(h.Cards)
 }
 
+// GetCard returns the card in the hand with the given UUID, or nil if it is not in the hand
+func (h *Hand) GetCard(uuid uint8) *Card {
+	for i := range h.Cards {
+		if h.Cards[i].UUID == uuid {
+			return h.Cards[i]
+		}
+	}
+	return nil
+}
+
 func (h *Hand) Contains(card Card) bool {
 	for i := range h.Cards {
 		if h.Cards[i].UUID == card.UUID {
@@ -69,6 +79,14 @@ func (h *Hand) Contains(card Card) bool {
 	return false
 }
 
+// Clone returns a copy of the hand that does not share its card slice.
+func (h Hand) Clone() Hand {
+	return Hand{
+		Cards: slices.Clone(h.Cards),
+		Size:  h.Size,
+	}
+}
+
 func NewHandFromDeck(deck *Deck, numCards uint8) *Hand {
 	cards := make([]*Card, numCards)
 	for i := range int(numCards) {
@@ -0,0 +1,55 @@
+package engine
+
+import "testing"
+
+func TestHandCardMovement(t *testing.T) {
+	deck := NewDeck(NO_SHUFFLE_SEED)
+	hand := NewHandFromDeck(deck, NUM_CARDS)
+
+	if hand.Size != NUM_CARDS || deck.Size != int(TOTAL_DECK_SIZE)-NUM_CARDS {
+		t.Fatalf("dealt hand has %d cards and deck %d", hand.Size, deck.Size)
+	}
+
+	card := *hand.Cards[0]
+	if !hand.RemoveCard(card) || hand.Contains(card) {
+		t.Fatal("failed to remove a card from the hand")
+	}
+	if hand.RemoveCard(card) {
+		t.Error("removed a card twice")
+	}
+	if hand.Size != NUM_CARDS-1 {
+		t.Errorf("hand size is %d after removing a card, want %d", hand.Size, NUM_CARDS-1)
+	}
+
+	hand.AddCard(&card)
+	hand.AddCard(&card)
+	if hand.Size != NUM_CARDS || !hand.Contains(card) {
+		t.Errorf("adding the same card twice gave a hand of %d cards, want %d", hand.Size, NUM_CARDS)
+	}
+}
+
+func TestHandClone(t *testing.T) {
+	deck := NewDeck(NO_SHUFFLE_SEED)
+	hand := NewHandFromDeck(deck, 5)
+	clone := hand.Clone()
+
+	hand.RemoveCard(*hand.Cards[0])
+	if clone.Size != 5 || len(clone.Cards) != 5 || clone.Cards[0] == nil {
+		t.Errorf("clone changed with the original hand: %v", clone.String())
+	}
+}
+
+func TestSortHandBySuitAndValue(t *testing.T) {
+	deck := NewDeck(TEST_SEED)
+	hand := NewHandFromDeck(deck, NUM_CARDS)
+	SortHandBySuitAndValue(hand)
+
+	suitOrder := map[CardSuit]int{SPADE: 0, CLUB: 1, HEART: 2, DIAMOND: 3}
+	for i := 1; i < len(hand.Cards); i++ {
+		previous, card := hand.Cards[i-1], hand.Cards[i]
+		if suitOrder[previous.Suit] > suitOrder[card.Suit] ||
+			(previous.Suit == card.Suit && previous.Value > card.Value) {
+			t.Fatalf("hand is not sorted: %s", hand.String())
+		}
+	}
+}
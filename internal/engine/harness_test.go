@@ -0,0 +1,116 @@
+package engine
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"mexemexe/internal/service"
+)
+
+const TEST_SEED uint64 = 42
+
+// gameRun is the outcome of a game played through the harness
+type gameRun struct {
+	finished bool
+	events   [][]OutputEvent // indexed like Game.Players
+}
+
+// states returns only the game states emitted to the player at index i
+func (r *gameRun) states(i int) []GameStateMessageOut {
+	states := []GameStateMessageOut{}
+	for _, event := range r.events[i] {
+		if event.Type == "state" {
+			states = append(states, event.State)
+		}
+	}
+	return states
+}
+
+// newTestGame creates a game with a fixed seed and players named after their UUIDs
+func newTestGame(t *testing.T, seed uint64, numPlayers int) *Game {
+	t.Helper()
+	names := make([]string, numPlayers)
+	uuids := make([]string, numPlayers)
+	for i := range numPlayers {
+		names[i] = fmt.Sprintf("player%d", i)
+		uuids[i] = fmt.Sprintf("uuid-%d", i)
+	}
+	config := NewGameConfig(names, uuids)
+	config.Seed = seed
+	return NewGame(config, service.NewLogger(service.LEVEL_ERROR, "test"))
+}
+
+// repeatPlays returns the plays repeated n times
+func repeatPlays(n int, plays ...Play) []Play {
+	script := []Play{}
+	for range n {
+		script = append(script, plays...)
+	}
+	return script
+}
+
+// runScriptedGame plays the game to the end, taking the plays of each player
+// from scripts (keyed by player UUID) and recording everything sent to them.
+func runScriptedGame(t *testing.T, game *Game, scripts map[string][]Play) *gameRun {
+	t.Helper()
+	inputs := make([]InputProvider, len(game.Players))
+	for i, player := range game.Players {
+		inputs[i] = NewScriptedInputProvider(player.UUID, scripts[player.UUID])
+	}
+	return runGame(t, game, inputs)
+}
+
+// teeOutputProvider sends everything to two output providers
+type teeOutputProvider struct {
+	first  OutputProvider
+	second OutputProvider
+}
+
+func (t teeOutputProvider) GetUUID() string {
+	return t.first.GetUUID()
+}
+
+func (t teeOutputProvider) Write(messageType string, data interface{}) {
+	t.first.Write(messageType, data)
+	t.second.Write(messageType, data)
+}
+
+func (t teeOutputProvider) SendState(table Table, hand Hand, turnState TurnState) {
+	t.first.SendState(table, hand, turnState)
+	t.second.SendState(table, hand, turnState)
+}
+
+// runGame plays the game to the end with the given inputs, indexed like game.Players
+func runGame(t *testing.T, game *Game, inputs []InputProvider) *gameRun {
+	t.Helper()
+	run := &gameRun{events: make([][]OutputEvent, len(game.Players))}
+
+	channels := make([]*ChannelOutputProvider, len(game.Players))
+	outputs := make([]OutputProvider, len(game.Players))
+	var wg sync.WaitGroup
+	for i, player := range game.Players {
+		channels[i] = NewChannelOutputProvider(player.UUID, 0)
+		outputs[i] = channels[i]
+
+		// Inputs such as bots learn about the game through the states sent to them
+		if output, ok := inputs[i].(OutputProvider); ok {
+			outputs[i] = teeOutputProvider{output, channels[i]}
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for event := range channels[i].Events() {
+				run.events[i] = append(run.events[i], event)
+			}
+		}()
+	}
+
+	run.finished = game.Start(inputs, outputs, game.Players[0].UUID)
+
+	for _, channel := range channels {
+		channel.Close()
+	}
+	wg.Wait()
+	return run
+}
@@ -2,9 +2,10 @@ package engine
 
 import (
 	"encoding/json"
+	"errors"
+	"mexemexe/internal/protocol"
 	"mexemexe/internal/service"
-
-	"github.com/gorilla/websocket"
+	"time"
 )
 
 type RawGamePlayMessage struct {
@@ -17,12 +18,14 @@ type InputProvider interface {
 }
 
 type WebsocketInputProvider struct {
-	uuid   string
-	conn   *websocket.Conn
+	uuid string
+	conn *protocol.Conn
+	// source holds the messages routed to the game when something else reads the connection
+	source <-chan protocol.Envelope
 	logger *service.GameLogger
 }
 
-func NewWebsocketInputProvider(conn *websocket.Conn, uuid string, logger *service.GameLogger) *WebsocketInputProvider {
+func NewWebsocketInputProvider(conn *protocol.Conn, uuid string, logger *service.GameLogger) *WebsocketInputProvider {
 	return &WebsocketInputProvider{
 		uuid:   uuid,
 		conn:   conn,
@@ -30,51 +33,191 @@ func NewWebsocketInputProvider(conn *websocket.Conn, uuid string, logger *servic
 	}
 }
 
+// SetSource makes GetPlay read the messages routed to it instead of reading
+// the connection, for when the connection carries more than plays. The
+// channel is closed once the player is gone for good, which GetPlay reports
+// as a disconnection.
+func (w *WebsocketInputProvider) SetSource(source <-chan protocol.Envelope) {
+	w.source = source
+}
+
 func (w WebsocketInputProvider) IsConnected() bool {
-	return true
+	select {
+	case <-w.conn.Done():
+		return false
+	default:
+		return true
+	}
+}
+
+// errTurnOver is returned by receive once the deadline of the turn has passed
+var errTurnOver = errors.New("turn deadline passed")
+
+// receive returns the next message for the game, or errTurnOver if none
+// arrives before the deadline. A zero deadline waits forever.
+func (w *WebsocketInputProvider) receive(deadline time.Time) (protocol.Envelope, error) {
+	source := w.source
+	if source == nil {
+		source = w.conn.Messages()
+	}
+	var expired <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case envelope, ok := <-source:
+		if !ok {
+			err := w.conn.Err()
+			if err == nil {
+				err = protocol.ErrClosed
+			}
+			return protocol.Envelope{}, err
+		}
+		return envelope, nil
+	case <-expired:
+		return protocol.Envelope{}, errTurnOver
+	}
 }
 
 func (w *WebsocketInputProvider) GetPlay(turnState TurnState) Play {
 
-	var rawMsg RawGamePlayMessage
-	err := w.conn.ReadJSON(&rawMsg)
+	envelope, err := w.receive(turnState.deadline)
+	for err == nil && envelope.Type != protocol.GAME_PLAY {
+		w.logger.Errorf("ignoring %s message during the game", envelope.Type)
+		envelope, err = w.receive(turnState.deadline)
+	}
+	if errors.Is(err, errTurnOver) {
+		w.logger.Infof("Turn of player %s timed out", w.uuid)
+		return NewTimeoutPlay()
+	}
 	if err != nil {
 		w.logger.Errorf("error reading from websocket: %v", err)
-		return NewQuitPlay()
+		return NewDisconnectPlay()
 	}
 
-	// Detect play type
-	type TypeDetector struct {
-		Type string `json:"type"`
+	var rawMsg RawGamePlayMessage
+	err = envelope.Decode(&rawMsg)
+	if err != nil {
+		w.logger.Errorf("error reading play: %v", err)
+		return NewQuitPlay()
 	}
 
-	var detector TypeDetector
-	err = json.Unmarshal(rawMsg.Play, &detector)
+	play, err := DecodePlay(rawMsg.Play)
 	if err != nil {
-		w.logger.Errorf("error detecting play type: %v", err)
+		w.logger.Errorf("error decoding play: %v", err)
+		return NewQuitPlay()
+	}
+	// Only the server times players out or finds them gone
+	if play.GetName() == TIMEOUT || play.GetName() == DISCONNECT {
+		w.logger.Errorf("client sent a %s play", play.GetName())
 		return NewQuitPlay()
 	}
+	w.logger.Infof("Detected play type: %s", play.GetName())
+	return play
+}
 
-	w.logger.Infof("Detected play type: %s", detector.Type)
+// HotSeat is shared by the local players of a terminal game. It shows the
+// "pass the keyboard" screen whenever the turn moves to a different player.
+type HotSeat struct {
+	currentUUID string
+}
 
-	// Create concrete Play based on type
-	switch detector.Type {
-	case "DRAW_CARD":
-		return NewDrawCardPlay()
-	case "END_TURN":
-		return NewEndTurnPlay()
-	case "QUIT":
-		return NewQuitPlay()
-	case "PLAY_MELD":
-		var meldPlay MeldPlay
-		err = json.Unmarshal(rawMsg.Play, &meldPlay)
-		if err != nil {
-			w.logger.Errorf("error parsing meld: %v", err)
-			return NewQuitPlay()
+func NewHotSeat() *HotSeat {
+	return &HotSeat{}
+}
+
+func (h *HotSeat) TakeSeat(uuid string, renderer *Renderer) {
+	if h.currentUUID == uuid {
+		return
+	}
+	h.currentUUID = uuid
+	renderer.PassKeyboardDisplay()
+}
+
+// TerminalInputProvider reads the plays of a local player from the keyboard
+type TerminalInputProvider struct {
+	uuid     string
+	renderer *Renderer
+	hotSeat  *HotSeat
+}
+
+// NewTerminalInputProvider creates a keyboard input provider. hotSeat may be nil
+// when a single human plays on the terminal.
+func NewTerminalInputProvider(uuid string, renderer *Renderer, hotSeat *HotSeat) *TerminalInputProvider {
+	return &TerminalInputProvider{
+		uuid:     uuid,
+		renderer: renderer,
+		hotSeat:  hotSeat,
+	}
+}
+
+func (t *TerminalInputProvider) IsConnected() bool {
+	return true
+}
+
+func (t *TerminalInputProvider) GetPlay(turnState TurnState) Play {
+	if t.hotSeat != nil {
+		t.hotSeat.TakeSeat(t.uuid, t.renderer)
+	}
+	return t.renderer.UserInputDisplay(nil)
+}
+
+// ChannelInputProvider takes the plays of a player from a channel, so the engine
+// can be driven in-process without a websocket. A closed channel means the
+// player is gone and is reported as a disconnection.
+type ChannelInputProvider struct {
+	uuid      string
+	plays     <-chan Play
+	connected bool
+	timeout   time.Duration
+}
+
+func NewChannelInputProvider(uuid string, plays <-chan Play) *ChannelInputProvider {
+	return &ChannelInputProvider{
+		uuid:      uuid,
+		plays:     plays,
+		connected: true,
+	}
+}
+
+func (c *ChannelInputProvider) IsConnected() bool {
+	return c.connected
+}
+
+// SetTimeout makes GetPlay give up and play a timeout when no play arrives
+// within d. Zero waits forever.
+func (c *ChannelInputProvider) SetTimeout(d time.Duration) {
+	c.timeout = d
+}
+
+func (c *ChannelInputProvider) GetPlay(turnState TurnState) Play {
+	var expired <-chan time.Time
+	if c.timeout > 0 {
+		expired = time.After(c.timeout)
+	}
+
+	select {
+	case play, ok := <-c.plays:
+		if !ok {
+			c.connected = false
+			return NewDisconnectPlay()
 		}
-		return NewMeldPlay(meldPlay.Cards)
-	default:
-		w.logger.Errorf("unknown play type: %s", detector.Type)
-		return NewQuitPlay()
+		return play
+	case <-expired:
+		return NewTimeoutPlay()
+	}
+}
+
+// NewScriptedInputProvider returns an input provider that replays a fixed list
+// of plays in order, and disconnects once the script runs out.
+func NewScriptedInputProvider(uuid string, script []Play) *ChannelInputProvider {
+	plays := make(chan Play, len(script))
+	for _, play := range script {
+		plays <- play
 	}
+	close(plays)
+	return NewChannelInputProvider(uuid, plays)
 }
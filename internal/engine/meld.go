@@ -62,6 +62,25 @@ func MakeMeldFromCards(cards []Card) (Meld, error) {
 
 }
 
+// MeldPoints adds up the value of the cards (J is 11, Q 12, K 13 and A 14)
+func MeldPoints(cards []Card) uint32 {
+	points := uint32(0)
+	for _, card := range cards {
+		points += uint32(card.Value)
+	}
+	return points
+}
+
+// IsValidMeld tells if the cards, in any order, make a sequence or a book
+func IsValidMeld(cards []*Card) bool {
+	meldCards := make([]Card, len(cards))
+	for i, card := range cards {
+		meldCards[i] = *card
+	}
+	_, err := MakeMeldFromCards(meldCards)
+	return err == nil
+}
+
 func isMeldSequence(cards []Card) bool {
 
 	// Check if has same suit - if not, it is not a sequence
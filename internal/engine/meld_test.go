@@ -0,0 +1,114 @@
+package engine
+
+import "testing"
+
+// newTestCard builds a card that only carries what meld validation looks at
+func newTestCard(value CardValue, suit CardSuit) Card {
+	return Card{Value: value, Suit: suit}
+}
+
+func TestIsMeldSequence(t *testing.T) {
+	tests := []struct {
+		name  string
+		cards []Card
+		want  bool
+	}{
+		{"three in a row", []Card{newTestCard(4, HEART), newTestCard(5, HEART), newTestCard(6, HEART)}, true},
+		{"long run up to the ace", []Card{newTestCard(10, SPADE), newTestCard(JACK_VALUE, SPADE), newTestCard(QUEEN_VALUE, SPADE), newTestCard(KING_VALUE, SPADE), newTestCard(ACE_VALUE, SPADE)}, true},
+		{"mixed suits", []Card{newTestCard(4, HEART), newTestCard(5, DIAMOND), newTestCard(6, HEART)}, false},
+		{"gap in values", []Card{newTestCard(4, CLUB), newTestCard(5, CLUB), newTestCard(7, CLUB)}, false},
+		{"repeated value", []Card{newTestCard(4, CLUB), newTestCard(4, CLUB), newTestCard(5, CLUB)}, false},
+		{"descending order", []Card{newTestCard(6, CLUB), newTestCard(5, CLUB), newTestCard(4, CLUB)}, false},
+		{"ace does not wrap around", []Card{newTestCard(KING_VALUE, CLUB), newTestCard(ACE_VALUE, CLUB), newTestCard(TWO_VALUE, CLUB)}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isMeldSequence(tt.cards); got != tt.want {
+				t.Errorf("isMeldSequence() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsMeldBook(t *testing.T) {
+	tests := []struct {
+		name  string
+		cards []Card
+		want  bool
+	}{
+		{"three suits", []Card{newTestCard(QUEEN_VALUE, HEART), newTestCard(QUEEN_VALUE, SPADE), newTestCard(QUEEN_VALUE, CLUB)}, true},
+		{"four suits", []Card{newTestCard(7, HEART), newTestCard(7, SPADE), newTestCard(7, CLUB), newTestCard(7, DIAMOND)}, true},
+		{"both copies of a card", []Card{newTestCard(7, HEART), newTestCard(7, HEART), newTestCard(7, CLUB)}, true},
+		{"different values", []Card{newTestCard(7, HEART), newTestCard(8, SPADE), newTestCard(7, CLUB)}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isMeldBook(tt.cards); got != tt.want {
+				t.Errorf("isMeldBook() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMakeMeldFromCards(t *testing.T) {
+	tests := []struct {
+		name     string
+		cards    []Card
+		wantType MeldType
+		wantErr  bool
+	}{
+		{"unsorted sequence", []Card{newTestCard(6, HEART), newTestCard(4, HEART), newTestCard(5, HEART)}, SEQUENCE, false},
+		{"book", []Card{newTestCard(2, HEART), newTestCard(2, SPADE), newTestCard(2, CLUB)}, BOOK, false},
+		{"too few cards", []Card{newTestCard(2, HEART), newTestCard(2, SPADE)}, NONE, true},
+		{"no cards", []Card{}, NONE, true},
+		{"not a meld", []Card{newTestCard(2, HEART), newTestCard(9, SPADE), newTestCard(KING_VALUE, CLUB)}, NONE, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			meld, err := MakeMeldFromCards(tt.cards)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("MakeMeldFromCards() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if meld.Type != tt.wantType {
+				t.Errorf("MakeMeldFromCards() type = %s, want %s", meld.Type, tt.wantType)
+			}
+			if !tt.wantErr && !meld.IsValid() {
+				t.Errorf("MakeMeldFromCards() returned a meld that is not valid: %+v", meld)
+			}
+		})
+	}
+}
+
+func TestMeldIsValid(t *testing.T) {
+	sequence := []Card{newTestCard(4, HEART), newTestCard(5, HEART), newTestCard(6, HEART)}
+
+	if !(&Meld{SEQUENCE, sequence}).IsValid() {
+		t.Error("sequence meld should be valid")
+	}
+	if (&Meld{BOOK, sequence}).IsValid() {
+		t.Error("a sequence labeled as a book should not be valid")
+	}
+	if (&Meld{NONE, sequence}).IsValid() {
+		t.Error("a meld without type should not be valid")
+	}
+}
+
+func TestFindMeldInCards(t *testing.T) {
+	deck := NewDeck(NO_SHUFFLE_SEED)
+
+	// The unshuffled deck starts with two of each spade: 2,2,3,3,4,4,...
+	meld := FindMeldInCards(deck.Cards[:8])
+	if len(meld) != 4 {
+		t.Fatalf("found a meld of %d cards, want the 2-5 spade sequence", len(meld))
+	}
+	if _, err := MakeMeldFromCards(meld); err != nil {
+		t.Errorf("found meld is not valid: %v", err)
+	}
+
+	if meld := FindMeldInCards(deck.Cards[:4]); meld != nil {
+		t.Errorf("found a meld in two pairs: %v", meld)
+	}
+}
@@ -5,6 +5,9 @@ import (
 	"log"
 	"math/rand/v2"
 	"mexemexe/internal/service"
+	"slices"
+	"sync"
+	"time"
 )
 
 // Mexe-mexe rules:
@@ -26,6 +29,22 @@ type GameOptions struct {
 	NumCards   uint8
 }
 
+// GameRules holds the optional house rules of a game. The zero value plays without them.
+type GameRules struct {
+	// OpeningMinPoints is the minimum value of a player's first meld, which must
+	// be made only with cards from their hand. Zero disables the opening rule.
+	OpeningMinPoints uint32
+	// FreezeLeaverHands keeps the hand of a player who leaves a game that goes
+	// on out of play, instead of discarding it
+	FreezeLeaverHands bool
+	// DiscardPile makes players end their turn by discarding a card, which the
+	// next player may take instead of drawing from the deck
+	DiscardPile bool
+	// TurnTimeout is how long a player has to finish their turn before it is
+	// played out as a timeout. Zero waits forever.
+	TurnTimeout time.Duration
+}
+
 type GameConfig struct {
 	Seed              uint64
 	PlayersName       []string
@@ -34,6 +53,7 @@ type GameConfig struct {
 	NumCards          uint8
 	RandomPlayerOrder bool
 	TotalCards        uint8
+	Rules             GameRules
 }
 
 func NewGameConfig(playersNames []string, playersUUID []string) *GameConfig {
@@ -54,7 +74,20 @@ type Game struct {
 	Deck    *Deck
 	Table   Table
 	Players []Player
-	logger  *service.GameLogger
+	// CurrentPlayer is the index in Players of the player whose turn is next or in progress
+	CurrentPlayer int
+	// TurnsPlayed counts the completed turns, including those before a restore
+	TurnsPlayed int
+	// DiscardPile holds the cards discarded at the end of the turns, when the rules use it
+	DiscardPile DiscardPile
+	// Discards holds the cards out of play, such as the hands of the players who left
+	Discards    []*Card
+	result      GameResult
+	abandoned   bool
+	turnEndHook func(g *Game)
+	outputs     []OutputProvider
+	mu          sync.Mutex
+	logger      *service.GameLogger
 }
 
 func NewEmptyGame(config *GameConfig, logger *service.GameLogger) *Game {
@@ -106,6 +139,26 @@ func (g *Game) ShufflePlayers() {
 	})
 }
 
+// SetTurnEndHook registers a function called by Start after every completed
+// turn, once CurrentPlayer points to the next player. It runs on the game goroutine.
+func (g *Game) SetTurnEndHook(hook func(g *Game)) {
+	g.turnEndHook = hook
+}
+
+// NextTurnState returns the state the turn of the current player starts with
+func (g *Game) NextTurnState() TurnState {
+	player := &g.Players[g.CurrentPlayer]
+	turnState := NewTurnState(player.UUID)
+	turnState.OpeningMinPoints = player.OpeningRequirement(&g.Config.Rules)
+	turnState.HasDiscardPile = g.Config.Rules.DiscardPile
+	turnState.UpdateDiscardPile(&g.DiscardPile)
+	return *turnState
+}
+
+// Start plays the game from the turn of CurrentPlayer until someone wins, the
+// deck runs out or every other player left. A player who quits resigns: the
+// game goes on without them, or ends once a single player is left, who wins.
+// It returns false if the game was abandoned.
 func (g *Game) Start(inputProvider []InputProvider, outputProvider []OutputProvider, firstPlayerUUID string) bool {
 
 	g.logger.Infof("Game started!\r\n")
@@ -114,42 +167,158 @@ func (g *Game) Start(inputProvider []InputProvider, outputProvider []OutputProvi
 	g.logger.Infof("Table: %v\r\n", g.Table.Size)
 	g.logger.Infof("First player UUID: %s\r\n", firstPlayerUUID)
 
+	g.mu.Lock()
+	g.outputs = outputProvider
+	g.mu.Unlock()
+
 	for g.Deck.Size > 0 {
-		for i := range g.Players {
+		i := g.CurrentPlayer
 
-			g.ValidadeGame()
-			player := &g.Players[i]
-			SendStateToPlayers(outputProvider, g.Table, g.Players, *NewTurnState(player.UUID))
-			g.logger.Infof("Player %s turn.\r\n", player.Name)
-			availablePlay := player.PlayTurn(g.Deck, &g.Table, inputProvider[i], outputProvider, g.Players)
+		g.ValidadeGame()
+		player := &g.Players[i]
+		g.logger.Infof("Player %s turn.\r\n", player.Name)
+		availablePlay := player.PlayTurn(g.Deck, &g.DiscardPile, &g.Table, inputProvider[i], outputProvider, g.Players, &g.Config.Rules)
 
-			switch availablePlay {
-			case QUIT:
-				g.logger.Infof("Player %s quits", player.Name)
+		switch availablePlay {
+		case QUIT, DISCONNECT:
+			if g.isAbandoned() {
+				g.logger.Infof("Player %s left a game cut short", player.Name)
+				g.finish(OUTCOME_ABANDONED, "", player.UUID)
 				return false
-
-			case END_TURN:
-				g.logger.Infof("Player %s ends turn", player.Name)
-
-			case DRAW_CARD:
-				g.logger.Infof("Player %s drawed a card", player.Name)
-
-			case PLAY_MELD:
-				g.logger.Infof("Player %s played a meld", player.Name)
 			}
-			if player.Hand.Size == 0 {
-				g.logger.Infof("Player %s wins!", player.Name)
+			g.leave(player, availablePlay)
+			if active := ActivePlayers(g.Players); len(active) == 1 {
+				g.logger.Infof("Player %s left, the last player wins", player.Name)
+				g.finish(OUTCOME_RESIGNED, active[0], player.UUID)
 				return true
 			}
+
+		case END_TURN:
+			g.logger.Infof("Player %s ends turn", player.Name)
+
+		case DISCARD:
+			g.logger.Infof("Player %s discards and ends turn", player.Name)
+
+		case TIMEOUT:
+			g.logger.Infof("Player %s ran out of time", player.Name)
+
+		case DRAW_CARD:
+			g.logger.Infof("Player %s drawed a card", player.Name)
+
+		case PLAY_MELD:
+			g.logger.Infof("Player %s played a meld", player.Name)
+		}
+		g.TurnsPlayed++
+		if !player.Left && player.Hand.Size == 0 {
+			g.logger.Infof("Player %s wins!", player.Name)
+			g.finish(OUTCOME_WON, player.UUID, "")
+			return true
+		}
+
+		g.CurrentPlayer = g.nextPlayer(i)
+		if g.turnEndHook != nil {
+			g.turnEndHook(g)
 		}
 	}
 	// Broadcast to all players
 	// outputProvider.Write("message", "Deck is empty! Game over!")
 	fmt.Println("Deck is empty! Game over!")
 	// g.ComputePoints()
+	g.finish(OUTCOME_DECK_EMPTY, g.fewestCardsPlayer(), "")
 	return true
 }
 
+// nextPlayer returns the index of the first player after the one at index i
+// who is still in the game
+func (g *Game) nextPlayer(i int) int {
+	next := (i + 1) % len(g.Players)
+	for g.Players[next].Left && next != i {
+		next = (next + 1) % len(g.Players)
+	}
+	return next
+}
+
+// leave takes a player who resigned or lost their connection out of the
+// game. Their hand is put out of play, not on the discard pile, unless the
+// rules freeze it.
+func (g *Game) leave(player *Player, play AvailablePlay) {
+	player.Left = true
+	reason := "resigned"
+	if play == DISCONNECT {
+		reason = "lost their connection"
+	}
+	g.logger.Infof("Player %s %s and left the game", player.Name, reason)
+
+	message := fmt.Sprintf("%s %s and left the game.", player.Name, reason)
+	if len(ActivePlayers(g.Players)) > 1 {
+		if g.Config.Rules.FreezeLeaverHands {
+			message += " Their hand is frozen until the end of the game."
+		} else {
+			g.Discards = append(g.Discards, player.Hand.Cards...)
+			player.Hand = Hand{Cards: []*Card{}}
+			message += " Their cards were put out of play."
+		}
+	}
+	g.notifyOthers(player.UUID, message)
+}
+
+// Abandon cuts the game short, as when the server stops: the next player to
+// leave ends the game without a winner instead of leaving it to the others.
+// It may be called from any goroutine while the game runs.
+func (g *Game) Abandon() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.abandoned = true
+}
+
+func (g *Game) isAbandoned() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.abandoned
+}
+
+// playerName returns the name of the player with the given UUID
+func (g *Game) playerName(uuid string) string {
+	i := slices.Index(g.Config.PlayersUUID, uuid)
+	if i < 0 {
+		return uuid
+	}
+	return g.Config.PlayersName[i]
+}
+
+// notifyOthers sends a message to every player but the one with the given UUID
+func (g *Game) notifyOthers(uuid string, message string) {
+	g.mu.Lock()
+	outputs := g.outputs
+	g.mu.Unlock()
+	for _, output := range outputs {
+		if output.GetUUID() != uuid {
+			output.Write("message", message)
+		}
+	}
+}
+
+// NotifyDisconnected tells the other players that a player lost their
+// connection, and how long they have to come back before leaving the game.
+// It may be called from any goroutine while the game runs.
+func (g *Game) NotifyDisconnected(uuid string, grace time.Duration) {
+	name := g.playerName(uuid)
+	g.logger.Infof("Player %s disconnected", name)
+	if grace <= 0 {
+		g.notifyOthers(uuid, fmt.Sprintf("%s disconnected and leaves the game when their turn comes.", name))
+		return
+	}
+	g.notifyOthers(uuid, fmt.Sprintf("%s disconnected and has %s to come back.", name, grace))
+}
+
+// NotifyReconnected tells the other players that a player came back.
+// It may be called from any goroutine while the game runs.
+func (g *Game) NotifyReconnected(uuid string) {
+	name := g.playerName(uuid)
+	g.logger.Infof("Player %s reconnected", name)
+	g.notifyOthers(uuid, fmt.Sprintf("%s is back.", name))
+}
+
 func (g *Game) ComputePoints() {
 	// TODO: Implement
 }
@@ -165,16 +334,25 @@ func (g *Game) Print(player *Player) {
 }
 
 func (g *Game) ValidadeGame() {
+	err := g.CheckCardConservation()
+	if err != nil {
+		log.Fatalf("ERROR: %v", err)
+	}
+}
+
+// CheckCardConservation returns an error if the cards in hands, deck, table
+// and discards don't add up to the cards the game started with.
+func (g *Game) CheckCardConservation() error {
 	numberCardsWithPlayers := 0
 	for i := range g.Players {
 		numberCardsWithPlayers += len(g.Players[i].Hand.Cards)
 	}
-	totalCardsGame := numberCardsWithPlayers + g.Deck.Size + len(g.Table.Cards)
+	totalCardsGame := numberCardsWithPlayers + g.Deck.Size + len(g.Table.Cards) + g.DiscardPile.Size() + len(g.Discards)
 
-	if uint8(totalCardsGame) == uint8(g.Config.TotalCards) {
-		return
+	if totalCardsGame == int(g.Config.TotalCards) {
+		return nil
 	}
-	log.Fatalf("ERROR: Card leek. Current total cards: %d, expected: %d", totalCardsGame, g.Config.TotalCards)
+	return fmt.Errorf("card leak. Current total cards: %d, expected: %d", totalCardsGame, g.Config.TotalCards)
 }
 
 // SendStateToPlayers sends the current state to all players via outputProviders
@@ -0,0 +1,582 @@
+package engine
+
+import (
+	"flag"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScriptedGameQuit(t *testing.T) {
+	game := newTestGame(t, TEST_SEED, 2)
+	first, second := game.Players[0].UUID, game.Players[1].UUID
+
+	run := runScriptedGame(t, game, map[string][]Play{
+		first:  {NewDrawCardPlay(), NewEndTurnPlay()},
+		second: {NewQuitPlay()},
+	})
+
+	// Quitting resigns: the only other player wins
+	if !run.finished {
+		t.Fatal("a game ended by a resignation must be reported as finished")
+	}
+	result := game.Result()
+	if result.Outcome != OUTCOME_RESIGNED || result.WinnerUUID != first || result.QuitterUUID != second || !result.HasLeft(second) {
+		t.Errorf("result = %+v", result)
+	}
+
+	for i := range game.Players {
+		states := run.states(i)
+		if len(states) != 5 {
+			t.Fatalf("player %d got %d states, want 5", i, len(states))
+		}
+		if states[0].Turn.PlayerUUID != first || states[0].Turn.HasDrawedCard {
+			t.Errorf("player %d: first state is not a fresh turn of %s: %+v", i, first, states[0].Turn)
+		}
+		if !states[1].Turn.HasDrawedCard {
+			t.Errorf("player %d: state after the draw does not record it: %+v", i, states[1].Turn)
+		}
+		if states[3].Turn.PlayerUUID != second {
+			t.Errorf("player %d: turn did not pass to %s: %+v", i, second, states[3].Turn)
+		}
+		if !states[4].Turn.GameEnded {
+			t.Errorf("player %d: last state does not end the game: %+v", i, states[4].Turn)
+		}
+	}
+
+	if got := run.states(0)[1].Hand.Size; got != NUM_CARDS+1 {
+		t.Errorf("first player hand after drawing has %d cards, want %d", got, NUM_CARDS+1)
+	}
+}
+
+func TestScriptedGameDrawsUntilDeckIsEmpty(t *testing.T) {
+	game := newTestGame(t, TEST_SEED, 2)
+	turnsEach := (int(TOTAL_DECK_SIZE) - 2*NUM_CARDS) / 2
+
+	scripts := map[string][]Play{}
+	for _, player := range game.Players {
+		scripts[player.UUID] = repeatPlays(turnsEach, NewDrawCardPlay(), NewEndTurnPlay())
+	}
+	run := runScriptedGame(t, game, scripts)
+
+	if !run.finished {
+		t.Fatal("game did not finish")
+	}
+	if game.Deck.Size != 0 {
+		t.Errorf("deck has %d cards left, want 0", game.Deck.Size)
+	}
+
+	for i, player := range game.Players {
+		if player.Hand.Size != NUM_CARDS+turnsEach {
+			t.Errorf("%s has %d cards, want %d", player.Name, player.Hand.Size, NUM_CARDS+turnsEach)
+		}
+
+		previous := 0
+		for _, state := range run.states(i) {
+			if state.Hand.Size < previous {
+				t.Fatalf("%s hand shrank from %d to %d without playing a meld", player.Name, previous, state.Hand.Size)
+			}
+			previous = state.Hand.Size
+		}
+	}
+}
+
+func TestBotsFinishGame(t *testing.T) {
+	for _, discardPile := range []bool{false, true} {
+		t.Run(fmt.Sprintf("discard pile %t", discardPile), func(t *testing.T) {
+			game := newTestGame(t, TEST_SEED, 3)
+			game.Config.Rules.DiscardPile = discardPile
+			inputs := make([]InputProvider, len(game.Players))
+			outputs := make([]OutputProvider, len(game.Players))
+			for i, player := range game.Players {
+				bot := NewBotProvider(player.UUID)
+				inputs[i] = bot
+				outputs[i] = bot
+			}
+
+			if !game.Start(inputs, outputs, game.Players[0].UUID) {
+				t.Fatal("bot game did not finish")
+			}
+			// Bots that can't end their turn resign
+			if result := game.Result(); result.AnyoneLeft() {
+				t.Errorf("a bot left the game: %+v", result)
+			}
+			if discardPile && game.DiscardPile.Size() == 0 {
+				t.Error("bots never discarded")
+			}
+			game.ValidadeGame()
+		})
+	}
+}
+
+func TestSameSeedReplaysSameGame(t *testing.T) {
+	play := func() *gameRun {
+		game := newTestGame(t, TEST_SEED, 2)
+		scripts := map[string][]Play{}
+		for _, player := range game.Players {
+			scripts[player.UUID] = repeatPlays(3, NewDrawCardPlay(), NewEndTurnPlay())
+		}
+		return runScriptedGame(t, game, scripts)
+	}
+
+	first, second := play(), play()
+	if !reflect.DeepEqual(first.events, second.events) {
+		t.Fatal("two games with the same seed and scripts emitted different events")
+	}
+}
+
+func TestCheckCardConservation(t *testing.T) {
+	game := newTestGame(t, TEST_SEED, 2)
+	if err := game.CheckCardConservation(); err != nil {
+		t.Fatalf("new game: %v", err)
+	}
+
+	game.Players[0].Hand.RemoveCard(*game.Players[0].Hand.Cards[0])
+	if err := game.CheckCardConservation(); err == nil {
+		t.Error("a card removed from a hand was not reported")
+	}
+}
+
+// randomInputProvider picks a random legal play and checks the game is
+// consistent every time it is asked for one
+type randomInputProvider struct {
+	t    *testing.T
+	game *Game
+	uuid string
+	rng  *rand.Rand
+}
+
+func (r *randomInputProvider) IsConnected() bool {
+	return true
+}
+
+func (r *randomInputProvider) GetPlay(turnState TurnState) Play {
+	if err := checkEveryCardOnce(r.game); err != nil {
+		r.t.Error(err)
+		return NewQuitPlay()
+	}
+
+	var player *Player
+	for i := range r.game.Players {
+		if r.game.Players[i].UUID == r.uuid {
+			player = &r.game.Players[i]
+		}
+	}
+
+	plays := []Play{}
+	for _, meld := range allMeldsOfThree(player.Hand.Cards) {
+		plays = append(plays, NewMeldPlay(meld))
+	}
+	if !turnState.HasDrawedCard && !turnState.HasPlayedMeld {
+		plays = append(plays, NewDrawCardPlay())
+	}
+	if turnState.HasDrawedCard || turnState.HasPlayedMeld {
+		plays = append(plays, NewEndTurnPlay())
+	}
+	return plays[r.rng.IntN(len(plays))]
+}
+
+// allMeldsOfThree lists every valid three card meld in cards
+func allMeldsOfThree(cards []*Card) [][]Card {
+	melds := [][]Card{}
+	for i := range cards {
+		for j := i + 1; j < len(cards); j++ {
+			for k := j + 1; k < len(cards); k++ {
+				meld := []Card{*cards[i], *cards[j], *cards[k]}
+				if _, err := MakeMeldFromCards(meld); err == nil {
+					melds = append(melds, meld)
+				}
+			}
+		}
+	}
+	return melds
+}
+
+// checkEveryCardOnce verifies that each card of the deck is in exactly one place
+func checkEveryCardOnce(game *Game) error {
+	if err := game.CheckCardConservation(); err != nil {
+		return err
+	}
+	seen := map[uint8]string{}
+	place := func(where string, cards []*Card) error {
+		for _, card := range cards {
+			if previous, ok := seen[card.UUID]; ok {
+				return fmt.Errorf("card %d is both in %s and in %s", card.UUID, previous, where)
+			}
+			seen[card.UUID] = where
+		}
+		return nil
+	}
+	if err := place("the deck", game.Deck.Cards); err != nil {
+		return err
+	}
+	if err := place("the table", game.Table.Cards); err != nil {
+		return err
+	}
+	for _, player := range game.Players {
+		if err := place(player.Name+"'s hand", player.Hand.Cards); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestRandomLegalPlaysConserveCards(t *testing.T) {
+	for seed := uint64(2); seed < 42; seed++ {
+		numPlayers := 2 + int(seed%3)
+		game := newTestGame(t, seed, numPlayers)
+
+		inputs := make([]InputProvider, numPlayers)
+		for i, player := range game.Players {
+			inputs[i] = &randomInputProvider{
+				t:    t,
+				game: game,
+				uuid: player.UUID,
+				rng:  rand.New(rand.NewPCG(seed, uint64(i))),
+			}
+		}
+
+		if !runGame(t, game, inputs).finished {
+			t.Fatalf("seed %d: game did not finish", seed)
+		}
+		if err := checkEveryCardOnce(game); err != nil {
+			t.Fatalf("seed %d: %v", seed, err)
+		}
+	}
+}
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden game transcripts")
+
+// transcript renders every state sent to every player, one line per state
+func transcript(game *Game, run *gameRun) string {
+	var out strings.Builder
+	for i, player := range game.Players {
+		fmt.Fprintf(&out, "== %s (%s)\n", player.Name, player.UUID)
+		for _, state := range run.states(i) {
+			fmt.Fprintf(&out, "turn=%s drawn=%t melded=%t ended=%t\n  hand: %s\n  table: %s\n",
+				state.Turn.PlayerUUID, state.Turn.HasDrawedCard, state.Turn.HasPlayedMeld, state.Turn.GameEnded,
+				state.Hand.String(), symbols(state.Table.Cards))
+		}
+	}
+	return out.String()
+}
+
+func symbols(cards []*Card) string {
+	hand := NewHandFromCards(cards)
+	return hand.String()
+}
+
+func TestGoldenBotGames(t *testing.T) {
+	games := []struct {
+		seed       uint64
+		numPlayers int
+	}{
+		{7, 2},
+		{42, 2},
+		{1234, 3},
+		{9001, 4},
+	}
+
+	for _, g := range games {
+		name := fmt.Sprintf("bots_seed%d_%dp", g.seed, g.numPlayers)
+		t.Run(name, func(t *testing.T) {
+			game := newTestGame(t, g.seed, g.numPlayers)
+			inputs := make([]InputProvider, g.numPlayers)
+			for i, player := range game.Players {
+				inputs[i] = NewBotProvider(player.UUID)
+			}
+			run := runGame(t, game, inputs)
+
+			got := transcript(game, run)
+			path := filepath.Join("testdata", "golden", name+".golden")
+			if *updateGolden {
+				if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, []byte(got), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			want, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("%v (run with -update to create it)", err)
+			}
+			if got != string(want) {
+				t.Errorf("transcript differs from %s (run with -update to accept the change)", path)
+			}
+		})
+	}
+}
+
+func TestScriptedGameUndo(t *testing.T) {
+	game := newTestGame(t, TEST_SEED, 2)
+	first, second := game.Players[0], game.Players[1]
+	meld := FindMeldInCards(first.Hand.Cards)
+	if meld == nil {
+		t.Fatal("test seed must deal a meld to the first player")
+	}
+
+	run := runScriptedGame(t, game, map[string][]Play{
+		first.UUID: {
+			NewMeldPlay(meld), NewUndoPlay(), NewUndoPlay(),
+			NewDrawCardPlay(), NewMeldPlay(meld), NewUndoPlay(), NewEndTurnPlay(),
+		},
+		second.UUID: {NewQuitPlay()},
+	})
+
+	// turn start, meld, undo, draw, meld, end turn, second player's turn, quit
+	states := run.states(0)
+	if len(states) != 8 {
+		t.Fatalf("got %d states, want 8", len(states))
+	}
+
+	undone := states[2]
+	if undone.Hand.Size != NUM_CARDS || undone.Table.Size != 0 || undone.Turn.HasPlayedMeld {
+		t.Errorf("undo did not restore the turn start: hand %d, table %d, melded %t",
+			undone.Hand.Size, undone.Table.Size, undone.Turn.HasPlayedMeld)
+	}
+
+	ended := states[5]
+	if ended.Table.Size != len(meld) || ended.Hand.Size != NUM_CARDS+1-len(meld) {
+		t.Errorf("meld played after drawing was undone: hand %d, table %d", ended.Hand.Size, ended.Table.Size)
+	}
+
+	messages := 0
+	for _, event := range run.events[0] {
+		if event.Type == "message" && !strings.Contains(event.Message, "resigned") {
+			messages++
+		}
+	}
+	if messages != 2 {
+		t.Errorf("got %d refusal messages, want 2 (nothing to undo, undo after draw)", messages)
+	}
+}
+
+func TestBrokenTableIsRolledBackOnTimeout(t *testing.T) {
+	game := newTestGame(t, TEST_SEED, 2)
+	first, second := game.Players[0], game.Players[1]
+	meld := FindMeldInCards(first.Hand.Cards)
+	if len(meld) < MIN_MELD_SIZE+1 {
+		t.Fatalf("test seed must deal a meld of at least %d cards to the first player", MIN_MELD_SIZE+1)
+	}
+
+	// Play the meld, then move all but one of its cards into a new meld, leaving one loose card
+	plays := make(chan Play, 3)
+	plays <- NewMeldPlay(meld)
+	plays <- NewMeldPlay(meld[:len(meld)-1])
+	plays <- NewEndTurnPlay()
+	firstInput := NewChannelInputProvider(first.UUID, plays)
+	firstInput.SetTimeout(50 * time.Millisecond)
+
+	run := runGame(t, game, []InputProvider{
+		firstInput,
+		NewScriptedInputProvider(second.UUID, []Play{NewQuitPlay()}),
+	})
+
+	// turn start, meld, meld, timeout, second player's turn, quit
+	states := run.states(0)
+	if len(states) != 6 {
+		t.Fatalf("got %d states, want 6", len(states))
+	}
+
+	broken := states[2]
+	if len(broken.Table.Melds) != 2 || broken.Table.IsValid() {
+		t.Fatalf("second meld should leave a loose card: %d melds, valid %t", len(broken.Table.Melds), broken.Table.IsValid())
+	}
+
+	rolledBack := states[3]
+	if rolledBack.Table.Size != 0 || rolledBack.Hand.Size != NUM_CARDS+1 {
+		t.Errorf("after the timeout table has %d cards and hand %d, want 0 and %d",
+			rolledBack.Table.Size, rolledBack.Hand.Size, NUM_CARDS+1)
+	}
+
+	messages := []string{}
+	for _, event := range run.events[0] {
+		if event.Type == "message" {
+			messages = append(messages, event.Message)
+		}
+	}
+	if len(messages) != 4 || !strings.Contains(messages[0], "invalid melds") || !strings.Contains(messages[1], "out of time") ||
+		!strings.Contains(messages[2], "penalty") || !strings.Contains(messages[3], "resigned") {
+		t.Errorf("expected the end of turn to be refused, a timeout and a penalty notice and the resignation of the other player, got %q", messages)
+	}
+}
+
+func TestOpeningRule(t *testing.T) {
+	game := newTestGame(t, TEST_SEED, 2)
+	game.Config.Rules.OpeningMinPoints = 1
+	first, second := game.Players[0], game.Players[1]
+	meld := FindMeldInCards(first.Hand.Cards)
+
+	run := runScriptedGame(t, game, map[string][]Play{
+		first.UUID:  {NewMeldPlay(meld), NewUndoPlay(), NewDrawCardPlay(), NewEndTurnPlay()},
+		second.UUID: {NewQuitPlay()},
+	})
+
+	// turn start, meld, undo, draw, end turn, ...
+	states := run.states(0)
+	if states[0].Turn.OpeningMinPoints != 1 {
+		t.Errorf("turn start requires an opening of %d points, want 1", states[0].Turn.OpeningMinPoints)
+	}
+	if states[1].Turn.OpeningMinPoints != 0 {
+		t.Errorf("opening is still required after the opening meld")
+	}
+	if states[2].Turn.OpeningMinPoints != 1 || game.Players[0].HasOpened {
+		t.Errorf("undoing the opening meld did not bring the opening requirement back")
+	}
+
+	// A meld worth less than the minimum is refused
+	game = newTestGame(t, TEST_SEED, 2)
+	game.Config.Rules.OpeningMinPoints = MeldPoints(meld) + 1
+	run = runScriptedGame(t, game, map[string][]Play{
+		first.UUID:  {NewMeldPlay(meld), NewDrawCardPlay(), NewEndTurnPlay()},
+		second.UUID: {NewQuitPlay()},
+	})
+	if run.events[0][1].Type != "message" || !strings.Contains(run.events[0][1].Message, "opening meld") {
+		t.Errorf("opening meld below the minimum was not refused: %+v", run.events[0][1])
+	}
+	if game.Players[0].HasOpened || game.Table.Size != 0 {
+		t.Error("refused opening meld was played")
+	}
+}
+
+func TestGameGoesOnWithoutLeaver(t *testing.T) {
+	for _, frozen := range []bool{false, true} {
+		t.Run(fmt.Sprintf("frozen %t", frozen), func(t *testing.T) {
+			game := newTestGame(t, TEST_SEED, 3)
+			game.Config.Rules.FreezeLeaverHands = frozen
+			first, second, third := game.Players[0].UUID, game.Players[1].UUID, game.Players[2].UUID
+
+			// The second player resigns, the first one disconnects after two more turns
+			run := runScriptedGame(t, game, map[string][]Play{
+				first:  repeatPlays(2, NewDrawCardPlay(), NewEndTurnPlay()),
+				second: {NewQuitPlay()},
+				third:  repeatPlays(3, NewDrawCardPlay(), NewEndTurnPlay()),
+			})
+
+			result := game.Result()
+			if !run.finished || result.Outcome != OUTCOME_RESIGNED || result.WinnerUUID != third || result.QuitterUUID != first {
+				t.Fatalf("result = %+v", result)
+			}
+			if !result.HasLeft(first) || !result.HasLeft(second) || result.HasLeft(third) {
+				t.Errorf("players who left: %+v", result.Players)
+			}
+
+			leaver := game.Players[1]
+			wantHand, wantDiscards := 0, NUM_CARDS
+			if frozen {
+				wantHand, wantDiscards = NUM_CARDS, 0
+			}
+			if leaver.Hand.Size != wantHand || len(game.Discards) != wantDiscards {
+				t.Errorf("leaver has %d cards and %d were discarded, want %d and %d", leaver.Hand.Size, len(game.Discards), wantHand, wantDiscards)
+			}
+			if err := game.CheckCardConservation(); err != nil {
+				t.Error(err)
+			}
+
+			// Once the second player resigned, the turn skips them
+			quit := false
+			for _, state := range run.states(2) {
+				if state.Turn.PlayerUUID == second && quit {
+					t.Fatal("the turn came back to the player who resigned")
+				}
+				quit = quit || state.Turn.PlayerUUID == third
+			}
+
+			restored, err := RestoreGame(game.Snapshot(), game.logger)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !restored.Players[1].Left || len(restored.Discards) != wantDiscards {
+				t.Errorf("restored game lost the leaver: left %t, %d discards", restored.Players[1].Left, len(restored.Discards))
+			}
+		})
+	}
+}
+
+func TestDiscardPile(t *testing.T) {
+	game := newTestGame(t, TEST_SEED, 2)
+	game.Config.Rules.DiscardPile = true
+	first, second := game.Players[0], game.Players[1]
+	firstDiscard, secondDiscard := *first.Hand.Cards[0], *second.Hand.Cards[0]
+
+	// The first player can't end the turn without discarding, the second one
+	// takes that discard and can't throw it straight back
+	run := runScriptedGame(t, game, map[string][]Play{
+		first.UUID:  {NewDrawCardPlay(), NewEndTurnPlay(), NewDiscardPlay(firstDiscard)},
+		second.UUID: {NewTakeDiscardPlay(), NewDiscardPlay(firstDiscard), NewDiscardPlay(secondDiscard)},
+	})
+
+	if !run.finished || game.Result().WinnerUUID != second.UUID {
+		t.Fatalf("result = %+v", game.Result())
+	}
+	messages := []string{}
+	for _, event := range run.events[0] {
+		if event.Type == "message" {
+			messages = append(messages, event.Message)
+		}
+	}
+	if len(messages) < 1 || !strings.Contains(messages[0], "must discard") {
+		t.Errorf("ending the turn without discarding was not refused: %q", messages)
+	}
+	messages = []string{}
+	for _, event := range run.events[1] {
+		if event.Type == "message" {
+			messages = append(messages, event.Message)
+		}
+	}
+	if len(messages) < 1 || !strings.Contains(messages[0], "you took") {
+		t.Errorf("discarding the card just taken was not refused: %q", messages)
+	}
+
+	// turn start, draw, discard, turn start, take, discard, ...
+	states := run.states(1)
+	if !states[0].Turn.HasDiscardPile || states[0].Turn.DiscardTop != nil || states[0].Turn.DiscardSize != 0 {
+		t.Errorf("the game starts with a discard pile: %+v", states[0].Turn)
+	}
+	if top := states[2].Turn.DiscardTop; top == nil || top.UUID != firstDiscard.UUID || states[2].Turn.DiscardSize != 1 {
+		t.Errorf("the discard is not on top of the pile: %+v", states[2].Turn)
+	}
+	if states[4].Turn.DiscardTop != nil || !states[4].Turn.HasDrawedCard || !states[4].Hand.Contains(firstDiscard) {
+		t.Errorf("taking the discard did not move it to the hand: %+v", states[4].Turn)
+	}
+	if top := states[5].Turn.DiscardTop; top == nil || top.UUID != secondDiscard.UUID {
+		t.Errorf("the second discard is not on top of the pile: %+v", states[5].Turn)
+	}
+
+	if game.Players[0].Hand.Size != NUM_CARDS || game.Players[1].Hand.Size != NUM_CARDS {
+		t.Errorf("hands have %d and %d cards", game.Players[0].Hand.Size, game.Players[1].Hand.Size)
+	}
+	if err := game.CheckCardConservation(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDiscardPileSnapshot(t *testing.T) {
+	game := newTestGame(t, TEST_SEED, 2)
+	game.Config.Rules.DiscardPile = true
+	discarded := game.Players[0].Hand.Cards[0]
+	game.Players[0].Hand.RemoveCard(*discarded)
+	game.DiscardPile.Push(discarded)
+
+	snapshot := game.Snapshot()
+	if top := snapshot.Turn.DiscardTop; top == nil || top.UUID != discarded.UUID {
+		t.Errorf("snapshot turn does not show the discard: %+v", snapshot.Turn)
+	}
+	restored, err := RestoreGame(snapshot, game.logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if top := restored.DiscardPile.Top(); top == nil || top.UUID != discarded.UUID || restored.DiscardPile.Size() != 1 {
+		t.Errorf("restored discard pile has %d cards", restored.DiscardPile.Size())
+	}
+	if err := restored.CheckCardConservation(); err != nil {
+		t.Error(err)
+	}
+}
@@ -4,9 +4,8 @@ import (
 	"fmt"
 	"log"
 
+	"mexemexe/internal/protocol"
 	"mexemexe/internal/service"
-
-	"github.com/gorilla/websocket"
 )
 
 var EMPTY_WS_OUTPUT_PROVIDER = WebsocketOutputProvider{
@@ -21,6 +20,10 @@ type GameStateMessageOut struct {
 	Turn  TurnState `json:"turn"`
 }
 
+type GameMessageOut struct {
+	Message string `json:"message"`
+}
+
 type MessageType string
 
 type OutputProvider interface {
@@ -29,23 +32,47 @@ type OutputProvider interface {
 	GetUUID() string
 }
 
-type TerminalOutputProvider struct{}
+// TerminalOutputProvider feeds the game state of a local player into their Renderer
+type TerminalOutputProvider struct {
+	uuid     string
+	renderer *Renderer
+}
+
+func NewTerminalOutputProvider(uuid string, renderer *Renderer) TerminalOutputProvider {
+	return TerminalOutputProvider{
+		uuid:     uuid,
+		renderer: renderer,
+	}
+}
+
+func (t TerminalOutputProvider) GetUUID() string {
+	return t.uuid
+}
 
 func (t TerminalOutputProvider) Write(messageType string, data interface{}) {
 	switch messageType {
 
 	case "message":
-		fmt.Println(data)
+		if t.renderer == nil {
+			fmt.Println(data)
+			return
+		}
+		t.renderer.SetStatusMessage(fmt.Sprint(data))
 	}
 }
 
+func (t TerminalOutputProvider) SendState(table Table, hand Hand, turnState TurnState) {
+	// The engine keeps mutating its own hand and table, so the renderer gets copies
+	t.renderer.UpdateRenderer(table.Clone(), hand.Clone(), turnState)
+}
+
 type WebsocketOutputProvider struct {
 	uuid   string
-	conn   *websocket.Conn
+	conn   *protocol.Conn
 	logger *service.GameLogger
 }
 
-func NewWebsocketOutputProvider(conn *websocket.Conn, uuid string, logger *service.GameLogger) WebsocketOutputProvider {
+func NewWebsocketOutputProvider(conn *protocol.Conn, uuid string, logger *service.GameLogger) WebsocketOutputProvider {
 	return WebsocketOutputProvider{
 		uuid:   uuid,
 		conn:   conn,
@@ -59,6 +86,13 @@ func (w WebsocketOutputProvider) GetUUID() string {
 
 func (w WebsocketOutputProvider) Write(messageType string, data interface{}) {
 	log.Printf("DEBUG: Write - Writing message type %s", messageType)
+	message := GameMessageOut{
+		Message: fmt.Sprint(data),
+	}
+	err := w.conn.Send(protocol.GAME_MESSAGE, message)
+	if err != nil {
+		w.logger.Errorf("error writing to websocket: %v", err)
+	}
 }
 
 func (w WebsocketOutputProvider) SendState(table Table, hand Hand, turnState TurnState) {
@@ -70,10 +104,63 @@ func (w WebsocketOutputProvider) SendState(table Table, hand Hand, turnState Tur
 		Hand:  hand,
 		Turn:  turnState,
 	}
-	err := w.conn.WriteJSON(gameState)
+	err := w.conn.Send(protocol.GAME_STATE, gameState)
 	if err != nil {
 		w.logger.Errorf("error writing to websocket: %v", err)
 		return
 	}
 	w.logger.Infof("Successfully sent game state to player")
 }
+
+// OutputEvent is everything an OutputProvider can emit, in the order it was emitted
+type OutputEvent struct {
+	Type    string
+	Message string
+	State   GameStateMessageOut
+}
+
+// ChannelOutputProvider publishes game updates on a channel instead of a websocket.
+// Sends block until the event is received, so the channel must be drained.
+type ChannelOutputProvider struct {
+	uuid   string
+	events chan OutputEvent
+}
+
+func NewChannelOutputProvider(uuid string, bufferSize int) *ChannelOutputProvider {
+	return &ChannelOutputProvider{
+		uuid:   uuid,
+		events: make(chan OutputEvent, bufferSize),
+	}
+}
+
+func (c *ChannelOutputProvider) GetUUID() string {
+	return c.uuid
+}
+
+// Events returns the channel the updates are published on
+func (c *ChannelOutputProvider) Events() <-chan OutputEvent {
+	return c.events
+}
+
+func (c *ChannelOutputProvider) Write(messageType string, data interface{}) {
+	c.events <- OutputEvent{
+		Type:    messageType,
+		Message: fmt.Sprint(data),
+	}
+}
+
+func (c *ChannelOutputProvider) SendState(table Table, hand Hand, turnState TurnState) {
+	c.events <- OutputEvent{
+		Type: "state",
+		State: GameStateMessageOut{
+			Table: table.Clone(),
+			Hand:  hand.Clone(),
+			Turn:  turnState,
+		},
+	}
+}
+
+// Close closes the events channel. It must only be called once the game is over.
+func (c *ChannelOutputProvider) Close() {
+	close(c.events)
+}
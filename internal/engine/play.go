@@ -1,6 +1,11 @@
 package engine
 
-import "log"
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+)
 
 type AvailablePlay string
 
@@ -9,6 +14,14 @@ const (
 	DRAW_CARD AvailablePlay = "DRAW_CARD"
 	QUIT      AvailablePlay = "QUIT"
 	END_TURN  AvailablePlay = "END_TURN"
+	UNDO      AvailablePlay = "UNDO"
+	TIMEOUT   AvailablePlay = "TIMEOUT"
+	// DISCONNECT is played on behalf of a player whose connection was lost for good
+	DISCONNECT AvailablePlay = "DISCONNECT"
+	// DISCARD puts a card of the hand on the discard pile and ends the turn
+	DISCARD AvailablePlay = "DISCARD"
+	// TAKE_DISCARD takes the top card of the discard pile instead of drawing from the deck
+	TAKE_DISCARD AvailablePlay = "TAKE_DISCARD"
 	// SELECT_HAND  AvailablePlay = "SELECT_HAND" deprecated
 	// SELECT_TABLE AvailablePlay = "SELECT_TABLE" deprecated
 )
@@ -18,6 +31,49 @@ type Play interface {
 	GetCards() []Card
 }
 
+// DecodePlay decodes a play from its JSON form, telling the kind of play by its type
+func DecodePlay(data json.RawMessage) (Play, error) {
+	var detector struct {
+		Type AvailablePlay `json:"type"`
+	}
+	err := json.Unmarshal(data, &detector)
+	if err != nil {
+		return nil, fmt.Errorf("detecting play type: %w", err)
+	}
+
+	switch detector.Type {
+	case DRAW_CARD:
+		return NewDrawCardPlay(), nil
+	case END_TURN:
+		return NewEndTurnPlay(), nil
+	case QUIT:
+		return NewQuitPlay(), nil
+	case UNDO:
+		return NewUndoPlay(), nil
+	case TIMEOUT:
+		return NewTimeoutPlay(), nil
+	case DISCONNECT:
+		return NewDisconnectPlay(), nil
+	case TAKE_DISCARD:
+		return NewTakeDiscardPlay(), nil
+	case DISCARD:
+		var discardPlay DiscardPlay
+		err = json.Unmarshal(data, &discardPlay)
+		if err != nil {
+			return nil, fmt.Errorf("parsing discard: %w", err)
+		}
+		return NewDiscardPlay(discardPlay.Card), nil
+	case PLAY_MELD:
+		var meldPlay MeldPlay
+		err = json.Unmarshal(data, &meldPlay)
+		if err != nil {
+			return nil, fmt.Errorf("parsing meld: %w", err)
+		}
+		return NewMeldPlay(meldPlay.Cards), nil
+	}
+	return nil, fmt.Errorf("unknown play type: %q", detector.Type)
+}
+
 type QuitPlay struct {
 	Type string `json:"type"`
 }
@@ -33,6 +89,41 @@ func (p QuitPlay) GetCards() []Card {
 	return nil
 }
 
+// TimeoutPlay is played on behalf of a player who took too long to play
+type TimeoutPlay struct {
+	Type string `json:"type"`
+}
+
+func NewTimeoutPlay() TimeoutPlay {
+	return TimeoutPlay{Type: "TIMEOUT"}
+}
+
+func (t TimeoutPlay) GetName() AvailablePlay {
+	return TIMEOUT
+}
+
+func (t TimeoutPlay) GetCards() []Card {
+	return nil
+}
+
+// DisconnectPlay is played on behalf of a player who lost their connection
+// and did not come back. They leave the game, like a player who quits.
+type DisconnectPlay struct {
+	Type string `json:"type"`
+}
+
+func NewDisconnectPlay() DisconnectPlay {
+	return DisconnectPlay{Type: "DISCONNECT"}
+}
+
+func (d DisconnectPlay) GetName() AvailablePlay {
+	return DISCONNECT
+}
+
+func (d DisconnectPlay) GetCards() []Card {
+	return nil
+}
+
 type EndTurnPlay struct {
 	Type string `json:"type"`
 }
@@ -49,6 +140,22 @@ func (p EndTurnPlay) GetCards() []Card {
 	return nil
 }
 
+type UndoPlay struct {
+	Type string `json:"type"`
+}
+
+func NewUndoPlay() UndoPlay {
+	return UndoPlay{Type: "UNDO"}
+}
+
+func (u UndoPlay) GetName() AvailablePlay {
+	return UNDO
+}
+
+func (u UndoPlay) GetCards() []Card {
+	return nil
+}
+
 type MeldPlay struct {
 	Type  string `json:"type"`
 	Cards []Card `json:"cards"`
@@ -84,21 +191,176 @@ func (p DrawCardPlay) GetCards() []Card {
 	return nil
 }
 
-func IsValid(turnState *TurnState, play Play, outputProvider OutputProvider) bool {
+// DiscardPlay puts a card of the player's hand on the discard pile, ending their turn
+type DiscardPlay struct {
+	Type string `json:"type"`
+	Card Card   `json:"card"`
+}
+
+func NewDiscardPlay(card Card) DiscardPlay {
+	return DiscardPlay{
+		Type: "DISCARD",
+		Card: card,
+	}
+}
+
+func (d DiscardPlay) GetName() AvailablePlay {
+	return DISCARD
+}
+
+func (d DiscardPlay) GetCards() []Card {
+	return []Card{d.Card}
+}
+
+// TakeDiscardPlay takes the top card of the discard pile into the player's hand
+type TakeDiscardPlay struct {
+	Type string `json:"type"`
+}
+
+func NewTakeDiscardPlay() TakeDiscardPlay {
+	return TakeDiscardPlay{Type: "TAKE_DISCARD"}
+}
+
+func (t TakeDiscardPlay) GetName() AvailablePlay {
+	return TAKE_DISCARD
+}
+
+func (t TakeDiscardPlay) GetCards() []Card {
+	return nil
+}
+
+// CheckOpeningMeld returns an error if cards can't be a player's opening meld:
+// it must be made only from their hand and be worth at least minPoints.
+func CheckOpeningMeld(cards []Card, hand *Hand, minPoints uint32) error {
+	for _, card := range cards {
+		if !hand.Contains(card) {
+			return fmt.Errorf("Your opening meld must be made only with cards from your hand.")
+		}
+	}
+	if points := MeldPoints(cards); points < minPoints {
+		return fmt.Errorf("Your opening meld must be worth at least %d points (this one is worth %d).", minPoints, points)
+	}
+	return nil
+}
+
+// lookupCards returns the cards of the player's hand or of the table with the
+// UUIDs of cards, so that a play is judged on the real cards and not on the
+// values the client sent. Each card must be found and used only once.
+func lookupCards(cards []Card, hand *Hand, table *Table) ([]Card, error) {
+	found := make([]Card, 0, len(cards))
+	seen := make(map[uint8]bool, len(cards))
+	for _, card := range cards {
+		if seen[card.UUID] {
+			return nil, fmt.Errorf("card %d is used twice", card.UUID)
+		}
+		seen[card.UUID] = true
+
+		match := hand.GetCard(card.UUID)
+		if match == nil {
+			match = table.GetCard(card.UUID)
+		}
+		if match == nil {
+			return nil, fmt.Errorf("card %d is neither in the hand nor on the table", card.UUID)
+		}
+		found = append(found, *match)
+	}
+	return found, nil
+}
+
+func IsValid(turnState *TurnState, play Play, player *Player, table *Table, rules *GameRules, outputProvider OutputProvider) bool {
 	switch play.GetName() {
 
 	case PLAY_MELD:
-		return true // Meld is validated at client side
+		// The melds left behind on the table may be broken, but the new one must be valid
+		meldCards, err := lookupCards(play.GetCards(), &player.Hand, table)
+		if err != nil {
+			outputProvider.Write("message", "Those cards are not in your hand or on the table.")
+			return false
+		}
+		if _, err := MakeMeldFromCards(slices.Clone(meldCards)); err != nil {
+			outputProvider.Write("message", "That is not a valid meld.")
+			return false
+		}
+
+		// Until they open, players can't touch the table (no mexe-mexe either)
+		if minPoints := player.OpeningRequirement(rules); minPoints > 0 {
+			if err := CheckOpeningMeld(meldCards, &player.Hand, minPoints); err != nil {
+				outputProvider.Write("message", err.Error())
+				return false
+			}
+		}
+		return true
 
 	case END_TURN:
 
-		if turnState.HasPlayedMeld || turnState.HasDrawedCard {
-			return true
-		} else {
+		if !turnState.HasPlayedMeld && !turnState.HasDrawedCard {
 			outputProvider.Write("message", "You must play a meld or draw a card before ending the turn.")
 			return false
 		}
 
+		// With a discard pile, only a player who melded their whole hand ends the turn without discarding
+		if rules.DiscardPile && player.Hand.Size > 0 {
+			outputProvider.Write("message", "You must discard a card to end the turn.")
+			return false
+		}
+
+		if !table.IsValid() {
+			outputProvider.Write("message", "The table has invalid melds. Fix or undo them before ending the turn.")
+			return false
+		}
+		return true
+
+	case DISCARD:
+		if !rules.DiscardPile {
+			outputProvider.Write("message", "There is no discard pile in this game.")
+			return false
+		}
+
+		if !turnState.HasPlayedMeld && !turnState.HasDrawedCard {
+			outputProvider.Write("message", "You must play a meld or draw a card before discarding.")
+			return false
+		}
+
+		cards := play.GetCards()
+		if len(cards) != 1 || !player.Hand.Contains(cards[0]) {
+			outputProvider.Write("message", "You can only discard a card from your hand.")
+			return false
+		}
+
+		// Otherwise taking the discard would be a way to skip a turn
+		if cards[0].UUID == turnState.takenDiscard {
+			outputProvider.Write("message", "You can't discard the card you took from the discard pile.")
+			return false
+		}
+
+		if !table.IsValid() {
+			outputProvider.Write("message", "The table has invalid melds. Fix or undo them before discarding.")
+			return false
+		}
+		return true
+
+	case TAKE_DISCARD:
+		if !rules.DiscardPile {
+			outputProvider.Write("message", "There is no discard pile in this game.")
+			return false
+		}
+
+		if turnState.HasPlayedMeld {
+			outputProvider.Write("message", "You can't take the discard after playing a meld.")
+			return false
+		}
+
+		if turnState.HasDrawedCard {
+			outputProvider.Write("message", "You can't draw a card twice in a turn.")
+			return false
+		}
+
+		if turnState.DiscardTop == nil {
+			outputProvider.Write("message", "The discard pile is empty.")
+			return false
+		}
+		return true
+
 	case DRAW_CARD:
 		if turnState.HasPlayedMeld {
 			outputProvider.Write("message", "You can't draw a card after playing a meld.")
@@ -113,7 +375,20 @@ func IsValid(turnState *TurnState, play Play, outputProvider OutputProvider) boo
 			return true
 		}
 
-	case QUIT:
+	case UNDO:
+		// A drawn card has been seen, so the turn can't be taken back anymore
+		if turnState.HasDrawedCard {
+			outputProvider.Write("message", "You can't undo after drawing a card.")
+			return false
+		}
+
+		if !turnState.HasPlayedMeld {
+			outputProvider.Write("message", "There is nothing to undo.")
+			return false
+		}
+		return true
+
+	case QUIT, TIMEOUT, DISCONNECT:
 		return true
 
 	default:
@@ -121,19 +396,25 @@ func IsValid(turnState *TurnState, play Play, outputProvider OutputProvider) boo
 	}
 }
 
-func MakePlay(play Play, deck *Deck, table *Table, player *Player) {
+func MakePlay(play Play, deck *Deck, discards *DiscardPile, table *Table, player *Player) {
 
 	switch play.GetName() {
 
 	case PLAY_MELD:
+		// Mexe-mexe: besides the hand, the meld may take cards from melds already on the table
 		log.Print("player :: !> Playing meld")
+		meld := []*Card{}
 		for _, card := range play.GetCards() {
 			card.Print()
-			if player.Hand.Contains(card) {
+			if handCard := player.Hand.GetCard(card.UUID); handCard != nil {
 				player.Hand.RemoveCard(card)
-				table.AddCard(&card)
+				meld = append(meld, handCard)
+			} else if tableCard := table.GetCard(card.UUID); tableCard != nil {
+				table.RemoveCard(tableCard)
+				meld = append(meld, tableCard)
 			}
 		}
+		table.AddMeld(meld)
 		return
 
 	case DRAW_CARD:
@@ -142,14 +423,40 @@ func MakePlay(play Play, deck *Deck, table *Table, player *Player) {
 		player.Hand.AddCard(card)
 		return
 
+	case TAKE_DISCARD:
+		log.Print("player :: !> Taking the discard")
+		player.Hand.AddCard(discards.TakeTop())
+		return
+
+	case DISCARD:
+		log.Print("player :: !> Discarding")
+		card := play.GetCards()[0]
+		handCard := player.Hand.GetCard(card.UUID)
+		player.Hand.RemoveCard(card)
+		discards.Push(handCard)
+		return
+
 	case END_TURN:
 		log.Print("player :: !> Passing turn")
 		return
 
+	case UNDO:
+		// Undo restores a checkpoint of the turn history, which is kept by PlayTurn
+		log.Print("player :: !> Undoing last meld")
+		return
+
 	case QUIT:
 		log.Print("player :: !> Quitting")
 		return
 
+	case TIMEOUT:
+		log.Print("player :: !> Turn timed out")
+		return
+
+	case DISCONNECT:
+		log.Print("player :: !> Leaving after a disconnection")
+		return
+
 	default:
 		return
 	}
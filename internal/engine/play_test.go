@@ -0,0 +1,265 @@
+package engine
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIsValid(t *testing.T) {
+	deck := NewDeck(NO_SHUFFLE_SEED)
+
+	// 2,3,4 of spades, and 2,2,3 of spades which is not a meld
+	meld := []Card{*deck.Cards[0], *deck.Cards[2], *deck.Cards[4]}
+	notMeld := []Card{*deck.Cards[0], *deck.Cards[1], *deck.Cards[2]}
+
+	validTable := Table{}
+	validTable.AddMeld([]*Card{deck.Cards[0], deck.Cards[2], deck.Cards[4]})
+	brokenTable := Table{}
+	brokenTable.AddMeld([]*Card{deck.Cards[0], deck.Cards[2]})
+
+	// The opening rule is checked separately, this player has already opened
+	player := NewPlayer("player0", *NewHandFromCards([]*Card{deck.Cards[0], deck.Cards[2], deck.Cards[4]}), "uuid-0", INITIAL_POINTS)
+	player.HasOpened = true
+
+	tests := []struct {
+		name      string
+		drawn     bool
+		melded    bool
+		table     Table
+		play      Play
+		want      bool
+		wantWrite bool
+	}{
+		{"meld at turn start", false, false, Table{}, NewMeldPlay(meld), true, false},
+		{"meld after another meld", false, true, validTable, NewMeldPlay(meld), true, false},
+		{"meld on a broken table", false, true, brokenTable, NewMeldPlay(meld), true, false},
+		{"invalid meld", false, false, Table{}, NewMeldPlay(notMeld), false, true},
+		{"meld of two cards", false, false, Table{}, NewMeldPlay(meld[:2]), false, true},
+		{"draw at turn start", false, false, Table{}, NewDrawCardPlay(), true, false},
+		{"draw twice", true, false, Table{}, NewDrawCardPlay(), false, true},
+		{"draw after meld", false, true, Table{}, NewDrawCardPlay(), false, true},
+		{"end turn without playing", false, false, Table{}, NewEndTurnPlay(), false, true},
+		{"end turn after draw", true, false, Table{}, NewEndTurnPlay(), true, false},
+		{"end turn after meld", false, true, validTable, NewEndTurnPlay(), true, false},
+		{"end turn with a broken table", false, true, brokenTable, NewEndTurnPlay(), false, true},
+		{"undo a meld", false, true, Table{}, NewUndoPlay(), true, false},
+		{"undo without meld", false, false, Table{}, NewUndoPlay(), false, true},
+		{"undo after draw", true, false, Table{}, NewUndoPlay(), false, true},
+		{"undo a meld played after drawing", true, true, Table{}, NewUndoPlay(), false, true},
+		{"quit at turn start", false, false, Table{}, NewQuitPlay(), true, false},
+		{"quit after draw", true, false, Table{}, NewQuitPlay(), true, false},
+		{"timeout with a broken table", false, true, brokenTable, NewTimeoutPlay(), true, false},
+		{"disconnect with a broken table", false, true, brokenTable, NewDisconnectPlay(), true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			turnState := NewTurnState("uuid-0")
+			turnState.UpdateDrawedCard(tt.drawn)
+			turnState.UpdatePlayedMeld(tt.melded)
+			output := NewChannelOutputProvider("uuid-0", 1)
+
+			if got := IsValid(turnState, tt.play, &player, &tt.table, &GameRules{OpeningMinPoints: 30}, output); got != tt.want {
+				t.Errorf("IsValid() = %v, want %v", got, tt.want)
+			}
+			if wrote := len(output.Events()) > 0; wrote != tt.wantWrite {
+				t.Errorf("IsValid() wrote a message: %v, want %v", wrote, tt.wantWrite)
+			}
+		})
+	}
+}
+
+func TestIsValidOpening(t *testing.T) {
+	deck := NewDeck(NO_SHUFFLE_SEED)
+
+	// 2,3,4 of spades (9 points), and the other 4 of spades is on the table
+	hand := NewHandFromCards([]*Card{deck.Cards[0], deck.Cards[2], deck.Cards[4], deck.Cards[6], deck.Cards[8]})
+	player := NewPlayer("player0", *hand, "uuid-0", INITIAL_POINTS)
+	table := Table{}
+	table.AddMeld([]*Card{deck.Cards[5], deck.Cards[24], deck.Cards[50]})
+
+	small := NewMeldPlay([]Card{*deck.Cards[0], *deck.Cards[2], *deck.Cards[4]})
+	large := NewMeldPlay([]Card{*deck.Cards[0], *deck.Cards[2], *deck.Cards[4], *deck.Cards[6], *deck.Cards[8]})
+	withTableCard := NewMeldPlay([]Card{*deck.Cards[0], *deck.Cards[2], *deck.Cards[5]})
+
+	// The real UUIDs of the 2,3,4 of spades sent as the queen, king and ace
+	tampered := []Card{*deck.Cards[0], *deck.Cards[2], *deck.Cards[4]}
+	for i, value := range []CardValue{QUEEN_VALUE, KING_VALUE, ACE_VALUE} {
+		tampered[i].Value = value
+	}
+
+	tests := []struct {
+		name      string
+		minPoints uint32
+		opened    bool
+		play      Play
+		want      bool
+	}{
+		{"no opening rule", 0, false, small, true},
+		{"opening below the minimum", 10, false, small, false},
+		{"opening at the minimum", 9, false, small, true},
+		{"longer opening meld", 20, false, large, true},
+		{"opening with a table card", 5, false, withTableCard, false},
+		{"table card after opening", 30, true, withTableCard, true},
+		{"small meld after opening", 30, true, small, true},
+		{"opening with tampered card values", 20, false, NewMeldPlay(tampered), false},
+		{"opening with a card sent twice", 5, false, NewMeldPlay([]Card{*deck.Cards[0], *deck.Cards[2], *deck.Cards[4], *deck.Cards[4]}), false},
+		{"opening with an unknown card", 5, false, NewMeldPlay([]Card{*deck.Cards[0], *deck.Cards[2], *deck.Cards[44]}), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			player.HasOpened = tt.opened
+			output := NewChannelOutputProvider("uuid-0", 1)
+			rules := GameRules{OpeningMinPoints: tt.minPoints}
+
+			if got := IsValid(NewTurnState("uuid-0"), tt.play, &player, &table, &rules, output); got != tt.want {
+				t.Errorf("IsValid() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMakePlay(t *testing.T) {
+	deck := NewDeck(NO_SHUFFLE_SEED)
+	hand := NewHandFromDeck(deck, 8)
+	player := NewPlayer("player0", *hand, "uuid-0", INITIAL_POINTS)
+	table := Table{}
+
+	MakePlay(NewDrawCardPlay(), deck, &DiscardPile{}, &table, &player)
+	if player.Hand.Size != 9 || deck.Size != int(TOTAL_DECK_SIZE)-9 {
+		t.Fatalf("after drawing hand has %d cards and deck %d", player.Hand.Size, deck.Size)
+	}
+
+	meld := FindMeldInCards(player.Hand.Cards)
+	MakePlay(NewMeldPlay(meld), deck, &DiscardPile{}, &table, &player)
+	if table.Size != len(meld) || player.Hand.Size != 9-len(meld) {
+		t.Fatalf("after a meld of %d cards hand has %d and table %d", len(meld), player.Hand.Size, table.Size)
+	}
+	for _, card := range meld {
+		if player.Hand.Contains(card) || !table.Contains(&card) {
+			t.Errorf("%s did not move from the hand to the table", card.Name)
+		}
+	}
+
+	// Cards that are not in the hand can't be played
+	MakePlay(NewMeldPlay(meld), deck, &DiscardPile{}, &table, &player)
+	if table.Size != len(meld) || player.Hand.Size != 9-len(meld) {
+		t.Errorf("replaying a meld moved cards: hand %d, table %d", player.Hand.Size, table.Size)
+	}
+}
+
+func TestMakePlayMexeMexe(t *testing.T) {
+	deck := NewDeck(NO_SHUFFLE_SEED)
+
+	// Table: 2,3,4,5 of spades. Hand: the other 2 and 3 of spades.
+	table := Table{}
+	table.AddMeld([]*Card{deck.Cards[0], deck.Cards[2], deck.Cards[4], deck.Cards[6]})
+	player := NewPlayer("player0", *NewHandFromCards([]*Card{deck.Cards[1], deck.Cards[3]}), "uuid-0", INITIAL_POINTS)
+
+	// Take the 4 from the table: 2,3,4 and 2,3,_,5
+	MakePlay(NewMeldPlay([]Card{*deck.Cards[1], *deck.Cards[3], *deck.Cards[4]}), deck, &DiscardPile{}, &table, &player)
+
+	if player.Hand.Size != 0 || table.Size != 6 || len(table.Melds) != 2 {
+		t.Fatalf("hand %d, table %d in %d melds, want 0, 6 in 2", player.Hand.Size, table.Size, len(table.Melds))
+	}
+	if invalid := table.InvalidMelds(); len(invalid) != 1 || invalid[0] != 0 {
+		t.Errorf("invalid melds %v, want the broken 2,3,5 at index 0", invalid)
+	}
+}
+
+func TestIsValidDiscardPile(t *testing.T) {
+	deck := NewDeck(NO_SHUFFLE_SEED)
+
+	// 2,3,4 of spades in hand, the 5 of spades was taken from the discard pile
+	hand := NewHandFromCards([]*Card{deck.Cards[0], deck.Cards[2], deck.Cards[4], deck.Cards[6]})
+	player := NewPlayer("player0", *hand, "uuid-0", INITIAL_POINTS)
+	player.HasOpened = true
+	brokenTable := Table{}
+	brokenTable.AddMeld([]*Card{deck.Cards[1], deck.Cards[3]})
+
+	discard := NewDiscardPlay(*deck.Cards[0])
+	top := deck.Cards[10]
+
+	tests := []struct {
+		name     string
+		rule     bool
+		drawn    bool
+		melded   bool
+		taken    *Card
+		top      *Card
+		table    Table
+		hand     Hand
+		play     Play
+		want     bool
+		wantText string
+	}{
+		{"discard without the rule", false, true, false, nil, nil, Table{}, *hand, discard, false, "no discard pile"},
+		{"take without the rule", false, false, false, nil, top, Table{}, *hand, NewTakeDiscardPlay(), false, "no discard pile"},
+		{"discard at turn start", true, false, false, nil, nil, Table{}, *hand, discard, false, "before discarding"},
+		{"discard after draw", true, true, false, nil, nil, Table{}, *hand, discard, true, ""},
+		{"discard after meld", true, false, true, nil, nil, Table{}, *hand, discard, true, ""},
+		{"discard a card not in hand", true, true, false, nil, nil, Table{}, *hand, NewDiscardPlay(*deck.Cards[8]), false, "from your hand"},
+		{"discard the taken card", true, true, false, deck.Cards[6], nil, Table{}, *hand, NewDiscardPlay(*deck.Cards[6]), false, "you took"},
+		{"discard another card after taking", true, true, false, deck.Cards[6], nil, Table{}, *hand, discard, true, ""},
+		{"discard with a broken table", true, false, true, nil, nil, brokenTable, *hand, discard, false, "invalid melds"},
+		{"take at turn start", true, false, false, nil, top, Table{}, *hand, NewTakeDiscardPlay(), true, ""},
+		{"take from an empty pile", true, false, false, nil, nil, Table{}, *hand, NewTakeDiscardPlay(), false, "empty"},
+		{"take after draw", true, true, false, nil, top, Table{}, *hand, NewTakeDiscardPlay(), false, "twice"},
+		{"take after meld", true, false, true, nil, top, Table{}, *hand, NewTakeDiscardPlay(), false, "after playing a meld"},
+		{"end turn without discarding", true, true, false, nil, nil, Table{}, *hand, NewEndTurnPlay(), false, "must discard"},
+		{"end turn with an empty hand", true, false, true, nil, nil, Table{}, Hand{}, NewEndTurnPlay(), true, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			turnState := NewTurnState("uuid-0")
+			turnState.UpdateDrawedCard(tt.drawn)
+			turnState.UpdatePlayedMeld(tt.melded)
+			turnState.HasDiscardPile = tt.rule
+			turnState.DiscardTop = tt.top
+			if tt.taken != nil {
+				turnState.takenDiscard = tt.taken.UUID
+			}
+			player.Hand = tt.hand
+			output := NewChannelOutputProvider("uuid-0", 1)
+			rules := GameRules{DiscardPile: tt.rule}
+
+			if got := IsValid(turnState, tt.play, &player, &tt.table, &rules, output); got != tt.want {
+				t.Errorf("IsValid() = %v, want %v", got, tt.want)
+			}
+			events := output.Events()
+			if tt.wantText == "" {
+				if len(events) > 0 {
+					t.Errorf("IsValid() wrote %q", (<-events).Message)
+				}
+				return
+			}
+			if len(events) == 0 {
+				t.Fatalf("IsValid() wrote nothing, want a message about %q", tt.wantText)
+			}
+			if message := (<-events).Message; !strings.Contains(message, tt.wantText) {
+				t.Errorf("IsValid() wrote %q, want a message about %q", message, tt.wantText)
+			}
+		})
+	}
+}
+
+func TestMakePlayDiscardPile(t *testing.T) {
+	deck := NewDeck(NO_SHUFFLE_SEED)
+	hand := NewHandFromDeck(deck, 4)
+	player := NewPlayer("player0", *hand, "uuid-0", INITIAL_POINTS)
+	table := Table{}
+	discards := DiscardPile{}
+
+	card := *player.Hand.Cards[2]
+	MakePlay(NewDiscardPlay(card), deck, &discards, &table, &player)
+	if player.Hand.Size != 3 || player.Hand.Contains(card) || discards.Size() != 1 || discards.Top().UUID != card.UUID {
+		t.Fatalf("after discarding hand has %d cards and the pile %d", player.Hand.Size, discards.Size())
+	}
+
+	MakePlay(NewTakeDiscardPlay(), deck, &discards, &table, &player)
+	if player.Hand.Size != 4 || !player.Hand.Contains(card) || discards.Size() != 0 || discards.Top() != nil {
+		t.Errorf("after taking the discard hand has %d cards and the pile %d", player.Hand.Size, discards.Size())
+	}
+}
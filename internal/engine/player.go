@@ -3,6 +3,7 @@ package engine
 import (
 	"fmt"
 	"log"
+	"time"
 )
 
 const MAX_BUFFER_SIZE = 3
@@ -13,6 +14,9 @@ var INPUT_MAPPING = map[string]AvailablePlay{
 	"m": PLAY_MELD,
 	"d": DRAW_CARD,
 	"e": END_TURN,
+	"u": UNDO,
+	"t": TAKE_DISCARD,
+	"x": DISCARD,
 }
 
 type TurnState struct {
@@ -20,6 +24,17 @@ type TurnState struct {
 	HasPlayedMeld bool
 	PlayerUUID    string
 	GameEnded     bool
+	// OpeningMinPoints is the value the player's opening meld must reach. Zero once they have opened.
+	OpeningMinPoints uint32
+	// HasDiscardPile tells if turns end by discarding a card, which the next player may take
+	HasDiscardPile bool
+	// DiscardTop is the card on top of the discard pile, left out while it is empty
+	DiscardTop  *Card `json:"DiscardTop,omitempty"`
+	DiscardSize int
+	// takenDiscard is the UUID of the card taken from the discard pile in this turn, zero if none
+	takenDiscard uint8
+	// deadline is when the turn times out, zero if it never does
+	deadline time.Time
 }
 
 func NewTurnState(playerUUID string) *TurnState {
@@ -43,16 +58,25 @@ func (t *TurnState) UpdateGameEnded(hasGameEnded bool) {
 	t.GameEnded = hasGameEnded
 }
 
+// UpdateDiscardPile shows the top of the discard pile in the state
+func (t *TurnState) UpdateDiscardPile(discards *DiscardPile) {
+	t.DiscardTop = discards.Top()
+	t.DiscardSize = discards.Size()
+}
+
 func (t *TurnState) Print() {
 	fmt.Printf("Has drawed card in this turn: %t\r\n", t.HasDrawedCard)
 	fmt.Printf("Has played meld in this turn: %t\r\n", t.HasPlayedMeld)
 }
 
 type Player struct {
-	Name   string
-	Hand   Hand
-	Points uint32
-	UUID   string
+	Name      string
+	Hand      Hand
+	Points    uint32
+	UUID      string
+	HasOpened bool
+	// Left is set once the player resigned or lost their connection for good. The game goes on without them.
+	Left bool
 }
 
 func NewPlayer(name string, hand Hand, uuid string, points uint32) Player {
@@ -75,6 +99,17 @@ func GetOutputProviderFromUUID(uuid string, outputProviders []OutputProvider) Ou
 	return EMPTY_WS_OUTPUT_PROVIDER
 }
 
+// ActivePlayers returns the UUIDs of the players still in the game, in turn order
+func ActivePlayers(players []Player) []string {
+	active := []string{}
+	for _, player := range players {
+		if !player.Left {
+			active = append(active, player.UUID)
+		}
+	}
+	return active
+}
+
 func (p *Player) Print() {
 	fmt.Println(p.Name)
 }
@@ -87,10 +122,28 @@ func (p *Player) UpdatePoints(points uint32) {
 	p.Points = points
 }
 
-func (p *Player) PlayTurn(deck *Deck, table *Table, inputProvider InputProvider, outputProviders []OutputProvider, players []Player) AvailablePlay {
+// OpeningRequirement returns the minimum value of the player's next meld, or zero if they don't have to open
+func (p *Player) OpeningRequirement(rules *GameRules) uint32 {
+	if p.HasOpened {
+		return 0
+	}
+	return rules.OpeningMinPoints
+}
+
+func (p *Player) PlayTurn(deck *Deck, discards *DiscardPile, table *Table, inputProvider InputProvider, outputProviders []OutputProvider, players []Player, rules *GameRules) AvailablePlay {
 
 	turnState := NewTurnState(p.UUID)
+	turnState.OpeningMinPoints = p.OpeningRequirement(rules)
+	turnState.HasDiscardPile = rules.DiscardPile
+	turnState.UpdateDiscardPile(discards)
+	if rules.TurnTimeout > 0 {
+		turnState.deadline = time.Now().Add(rules.TurnTimeout)
+	}
 	thisPlayerOutputProvider := GetOutputProviderFromUUID(p.UUID, outputProviders)
+	history := NewTurnHistory(p.Hand, *table)
+	hadOpened := p.HasOpened
+
+	SendStateToPlayers(outputProviders, *table, players, *turnState)
 
 	for {
 		log.Print("player :: !> DEBUG: Turn state: turnState.HasDrawedCard: ", turnState.HasDrawedCard)
@@ -102,29 +155,71 @@ func (p *Player) PlayTurn(deck *Deck, table *Table, inputProvider InputProvider,
 		play := inputProvider.GetPlay(*turnState)
 
 		log.Print("player :: !> Got Play: ", play.GetName())
-		if IsValid(turnState, play, thisPlayerOutputProvider) {
+		if IsValid(turnState, play, p, table, rules, thisPlayerOutputProvider) {
 			log.Print("player :: !> Play is valid")
 
-			MakePlay(play, deck, table, p)
+			if play.GetName() == PLAY_MELD {
+				history.Checkpoint(p.Hand, *table)
+			}
+
+			if play.GetName() == TAKE_DISCARD {
+				turnState.takenDiscard = turnState.DiscardTop.UUID
+			}
+
+			MakePlay(play, deck, discards, table, p)
+			turnState.UpdateDiscardPile(discards)
+
+			if play.GetName() == UNDO {
+				history.Undo(&p.Hand, table)
+				turnState.UpdatePlayedMeld(history.CanUndo())
+
+				// The opening is the first meld of the turn, so it stands while any meld does
+				p.HasOpened = hadOpened || history.CanUndo()
+				turnState.OpeningMinPoints = p.OpeningRequirement(rules)
+				SendStateToPlayers(outputProviders, *table, players, *turnState)
+				continue
+			}
 
-			if play.GetName() == DRAW_CARD {
+			if play.GetName() == DRAW_CARD || play.GetName() == TAKE_DISCARD {
 				turnState.UpdateDrawedCard(true)
 				SendStateToPlayers(outputProviders, *table, players, *turnState)
 				continue
 			}
 
 			if play.GetName() == PLAY_MELD {
+				p.HasOpened = true
+				turnState.OpeningMinPoints = 0
 				turnState.UpdatePlayedMeld(true)
 				SendStateToPlayers(outputProviders, *table, players, *turnState)
 				continue
 			}
-			if play.GetName() == QUIT {
-				turnState.UpdateGameEnded(true)
+			if play.GetName() == QUIT || play.GetName() == TIMEOUT || play.GetName() == DISCONNECT {
+				if play.GetName() == TIMEOUT {
+					thisPlayerOutputProvider.Write("message", "You ran out of time.")
+				}
+
+				// Broken melds can't stay on the table: the turn is rolled back and costs a card
+				if !table.IsValid() {
+					history.Rollback(&p.Hand, table)
+					turnState.UpdatePlayedMeld(false)
+					p.HasOpened = hadOpened
+					penaltyCard := deck.DrawCard()
+					if penaltyCard != nil {
+						p.Hand.AddCard(penaltyCard)
+						turnState.UpdateDrawedCard(true)
+					}
+					thisPlayerOutputProvider.Write("message", "The table had invalid melds. Your turn was undone and you drew a penalty card.")
+				}
+
+				// The game goes on without a player who leaves, unless only one is left to play it
+				if play.GetName() == QUIT || play.GetName() == DISCONNECT {
+					turnState.UpdateGameEnded(len(ActivePlayers(players)) <= 2)
+				}
 				SendStateToPlayers(outputProviders, *table, players, *turnState)
 				return play.GetName()
 			}
 
-			if play.GetName() == END_TURN {
+			if play.GetName() == END_TURN || play.GetName() == DISCARD {
 				SendStateToPlayers(outputProviders, *table, players, *turnState)
 				return play.GetName()
 			}
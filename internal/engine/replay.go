@@ -0,0 +1,198 @@
+package engine
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mexemexe/internal/service"
+	"sync"
+	"time"
+)
+
+// REPLAY_VERSION is the version of the replay format
+const REPLAY_VERSION = 1
+
+// Kinds of replay events
+const (
+	// REPLAY_PLAY is a play made by a player, fed back to the engine on replay
+	REPLAY_PLAY = "play"
+	// REPLAY_CHAT is a chat message sent by a player, as the others saw it
+	REPLAY_CHAT = "chat"
+)
+
+// ReplayEvent is something that happened during a game, in the order it happened
+type ReplayEvent struct {
+	// Turn is the number of turns played before the event
+	Turn       int             `json:"turn"`
+	PlayerUUID string          `json:"player_uuid"`
+	Type       string          `json:"type"`
+	Time       time.Time       `json:"time"`
+	Play       json.RawMessage `json:"play,omitempty"`
+	Text       string          `json:"text,omitempty"`
+}
+
+// Replay is enough to play a game again: where it started and every play made since
+type Replay struct {
+	Version int           `json:"version"`
+	Start   GameSnapshot  `json:"start"`
+	Events  []ReplayEvent `json:"events"`
+}
+
+// Marshal encodes the replay as gzipped JSON for storage
+func (r Replay) Marshal() ([]byte, error) {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	err := json.NewEncoder(writer).Encode(r)
+	if err != nil {
+		return nil, err
+	}
+	err = writer.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalReplay decodes a replay written by Marshal
+func UnmarshalReplay(data []byte) (Replay, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return Replay{}, fmt.Errorf("decoding replay: %w", err)
+	}
+	decoded, err := io.ReadAll(reader)
+	if err != nil {
+		return Replay{}, fmt.Errorf("decoding replay: %w", err)
+	}
+	var replay Replay
+	err = json.Unmarshal(decoded, &replay)
+	if err != nil {
+		return Replay{}, fmt.Errorf("decoding replay: %w", err)
+	}
+	if replay.Version != REPLAY_VERSION {
+		return Replay{}, fmt.Errorf("replay version %d is not supported, expected %d", replay.Version, REPLAY_VERSION)
+	}
+	return replay, nil
+}
+
+// Play runs the game of the replay again, feeding every player their recorded
+// plays, and returns it once it is over
+func (r Replay) Play(logger *service.GameLogger) (*Game, error) {
+	game, err := RestoreGame(r.Start, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	scripts := make(map[string][]Play)
+	for _, event := range r.Events {
+		if event.Type != REPLAY_PLAY {
+			continue
+		}
+		play, err := DecodePlay(event.Play)
+		if err != nil {
+			return nil, fmt.Errorf("turn %d: %w", event.Turn, err)
+		}
+		scripts[event.PlayerUUID] = append(scripts[event.PlayerUUID], play)
+	}
+
+	inputs := make([]InputProvider, len(game.Players))
+	outputs := make([]OutputProvider, len(game.Players))
+	for i, player := range game.Players {
+		inputs[i] = NewScriptedInputProvider(player.UUID, scripts[player.UUID])
+		outputs[i] = discardOutputProvider{uuid: player.UUID}
+	}
+	game.Start(inputs, outputs, game.Players[game.CurrentPlayer].UUID)
+	return game, nil
+}
+
+// ReplayRecorder records the plays of a game as they are made. It may be read
+// from any goroutine while the game runs.
+type ReplayRecorder struct {
+	game   *Game
+	replay Replay
+	// turn is the turn in progress, as last seen on the game goroutine
+	turn int
+	mu   sync.Mutex
+}
+
+// NewReplayRecorder starts recording the game from its current state. It must
+// be created before the game starts.
+func NewReplayRecorder(game *Game) *ReplayRecorder {
+	return &ReplayRecorder{
+		game: game,
+		replay: Replay{
+			Version: REPLAY_VERSION,
+			Start:   game.Snapshot(),
+			Events:  []ReplayEvent{},
+		},
+		turn: game.TurnsPlayed,
+	}
+}
+
+// Wrap returns input providers that record every play of the given ones
+func (r *ReplayRecorder) Wrap(inputs []InputProvider) []InputProvider {
+	wrapped := make([]InputProvider, len(inputs))
+	for i, input := range inputs {
+		wrapped[i] = recordingInputProvider{
+			InputProvider: input,
+			recorder:      r,
+		}
+	}
+	return wrapped
+}
+
+// Record adds an event to the replay, stamped with the turn in progress
+func (r *ReplayRecorder) Record(event ReplayEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	event.Turn = r.turn
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	r.replay.Events = append(r.replay.Events, event)
+}
+
+// Replay returns a copy of everything recorded so far
+func (r *ReplayRecorder) Replay() Replay {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	replay := r.replay
+	replay.Events = append([]ReplayEvent(nil), r.replay.Events...)
+	return replay
+}
+
+// recordingInputProvider records the plays of an input provider before handing them to the game
+type recordingInputProvider struct {
+	InputProvider
+	recorder *ReplayRecorder
+}
+
+func (p recordingInputProvider) GetPlay(turnState TurnState) Play {
+	play := p.InputProvider.GetPlay(turnState)
+	p.recorder.mu.Lock()
+	p.recorder.turn = p.recorder.game.TurnsPlayed
+	p.recorder.mu.Unlock()
+	data, err := json.Marshal(play)
+	if err == nil {
+		p.recorder.Record(ReplayEvent{
+			PlayerUUID: turnState.PlayerUUID,
+			Type:       REPLAY_PLAY,
+			Play:       data,
+		})
+	}
+	return play
+}
+
+// discardOutputProvider drops everything sent to a player
+type discardOutputProvider struct {
+	uuid string
+}
+
+func (d discardOutputProvider) GetUUID() string {
+	return d.uuid
+}
+
+func (d discardOutputProvider) Write(messageType string, data interface{}) {}
+
+func (d discardOutputProvider) SendState(table Table, hand Hand, turnState TurnState) {}
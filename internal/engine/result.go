@@ -0,0 +1,103 @@
+package engine
+
+// How a game ended
+const (
+	// OUTCOME_WON means a player got rid of all their cards
+	OUTCOME_WON = "won"
+	// OUTCOME_DECK_EMPTY means the deck ran out. The player with the fewest cards wins, unless tied.
+	OUTCOME_DECK_EMPTY = "deck_empty"
+	// OUTCOME_RESIGNED means every other player resigned or lost their connection. The last one left wins.
+	OUTCOME_RESIGNED = "resigned"
+	// OUTCOME_ABANDONED means the game was cut short without a winner, as when the server stops
+	OUTCOME_ABANDONED = "abandoned"
+)
+
+// PlayerResult is how a player finished a game
+type PlayerResult struct {
+	UUID      string `json:"uuid"`
+	Name      string `json:"name"`
+	CardsLeft int    `json:"cards_left"`
+	// Left is set for the players who resigned or lost their connection before the end
+	Left bool `json:"left,omitempty"`
+}
+
+// GameResult is how a game ended. Players are in turn order.
+type GameResult struct {
+	Outcome string `json:"outcome"`
+	// WinnerUUID is empty when the game was abandoned or ended in a tie
+	WinnerUUID string `json:"winner_uuid,omitempty"`
+	// QuitterUUID is the last player who left the game, when it ended because of it
+	QuitterUUID string         `json:"quitter_uuid,omitempty"`
+	TurnsPlayed int            `json:"turns_played"`
+	Players     []PlayerResult `json:"players"`
+}
+
+// Finished tells whether the game is over, as opposed to not started or cut short
+func (r GameResult) Finished() bool {
+	return r.Outcome != ""
+}
+
+// HasLeft tells whether the player with the given UUID left the game before it ended
+func (r GameResult) HasLeft(uuid string) bool {
+	for _, player := range r.Players {
+		if player.UUID == uuid {
+			return player.Left
+		}
+	}
+	return false
+}
+
+// AnyoneLeft tells whether some player left the game before it ended
+func (r GameResult) AnyoneLeft() bool {
+	for _, player := range r.Players {
+		if player.Left {
+			return true
+		}
+	}
+	return false
+}
+
+// Result returns how the game ended. It is empty until Start returns.
+func (g *Game) Result() GameResult {
+	return g.result
+}
+
+func (g *Game) finish(outcome string, winnerUUID string, quitterUUID string) {
+	players := make([]PlayerResult, len(g.Players))
+	for i, player := range g.Players {
+		players[i] = PlayerResult{
+			UUID:      player.UUID,
+			Name:      player.Name,
+			CardsLeft: len(player.Hand.Cards),
+			Left:      player.Left,
+		}
+	}
+	g.result = GameResult{
+		Outcome:     outcome,
+		WinnerUUID:  winnerUUID,
+		QuitterUUID: quitterUUID,
+		TurnsPlayed: g.TurnsPlayed,
+		Players:     players,
+	}
+}
+
+// fewestCardsPlayer returns the player still in the game with the fewest
+// cards in hand, or "" on a tie
+func (g *Game) fewestCardsPlayer() string {
+	winner := ""
+	fewest := -1
+	for _, player := range g.Players {
+		if player.Left {
+			continue
+		}
+		cards := len(player.Hand.Cards)
+		switch {
+		case fewest == -1 || cards < fewest:
+			winner = player.UUID
+			fewest = cards
+		case cards == fewest:
+			winner = ""
+		}
+	}
+	return winner
+}
@@ -0,0 +1,185 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"mexemexe/internal/service"
+)
+
+// SNAPSHOT_VERSION is the version of the game snapshot format
+const SNAPSHOT_VERSION = 1
+
+// PlayerSnapshot is a player as saved in a GameSnapshot. Cards are saved by UUID.
+type PlayerSnapshot struct {
+	Name      string `json:"name"`
+	UUID      string `json:"uuid"`
+	Points    uint32 `json:"points"`
+	HasOpened bool   `json:"has_opened"`
+	Left      bool   `json:"left,omitempty"`
+	Hand      []int  `json:"hand"`
+}
+
+// GameSnapshot holds everything needed to resume a game between two turns
+type GameSnapshot struct {
+	Version       int              `json:"version"`
+	Config        GameConfig       `json:"config"`
+	DeckSeed      uint64           `json:"deck_seed"`
+	Deck          []int            `json:"deck"`
+	Players       []PlayerSnapshot `json:"players"`
+	Table         [][]int          `json:"table"`
+	DiscardPile   []int            `json:"discard_pile,omitempty"`
+	Discards      []int            `json:"discards,omitempty"`
+	CurrentPlayer int              `json:"current_player"`
+	TurnsPlayed   int              `json:"turns_played"`
+	Turn          TurnState        `json:"turn"`
+}
+
+func snapshotCards(cards []*Card) []int {
+	uuids := make([]int, len(cards))
+	for i, card := range cards {
+		uuids[i] = int(card.UUID)
+	}
+	return uuids
+}
+
+// Snapshot saves the game as it is before the turn of the current player
+func (g *Game) Snapshot() GameSnapshot {
+	players := make([]PlayerSnapshot, len(g.Players))
+	for i, player := range g.Players {
+		players[i] = PlayerSnapshot{
+			Name:      player.Name,
+			UUID:      player.UUID,
+			Points:    player.Points,
+			HasOpened: player.HasOpened,
+			Left:      player.Left,
+			Hand:      snapshotCards(player.Hand.Cards),
+		}
+	}
+
+	table := make([][]int, len(g.Table.Melds))
+	for i, meld := range g.Table.Melds {
+		table[i] = snapshotCards(meld)
+	}
+
+	return GameSnapshot{
+		Version:       SNAPSHOT_VERSION,
+		Config:        *g.Config,
+		DeckSeed:      g.Deck.Seed,
+		Deck:          snapshotCards(g.Deck.Cards),
+		Players:       players,
+		Table:         table,
+		DiscardPile:   snapshotCards(g.DiscardPile.Cards),
+		Discards:      snapshotCards(g.Discards),
+		CurrentPlayer: g.CurrentPlayer,
+		TurnsPlayed:   g.TurnsPlayed,
+		Turn:          g.NextTurnState(),
+	}
+}
+
+// Marshal encodes the snapshot for storage
+func (s GameSnapshot) Marshal() ([]byte, error) {
+	return json.MarshalIndent(s, "", "  ")
+}
+
+// UnmarshalGameSnapshot decodes a snapshot written by Marshal
+func UnmarshalGameSnapshot(data []byte) (GameSnapshot, error) {
+	var snapshot GameSnapshot
+	err := json.Unmarshal(data, &snapshot)
+	if err != nil {
+		return GameSnapshot{}, fmt.Errorf("decoding game snapshot: %w", err)
+	}
+	if snapshot.Version != SNAPSHOT_VERSION {
+		return GameSnapshot{}, fmt.Errorf("game snapshot version %d is not supported, expected %d", snapshot.Version, SNAPSHOT_VERSION)
+	}
+	return snapshot, nil
+}
+
+// RestoreGame rebuilds a game from a snapshot. Every card of the deck must be
+// in exactly one place.
+func RestoreGame(snapshot GameSnapshot, logger *service.GameLogger) (*Game, error) {
+	if snapshot.Version != SNAPSHOT_VERSION {
+		return nil, fmt.Errorf("game snapshot version %d is not supported, expected %d", snapshot.Version, SNAPSHOT_VERSION)
+	}
+	if len(snapshot.Players) == 0 || snapshot.CurrentPlayer < 0 || snapshot.CurrentPlayer >= len(snapshot.Players) {
+		return nil, fmt.Errorf("current player %d out of %d players", snapshot.CurrentPlayer, len(snapshot.Players))
+	}
+	if snapshot.Turn.PlayerUUID != snapshot.Players[snapshot.CurrentPlayer].UUID {
+		return nil, fmt.Errorf("turn of %s but current player is %s", snapshot.Turn.PlayerUUID, snapshot.Players[snapshot.CurrentPlayer].UUID)
+	}
+
+	// A fresh unshuffled deck holds one of each card, to be handed out by UUID
+	pool := make(map[int]*Card, TOTAL_DECK_SIZE)
+	for _, card := range NewDeck(NO_SHUFFLE_SEED).Cards {
+		pool[int(card.UUID)] = card
+	}
+	take := func(uuids []int) ([]*Card, error) {
+		cards := make([]*Card, len(uuids))
+		for i, uuid := range uuids {
+			card, ok := pool[uuid]
+			if !ok {
+				return nil, fmt.Errorf("card %d is unknown or appears twice", uuid)
+			}
+			delete(pool, uuid)
+			cards[i] = card
+		}
+		return cards, nil
+	}
+
+	deckCards, err := take(snapshot.Deck)
+	if err != nil {
+		return nil, fmt.Errorf("deck: %w", err)
+	}
+	deck := &Deck{
+		Cards: deckCards,
+		Seed:  snapshot.DeckSeed,
+	}
+	deck.updateSize()
+
+	players := make([]Player, len(snapshot.Players))
+	for i, saved := range snapshot.Players {
+		cards, err := take(saved.Hand)
+		if err != nil {
+			return nil, fmt.Errorf("hand of %s: %w", saved.Name, err)
+		}
+		players[i] = NewPlayer(saved.Name, *NewHandFromCards(cards), saved.UUID, saved.Points)
+		players[i].HasOpened = saved.HasOpened
+		players[i].Left = saved.Left
+	}
+
+	table := Table{}
+	for _, saved := range snapshot.Table {
+		meld, err := take(saved)
+		if err != nil {
+			return nil, fmt.Errorf("table: %w", err)
+		}
+		table.Melds = append(table.Melds, meld)
+	}
+	table.updateCards()
+
+	discardPile, err := take(snapshot.DiscardPile)
+	if err != nil {
+		return nil, fmt.Errorf("discard pile: %w", err)
+	}
+
+	discards, err := take(snapshot.Discards)
+	if err != nil {
+		return nil, fmt.Errorf("discards: %w", err)
+	}
+
+	if len(pool) != 0 {
+		return nil, fmt.Errorf("%d cards are missing", len(pool))
+	}
+
+	config := snapshot.Config
+	return &Game{
+		Config:        &config,
+		Deck:          deck,
+		Table:         table,
+		DiscardPile:   DiscardPile{Cards: discardPile},
+		Discards:      discards,
+		Players:       players,
+		CurrentPlayer: snapshot.CurrentPlayer,
+		TurnsPlayed:   snapshot.TurnsPlayed,
+		logger:        logger,
+	}, nil
+}
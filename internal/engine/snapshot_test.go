@@ -0,0 +1,146 @@
+package engine
+
+import (
+	"reflect"
+	"testing"
+
+	"mexemexe/internal/service"
+)
+
+// botInputs returns a bot for every player of the game
+func botInputs(game *Game) []InputProvider {
+	inputs := make([]InputProvider, len(game.Players))
+	for i, player := range game.Players {
+		inputs[i] = NewBotProvider(player.UUID)
+	}
+	return inputs
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	game := newTestGame(t, TEST_SEED, 3)
+	game.Config.Rules.OpeningMinPoints = 20
+
+	var snapshots []GameSnapshot
+	game.SetTurnEndHook(func(g *Game) {
+		snapshots = append(snapshots, g.Snapshot())
+	})
+	runGame(t, game, botInputs(game))
+	if len(snapshots) < 10 {
+		t.Fatalf("only %d turns were played", len(snapshots))
+	}
+
+	for _, snapshot := range []GameSnapshot{snapshots[0], snapshots[len(snapshots)/2], snapshots[len(snapshots)-1]} {
+		data, err := snapshot.Marshal()
+		if err != nil {
+			t.Fatalf("Marshal() error: %v", err)
+		}
+		decoded, err := UnmarshalGameSnapshot(data)
+		if err != nil {
+			t.Fatalf("UnmarshalGameSnapshot() error: %v", err)
+		}
+		restored, err := RestoreGame(decoded, service.NewLogger(service.LEVEL_ERROR, "test"))
+		if err != nil {
+			t.Fatalf("RestoreGame() error: %v", err)
+		}
+		if err := restored.CheckCardConservation(); err != nil {
+			t.Fatal(err)
+		}
+		if again := restored.Snapshot(); !reflect.DeepEqual(again, snapshot) {
+			t.Errorf("restored game snapshots differently:\n%+v\nwant\n%+v", again, snapshot)
+		}
+	}
+}
+
+func TestRestoredGameContinuesIdentically(t *testing.T) {
+	original := newTestGame(t, TEST_SEED, 2)
+	var snapshots []GameSnapshot
+	original.SetTurnEndHook(func(g *Game) {
+		snapshots = append(snapshots, g.Snapshot())
+	})
+	originalRun := runGame(t, original, botInputs(original))
+
+	// Resume from the middle of the game with fresh bots
+	middle := snapshots[len(snapshots)/2]
+	restored, err := RestoreGame(middle, service.NewLogger(service.LEVEL_ERROR, "test"))
+	if err != nil {
+		t.Fatalf("RestoreGame() error: %v", err)
+	}
+	restoredRun := runGame(t, restored, botInputs(restored))
+
+	if restoredRun.finished != originalRun.finished {
+		t.Errorf("restored game finished: %v, original: %v", restoredRun.finished, originalRun.finished)
+	}
+	if !reflect.DeepEqual(restored.Snapshot(), original.Snapshot()) {
+		t.Error("restored game ended differently from the original")
+	}
+
+	// The restored game emitted the tail of what the original did
+	for i := range original.Players {
+		originalStates, restoredStates := originalRun.states(i), restoredRun.states(i)
+		tail := originalStates[len(originalStates)-len(restoredStates):]
+		if !reflect.DeepEqual(restoredStates, tail) {
+			t.Errorf("player %d saw different states after the restore", i)
+		}
+	}
+}
+
+func TestRestoreGameRejectsBrokenSnapshots(t *testing.T) {
+	game := newTestGame(t, TEST_SEED, 2)
+	logger := service.NewLogger(service.LEVEL_ERROR, "test")
+
+	tests := []struct {
+		name   string
+		change func(s *GameSnapshot)
+	}{
+		{"unknown version", func(s *GameSnapshot) { s.Version = SNAPSHOT_VERSION + 1 }},
+		{"current player out of range", func(s *GameSnapshot) { s.CurrentPlayer = 2 }},
+		{"turn of another player", func(s *GameSnapshot) { s.Turn.PlayerUUID = "uuid-x" }},
+		{"card missing", func(s *GameSnapshot) { s.Deck = s.Deck[1:] }},
+		{"card twice", func(s *GameSnapshot) { s.Players[0].Hand = append(s.Players[0].Hand, s.Deck[0]) }},
+		{"unknown card", func(s *GameSnapshot) { s.Table = [][]int{{0}} }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			snapshot := game.Snapshot()
+			tt.change(&snapshot)
+			if _, err := RestoreGame(snapshot, logger); err == nil {
+				t.Error("RestoreGame() accepted a broken snapshot")
+			}
+		})
+	}
+}
+
+func TestReplayPlaysTheSameGame(t *testing.T) {
+	game := newTestGame(t, TEST_SEED, 3)
+	game.Config.Rules.OpeningMinPoints = 20
+	recorder := NewReplayRecorder(game)
+	runGame(t, game, recorder.Wrap(botInputs(game)))
+
+	data, err := recorder.Replay().Marshal()
+	if err != nil {
+		t.Fatalf("Marshal() error: %v", err)
+	}
+	replay, err := UnmarshalReplay(data)
+	if err != nil {
+		t.Fatalf("UnmarshalReplay() error: %v", err)
+	}
+	if len(replay.Events) < game.TurnsPlayed {
+		t.Fatalf("only %d plays were recorded in %d turns", len(replay.Events), game.TurnsPlayed)
+	}
+	last := replay.Events[len(replay.Events)-1]
+	if last.Turn != game.TurnsPlayed && last.Turn != game.TurnsPlayed-1 {
+		t.Errorf("last play recorded on turn %d, the game played %d turns", last.Turn, game.TurnsPlayed)
+	}
+
+	replayed, err := replay.Play(service.NewLogger(service.LEVEL_ERROR, "test"))
+	if err != nil {
+		t.Fatalf("Play() error: %v", err)
+	}
+	if !reflect.DeepEqual(replayed.Snapshot(), game.Snapshot()) {
+		t.Error("replayed game ended differently from the original")
+	}
+	if !reflect.DeepEqual(replayed.Result(), game.Result()) || !game.Result().Finished() {
+		t.Errorf("replayed result = %+v, want %+v", replayed.Result(), game.Result())
+	}
+}
@@ -5,17 +5,25 @@ import (
 	"slices"
 )
 
+// Table holds the melds played by every player. Cards lists the cards of all
+// melds in order, so the table can also be looked at as a single row of cards.
 type Table struct {
 	Cards []*Card
+	Melds [][]*Card
 	Size  int
 }
 
 func (t *Table) RemoveCard(card *Card) bool {
-	for i := 0; i < len(t.Cards); i++ {
-		if t.Cards[i].UUID == card.UUID {
-			t.Cards = slices.Delete(t.Cards, i, i+1)
-			t.updateSize()
-			return true
+	for i, meld := range t.Melds {
+		for j := range meld {
+			if meld[j].UUID == card.UUID {
+				t.Melds[i] = slices.Delete(meld, j, j+1)
+				if len(t.Melds[i]) == 0 {
+					t.Melds = slices.Delete(t.Melds, i, i+1)
+				}
+				t.updateCards()
+				return true
+			}
 		}
 	}
 	return false
@@ -30,21 +38,74 @@ func (t *Table) Print() {
 }
 
 func (t *Table) Contains(card *Card) bool {
+	return t.GetCard(card.UUID) != nil
+}
+
+// GetCard returns the card on the table with the given UUID, or nil if it is not on the table
+func (t *Table) GetCard(uuid uint8) *Card {
 	for i := 0; i < len(t.Cards); i++ {
-		if t.Cards[i].UUID == card.UUID {
-			return true
+		if t.Cards[i].UUID == uuid {
+			return t.Cards[i]
 		}
 	}
-	return false
+	return nil
 }
 
+// AddCard puts a loose card on the table, as a meld of its own
 func (t *Table) AddCard(card *Card) {
-	for i := range t.Cards {
-		if t.Cards[i].UUID == card.UUID {
-			return
+	t.AddMeld([]*Card{card})
+}
+
+// AddMeld puts a new meld on the table. Cards already on the table are skipped.
+func (t *Table) AddMeld(cards []*Card) {
+	meld := []*Card{}
+	for _, card := range cards {
+		if t.Contains(card) || slices.ContainsFunc(meld, func(c *Card) bool { return c.UUID == card.UUID }) {
+			continue
+		}
+		meld = append(meld, card)
+	}
+	if len(meld) == 0 {
+		return
+	}
+	t.Melds = append(t.Melds, meld)
+	t.updateCards()
+}
+
+// InvalidMelds returns the index of every meld on the table that is not a sequence or a book
+func (t *Table) InvalidMelds() []int {
+	invalid := []int{}
+	for i, meld := range t.Melds {
+		if !IsValidMeld(meld) {
+			invalid = append(invalid, i)
 		}
 	}
-	t.Cards = append(t.Cards, card)
+	return invalid
+}
+
+// IsValid tells if every meld on the table is a sequence or a book
+func (t *Table) IsValid() bool {
+	return len(t.InvalidMelds()) == 0
+}
+
+// Clone returns a copy of the table that does not share its card slices.
+func (t Table) Clone() Table {
+	melds := make([][]*Card, len(t.Melds))
+	for i, meld := range t.Melds {
+		melds[i] = slices.Clone(meld)
+	}
+	return Table{
+		Cards: slices.Clone(t.Cards),
+		Melds: melds,
+		Size:  t.Size,
+	}
+}
+
+func (t *Table) updateCards() {
+	t.Cards = []*Card{}
+	for _, meld := range t.Melds {
+		t.Cards = append(t.Cards, meld...)
+	}
 	t.updateSize()
 }
 
@@ -0,0 +1,31 @@
+package engine
+
+import "testing"
+
+func TestTableCardMovement(t *testing.T) {
+	deck := NewDeck(NO_SHUFFLE_SEED)
+	table := Table{}
+
+	first, second := deck.DrawCard(), deck.DrawCard()
+	table.AddCard(first)
+	table.AddCard(second)
+	table.AddCard(first)
+
+	if table.Size != 2 || !table.Contains(first) || !table.Contains(second) {
+		t.Fatalf("table has %d cards after adding two, one of them twice", table.Size)
+	}
+
+	clone := table.Clone()
+	if !table.RemoveCard(first) || table.Contains(first) {
+		t.Fatal("failed to remove a card from the table")
+	}
+	if table.RemoveCard(first) {
+		t.Error("removed a card twice")
+	}
+	if table.Size != 1 {
+		t.Errorf("table size is %d, want 1", table.Size)
+	}
+	if clone.Size != 2 || !clone.Contains(first) {
+		t.Error("clone changed with the original table")
+	}
+}
@@ -0,0 +1,332 @@
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// PROTOCOL_VERSION is the version of the wire protocol spoken by this build
+const PROTOCOL_VERSION = 1
+
+// MIN_PROTOCOL_VERSION is the oldest protocol version the server still accepts
+const MIN_PROTOCOL_VERSION = 1
+
+// DEFAULT_SEND_QUEUE_SIZE is how many messages can wait to be written to a connection
+const DEFAULT_SEND_QUEUE_SIZE = 64
+
+// DEFAULT_RECEIVE_QUEUE_SIZE is how many received messages can wait to be handled
+const DEFAULT_RECEIVE_QUEUE_SIZE = 16
+
+// WRITE_TIMEOUT is how long writing a single message may take before the peer is dropped
+const WRITE_TIMEOUT = 10 * time.Second
+
+// PONG_WAIT is how long the peer may stay silent, answering no ping, before it is dropped
+const PONG_WAIT = 60 * time.Second
+
+// PING_PERIOD is how often the peer is pinged. It must be shorter than PONG_WAIT.
+const PING_PERIOD = PONG_WAIT * 9 / 10
+
+// ErrSlowConsumer is returned by Send when the peer reads too slowly to keep up
+var ErrSlowConsumer = errors.New("peer is not reading its messages")
+
+// ErrClosed is returned by Send once the connection is closed
+var ErrClosed = errors.New("connection closed")
+
+type MessageType string
+
+// Client to server messages
+const JOIN MessageType = "join"
+const START_GAME MessageType = "start_game"
+const GAME_PLAY MessageType = "game_play"
+const RATING_REQUEST MessageType = "rating_request"
+
+// Server to client messages
+const WELCOME MessageType = "welcome"
+const MAX_CAPACITY MessageType = "max_capacity"
+const ERROR MessageType = "error"
+const JOINED_GAME_ROOM MessageType = "joined_game_room"
+const GAME_STATE MessageType = "game_state"
+const GAME_MESSAGE MessageType = "game_message"
+const SERVER_NOTICE MessageType = "server_notice"
+const RATING MessageType = "rating"
+const QUEUE_UPDATE MessageType = "queue_update"
+const SEARCH_CANCELLED MessageType = "search_cancelled"
+const CHAT MessageType = "chat"
+const CHAT_POSTED MessageType = "chat_posted"
+const LOBBY_SUBSCRIBE MessageType = "lobby_subscribe"
+const LOBBY_UNSUBSCRIBE MessageType = "lobby_unsubscribe"
+const REMATCH MessageType = "rematch"
+const LOBBY MessageType = "lobby"
+const LOBBY_UPDATE MessageType = "lobby_update"
+const GAME_OVER MessageType = "game_over"
+const BACK_TO_LOBBY MessageType = "back_to_lobby"
+
+// Envelope wraps every message sent over the wire. Seq counts the messages
+// sent by each end of a connection, starting at 1.
+type Envelope struct {
+	Type    MessageType     `json:"type"`
+	Version int             `json:"version"`
+	Seq     uint64          `json:"seq"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// Decode unmarshals the payload of the envelope into v
+func (e Envelope) Decode(v interface{}) error {
+	err := json.Unmarshal(e.Payload, v)
+	if err != nil {
+		return fmt.Errorf("decoding %s payload: %w", e.Type, err)
+	}
+	return nil
+}
+
+// IsCompatibleVersion tells if a peer speaking version can talk to this build
+func IsCompatibleVersion(version int) bool {
+	return version >= MIN_PROTOCOL_VERSION && version <= PROTOCOL_VERSION
+}
+
+// ConnOptions sets the queue sizes and timeouts of a Conn
+type ConnOptions struct {
+	SendQueueSize    int
+	ReceiveQueueSize int
+	WriteTimeout     time.Duration
+	PongWait         time.Duration
+	PingPeriod       time.Duration
+}
+
+func DefaultConnOptions() ConnOptions {
+	return ConnOptions{
+		SendQueueSize:    DEFAULT_SEND_QUEUE_SIZE,
+		ReceiveQueueSize: DEFAULT_RECEIVE_QUEUE_SIZE,
+		WriteTimeout:     WRITE_TIMEOUT,
+		PongWait:         PONG_WAIT,
+		PingPeriod:       PING_PERIOD,
+	}
+}
+
+// Conn sends and receives envelopes over a websocket connection. Messages
+// are queued by Send and written by a single goroutine, so any number of
+// goroutines may send and a stalled peer never blocks them. Another goroutine
+// keeps reading, so pings are answered and a silent peer is detected even
+// while nobody waits for its messages.
+type Conn struct {
+	ws         *websocket.Conn
+	options    ConnOptions
+	sendSeq    uint64
+	recvSeq    uint64
+	outbound   chan Envelope
+	inbound    chan Envelope
+	writerDone chan struct{}
+	done       chan struct{}
+	closed     bool
+	err        error
+	mu         sync.Mutex
+}
+
+func NewConn(ws *websocket.Conn) *Conn {
+	return NewConnWithOptions(ws, DefaultConnOptions())
+}
+
+func NewConnWithOptions(ws *websocket.Conn, options ConnOptions) *Conn {
+	c := &Conn{
+		ws:         ws,
+		options:    options,
+		outbound:   make(chan Envelope, options.SendQueueSize),
+		inbound:    make(chan Envelope, options.ReceiveQueueSize),
+		writerDone: make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	ws.SetPongHandler(func(string) error {
+		return ws.SetReadDeadline(time.Now().Add(options.PongWait))
+	})
+	go c.writeLoop()
+	go c.readLoop()
+	return c
+}
+
+// Send wraps payload in an envelope of the given type and queues it. It never
+// blocks: if the queue is full the peer is dropped and ErrSlowConsumer returned.
+func (c *Conn) Send(messageType MessageType, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("encoding %s payload: %w", messageType, err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return c.err
+	}
+	c.sendSeq++
+	envelope := Envelope{
+		Type:    messageType,
+		Version: PROTOCOL_VERSION,
+		Seq:     c.sendSeq,
+		Payload: data,
+	}
+
+	select {
+	case c.outbound <- envelope:
+		return nil
+	default:
+		c.closeLocked(ErrSlowConsumer)
+		// Unblock the writer stuck on the stalled peer
+		c.ws.Close()
+		return ErrSlowConsumer
+	}
+}
+
+// writeLoop is the only goroutine writing to the websocket
+func (c *Conn) writeLoop() {
+	defer close(c.writerDone)
+	ticker := time.NewTicker(c.options.PingPeriod)
+	defer ticker.Stop()
+
+	for {
+		var err error
+		select {
+		case envelope, ok := <-c.outbound:
+			if !ok {
+				return
+			}
+			c.ws.SetWriteDeadline(time.Now().Add(c.options.WriteTimeout))
+			err = c.ws.WriteJSON(envelope)
+			if err != nil {
+				err = fmt.Errorf("writing %s message: %w", envelope.Type, err)
+			}
+		case <-ticker.C:
+			err = c.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(c.options.WriteTimeout))
+			if err != nil {
+				err = fmt.Errorf("writing ping: %w", err)
+			}
+		}
+
+		if err != nil {
+			c.fail(err)
+			c.ws.Close()
+			// Drop whatever is still queued
+			for range c.outbound {
+			}
+			return
+		}
+	}
+}
+
+// readLoop is the only goroutine reading from the websocket
+func (c *Conn) readLoop() {
+	defer close(c.inbound)
+	for {
+		c.ws.SetReadDeadline(time.Now().Add(c.options.PongWait))
+		var envelope Envelope
+		err := c.ws.ReadJSON(&envelope)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		if envelope.Seq != c.recvSeq+1 {
+			c.fail(fmt.Errorf("message %s out of sequence: got %d, expected %d", envelope.Type, envelope.Seq, c.recvSeq+1))
+			c.ws.Close()
+			return
+		}
+		c.recvSeq = envelope.Seq
+
+		select {
+		case c.inbound <- envelope:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// fail stops accepting messages, recording why
+func (c *Conn) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closeLocked(err)
+}
+
+func (c *Conn) closeLocked(err error) {
+	if c.closed {
+		return
+	}
+	c.closed = true
+	c.err = err
+	close(c.outbound)
+	close(c.done)
+}
+
+// Done returns a channel that is closed once the connection is closed or broken
+func (c *Conn) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns why the connection stopped accepting messages, or nil while it is open
+func (c *Conn) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// Receive returns the next envelope. Messages must arrive in sequence.
+// Messages received before the connection broke are still returned.
+func (c *Conn) Receive() (Envelope, error) {
+	envelope, ok := <-c.inbound
+	if !ok {
+		return Envelope{}, c.Err()
+	}
+	return envelope, nil
+}
+
+// Messages returns the channel Receive reads from, to wait for the next
+// envelope together with other events. It is closed once the connection breaks.
+func (c *Conn) Messages() <-chan Envelope {
+	return c.inbound
+}
+
+// RemoteAddr returns the address of the other end of the connection
+func (c *Conn) RemoteAddr() string {
+	return c.ws.RemoteAddr().String()
+}
+
+// Close writes the messages already queued, giving up after the write timeout,
+// and closes the websocket
+func (c *Conn) Close() error {
+	c.fail(ErrClosed)
+	select {
+	case <-c.writerDone:
+	case <-time.After(c.options.WriteTimeout):
+	}
+	return c.ws.Close()
+}
+
+// HandlerFunc handles one type of message
+type HandlerFunc func(envelope Envelope) error
+
+// Dispatcher routes envelopes to the handler registered for their type
+type Dispatcher struct {
+	handlers map[MessageType]HandlerFunc
+}
+
+func NewDispatcher() *Dispatcher {
+	return &Dispatcher{
+		handlers: make(map[MessageType]HandlerFunc),
+	}
+}
+
+// Handle registers the handler for a message type, replacing any previous one
+func (d *Dispatcher) Handle(messageType MessageType, handler HandlerFunc) {
+	d.handlers[messageType] = handler
+}
+
+// Dispatch calls the handler of the envelope type
+func (d *Dispatcher) Dispatch(envelope Envelope) error {
+	handler, ok := d.handlers[envelope.Type]
+	if !ok {
+		return fmt.Errorf("unexpected message type %q", envelope.Type)
+	}
+	return handler(envelope)
+}
@@ -0,0 +1,220 @@
+package protocol
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsPair returns the client and server ends of a websocket connection
+func wsPair(t *testing.T) (*websocket.Conn, *websocket.Conn) {
+	t.Helper()
+	upgrader := websocket.Upgrader{}
+	serverSide := make(chan *websocket.Conn, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade: %v", err)
+			return
+		}
+		serverSide <- ws
+	}))
+	t.Cleanup(ts.Close)
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { ws.Close() })
+
+	select {
+	case raw := <-serverSide:
+		t.Cleanup(func() { raw.Close() })
+		return ws, raw
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the connection")
+		return nil, nil
+	}
+}
+
+// connPair returns both ends of a websocket connection, one of them wrapped in a
+// Conn with the given send queue size
+func connPair(t *testing.T, queueSize int) (*Conn, *websocket.Conn) {
+	t.Helper()
+	ws, raw := wsPair(t)
+	raw.SetReadDeadline(time.Now().Add(5 * time.Second))
+	options := DefaultConnOptions()
+	options.SendQueueSize = queueSize
+	return NewConnWithOptions(ws, options), raw
+}
+
+func TestSendNumbersMessages(t *testing.T) {
+	conn, raw := connPair(t, DEFAULT_SEND_QUEUE_SIZE)
+
+	for _, message := range []string{"first", "second"} {
+		if err := conn.Send(WELCOME, map[string]string{"message": message}); err != nil {
+			t.Fatalf("send: %v", err)
+		}
+	}
+
+	for i, want := range []string{"first", "second"} {
+		var envelope Envelope
+		if err := raw.ReadJSON(&envelope); err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if envelope.Type != WELCOME || envelope.Version != PROTOCOL_VERSION || envelope.Seq != uint64(i+1) {
+			t.Errorf("envelope %d: type %s, version %d, seq %d", i, envelope.Type, envelope.Version, envelope.Seq)
+		}
+		var payload map[string]string
+		if err := envelope.Decode(&payload); err != nil || payload["message"] != want {
+			t.Errorf("envelope %d: payload %s, err %v", i, envelope.Payload, err)
+		}
+	}
+}
+
+func TestReceiveRejectsOutOfSequence(t *testing.T) {
+	conn, raw := connPair(t, DEFAULT_SEND_QUEUE_SIZE)
+
+	for _, seq := range []uint64{1, 3} {
+		if err := raw.WriteJSON(Envelope{Type: GAME_PLAY, Version: PROTOCOL_VERSION, Seq: seq, Payload: []byte("{}")}); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+
+	if _, err := conn.Receive(); err != nil {
+		t.Fatalf("first message: %v", err)
+	}
+	if _, err := conn.Receive(); err == nil {
+		t.Error("a skipped sequence number was accepted")
+	}
+}
+
+func TestDispatcher(t *testing.T) {
+	dispatcher := NewDispatcher()
+	handled := []MessageType{}
+	for _, messageType := range []MessageType{WELCOME, ERROR} {
+		dispatcher.Handle(messageType, func(envelope Envelope) error {
+			handled = append(handled, envelope.Type)
+			return nil
+		})
+	}
+
+	for _, messageType := range []MessageType{ERROR, WELCOME} {
+		if err := dispatcher.Dispatch(Envelope{Type: messageType}); err != nil {
+			t.Errorf("dispatch %s: %v", messageType, err)
+		}
+	}
+	if len(handled) != 2 || handled[0] != ERROR || handled[1] != WELCOME {
+		t.Errorf("handled %v, want [error welcome]", handled)
+	}
+
+	if err := dispatcher.Dispatch(Envelope{Type: GAME_STATE}); err == nil {
+		t.Error("a message without handler was dispatched")
+	}
+}
+
+func TestIsCompatibleVersion(t *testing.T) {
+	if !IsCompatibleVersion(PROTOCOL_VERSION) {
+		t.Error("the current version is not compatible")
+	}
+	if IsCompatibleVersion(MIN_PROTOCOL_VERSION-1) || IsCompatibleVersion(PROTOCOL_VERSION+1) {
+		t.Error("versions outside the supported range are compatible")
+	}
+}
+
+func TestCloseFlushesQueue(t *testing.T) {
+	conn, raw := connPair(t, DEFAULT_SEND_QUEUE_SIZE)
+
+	for i := 0; i < 3; i++ {
+		if err := conn.Send(GAME_MESSAGE, i); err != nil {
+			t.Fatalf("send: %v", err)
+		}
+	}
+	conn.Close()
+
+	for i := 0; i < 3; i++ {
+		var envelope Envelope
+		if err := raw.ReadJSON(&envelope); err != nil {
+			t.Fatalf("message %d lost on close: %v", i, err)
+		}
+	}
+	if err := conn.Send(GAME_MESSAGE, 3); err != ErrClosed {
+		t.Errorf("send after close returned %v, want ErrClosed", err)
+	}
+}
+
+func TestSlowConsumerIsDropped(t *testing.T) {
+	// The peer never reads, so the writer stalls once the socket buffers are full
+	conn, raw := connPair(t, 2)
+	payload := strings.Repeat("x", 64*1024)
+
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < 10000; i++ {
+			if err := conn.Send(GAME_STATE, payload); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	select {
+	case err := <-done:
+		if err != ErrSlowConsumer {
+			t.Fatalf("send returned %v, want ErrSlowConsumer", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Send blocked on a peer that does not read")
+	}
+	if conn.Err() != ErrSlowConsumer {
+		t.Errorf("Err() = %v, want ErrSlowConsumer", conn.Err())
+	}
+
+	// The connection was closed under the peer
+	raw.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, _, err := raw.NextReader(); err != nil {
+			break
+		}
+	}
+}
+
+func TestKeepalive(t *testing.T) {
+	options := DefaultConnOptions()
+	options.PongWait = 300 * time.Millisecond
+	options.PingPeriod = 100 * time.Millisecond
+
+	// A peer that keeps reading answers the pings and stays connected
+	peer, ws := wsPair(t)
+	alive := NewConnWithOptions(ws, options)
+	defer alive.Close()
+	go func() {
+		for {
+			if _, _, err := peer.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-alive.Done():
+		t.Fatalf("a peer answering pings was dropped: %v", alive.Err())
+	case <-time.After(3 * options.PongWait):
+	}
+
+	// A peer that never reads never answers
+	_, ws = wsPair(t)
+	silent := NewConnWithOptions(ws, options)
+	defer silent.Close()
+
+	select {
+	case <-silent.Done():
+	case <-time.After(10 * options.PongWait):
+		t.Fatal("a silent peer was not dropped")
+	}
+}
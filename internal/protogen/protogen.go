@@ -0,0 +1,434 @@
+package protogen
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"mexemexe/internal/engine"
+	"mexemexe/internal/protocol"
+	"mexemexe/internal/server"
+)
+
+const SCHEMA_FILE = "protocol.schema.json"
+const TYPESCRIPT_FILE = "protocol.d.ts"
+
+const JSON_SCHEMA_DRAFT = "https://json-schema.org/draft/2020-12/schema"
+
+type Direction string
+
+const CLIENT_TO_SERVER Direction = "client"
+const SERVER_TO_CLIENT Direction = "server"
+
+// Message pairs a wire message type with the Go type of its payload
+type Message struct {
+	Type      protocol.MessageType
+	Direction Direction
+	Payload   reflect.Type
+}
+
+// PlayVariant pairs the type tag of a play with its Go type
+type PlayVariant struct {
+	Name engine.AvailablePlay
+	Type reflect.Type
+}
+
+// MESSAGES lists every message of the wire protocol
+var MESSAGES = []Message{
+	{protocol.JOIN, CLIENT_TO_SERVER, reflect.TypeOf(server.JoinServerMessage{})},
+	{protocol.START_GAME, CLIENT_TO_SERVER, reflect.TypeOf(server.StartGameMessage{})},
+	{protocol.GAME_PLAY, CLIENT_TO_SERVER, reflect.TypeOf(server.GamePlayMessage{})},
+	{protocol.RATING_REQUEST, CLIENT_TO_SERVER, reflect.TypeOf(server.RatingRequestMessage{})},
+	{protocol.WELCOME, SERVER_TO_CLIENT, reflect.TypeOf(server.WelcomeMessage{})},
+	{protocol.MAX_CAPACITY, SERVER_TO_CLIENT, reflect.TypeOf(server.MaxCapacityMessage{})},
+	{protocol.ERROR, SERVER_TO_CLIENT, reflect.TypeOf(server.ErrorMessage{})},
+	{protocol.JOINED_GAME_ROOM, SERVER_TO_CLIENT, reflect.TypeOf(server.JoinedGameRoomMessage{})},
+	{protocol.GAME_STATE, SERVER_TO_CLIENT, reflect.TypeOf(engine.GameStateMessageOut{})},
+	{protocol.GAME_MESSAGE, SERVER_TO_CLIENT, reflect.TypeOf(engine.GameMessageOut{})},
+	{protocol.SERVER_NOTICE, SERVER_TO_CLIENT, reflect.TypeOf(server.ServerNoticeMessage{})},
+	{protocol.RATING, SERVER_TO_CLIENT, reflect.TypeOf(server.RatingMessage{})},
+	{protocol.QUEUE_UPDATE, SERVER_TO_CLIENT, reflect.TypeOf(server.QueueUpdateMessage{})},
+	{protocol.SEARCH_CANCELLED, SERVER_TO_CLIENT, reflect.TypeOf(server.SearchCancelledMessage{})},
+	{protocol.CHAT, CLIENT_TO_SERVER, reflect.TypeOf(server.ChatMessage{})},
+	{protocol.CHAT_POSTED, SERVER_TO_CLIENT, reflect.TypeOf(server.ChatPostedMessage{})},
+	{protocol.LOBBY_SUBSCRIBE, CLIENT_TO_SERVER, reflect.TypeOf(server.LobbySubscribeMessage{})},
+	{protocol.LOBBY_UNSUBSCRIBE, CLIENT_TO_SERVER, reflect.TypeOf(server.LobbyUnsubscribeMessage{})},
+	{protocol.LOBBY, SERVER_TO_CLIENT, reflect.TypeOf(server.LobbyMessage{})},
+	{protocol.LOBBY_UPDATE, SERVER_TO_CLIENT, reflect.TypeOf(server.LobbyUpdateMessage{})},
+	{protocol.GAME_OVER, SERVER_TO_CLIENT, reflect.TypeOf(server.GameOverMessage{})},
+	{protocol.REMATCH, CLIENT_TO_SERVER, reflect.TypeOf(server.RematchMessage{})},
+	{protocol.BACK_TO_LOBBY, SERVER_TO_CLIENT, reflect.TypeOf(server.BackToLobbyMessage{})},
+}
+
+// PLAYS lists the plays a client may send. TIMEOUT is only played by the server,
+// once a turn runs past the turn timeout.
+var PLAYS = []PlayVariant{
+	{engine.PLAY_MELD, reflect.TypeOf(engine.MeldPlay{})},
+	{engine.DRAW_CARD, reflect.TypeOf(engine.DrawCardPlay{})},
+	{engine.END_TURN, reflect.TypeOf(engine.EndTurnPlay{})},
+	{engine.UNDO, reflect.TypeOf(engine.UndoPlay{})},
+	{engine.QUIT, reflect.TypeOf(engine.QuitPlay{})},
+	{engine.DISCARD, reflect.TypeOf(engine.DiscardPlay{})},
+	{engine.TAKE_DISCARD, reflect.TypeOf(engine.TakeDiscardPlay{})},
+}
+
+// ENUMS lists the values of the string types that only take a fixed set of values
+var ENUMS = map[reflect.Type][]string{
+	reflect.TypeOf(engine.CardSuit("")):  {string(engine.SPADE), string(engine.CLUB), string(engine.HEART), string(engine.DIAMOND)},
+	reflect.TypeOf(engine.CardColor("")): {string(engine.RED), string(engine.BLACK)},
+}
+
+var playInterface = reflect.TypeOf((*engine.Play)(nil)).Elem()
+
+// field is a struct field as it appears in JSON
+type field struct {
+	name     string
+	optional bool
+	typ      reflect.Type
+}
+
+// jsonFields returns the fields encoding/json writes for a struct type
+func jsonFields(t reflect.Type) []field {
+	fields := []field{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name := f.Name
+		optional := false
+		if tag, ok := f.Tag.Lookup("json"); ok {
+			parts := strings.Split(tag, ",")
+			if parts[0] == "-" {
+				continue
+			}
+			if parts[0] != "" {
+				name = parts[0]
+			}
+			for _, option := range parts[1:] {
+				if option == "omitempty" {
+					optional = true
+				}
+			}
+		}
+		fields = append(fields, field{name: name, optional: optional, typ: f.Type})
+	}
+	return fields
+}
+
+// collector gathers the named types reachable from the messages
+type collector struct {
+	structs map[string]reflect.Type
+	enums   map[string]reflect.Type
+}
+
+func newCollector() *collector {
+	return &collector{
+		structs: make(map[string]reflect.Type),
+		enums:   make(map[string]reflect.Type),
+	}
+}
+
+func (c *collector) visit(t reflect.Type) error {
+	for t.Kind() == reflect.Pointer || t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+		t = t.Elem()
+	}
+	if t == playInterface {
+		for _, variant := range PLAYS {
+			err := c.visit(variant.Type)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if _, ok := ENUMS[t]; ok {
+		c.enums[t.Name()] = t
+		return nil
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+	if previous, ok := c.structs[t.Name()]; ok {
+		if previous != t {
+			return fmt.Errorf("two types are named %s: %s and %s", t.Name(), previous.PkgPath(), t.PkgPath())
+		}
+		return nil
+	}
+	c.structs[t.Name()] = t
+	for _, f := range jsonFields(t) {
+		err := c.visit(f.typ)
+		if err != nil {
+			return fmt.Errorf("%s.%s: %w", t.Name(), f.name, err)
+		}
+	}
+	return nil
+}
+
+func sortedNames[T any](types map[string]T) []string {
+	names := make([]string, 0, len(types))
+	for name := range types {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// playTag returns the type tag of a play variant, or "" if t is not one
+func playTag(t reflect.Type) engine.AvailablePlay {
+	for _, variant := range PLAYS {
+		if variant.Type == t {
+			return variant.Name
+		}
+	}
+	return ""
+}
+
+func collect() (*collector, error) {
+	c := newCollector()
+	for _, message := range MESSAGES {
+		err := c.visit(message.Payload)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Generate returns the generated files by name
+func Generate() (map[string][]byte, error) {
+	c, err := collect()
+	if err != nil {
+		return nil, err
+	}
+	schema, err := generateSchema(c)
+	if err != nil {
+		return nil, err
+	}
+	return map[string][]byte{
+		SCHEMA_FILE:     schema,
+		TYPESCRIPT_FILE: generateTypescript(c),
+	}, nil
+}
+
+/* JSON Schema */
+
+type schemaNode map[string]interface{}
+
+func schemaRef(name string) schemaNode {
+	return schemaNode{"$ref": "#/$defs/" + name}
+}
+
+func schemaType(t reflect.Type) (schemaNode, error) {
+	if t == playInterface {
+		return schemaRef("Play"), nil
+	}
+	if _, ok := ENUMS[t]; ok {
+		return schemaRef(t.Name()), nil
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return schemaType(t.Elem())
+	case reflect.Slice, reflect.Array:
+		items, err := schemaType(t.Elem())
+		if err != nil {
+			return nil, err
+		}
+		// encoding/json writes nil slices as null
+		return schemaNode{"type": []string{"array", "null"}, "items": items}, nil
+	case reflect.Struct:
+		return schemaRef(t.Name()), nil
+	case reflect.String:
+		return schemaNode{"type": "string"}, nil
+	case reflect.Bool:
+		return schemaNode{"type": "boolean"}, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return schemaNode{"type": "integer"}, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return schemaNode{"type": "integer", "minimum": 0}, nil
+	case reflect.Float32, reflect.Float64:
+		return schemaNode{"type": "number"}, nil
+	}
+	return nil, fmt.Errorf("unsupported type %s", t)
+}
+
+func schemaStruct(t reflect.Type) (schemaNode, error) {
+	properties := schemaNode{}
+	required := []string{}
+	tag := playTag(t)
+	for _, f := range jsonFields(t) {
+		property, err := schemaType(f.typ)
+		if err != nil {
+			return nil, fmt.Errorf("%s.%s: %w", t.Name(), f.name, err)
+		}
+		if tag != "" && f.name == "type" {
+			property = schemaNode{"const": string(tag)}
+		}
+		properties[f.name] = property
+		if !f.optional {
+			required = append(required, f.name)
+		}
+	}
+	return schemaNode{
+		"type":       "object",
+		"properties": properties,
+		"required":   required,
+	}, nil
+}
+
+func generateSchema(c *collector) ([]byte, error) {
+	defs := schemaNode{}
+	for _, name := range sortedNames(c.structs) {
+		def, err := schemaStruct(c.structs[name])
+		if err != nil {
+			return nil, err
+		}
+		defs[name] = def
+	}
+	for _, name := range sortedNames(c.enums) {
+		defs[name] = schemaNode{"type": "string", "enum": ENUMS[c.enums[name]]}
+	}
+
+	plays := []schemaNode{}
+	for _, variant := range PLAYS {
+		plays = append(plays, schemaRef(variant.Type.Name()))
+	}
+	defs["Play"] = schemaNode{"oneOf": plays}
+
+	messageTypes := []string{}
+	envelopes := []schemaNode{}
+	for _, message := range MESSAGES {
+		messageTypes = append(messageTypes, string(message.Type))
+		envelopes = append(envelopes, schemaNode{
+			"type": "object",
+			"properties": schemaNode{
+				"type":    schemaNode{"const": string(message.Type)},
+				"version": schemaNode{"type": "integer", "minimum": protocol.MIN_PROTOCOL_VERSION},
+				"seq":     schemaNode{"type": "integer", "minimum": 1},
+				"payload": schemaRef(message.Payload.Name()),
+			},
+			"required": []string{"type", "version", "seq", "payload"},
+		})
+	}
+	defs["MessageType"] = schemaNode{"type": "string", "enum": messageTypes}
+
+	root := schemaNode{
+		"$schema":     JSON_SCHEMA_DRAFT,
+		"$id":         fmt.Sprintf("https://mexe-mexe.online/protocol/v%d.schema.json", protocol.PROTOCOL_VERSION),
+		"title":       "mexe-mexe wire protocol",
+		"description": fmt.Sprintf("Envelope of every message of protocol version %d. Code generated by protogen. DO NOT EDIT.", protocol.PROTOCOL_VERSION),
+		"oneOf":       envelopes,
+		"$defs":       defs,
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	err := encoder.Encode(root)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+/* TypeScript */
+
+func typescriptType(t reflect.Type) string {
+	if t == playInterface {
+		return "Play"
+	}
+	if _, ok := ENUMS[t]; ok {
+		return t.Name()
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return typescriptType(t.Elem())
+	case reflect.Slice, reflect.Array:
+		elem := typescriptType(t.Elem())
+		if strings.Contains(elem, "|") {
+			elem = "(" + elem + ")"
+		}
+		return elem + "[] | null"
+	case reflect.Struct:
+		return t.Name()
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	}
+	// Every other kind the collector accepts is a number
+	return "number"
+}
+
+func quoted(values []string) []string {
+	quoted := make([]string, len(values))
+	for i, value := range values {
+		quoted[i] = fmt.Sprintf("%q", value)
+	}
+	return quoted
+}
+
+func generateTypescript(c *collector) []byte {
+	var b strings.Builder
+	b.WriteString("// Code generated by protogen. DO NOT EDIT.\n\n")
+	fmt.Fprintf(&b, "export const PROTOCOL_VERSION = %d;\n", protocol.PROTOCOL_VERSION)
+	fmt.Fprintf(&b, "export const MIN_PROTOCOL_VERSION = %d;\n", protocol.MIN_PROTOCOL_VERSION)
+
+	for _, name := range sortedNames(c.enums) {
+		fmt.Fprintf(&b, "\nexport type %s = %s;\n", name, strings.Join(quoted(ENUMS[c.enums[name]]), " | "))
+	}
+
+	for _, name := range sortedNames(c.structs) {
+		t := c.structs[name]
+		tag := playTag(t)
+		fmt.Fprintf(&b, "\nexport interface %s {\n", name)
+		for _, f := range jsonFields(t) {
+			fieldType := typescriptType(f.typ)
+			if tag != "" && f.name == "type" {
+				fieldType = fmt.Sprintf("%q", string(tag))
+			}
+			optional := ""
+			if f.optional {
+				optional = "?"
+			}
+			fmt.Fprintf(&b, "  %s%s: %s;\n", f.name, optional, fieldType)
+		}
+		b.WriteString("}\n")
+	}
+
+	variants := []string{}
+	for _, variant := range PLAYS {
+		variants = append(variants, variant.Type.Name())
+	}
+	fmt.Fprintf(&b, "\nexport type Play = %s;\n", strings.Join(variants, " | "))
+
+	messageTypes := []string{}
+	for _, message := range MESSAGES {
+		messageTypes = append(messageTypes, string(message.Type))
+	}
+	fmt.Fprintf(&b, "\nexport type MessageType = %s;\n", strings.Join(quoted(messageTypes), " | "))
+
+	b.WriteString("\nexport interface Envelope<T extends MessageType, P> {\n")
+	b.WriteString("  type: T;\n  version: number;\n  seq: number;\n  payload: P;\n}\n")
+
+	for _, direction := range []Direction{CLIENT_TO_SERVER, SERVER_TO_CLIENT} {
+		envelopes := []string{}
+		for _, message := range MESSAGES {
+			if message.Direction == direction {
+				envelopes = append(envelopes, fmt.Sprintf("Envelope<%q, %s>", string(message.Type), message.Payload.Name()))
+			}
+		}
+		name := "ClientMessage"
+		if direction == SERVER_TO_CLIENT {
+			name = "ServerMessage"
+		}
+		fmt.Fprintf(&b, "\nexport type %s =\n  | %s;\n", name, strings.Join(envelopes, "\n  | "))
+	}
+	return []byte(b.String())
+}
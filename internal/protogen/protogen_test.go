@@ -0,0 +1,84 @@
+package protogen
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"mexemexe/internal/engine"
+)
+
+const SCHEMA_DIR = "../../schema"
+
+func TestGeneratedFilesUpToDate(t *testing.T) {
+	files, err := Generate()
+	if err != nil {
+		t.Fatalf("Generate() error: %v", err)
+	}
+	for name, want := range files {
+		got, err := os.ReadFile(filepath.Join(SCHEMA_DIR, name))
+		if err != nil {
+			t.Fatalf("reading %s: %v", name, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("schema/%s is out of date, run `go run ./cmd/protogen`", name)
+		}
+	}
+}
+
+func TestSchemaCoversPlays(t *testing.T) {
+	files, err := Generate()
+	if err != nil {
+		t.Fatalf("Generate() error: %v", err)
+	}
+
+	var schema struct {
+		Defs map[string]struct {
+			OneOf      []map[string]string       `json:"oneOf"`
+			Properties map[string]map[string]any `json:"properties"`
+		} `json:"$defs"`
+	}
+	if err := json.Unmarshal(files[SCHEMA_FILE], &schema); err != nil {
+		t.Fatalf("schema is not valid JSON: %v", err)
+	}
+
+	if len(schema.Defs["Play"].OneOf) != len(PLAYS) {
+		t.Errorf("Play has %d variants, want %d", len(schema.Defs["Play"].OneOf), len(PLAYS))
+	}
+	// The type tag of each variant must be what the play encodes to
+	for _, variant := range PLAYS {
+		tag := schema.Defs[variant.Type.Name()].Properties["type"]["const"]
+		if tag != string(variant.Name) {
+			t.Errorf("%s has type tag %v, want %s", variant.Type.Name(), tag, variant.Name)
+		}
+	}
+
+	data, _ := json.Marshal(engine.NewMeldPlay([]engine.Card{}))
+	if !strings.Contains(string(data), `"type":"PLAY_MELD"`) {
+		t.Errorf("MeldPlay encodes to %s", data)
+	}
+}
+
+func TestJsonFields(t *testing.T) {
+	type example struct {
+		Plain    int
+		Renamed  string `json:"renamed"`
+		Optional bool   `json:"optional,omitempty"`
+		Skipped  string `json:"-"`
+		hidden   string
+	}
+
+	fields := jsonFields(reflect.TypeOf(example{}))
+	want := []field{
+		{"Plain", false, reflect.TypeOf(0)},
+		{"renamed", false, reflect.TypeOf("")},
+		{"optional", true, reflect.TypeOf(false)},
+	}
+	if !reflect.DeepEqual(fields, want) {
+		t.Errorf("jsonFields() = %+v, want %+v", fields, want)
+	}
+}
@@ -0,0 +1,80 @@
+// Package rating rates players with the Elo system and tells which ratings
+// are close enough to be matched in a game.
+package rating
+
+import (
+	"math"
+	"time"
+)
+
+// DEFAULT_RATING is the rating of a player who never finished a rated game
+const DEFAULT_RATING = 1500.0
+
+// K_FACTOR is how many points a two player game moves at most
+const K_FACTOR = 32.0
+
+// Scores of a player against an opponent
+const (
+	LOSS = 0.0
+	TIE  = 0.5
+	WIN  = 1.0
+)
+
+// Expected is the score a player rated rating is expected to make against opponent
+func Expected(rating float64, opponent float64) float64 {
+	return 1 / (1 + math.Pow(10, (opponent-rating)/400))
+}
+
+// Update returns the ratings of the players of a game after it ended with the
+// given scores, one for each player. Each player is rated against every
+// other one, the higher score winning, and the K factor is shared among the
+// opponents so a game moves the same number of points whatever its size.
+func Update(ratings []float64, scores []float64) []float64 {
+	updated := make([]float64, len(ratings))
+	copy(updated, ratings)
+	if len(ratings) < 2 {
+		return updated
+	}
+
+	k := K_FACTOR / float64(len(ratings)-1)
+	for i := range ratings {
+		for j := range ratings {
+			if i == j {
+				continue
+			}
+			score := TIE
+			switch {
+			case scores[i] > scores[j]:
+				score = WIN
+			case scores[i] < scores[j]:
+				score = LOSS
+			}
+			updated[i] += k * (score - Expected(ratings[i], ratings[j]))
+		}
+	}
+	return updated
+}
+
+// Window is how far apart in rating players may be to be matched. It starts
+// at Initial and widens by Growth every second the waiting player waits, up
+// to Max. A Max of zero lets it widen without limit.
+type Window struct {
+	Initial float64
+	Growth  float64
+	Max     float64
+}
+
+// Width is the width of the window after waiting for waited
+func (w Window) Width(waited time.Duration) float64 {
+	width := w.Initial + w.Growth*waited.Seconds()
+	if w.Max > 0 && width > w.Max {
+		return w.Max
+	}
+	return width
+}
+
+// Accepts tells if a player rated waiting, who waited for waited, may be
+// matched with a player rated joining
+func (w Window) Accepts(waiting float64, joining float64, waited time.Duration) bool {
+	return math.Abs(waiting-joining) <= w.Width(waited)
+}
@@ -0,0 +1,55 @@
+package rating
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestUpdate(t *testing.T) {
+	// Even players trade half the K factor
+	got := Update([]float64{1500, 1500}, []float64{WIN, LOSS})
+	if got[0] != 1516 || got[1] != 1484 {
+		t.Errorf("Update() of even players = %v, want [1516 1484]", got)
+	}
+
+	// An upset moves more points than an expected win
+	upset := Update([]float64{1400, 1600}, []float64{WIN, LOSS})
+	expected := Update([]float64{1600, 1400}, []float64{WIN, LOSS})
+	if upset[0]-1400 <= expected[0]-1600 {
+		t.Errorf("upset won %.1f points, expected win %.1f", upset[0]-1400, expected[0]-1600)
+	}
+
+	// A tie between even players changes nothing, and points are conserved
+	tie := Update([]float64{1500, 1500, 1500}, []float64{TIE, TIE, TIE})
+	if tie[0] != 1500 || tie[1] != 1500 || tie[2] != 1500 {
+		t.Errorf("Update() of a tie = %v", tie)
+	}
+	three := Update([]float64{1450, 1500, 1620}, []float64{WIN, LOSS, LOSS})
+	if sum := three[0] + three[1] + three[2]; math.Abs(sum-4570) > 1e-9 {
+		t.Errorf("ratings sum to %v after the game, want 4570", sum)
+	}
+}
+
+func TestWindow(t *testing.T) {
+	window := Window{Initial: 100, Growth: 10, Max: 300}
+	tests := []struct {
+		waiting, joining float64
+		waited           time.Duration
+		want             bool
+	}{
+		{1500, 1600, 0, true},
+		{1500, 1650, 0, false},
+		{1500, 1650, 5 * time.Second, true},
+		{1500, 1850, time.Hour, false},
+		{1500, 1200, time.Hour, true},
+	}
+	for _, tt := range tests {
+		if got := window.Accepts(tt.waiting, tt.joining, tt.waited); got != tt.want {
+			t.Errorf("Accepts(%v, %v, %v) = %v, want %v", tt.waiting, tt.joining, tt.waited, got, tt.want)
+		}
+	}
+	if unlimited := (Window{Initial: 100, Growth: 10}); unlimited.Width(time.Hour) != 36100 {
+		t.Errorf("Width() without a max = %v", unlimited.Width(time.Hour))
+	}
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"mexemexe/internal/auth"
+	"strings"
+	"time"
+)
+
+// DEFAULT_SESSION_TTL is how long a session token lets a client log in without its password
+const DEFAULT_SESSION_TTL = 24 * time.Hour
+
+// AuthSettings choose how joining clients are authenticated
+type AuthSettings struct {
+	// Accounts requires players to log in to a local account. Otherwise guests
+	// get in under any free username.
+	Accounts          bool `yaml:"accounts"`
+	AllowRegistration bool `yaml:"allow_registration"`
+	// SessionSecret signs the session tokens. Empty generates one at startup,
+	// so tokens don't survive a restart.
+	SessionSecret string        `yaml:"session_secret"`
+	SessionTTL    time.Duration `yaml:"session_ttl"`
+}
+
+// validate reports every auth setting out of range
+func (a AuthSettings) validate() []error {
+	var errs []error
+	if a.SessionSecret != "" && len(a.SessionSecret) < auth.MIN_SESSION_SECRET_LENGTH {
+		errs = append(errs, fmt.Errorf("session secret must have at least %d characters", auth.MIN_SESSION_SECRET_LENGTH))
+	}
+	if a.SessionTTL <= 0 {
+		errs = append(errs, fmt.Errorf("session TTL must be positive, got %v", a.SessionTTL))
+	}
+	return errs
+}
+
+// newAuthenticator returns the authenticator of the settings, checking
+// passwords against accounts, and the signer of their session tokens
+func (a AuthSettings) newAuthenticator(accounts auth.AccountStore) (auth.Authenticator, *auth.SessionSigner, error) {
+	sessions := auth.NewRandomSessionSigner(a.SessionTTL)
+	if a.SessionSecret != "" {
+		var err error
+		sessions, err = auth.NewSessionSigner([]byte(a.SessionSecret), a.SessionTTL)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if !a.Accounts {
+		return auth.NewGuestAuthenticator(), sessions, nil
+	}
+	return auth.NewLocalAuthenticator(accounts, a.AllowRegistration), sessions, nil
+}
+
+// SetAuthenticator replaces the authenticator chosen by the configuration
+func (s *Server) SetAuthenticator(authenticator auth.Authenticator) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.authenticator = authenticator
+}
+
+// authenticate finds out who a joining client is, from its session token,
+// a new account or its credentials
+func (s *Server) authenticate(joinMsg JoinServerMessage) (auth.Identity, error) {
+	if joinMsg.SessionToken != "" {
+		return s.sessions.Verify(joinMsg.SessionToken, time.Now())
+	}
+
+	s.mu.Lock()
+	authenticator := s.authenticator
+	s.mu.Unlock()
+
+	credentials := auth.Credentials{
+		Username: joinMsg.Username,
+		Password: joinMsg.Password,
+	}
+	if joinMsg.Register {
+		registrar, ok := authenticator.(auth.Registrar)
+		if !ok {
+			return auth.Identity{}, auth.ErrRegistrationClosed
+		}
+		return registrar.Register(credentials)
+	}
+	return authenticator.Authenticate(credentials)
+}
+
+// authErrorMessage tells a client why it could not log in
+func authErrorMessage(err error) string {
+	switch {
+	case errors.Is(err, auth.ErrInvalidUsername):
+		return "Authentication failed. Usernames are 2 to 30 letters, digits or underscores."
+	case errors.Is(err, auth.ErrInvalidCredentials):
+		return "Authentication failed. Wrong username or password."
+	case errors.Is(err, auth.ErrPasswordRequired):
+		return "Authentication failed. This server requires an account: log in with your password or register a new account."
+	case errors.Is(err, auth.ErrSessionExpired), errors.Is(err, auth.ErrInvalidSession):
+		return "Authentication failed. Your session is no longer valid, please log in with your password."
+	case errors.Is(err, auth.ErrUsernameTaken):
+		return "Registration failed. That username is already registered."
+	case errors.Is(err, auth.ErrWeakPassword):
+		return fmt.Sprintf("Registration failed. Passwords must have at least %d characters.", auth.MIN_PASSWORD_LENGTH)
+	case errors.Is(err, auth.ErrRegistrationClosed):
+		return "Registration failed. This server does not accept new accounts."
+	}
+	return "Authentication failed. Please try again later."
+}
+
+// addUniqueClient registers a client unless another connected client uses its
+// username. A client logged in to the same account takes over the older connection.
+func (s *Server) addUniqueClient(newClient *Client) error {
+	s.mu.Lock()
+	var replaced *Client
+	for _, client := range s.Clients {
+		if !strings.EqualFold(client.Username, newClient.Username) {
+			continue
+		}
+		if newClient.UserID == "" || client.UserID != newClient.UserID {
+			s.mu.Unlock()
+			return fmt.Errorf("username %s is already connected", newClient.Username)
+		}
+		replaced = client
+		delete(s.Clients, client.UUID)
+	}
+	s.Clients[newClient.UUID] = newClient
+	s.mu.Unlock()
+
+	if replaced != nil {
+		s.logger.Infof("Client %s logged in again, closing its older connection %s", newClient.Username, replaced.UUID)
+		s.sendNotice(replaced.Conn, "You logged in from another connection.")
+		replaced.Conn.Close()
+	}
+	player := newClient.lobbyPlayer()
+	s.lobby.Publish(LobbyUpdateMessage{Event: LOBBY_PLAYER_UPDATED, Player: &player})
+	return nil
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"mexemexe/internal/engine"
+	"mexemexe/internal/protocol"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Defaults of the chat limits
+const (
+	DEFAULT_CHAT_MAX_LENGTH = 200
+	DEFAULT_CHAT_PER_MINUTE = 20
+	DEFAULT_CHAT_BURST      = 5
+)
+
+// ChatSettings limit what players may say in their game room
+type ChatSettings struct {
+	// MaxLength is the longest message, in characters
+	MaxLength int `yaml:"max_length"`
+	// PerMinute is how many messages a player may send each minute. Zero disables the chat.
+	PerMinute int `yaml:"per_minute"`
+	// Burst is how many messages a player may send at once before being slowed down
+	Burst int `yaml:"burst"`
+	// BlockedWords are masked in every message
+	BlockedWords []string `yaml:"blocked_words"`
+}
+
+// validate reports every chat setting out of range
+func (c ChatSettings) validate() []error {
+	var errs []error
+	if c.MaxLength < 1 {
+		errs = append(errs, fmt.Errorf("chat max length must be at least 1, got %d", c.MaxLength))
+	}
+	if c.PerMinute < 0 {
+		errs = append(errs, fmt.Errorf("chat messages per minute cannot be negative, got %d", c.PerMinute))
+	}
+	if c.Burst < 1 {
+		errs = append(errs, fmt.Errorf("chat burst must be at least 1, got %d", c.Burst))
+	}
+	return errs
+}
+
+// ChatFilter checks a chat message before the room sees it. It returns the
+// text to show, or an error telling the sender why the message was not sent.
+type ChatFilter func(text string) (string, error)
+
+// NewWordFilter returns a filter masking the given words, whatever their case
+func NewWordFilter(words []string) ChatFilter {
+	quoted := []string{}
+	for _, word := range words {
+		if word = strings.TrimSpace(word); word != "" {
+			quoted = append(quoted, regexp.QuoteMeta(word))
+		}
+	}
+	if len(quoted) == 0 {
+		return func(text string) (string, error) {
+			return text, nil
+		}
+	}
+
+	pattern := regexp.MustCompile(`(?i)\b(` + strings.Join(quoted, "|") + `)\b`)
+	return func(text string) (string, error) {
+		return pattern.ReplaceAllStringFunc(text, func(word string) string {
+			return strings.Repeat("*", utf8.RuneCountInString(word))
+		}), nil
+	}
+}
+
+// SetChatFilter replaces the word filter chosen by the configuration
+func (s *Server) SetChatFilter(filter ChatFilter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.chatFilter = filter
+}
+
+// rateLimiter lets through a burst of events, then one every interval
+type rateLimiter struct {
+	tokens   float64
+	burst    float64
+	interval time.Duration
+	last     time.Time
+}
+
+func newRateLimiter(burst int, interval time.Duration) *rateLimiter {
+	return &rateLimiter{
+		tokens:   float64(burst),
+		burst:    float64(burst),
+		interval: interval,
+	}
+}
+
+// Allow tells if an event may happen now, and counts it if so
+func (l *rateLimiter) Allow(now time.Time) bool {
+	if !l.last.IsZero() {
+		l.tokens = min(l.burst, l.tokens+float64(now.Sub(l.last))/float64(l.interval))
+	}
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// chatText returns the text of a chat message, checked against the chat settings
+func (s *Server) chatText(client *Client, chatMsg ChatMessage, now time.Time) (string, error) {
+	settings := s.config.Chat
+	if settings.PerMinute == 0 {
+		return "", errors.New("the chat is disabled on this server")
+	}
+
+	text := strings.TrimSpace(chatMsg.Text)
+	if chatMsg.Emote != "" {
+		emote, ok := engine.FindEmote(chatMsg.Emote)
+		if !ok {
+			return "", fmt.Errorf("there is no %q emote", chatMsg.Emote)
+		}
+		text = emote.Text
+	}
+	if text == "" {
+		return "", errors.New("it is empty")
+	}
+	if utf8.RuneCountInString(text) > settings.MaxLength {
+		return "", fmt.Errorf("it is longer than %d characters", settings.MaxLength)
+	}
+
+	client.mu.Lock()
+	if client.chatLimiter == nil {
+		client.chatLimiter = newRateLimiter(settings.Burst, time.Minute/time.Duration(settings.PerMinute))
+	}
+	allowed := client.chatLimiter.Allow(now)
+	client.mu.Unlock()
+	if !allowed {
+		return "", errors.New("you are sending messages too fast, please wait a moment")
+	}
+
+	s.mu.Lock()
+	filter := s.chatFilter
+	s.mu.Unlock()
+	return filter(text)
+}
+
+// chatHandler returns the handler of the messages sent to the chat of a room.
+// Accepted messages go to everyone in the room and into the replay.
+func (s *Server) chatHandler(room *GameRoom) func(client *Client, chatMsg ChatMessage) {
+	return func(client *Client, chatMsg ChatMessage) {
+		now := time.Now().UTC()
+		text, err := s.chatText(client, chatMsg, now)
+		if err != nil {
+			sendErr := client.Conn.Send(protocol.GAME_MESSAGE, GameMessage{Message: "Message not sent: " + err.Error() + "."})
+			if sendErr != nil {
+				room.logger.Errorf("error refusing chat message of %s: %v", client.Username, sendErr)
+			}
+			return
+		}
+
+		room.mu.Lock()
+		recorder := room.recorder
+		room.mu.Unlock()
+		if recorder != nil {
+			recorder.Record(engine.ReplayEvent{
+				PlayerUUID: client.UUID,
+				Type:       engine.REPLAY_CHAT,
+				Time:       now,
+				Text:       text,
+			})
+		}
+		room.Broadcast(protocol.CHAT_POSTED, ChatPostedMessage{
+			PlayerUUID: client.UUID,
+			Username:   client.Username,
+			Text:       text,
+			Emote:      chatMsg.Emote,
+			Time:       now,
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"mexemexe/internal/engine"
+	"mexemexe/internal/protocol"
+	"mexemexe/internal/service"
+)
+
+func TestWordFilter(t *testing.T) {
+	filter := NewWordFilter([]string{"darn", " heck "})
+	got, err := filter("Darn it, what the HECK. Darnell is fine.")
+	if err != nil || got != "**** it, what the ****. Darnell is fine." {
+		t.Errorf("filter() = %q, %v", got, err)
+	}
+	if got, _ := NewWordFilter(nil)("darn"); got != "darn" {
+		t.Errorf("empty filter changed the text to %q", got)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	limiter := newRateLimiter(2, time.Second)
+	now := time.Now()
+	if !limiter.Allow(now) || !limiter.Allow(now) {
+		t.Fatal("the burst was not allowed")
+	}
+	if limiter.Allow(now.Add(500 * time.Millisecond)) {
+		t.Error("allowed before an interval passed")
+	}
+	if !limiter.Allow(now.Add(time.Second)) {
+		t.Error("not allowed after an interval")
+	}
+}
+
+func TestChatDuringGame(t *testing.T) {
+	config := NewServerConfig(service.LEVEL_ERROR)
+	config.Chat.Burst = 3
+	config.Chat.BlockedWords = []string{"darn"}
+	s, url := newTestServerWithConfig(t, config)
+	alice, bob := dialFakeClient(t, url, "alice"), dialFakeClient(t, url, "bob")
+	alice.join()
+	bob.join()
+	room := startedRooms(t, s, 1)[0]
+
+	posted := func(text string) {
+		t.Helper()
+		for _, client := range []*fakeClient{alice, bob} {
+			var chatMsg ChatPostedMessage
+			client.readUntil(protocol.CHAT_POSTED, &chatMsg)
+			if chatMsg.Text != text {
+				t.Errorf("%s got %q, want %q", client.username, chatMsg.Text, text)
+			}
+		}
+	}
+	refused := func(client *fakeClient, reason string) {
+		t.Helper()
+		var gameMsg GameMessage
+		client.readUntil(protocol.GAME_MESSAGE, &gameMsg)
+		if !strings.Contains(gameMsg.Message, reason) {
+			t.Errorf("%s was told %q, want it to mention %q", client.username, gameMsg.Message, reason)
+		}
+	}
+
+	alice.write(protocol.CHAT, ChatMessage{Text: "  well DARN it "})
+	posted("well **** it")
+	bob.write(protocol.CHAT, ChatMessage{Emote: "gg"})
+	posted("Good game!")
+
+	alice.write(protocol.CHAT, ChatMessage{Text: strings.Repeat("a", DEFAULT_CHAT_MAX_LENGTH+1)})
+	refused(alice, "longer than")
+	alice.write(protocol.CHAT, ChatMessage{Emote: "dance"})
+	refused(alice, "emote")
+	alice.write(protocol.CHAT, ChatMessage{Text: "one"})
+	posted("one")
+	alice.write(protocol.CHAT, ChatMessage{Text: "two"})
+	posted("two")
+	alice.write(protocol.CHAT, ChatMessage{Text: "three"})
+	refused(alice, "too fast")
+
+	// Chatting doesn't get in the way of the game, and goes into its replay
+	var wg sync.WaitGroup
+	for _, client := range []*fakeClient{alice, bob} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client.play()
+		}()
+	}
+	select {
+	case <-room.Done():
+	case <-time.After(TEST_TIMEOUT):
+		t.Fatal("timed out waiting for the game to finish")
+	}
+	alice.ws.Close()
+	bob.ws.Close()
+	wg.Wait()
+
+	chat := []string{}
+	for _, event := range room.recorder.Replay().Events {
+		if event.Type == engine.REPLAY_CHAT {
+			chat = append(chat, event.Text)
+		}
+	}
+	if strings.Join(chat, "|") != "well **** it|Good game!|one|two" {
+		t.Errorf("replay chat = %q", chat)
+	}
+	if room.Game.Deck.Size != 0 {
+		t.Errorf("game finished with %d cards in the deck", room.Game.Deck.Size)
+	}
+}
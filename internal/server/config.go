@@ -1,11 +1,390 @@
 package server
 
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"mexemexe/internal/engine"
+	"mexemexe/internal/protocol"
+	"mexemexe/internal/service"
+	"mexemexe/internal/store"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DEFAULT_PORT is the port the server listens on
+const DEFAULT_PORT = 8888
+
+// DEFAULT_BUFFER_SIZE is the size of the websocket read and write buffers
+const DEFAULT_BUFFER_SIZE = 1024
+
+// DEFAULT_TURN_TIMEOUT is how long a player has to finish their turn
+const DEFAULT_TURN_TIMEOUT = 2 * time.Minute
+
+// ENV_PREFIX prefixes the environment variable of every setting, e.g. MEXE_PORT for -port
+const ENV_PREFIX = "MEXE_"
+
+// CONFIG_FILE_FLAG names the flag, and with ENV_PREFIX the variable, holding the config file path
+const CONFIG_FILE_FLAG = "config"
+
+// REDACTED replaces secrets in the configuration dump
+const REDACTED = "<redacted>"
+
+// DEFAULT_ALLOWED_ORIGINS are the browser origins allowed to open a websocket
+var DEFAULT_ALLOWED_ORIGINS = []string{
+	"https://mexe-mexe.online",
+	"https://www.mexe-mexe.online",
+}
+
+// GameDefaults are the settings of every game started by the server
+type GameDefaults struct {
+	NumCards int `yaml:"cards"`
+	// OpeningMinPoints is the minimum value of a player's first meld. Zero disables the opening rule.
+	OpeningMinPoints int `yaml:"opening_min_points"`
+	// FreezeLeaverHands keeps the hand of a player who leaves a game of three or more out of play, instead of discarding it
+	FreezeLeaverHands bool `yaml:"freeze_leaver_hands"`
+	// DiscardPile makes players end their turn by discarding a card, which the next player may take instead of drawing
+	DiscardPile bool `yaml:"discard_pile"`
+	// TurnTimeout is how long a player has to finish their turn. Zero lets turns last forever.
+	TurnTimeout time.Duration `yaml:"turn_timeout"`
+}
+
+// ServerConfig holds the settings of the server. They are read, from lowest to
+// highest priority, from the defaults, a YAML or JSON file, the environment and
+// the command line.
 type ServerConfig struct {
-	logLevel int
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	Capacity int    `yaml:"capacity"`
+	// AllowedOrigins are the browser origins allowed to connect. Clients that send no origin are always allowed.
+	AllowedOrigins   []string `yaml:"allowed_origins"`
+	AllowLocalhost   bool     `yaml:"allow_localhost"`
+	ReadBufferSize   int      `yaml:"read_buffer_size"`
+	WriteBufferSize  int      `yaml:"write_buffer_size"`
+	SendQueueSize    int      `yaml:"send_queue_size"`
+	ReceiveQueueSize int      `yaml:"receive_queue_size"`
+	LogLevel         string   `yaml:"log_level"`
+	// SnapshotDir is where games in progress are saved. Empty disables snapshots.
+	SnapshotDir string `yaml:"snapshot_dir"`
+	// DataDir keeps the accounts, finished games and stats. Empty keeps them in memory.
+	DataDir             string        `yaml:"data_dir"`
+	DrainTimeout        time.Duration `yaml:"drain_timeout"`
+	RestoredRoomTimeout time.Duration `yaml:"restored_room_timeout"`
+	// RematchTimeout is how long the players have to accept a rematch. Zero disables rematches.
+	RematchTimeout time.Duration `yaml:"rematch_timeout"`
+	// ReconnectGrace is how long a player who lost their connection during a game has to come back. Zero makes them leave at once.
+	ReconnectGrace time.Duration       `yaml:"reconnect_grace"`
+	TLS            TLSSettings         `yaml:"tls"`
+	Auth           AuthSettings        `yaml:"auth"`
+	Game           GameDefaults        `yaml:"game"`
+	Matchmaking    MatchmakingSettings `yaml:"matchmaking"`
+	Chat           ChatSettings        `yaml:"chat"`
 }
 
-func NewServerConfig(logLevel int) *ServerConfig {
+// DefaultServerConfig returns the configuration used when nothing is set
+func DefaultServerConfig() *ServerConfig {
 	return &ServerConfig{
-		logLevel: logLevel,
+		Port:                DEFAULT_PORT,
+		Capacity:            SERVER_CAPACITY,
+		AllowedOrigins:      append([]string{}, DEFAULT_ALLOWED_ORIGINS...),
+		AllowLocalhost:      true,
+		ReadBufferSize:      DEFAULT_BUFFER_SIZE,
+		WriteBufferSize:     DEFAULT_BUFFER_SIZE,
+		SendQueueSize:       protocol.DEFAULT_SEND_QUEUE_SIZE,
+		ReceiveQueueSize:    protocol.DEFAULT_RECEIVE_QUEUE_SIZE,
+		LogLevel:            service.LevelName(service.LEVEL_INFO),
+		DrainTimeout:        SHUTDOWN_DRAIN_TIMEOUT,
+		RestoredRoomTimeout: RESTORED_ROOM_TIMEOUT,
+		RematchTimeout:      DEFAULT_REMATCH_TIMEOUT,
+		ReconnectGrace:      DEFAULT_RECONNECT_GRACE,
+		TLS: TLSSettings{
+			HSTSMaxAge: DEFAULT_HSTS_MAX_AGE,
+		},
+		Auth: AuthSettings{
+			AllowRegistration: true,
+			SessionTTL:        DEFAULT_SESSION_TTL,
+		},
+		Game: GameDefaults{
+			NumCards:    engine.NUM_CARDS,
+			TurnTimeout: DEFAULT_TURN_TIMEOUT,
+		},
+		Matchmaking: MatchmakingSettings{
+			RatingWindow:       DEFAULT_RATING_WINDOW,
+			RatingWindowGrowth: DEFAULT_RATING_WINDOW_GROWTH,
+		},
+		Chat: ChatSettings{
+			MaxLength: DEFAULT_CHAT_MAX_LENGTH,
+			PerMinute: DEFAULT_CHAT_PER_MINUTE,
+			Burst:     DEFAULT_CHAT_BURST,
+		},
+	}
+}
+
+// NewServerConfig returns the default configuration with the given log level
+func NewServerConfig(logLevel int) *ServerConfig {
+	config := DefaultServerConfig()
+	config.LogLevel = service.LevelName(logLevel)
+	return config
+}
+
+// LoadServerConfig builds the configuration from the command line arguments,
+// the environment and the config file named by -config or MEXE_CONFIG
+func LoadServerConfig(args []string, lookupEnv func(string) (string, bool)) (*ServerConfig, error) {
+	// The first pass only finds the config file, and prints the usage on -h
+	var configFile string
+	probe := flag.NewFlagSet("server", flag.ContinueOnError)
+	probe.StringVar(&configFile, CONFIG_FILE_FLAG, "", "YAML or JSON file with the server settings")
+	DefaultServerConfig().defineFlags(probe)
+	probe.Usage = func() {
+		fmt.Fprintln(probe.Output(), "Usage of server:")
+		probe.PrintDefaults()
+		fmt.Fprintf(probe.Output(), "\nEvery flag can also be set in the environment, e.g. %s for -port.\n", service.EnvName(ENV_PREFIX, "port"))
+	}
+	err := probe.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	if configFile == "" {
+		configFile, _ = lookupEnv(service.EnvName(ENV_PREFIX, CONFIG_FILE_FLAG))
+	}
+
+	config := DefaultServerConfig()
+	if configFile != "" {
+		err = config.loadFile(configFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	flags := flag.NewFlagSet("server", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	flags.String(CONFIG_FILE_FLAG, "", "")
+	config.defineFlags(flags)
+
+	err = service.SetFlagsFromEnv(flags, ENV_PREFIX, lookupEnv)
+	if err != nil {
+		return nil, err
+	}
+
+	err = flags.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+
+	err = config.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// defineFlags binds a flag to every setting, with the current value as default
+func (c *ServerConfig) defineFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Host, "host", c.Host, "interface to listen on (empty listens on all)")
+	fs.IntVar(&c.Port, "port", c.Port, "port to listen on")
+	fs.IntVar(&c.Capacity, "capacity", c.Capacity, "maximum number of connected clients")
+	fs.Var((*listFlag)(&c.AllowedOrigins), "allowed-origins", "comma separated browser origins allowed to connect")
+	fs.BoolVar(&c.AllowLocalhost, "allow-localhost", c.AllowLocalhost, "allow browser origins on localhost")
+	fs.IntVar(&c.ReadBufferSize, "read-buffer-size", c.ReadBufferSize, "websocket read buffer size in bytes")
+	fs.IntVar(&c.WriteBufferSize, "write-buffer-size", c.WriteBufferSize, "websocket write buffer size in bytes")
+	fs.IntVar(&c.SendQueueSize, "send-queue-size", c.SendQueueSize, "messages waiting to be written to a client before it is dropped")
+	fs.IntVar(&c.ReceiveQueueSize, "receive-queue-size", c.ReceiveQueueSize, "messages from a client waiting to be handled")
+	fs.StringVar(&c.LogLevel, "log-level", c.LogLevel, "one of "+strings.Join(service.LEVEL_NAMES, ", "))
+	fs.StringVar(&c.SnapshotDir, "snapshots", c.SnapshotDir, "directory where games in progress are saved after every turn and restored from on startup (empty disables)")
+	fs.StringVar(&c.DataDir, "data-dir", c.DataDir, "directory of the accounts, finished games and stats (empty keeps them in memory until the server stops)")
+	fs.DurationVar(&c.DrainTimeout, "drain-timeout", c.DrainTimeout, "how long a shutdown waits for games in progress")
+	fs.DurationVar(&c.RestoredRoomTimeout, "restored-room-timeout", c.RestoredRoomTimeout, "how long a restored game waits for its players to rejoin")
+	fs.DurationVar(&c.RematchTimeout, "rematch-timeout", c.RematchTimeout, "how long the players have to accept a rematch once their game is over (0 disables rematches)")
+	fs.DurationVar(&c.ReconnectGrace, "reconnect-grace", c.ReconnectGrace, "how long a player who lost their connection during a game has to rejoin it before leaving it (0 makes them leave at once)")
+	fs.StringVar(&c.TLS.CertFile, "tls-cert", c.TLS.CertFile, "PEM certificate file, enables HTTPS and wss")
+	fs.StringVar(&c.TLS.KeyFile, "tls-key", c.TLS.KeyFile, "PEM private key file of the certificate")
+	fs.BoolVar(&c.TLS.SelfSigned, "tls-self-signed", c.TLS.SelfSigned, "serve HTTPS with a certificate generated at startup (development only)")
+	fs.IntVar(&c.TLS.RedirectPort, "http-redirect-port", c.TLS.RedirectPort, "plain HTTP port redirecting to HTTPS (0 disables)")
+	fs.DurationVar(&c.TLS.HSTSMaxAge, "hsts-max-age", c.TLS.HSTSMaxAge, "max-age of the Strict-Transport-Security header sent over HTTPS (0 disables)")
+	fs.BoolVar(&c.Auth.Accounts, "accounts", c.Auth.Accounts, "players must log in to an account kept in the data directory (guests are let in otherwise)")
+	fs.BoolVar(&c.Auth.AllowRegistration, "allow-registration", c.Auth.AllowRegistration, "let players create accounts when joining")
+	fs.StringVar(&c.Auth.SessionSecret, "session-secret", c.Auth.SessionSecret, "secret signing the session tokens, at least 32 characters (empty generates one per start)")
+	fs.DurationVar(&c.Auth.SessionTTL, "session-ttl", c.Auth.SessionTTL, "how long a session token logs a player in")
+	fs.IntVar(&c.Game.NumCards, "cards", c.Game.NumCards, "number of cards dealt to each player")
+	fs.IntVar(&c.Game.OpeningMinPoints, "opening", c.Game.OpeningMinPoints, "minimum points of each player's first meld, made only from their hand (0 disables)")
+	fs.BoolVar(&c.Game.FreezeLeaverHands, "freeze-leaver-hands", c.Game.FreezeLeaverHands, "keep the hand of a player who leaves a game of three or more out of play instead of discarding it")
+	fs.BoolVar(&c.Game.DiscardPile, "discard-pile", c.Game.DiscardPile, "end each turn by discarding a card, which the next player may take instead of drawing")
+	fs.DurationVar(&c.Game.TurnTimeout, "turn-timeout", c.Game.TurnTimeout, "how long a player has to finish their turn before it times out (0 disables)")
+	fs.Float64Var(&c.Matchmaking.RatingWindow, "rating-window", c.Matchmaking.RatingWindow, "how far apart in rating matched players may be")
+	fs.Float64Var(&c.Matchmaking.RatingWindowGrowth, "rating-window-growth", c.Matchmaking.RatingWindowGrowth, "rating points the window widens by every second a player waits")
+	fs.Float64Var(&c.Matchmaking.MaxRatingWindow, "max-rating-window", c.Matchmaking.MaxRatingWindow, "widest the rating window gets (0 widens without limit)")
+	fs.IntVar(&c.Chat.MaxLength, "chat-max-length", c.Chat.MaxLength, "longest chat message, in characters")
+	fs.IntVar(&c.Chat.PerMinute, "chat-per-minute", c.Chat.PerMinute, "chat messages each player may send per minute (0 disables the chat)")
+	fs.IntVar(&c.Chat.Burst, "chat-burst", c.Chat.Burst, "chat messages a player may send at once before being slowed down")
+	fs.Var((*listFlag)(&c.Chat.BlockedWords), "chat-blocked-words", "comma separated words masked in chat messages")
+}
+
+// loadFile overrides the settings present in a YAML or JSON file
+func (c *ServerConfig) loadFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("opening config file: %w", err)
+	}
+	defer file.Close()
+
+	// JSON is valid YAML, so one decoder reads both
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+	err = decoder.Decode(c)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("reading config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// Validate reports every setting out of range
+func (c *ServerConfig) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, v ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, v...))
+		}
+	}
+
+	check(c.Port > 0 && c.Port <= 65535, "port %d is out of range", c.Port)
+	check(c.Capacity > 0, "capacity must be positive, got %d", c.Capacity)
+	check(c.ReadBufferSize > 0, "read buffer size must be positive, got %d", c.ReadBufferSize)
+	check(c.WriteBufferSize > 0, "write buffer size must be positive, got %d", c.WriteBufferSize)
+	check(c.SendQueueSize > 0, "send queue size must be positive, got %d", c.SendQueueSize)
+	check(c.ReceiveQueueSize > 0, "receive queue size must be positive, got %d", c.ReceiveQueueSize)
+	check(c.DrainTimeout > 0, "drain timeout must be positive, got %v", c.DrainTimeout)
+	check(c.RestoredRoomTimeout > 0, "restored room timeout must be positive, got %v", c.RestoredRoomTimeout)
+	check(c.RematchTimeout >= 0, "rematch timeout cannot be negative, got %v", c.RematchTimeout)
+	check(c.ReconnectGrace >= 0, "reconnect grace cannot be negative, got %v", c.ReconnectGrace)
+
+	errs = append(errs, c.TLS.validate(c.Port)...)
+	errs = append(errs, c.Auth.validate()...)
+	errs = append(errs, c.Matchmaking.validate()...)
+	errs = append(errs, c.Chat.validate()...)
+
+	_, err := service.ParseLevel(c.LogLevel)
+	check(err == nil, "%v", err)
+
+	for _, origin := range c.AllowedOrigins {
+		u, err := url.Parse(origin)
+		check(err == nil && u.Scheme != "" && u.Host != "" && u.Path == "", "allowed origin %q is not a scheme://host[:port] origin", origin)
+	}
+
+	cards := c.Game.NumCards
+	check(cards >= engine.MIN_MELD_SIZE && engine.NUM_PLAYERS*cards < int(engine.TOTAL_DECK_SIZE),
+		"cannot deal %d cards to %d players from a deck of %d cards", cards, engine.NUM_PLAYERS, engine.TOTAL_DECK_SIZE)
+	check(c.Game.OpeningMinPoints >= 0, "opening minimum points cannot be negative, got %d", c.Game.OpeningMinPoints)
+	check(c.Game.TurnTimeout >= 0, "turn timeout cannot be negative, got %v", c.Game.TurnTimeout)
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid server configuration: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// Addr is the address the server listens on
+func (c *ServerConfig) Addr() string {
+	return net.JoinHostPort(c.Host, strconv.Itoa(c.Port))
+}
+
+// RedirectAddr is the address of the plain HTTP server redirecting to HTTPS
+func (c *ServerConfig) RedirectAddr() string {
+	return net.JoinHostPort(c.Host, strconv.Itoa(c.TLS.RedirectPort))
+}
+
+// Dump renders the configuration as YAML, for logging at startup. Secrets are redacted.
+func (c *ServerConfig) Dump() string {
+	redacted := *c
+	if redacted.Auth.SessionSecret != "" {
+		redacted.Auth.SessionSecret = REDACTED
+	}
+	data, err := yaml.Marshal(redacted)
+	if err != nil {
+		return fmt.Sprintf("%+v", redacted)
+	}
+	return string(data)
+}
+
+func (c *ServerConfig) logLevel() int {
+	level, err := service.ParseLevel(c.LogLevel)
+	if err != nil {
+		return service.LEVEL_INFO
+	}
+	return level
+}
+
+func (c *ServerConfig) connOptions() protocol.ConnOptions {
+	options := protocol.DefaultConnOptions()
+	options.SendQueueSize = c.SendQueueSize
+	options.ReceiveQueueSize = c.ReceiveQueueSize
+	return options
+}
+
+// openStore opens the storage of the data directory, or one in memory
+func (c *ServerConfig) openStore() (store.Store, error) {
+	if c.DataDir == "" {
+		return store.NewMemoryStore(), nil
+	}
+	return store.NewFileStore(c.DataDir)
+}
+
+// newGameConfig returns the configuration of a game between the given players
+func (c *ServerConfig) newGameConfig(playersNames []string, playersUUID []string) *engine.GameConfig {
+	config := engine.NewGameConfig(playersNames, playersUUID)
+	config.NumCards = uint8(c.Game.NumCards)
+	config.Rules.OpeningMinPoints = uint32(c.Game.OpeningMinPoints)
+	config.Rules.FreezeLeaverHands = c.Game.FreezeLeaverHands
+	config.Rules.DiscardPile = c.Game.DiscardPile
+	config.Rules.TurnTimeout = c.Game.TurnTimeout
+	return config
+}
+
+// allowsOrigin tells whether a browser on origin may open a websocket
+func (c *ServerConfig) allowsOrigin(origin string) bool {
+	if origin == "" {
+		return true
+	}
+	if c.AllowLocalhost {
+		u, err := url.Parse(origin)
+		if err == nil {
+			switch u.Hostname() {
+			case "localhost", "127.0.0.1", "::1":
+				return true
+			}
+		}
+	}
+	for _, allowed := range c.AllowedOrigins {
+		if strings.EqualFold(origin, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// listFlag is a comma separated list flag
+type listFlag []string
+
+func (l *listFlag) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
 	}
+	*l = items
+	return nil
 }
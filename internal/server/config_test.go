@@ -0,0 +1,158 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeEnv returns a lookup function over a fixed environment
+func fakeEnv(env map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+}
+
+func writeConfigFile(t *testing.T, name string, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadServerConfigDefaults(t *testing.T) {
+	config, err := LoadServerConfig(nil, fakeEnv(nil))
+	if err != nil {
+		t.Fatalf("LoadServerConfig() error: %v", err)
+	}
+	if !reflect.DeepEqual(config, DefaultServerConfig()) {
+		t.Errorf("config without settings = %+v, want the defaults", config)
+	}
+	if config.Addr() != ":8888" {
+		t.Errorf("Addr() = %q, want :8888", config.Addr())
+	}
+}
+
+func TestLoadServerConfigPrecedence(t *testing.T) {
+	yamlFile := writeConfigFile(t, "server.yaml", `
+port: 9000
+capacity: 50
+log_level: warning
+drain_timeout: 30s
+allowed_origins: [https://example.com]
+game:
+  cards: 15
+  discard_pile: true
+`)
+	config, err := LoadServerConfig(
+		[]string{"-config", yamlFile, "-capacity", "10"},
+		fakeEnv(map[string]string{"MEXE_PORT": "9100", "MEXE_CAPACITY": "20", "MEXE_OPENING": "30"}),
+	)
+	if err != nil {
+		t.Fatalf("LoadServerConfig() error: %v", err)
+	}
+
+	// Flags beat the environment, which beats the file, which beats the defaults
+	if config.Capacity != 10 || config.Port != 9100 || config.LogLevel != "warning" || config.ReadBufferSize != DEFAULT_BUFFER_SIZE {
+		t.Errorf("capacity %d, port %d, log level %s, read buffer %d", config.Capacity, config.Port, config.LogLevel, config.ReadBufferSize)
+	}
+	if config.DrainTimeout != 30*time.Second || !reflect.DeepEqual(config.AllowedOrigins, []string{"https://example.com"}) {
+		t.Errorf("drain timeout %v, allowed origins %v", config.DrainTimeout, config.AllowedOrigins)
+	}
+	if config.Game.NumCards != 15 || config.Game.OpeningMinPoints != 30 {
+		t.Errorf("game defaults %+v", config.Game)
+	}
+
+	game := config.newGameConfig([]string{"alice", "bob"}, []string{"uuid-1", "uuid-2"})
+	if game.NumCards != 15 || game.Rules.OpeningMinPoints != 30 || !game.Rules.DiscardPile {
+		t.Errorf("game config got %d cards, opening %d and discard pile %t", game.NumCards, game.Rules.OpeningMinPoints, game.Rules.DiscardPile)
+	}
+	if game.Rules.TurnTimeout != DEFAULT_TURN_TIMEOUT {
+		t.Errorf("game config got a turn timeout of %v", game.Rules.TurnTimeout)
+	}
+}
+
+func TestLoadServerConfigJSONFileFromEnv(t *testing.T) {
+	jsonFile := writeConfigFile(t, "server.json", `{"port": 7000, "snapshot_dir": "/var/lib/mexe", "data_dir": "/var/lib/mexe/data", "restored_room_timeout": "1m"}`)
+	config, err := LoadServerConfig(nil, fakeEnv(map[string]string{"MEXE_CONFIG": jsonFile}))
+	if err != nil {
+		t.Fatalf("LoadServerConfig() error: %v", err)
+	}
+	if config.Port != 7000 || config.SnapshotDir != "/var/lib/mexe" || config.RestoredRoomTimeout != time.Minute {
+		t.Errorf("port %d, snapshot dir %q, restored room timeout %v", config.Port, config.SnapshotDir, config.RestoredRoomTimeout)
+	}
+	if config.DataDir != "/var/lib/mexe/data" {
+		t.Errorf("data dir %q", config.DataDir)
+	}
+}
+
+func TestLoadServerConfigErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		env  map[string]string
+		file string
+		want string
+	}{
+		{"unknown file key", nil, nil, "prot: 9000", "field prot not found"},
+		{"missing file", []string{"-config", "/nonexistent/server.yaml"}, nil, "", "opening config file"},
+		{"bad env value", nil, map[string]string{"MEXE_PORT": "http"}, "", "MEXE_PORT"},
+		{"unknown flag", []string{"-colour"}, nil, "", "colour"},
+		{"port out of range", []string{"-port", "70000"}, nil, "", "port 70000"},
+		{"max rating window too narrow", []string{"-rating-window", "200", "-max-rating-window", "100"}, nil, "", "narrower than the rating window"},
+		{"chat burst of zero", []string{"-chat-burst", "0"}, nil, "", "chat burst must be at least 1"},
+		{"unknown log level", []string{"-log-level", "loud"}, nil, "", "unknown log level"},
+		{"bad origin", []string{"-allowed-origins", "example.com"}, nil, "", "allowed origin"},
+		{"too many cards", []string{"-cards", "60"}, nil, "", "cannot deal 60 cards"},
+		{"certificate without key", []string{"-tls-cert", "cert.pem"}, nil, "", "both a certificate and a key"},
+		{"redirect without TLS", []string{"-http-redirect-port", "80"}, nil, "", "needs TLS enabled"},
+		{"redirect on the server port", []string{"-tls-self-signed", "-http-redirect-port", "8888"}, nil, "", "same as the server port"},
+		{"no drain timeout", nil, map[string]string{"MEXE_DRAIN_TIMEOUT": "0s"}, "", "drain timeout"},
+		{"negative rematch timeout", []string{"-rematch-timeout", "-1s"}, nil, "", "rematch timeout cannot be negative"},
+		{"negative reconnect grace", []string{"-reconnect-grace", "-1s"}, nil, "", "reconnect grace cannot be negative"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := tt.args
+			if tt.file != "" {
+				args = append([]string{"-config", writeConfigFile(t, "server.yaml", tt.file)}, args...)
+			}
+			_, err := LoadServerConfig(args, fakeEnv(tt.env))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("LoadServerConfig() error = %v, want it to mention %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestAllowsOrigin(t *testing.T) {
+	config := DefaultServerConfig()
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{"", true},
+		{"https://mexe-mexe.online", true},
+		{"http://localhost:3000", true},
+		{"http://127.0.0.1:8080", true},
+		{"https://localhost.evil.example", false},
+		{"https://example.com", false},
+	}
+	for _, tt := range tests {
+		if got := config.allowsOrigin(tt.origin); got != tt.want {
+			t.Errorf("allowsOrigin(%q) = %v, want %v", tt.origin, got, tt.want)
+		}
+	}
+
+	config.AllowLocalhost = false
+	if config.allowsOrigin("http://localhost:3000") {
+		t.Error("localhost allowed with AllowLocalhost off")
+	}
+}
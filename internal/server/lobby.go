@@ -0,0 +1,310 @@
+package server
+
+import (
+	"fmt"
+	"mexemexe/internal/protocol"
+	"mexemexe/internal/service"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Statuses of the players online, as the lobby shows them
+const (
+	STATUS_IDLE       = "idle"
+	STATUS_SEARCHING  = "searching"
+	STATUS_WAITING    = "waiting"
+	STATUS_PLAYING    = "playing"
+	STATUS_SPECTATING = "spectating"
+)
+
+// Statuses of the rooms, as the lobby shows them
+const (
+	// ROOM_OPEN rooms were created from the lobby and wait for players to join
+	ROOM_OPEN = "open"
+	// ROOM_RUNNING rooms have a game in progress, open to spectators
+	ROOM_RUNNING = "running"
+	// ROOM_RESTORING rooms hold a game restored after a restart, waiting for its players
+	ROOM_RESTORING = "restoring"
+)
+
+// Events of the lobby updates
+const (
+	LOBBY_ROOM_UPDATED   = "room_updated"
+	LOBBY_ROOM_REMOVED   = "room_removed"
+	LOBBY_PLAYER_UPDATED = "player_updated"
+	LOBBY_PLAYER_OFFLINE = "player_offline"
+)
+
+// Lobby pushes the changes of the rooms and players online to the clients
+// subscribed to it
+type Lobby struct {
+	subscribers map[*Client]bool
+	mu          sync.Mutex
+	logger      *service.GameLogger
+}
+
+func NewLobby(logger *service.GameLogger) *Lobby {
+	return &Lobby{
+		subscribers: make(map[*Client]bool),
+		logger:      logger,
+	}
+}
+
+// Subscribe sends the client the lobby returned by snapshot, then every update
+// published after it
+func (l *Lobby) Subscribe(client *Client, snapshot func() LobbyMessage) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.subscribers[client] = true
+	return client.Conn.Send(protocol.LOBBY, snapshot())
+}
+
+// Unsubscribe stops the updates to the client
+func (l *Lobby) Unsubscribe(client *Client) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.subscribers, client)
+}
+
+// Publish sends an update to every subscriber
+func (l *Lobby) Publish(update LobbyUpdateMessage) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for client := range l.subscribers {
+		err := client.Conn.Send(protocol.LOBBY_UPDATE, update)
+		if err != nil {
+			l.logger.Errorf("error sending lobby update to %s: %v", client.Username, err)
+		}
+	}
+}
+
+// lobbySnapshot lists the rooms and players online
+func (s *Server) lobbySnapshot() LobbyMessage {
+	s.mu.Lock()
+	rooms := make([]*GameRoom, 0, len(s.Rooms))
+	for _, room := range s.Rooms {
+		rooms = append(rooms, room)
+	}
+	clients := make([]*Client, 0, len(s.Clients))
+	for _, client := range s.Clients {
+		clients = append(clients, client)
+	}
+	s.mu.Unlock()
+
+	lobby := LobbyMessage{
+		Rooms:   make([]LobbyRoom, len(rooms)),
+		Players: make([]LobbyPlayer, len(clients)),
+	}
+	for i, room := range rooms {
+		lobby.Rooms[i] = room.lobbyRoom()
+	}
+	for i, client := range clients {
+		lobby.Players[i] = client.lobbyPlayer()
+	}
+	sort.Slice(lobby.Rooms, func(i, j int) bool {
+		return lobby.Rooms[i].UUID < lobby.Rooms[j].UUID
+	})
+	sort.Slice(lobby.Players, func(i, j int) bool {
+		return strings.ToLower(lobby.Players[i].Username) < strings.ToLower(lobby.Players[j].Username)
+	})
+	return lobby
+}
+
+// publishRoom tells the lobby a room was added or changed
+func (s *Server) publishRoom(room *GameRoom) {
+	lobbyRoom := room.lobbyRoom()
+	s.lobby.Publish(LobbyUpdateMessage{Event: LOBBY_ROOM_UPDATED, Room: &lobbyRoom})
+}
+
+// setStatus changes what the client is doing, as the lobby shows it
+func (s *Server) setStatus(client *Client, status string) {
+	client.mu.Lock()
+	client.status = status
+	client.mu.Unlock()
+	player := client.lobbyPlayer()
+	s.lobby.Publish(LobbyUpdateMessage{Event: LOBBY_PLAYER_UPDATED, Player: &player})
+}
+
+// handleLobbyMessages registers the handlers of the lobby messages a client
+// may send whenever it is not playing
+func (s *Server) handleLobbyMessages(dispatcher *protocol.Dispatcher, client *Client) {
+	dispatcher.Handle(protocol.RATING_REQUEST, func(envelope protocol.Envelope) error {
+		var request RatingRequestMessage
+		err := envelope.Decode(&request)
+		if err != nil {
+			return err
+		}
+		return s.handleRatingRequest(client, request)
+	})
+	dispatcher.Handle(protocol.LOBBY_SUBSCRIBE, func(envelope protocol.Envelope) error {
+		return s.lobby.Subscribe(client, s.lobbySnapshot)
+	})
+	dispatcher.Handle(protocol.LOBBY_UNSUBSCRIBE, func(envelope protocol.Envelope) error {
+		s.lobby.Unsubscribe(client)
+		return nil
+	})
+}
+
+// findRoom returns the room with the given UUID
+func (s *Server) findRoom(roomUUID string) (*GameRoom, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	room, ok := s.Rooms[roomUUID]
+	if !ok {
+		return nil, fmt.Errorf("there is no room %s", roomUUID)
+	}
+	return room, nil
+}
+
+// handleCreateRoom opens a room listed in the lobby for the game asked for,
+// and waits in it for other players to join
+func (s *Server) handleCreateRoom(client *Client, startMsg StartGameMessage) (*GameRoom, error) {
+	if s.IsDraining() {
+		s.sendError(client.Conn, SERVER_RESTARTING_MESSAGE)
+		return nil, fmt.Errorf("server is shutting down")
+	}
+	key, err := s.queueKey(startMsg)
+	if err != nil {
+		s.sendError(client.Conn, "Can't create that game: "+err.Error()+".")
+		return nil, err
+	}
+
+	room := NewGameRoom(s.config.logLevel())
+	room.Mode = key.Mode
+	room.Capacity = uint8(key.Players)
+	room.open = true
+	room.AddClient(client)
+	s.AddRoom(room)
+	s.logger.Infof("Client %s created room %s for a %s game of %d players", client.UUID, room.UUID, key.Mode, key.Players)
+	return s.waitInOpenRoom(client, room, fmt.Sprintf("Created room %s. Waiting for %d more players to join ...", room.UUID, key.Players-1))
+}
+
+// handleJoinRoom takes a seat in an open room of the lobby, starting its game
+// once it is full. A client refused a seat stays in the lobby.
+func (s *Server) handleJoinRoom(client *Client, startMsg StartGameMessage) (*GameRoom, error) {
+	room, err := s.findRoom(startMsg.RoomUUID)
+	if err == nil {
+		err = room.join(client)
+	}
+	if err != nil {
+		s.sendError(client.Conn, "Can't join that room: "+err.Error()+".")
+		return nil, nil
+	}
+	s.logger.Infof("Client %s joined room %s", client.UUID, room.UUID)
+	s.publishRoom(room)
+
+	if room.isSealed() {
+		joinedMsg := JoinedGameRoomMessage{Message: "Joined the room. The game is starting ...", RoomUUID: room.UUID}
+		err = client.Conn.Send(protocol.JOINED_GAME_ROOM, joinedMsg)
+		if err != nil {
+			s.logger.Errorf("error writing joined message: %v", err)
+		}
+		s.startGameInRoom(room)
+		return room, nil
+	}
+	return s.waitInOpenRoom(client, room, "Joined the room. Waiting for more players to join ...")
+}
+
+// waitInOpenRoom waits until the open room of the client is full and its game
+// starts, answering the lobby messages meanwhile. A client that cancels or
+// disconnects leaves the room, which closes once nobody is left in it. The
+// game reads no play before stayInRoom hands the client off to the room, so
+// none is read here.
+func (s *Server) waitInOpenRoom(client *Client, room *GameRoom, message string) (*GameRoom, error) {
+	s.setStatus(client, STATUS_WAITING)
+	err := client.Conn.Send(protocol.JOINED_GAME_ROOM, JoinedGameRoomMessage{Message: message, RoomUUID: room.UUID})
+	if err != nil {
+		s.logger.Errorf("error writing joined message: %v", err)
+	}
+
+	cancelled := false
+	dispatcher := protocol.NewDispatcher()
+	s.handleLobbyMessages(dispatcher, client)
+	dispatcher.Handle(protocol.START_GAME, func(envelope protocol.Envelope) error {
+		var startMsg StartGameMessage
+		err := envelope.Decode(&startMsg)
+		if err != nil {
+			return err
+		}
+		if startMsg.Action != "cancel" {
+			s.sendError(client.Conn, "You are already waiting in a room, cancel first.")
+			return nil
+		}
+		cancelled = true
+		return nil
+	})
+
+	for !cancelled {
+		select {
+		case <-room.Started():
+			return room, nil
+
+		case envelope, ok := <-client.Conn.Messages():
+			if ok {
+				err = dispatcher.Dispatch(envelope)
+			}
+			if !ok || err != nil {
+				if s.leaveOpenRoom(room, client) {
+					return nil, fmt.Errorf("client %s left room %s: %v", client.UUID, room.UUID, client.Conn.Err())
+				}
+				<-room.Started()
+				return room, nil
+			}
+		}
+	}
+
+	if !s.leaveOpenRoom(room, client) {
+		s.logger.Infof("Client %s left room %s too late, its game is starting", client.UUID, room.UUID)
+		<-room.Started()
+		return room, nil
+	}
+	s.setStatus(client, STATUS_IDLE)
+	err = client.Conn.Send(protocol.SEARCH_CANCELLED, SearchCancelledMessage{
+		Message: "You left the room.",
+	})
+	return nil, err
+}
+
+// leaveOpenRoom takes a client out of an open room, closing the room once
+// empty. It returns false if the game of the room is already starting.
+func (s *Server) leaveOpenRoom(room *GameRoom, client *Client) bool {
+	left, empty := room.leave(client)
+	if !left {
+		return false
+	}
+	if empty {
+		s.RemoveRoom(room)
+		return true
+	}
+	s.publishRoom(room)
+	return true
+}
+
+// handleSpectate lets a client watch the game of a running room. A client
+// refused stays in the lobby.
+func (s *Server) handleSpectate(client *Client, startMsg StartGameMessage) (*GameRoom, error) {
+	room, err := s.findRoom(startMsg.RoomUUID)
+	if err == nil {
+		err = room.AddSpectator(client)
+	}
+	if err != nil {
+		s.sendError(client.Conn, "Can't watch that room: "+err.Error()+".")
+		return nil, nil
+	}
+	s.logger.Infof("Client %s is watching room %s", client.UUID, room.UUID)
+	s.lobby.Unsubscribe(client)
+	s.setStatus(client, STATUS_SPECTATING)
+	s.publishRoom(room)
+
+	joinedMsg := JoinedGameRoomMessage{
+		Message:  "Watching the game.",
+		RoomUUID: room.UUID,
+	}
+	err = client.Conn.Send(protocol.JOINED_GAME_ROOM, joinedMsg)
+	if err != nil {
+		return room, err
+	}
+	room.sendSpectatorState(client)
+	return room, nil
+}
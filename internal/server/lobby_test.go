@@ -0,0 +1,243 @@
+package server
+
+import (
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"mexemexe/internal/engine"
+	"mexemexe/internal/protocol"
+	"mexemexe/internal/service"
+)
+
+// lobbyUntil reads lobby updates until one matches
+func (c *fakeClient) lobbyUntil(match func(update LobbyUpdateMessage) bool) LobbyUpdateMessage {
+	c.t.Helper()
+	for {
+		var update LobbyUpdateMessage
+		c.readUntil(protocol.LOBBY_UPDATE, &update)
+		if match(update) {
+			return update
+		}
+	}
+}
+
+// createRoom opens a room in the lobby and returns its UUID
+func (c *fakeClient) createRoom() string {
+	c.t.Helper()
+	c.write(protocol.START_GAME, StartGameMessage{Action: "create"})
+	var joinedMsg JoinedGameRoomMessage
+	c.readUntil(protocol.JOINED_GAME_ROOM, &joinedMsg)
+	if joinedMsg.RoomUUID == "" {
+		c.t.Fatalf("%s: created a room without UUID: %+v", c.username, joinedMsg)
+	}
+	return joinedMsg.RoomUUID
+}
+
+func TestLobbyPushesRoomsAndPlayers(t *testing.T) {
+	config := NewServerConfig(service.LEVEL_ERROR)
+	config.ReconnectGrace = 0
+	s, url := newTestServerWithConfig(t, config)
+	carol := dialFakeClient(t, url, "carol")
+	carol.welcome()
+	carol.write(protocol.LOBBY_SUBSCRIBE, LobbySubscribeMessage{})
+	var lobby LobbyMessage
+	carol.read(protocol.LOBBY, &lobby)
+	if len(lobby.Rooms) != 0 || len(lobby.Players) != 1 || lobby.Players[0] != (LobbyPlayer{"carol", STATUS_IDLE}) {
+		t.Fatalf("lobby = %+v", lobby)
+	}
+
+	alice := dialFakeClient(t, url, "alice")
+	alice.welcome()
+	carol.lobbyUntil(func(update LobbyUpdateMessage) bool {
+		return update.Event == LOBBY_PLAYER_UPDATED && *update.Player == LobbyPlayer{"alice", STATUS_IDLE}
+	})
+
+	roomUUID := alice.createRoom()
+	update := carol.lobbyUntil(func(update LobbyUpdateMessage) bool {
+		return update.Event == LOBBY_ROOM_UPDATED
+	})
+	if update.Room.UUID != roomUUID || update.Room.Status != ROOM_OPEN || !slices.Equal(update.Room.Players, []string{"alice"}) {
+		t.Errorf("created room = %+v", update.Room)
+	}
+	carol.lobbyUntil(func(update LobbyUpdateMessage) bool {
+		return update.Event == LOBBY_PLAYER_UPDATED && *update.Player == LobbyPlayer{"alice", STATUS_WAITING}
+	})
+
+	// Bob takes the last seat and the game starts
+	bob := dialFakeClient(t, url, "bob")
+	bob.welcome()
+	bob.write(protocol.START_GAME, StartGameMessage{Action: "join", RoomUUID: roomUUID})
+	var state GameStateMessage
+	bob.readUntil(protocol.GAME_STATE, &state)
+	alice.readUntil(protocol.GAME_STATE, &state)
+	update = carol.lobbyUntil(func(update LobbyUpdateMessage) bool {
+		return update.Event == LOBBY_ROOM_UPDATED && update.Room.Status == ROOM_RUNNING
+	})
+	if !slices.Equal(update.Room.Players, []string{"alice", "bob"}) || update.Room.Mode != MODE_CLASSIC {
+		t.Errorf("running room = %+v", update.Room)
+	}
+
+	// A fresh snapshot lists everyone
+	carol.write(protocol.LOBBY_SUBSCRIBE, LobbySubscribeMessage{})
+	carol.readUntil(protocol.LOBBY, &lobby)
+	want := []LobbyPlayer{{"alice", STATUS_PLAYING}, {"bob", STATUS_PLAYING}, {"carol", STATUS_IDLE}}
+	if len(lobby.Rooms) != 1 || !slices.Equal(lobby.Players, want) {
+		t.Errorf("lobby = %+v", lobby)
+	}
+
+	// The game ends once bob is gone and his turn comes: its room closes and bob is offline
+	alice.states = append(alice.states, state)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		alice.play()
+	}()
+	bob.ws.Close()
+	removed, offline := false, false
+	carol.lobbyUntil(func(update LobbyUpdateMessage) bool {
+		removed = removed || (update.Event == LOBBY_ROOM_REMOVED && update.Room.UUID == roomUUID)
+		offline = offline || (update.Event == LOBBY_PLAYER_OFFLINE && update.Player.Username == "bob")
+		return removed && offline
+	})
+	wg.Wait()
+	if rooms := s.lobbySnapshot().Rooms; len(rooms) != 0 {
+		t.Errorf("rooms = %+v", rooms)
+	}
+}
+
+func TestSpectateRunningRoom(t *testing.T) {
+	s, url := newTestServer(t)
+	alice := dialFakeClient(t, url, "alice")
+	alice.welcome()
+	roomUUID := alice.createRoom()
+
+	// Nobody watches a game that has not started
+	carol := dialFakeClient(t, url, "carol")
+	carol.welcome()
+	carol.write(protocol.START_GAME, StartGameMessage{Action: "spectate", RoomUUID: roomUUID})
+	var errorMsg ErrorMessage
+	carol.read(protocol.ERROR, &errorMsg)
+
+	bob := dialFakeClient(t, url, "bob")
+	bob.welcome()
+	bob.write(protocol.START_GAME, StartGameMessage{Action: "join", RoomUUID: roomUUID})
+	room := startedRooms(t, s, 1)[0]
+
+	carol.write(protocol.START_GAME, StartGameMessage{Action: "spectate", RoomUUID: roomUUID})
+	var joinedMsg JoinedGameRoomMessage
+	carol.read(protocol.JOINED_GAME_ROOM, &joinedMsg)
+	if joinedMsg.RoomUUID != roomUUID {
+		t.Errorf("watching room %q, want %s", joinedMsg.RoomUUID, roomUUID)
+	}
+	if lobbyRoom := room.lobbyRoom(); lobbyRoom.Spectators != 1 {
+		t.Errorf("room = %+v", lobbyRoom)
+	}
+
+	// The table shows before anyone plays
+	var state GameStateMessage
+	carol.read(protocol.GAME_STATE, &state)
+	if len(state.Hand.Cards) != 0 || state.Turn.PlayerUUID == "" {
+		t.Errorf("spectator state = %+v", state)
+	}
+
+	var wg sync.WaitGroup
+	for _, player := range []*fakeClient{alice, bob} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			player.play()
+		}()
+	}
+	carol.readUntil(protocol.GAME_STATE, &state)
+	if len(state.Hand.Cards) != 0 || state.Turn.PlayerUUID == "" {
+		t.Errorf("spectator state = %+v", state)
+	}
+
+	// A spectator can't play, and leaves by disconnecting
+	carol.write(protocol.GAME_PLAY, GamePlayMessage{})
+	carol.ws.Close()
+	waitFor(t, "the spectator to leave", func() bool {
+		return room.lobbyRoom().Spectators == 0
+	})
+	wg.Wait()
+}
+
+func TestJoinAndLeaveOpenRooms(t *testing.T) {
+	s, url := newTestServer(t)
+	alice := dialFakeClient(t, url, "alice")
+	alice.welcome()
+	bob := dialFakeClient(t, url, "bob")
+	bob.welcome()
+
+	// A missing room is refused, without dropping the client
+	bob.write(protocol.START_GAME, StartGameMessage{Action: "join", RoomUUID: "no-such-room"})
+	var errorMsg ErrorMessage
+	bob.read(protocol.ERROR, &errorMsg)
+
+	// Alice leaves her room, which closes with nobody left in it
+	roomUUID := alice.createRoom()
+	alice.write(protocol.START_GAME, StartGameMessage{Action: "cancel"})
+	var cancelledMsg SearchCancelledMessage
+	alice.readUntil(protocol.SEARCH_CANCELLED, &cancelledMsg)
+	if _, err := s.findRoom(roomUUID); err == nil {
+		t.Errorf("empty room %s is still open", roomUUID)
+	}
+	bob.write(protocol.START_GAME, StartGameMessage{Action: "join", RoomUUID: roomUUID})
+	bob.read(protocol.ERROR, &errorMsg)
+
+	// Then she opens a room for three players, where bob waits with her
+	alice.write(protocol.START_GAME, StartGameMessage{Action: "create", Players: 3})
+	var joinedMsg JoinedGameRoomMessage
+	alice.read(protocol.JOINED_GAME_ROOM, &joinedMsg)
+	bob.write(protocol.START_GAME, StartGameMessage{Action: "join", RoomUUID: joinedMsg.RoomUUID})
+	bob.read(protocol.JOINED_GAME_ROOM, &joinedMsg)
+	room, err := s.findRoom(joinedMsg.RoomUUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lobbyRoom := room.lobbyRoom(); lobbyRoom.Capacity != 3 || !slices.Equal(lobbyRoom.Players, []string{"alice", "bob"}) {
+		t.Errorf("room = %+v", lobbyRoom)
+	}
+
+	// Bob drops out: his seat is free again and the room stays open for alice
+	bob.ws.Close()
+	waitFor(t, "bob to leave the room", func() bool {
+		return slices.Equal(room.lobbyRoom().Players, []string{"alice"})
+	})
+	if room.lobbyRoom().Status != ROOM_OPEN {
+		t.Errorf("room = %+v", room.lobbyRoom())
+	}
+}
+
+func TestFirstPlayInOpenRoom(t *testing.T) {
+	for range 5 {
+		_, url := newTestServer(t)
+		alice := dialFakeClient(t, url, "alice")
+		alice.welcome()
+		bob := dialFakeClient(t, url, "bob")
+		bob.welcome()
+
+		roomUUID := alice.createRoom()
+		bob.write(protocol.START_GAME, StartGameMessage{Action: "join", RoomUUID: roomUUID})
+		firstPlayReachesGame(t, []*fakeClient{alice, bob})
+	}
+}
+
+func TestGameWithoutAllItsPlayersIsOver(t *testing.T) {
+	s := NewServer(NewServerConfig(service.LEVEL_ERROR))
+	room := NewGameRoom(service.LEVEL_ERROR)
+	room.AddClient(&Client{UUID: "uuid-alice", Username: "alice", Conn: discardConn(t)})
+	config := s.config.newGameConfig([]string{"alice", "bob"}, []string{"uuid-alice", "uuid-bob"})
+	room.AddGame(engine.NewGame(config, room.logger))
+	s.AddRoom(room)
+	s.runGame(room)
+
+	select {
+	case <-room.Finished():
+	case <-time.After(TEST_TIMEOUT):
+		t.Fatal("the room never closed")
+	}
+}
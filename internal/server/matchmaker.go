@@ -0,0 +1,295 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"mexemexe/internal/engine"
+	"mexemexe/internal/protocol"
+	"mexemexe/internal/rating"
+	"mexemexe/internal/service"
+	"slices"
+	"time"
+)
+
+// MODE_CLASSIC is the game mode played with the rules set by the server configuration
+const MODE_CLASSIC = "classic"
+
+// MODES lists the game modes players can queue for
+var MODES = []string{MODE_CLASSIC}
+
+// MAX_PLAYERS is the largest game players can queue for
+const MAX_PLAYERS = 4
+
+// MATCHMAKING_TICK is how often the queues are matched again, as the rating windows widen
+const MATCHMAKING_TICK = time.Second
+
+// ErrMatchmakerStopped is returned when queueing after the matchmaker stopped
+var ErrMatchmakerStopped = errors.New("matchmaker stopped")
+
+// QueueKey tells which queue a player waits in: players only meet others
+// asking for the same mode and game size
+type QueueKey struct {
+	Mode    string
+	Players int
+}
+
+// Ticket is the place of a client in a matchmaking queue
+type Ticket struct {
+	client   *Client
+	key      QueueKey
+	enqueued time.Time
+	// position is the last position the client was told, 0 before the first update
+	position int
+	matched  chan *GameRoom
+}
+
+// Matched returns a channel that receives the room of the ticket once it is
+// matched, or nil if the client was found disconnected
+func (t *Ticket) Matched() <-chan *GameRoom {
+	return t.matched
+}
+
+type cancelRequest struct {
+	ticket *Ticket
+	reply  chan bool
+}
+
+// Matchmaker groups waiting clients into games. A single goroutine owns the
+// queues, so a client is never placed in two games and every group is started
+// as a whole.
+type Matchmaker struct {
+	window rating.Window
+	// start creates the room of a matched group and starts its game. It runs
+	// on the matchmaker goroutine.
+	start   func(key QueueKey, clients []*Client) *GameRoom
+	queues  map[QueueKey][]*Ticket
+	enqueue chan *Ticket
+	cancel  chan cancelRequest
+	stop    chan chan []*Client
+	done    chan struct{}
+	logger  *service.GameLogger
+}
+
+// NewMatchmaker starts a matchmaker calling start for every matched group
+func NewMatchmaker(window rating.Window, start func(key QueueKey, clients []*Client) *GameRoom, logger *service.GameLogger) *Matchmaker {
+	m := &Matchmaker{
+		window:  window,
+		start:   start,
+		queues:  make(map[QueueKey][]*Ticket),
+		enqueue: make(chan *Ticket),
+		cancel:  make(chan cancelRequest),
+		stop:    make(chan chan []*Client),
+		done:    make(chan struct{}),
+		logger:  logger,
+	}
+	go m.run()
+	return m
+}
+
+// Enqueue puts a client in the queue of key, at the rating the client has when queueing
+func (m *Matchmaker) Enqueue(client *Client, key QueueKey) (*Ticket, error) {
+	ticket := &Ticket{
+		client:   client,
+		key:      key,
+		enqueued: time.Now(),
+		matched:  make(chan *GameRoom, 1),
+	}
+	select {
+	case m.enqueue <- ticket:
+		return ticket, nil
+	case <-m.done:
+		return nil, ErrMatchmakerStopped
+	}
+}
+
+// Cancel takes a ticket out of its queue. It returns false if the ticket was
+// matched in the meantime, its room then waiting in Matched.
+func (m *Matchmaker) Cancel(ticket *Ticket) bool {
+	request := cancelRequest{
+		ticket: ticket,
+		reply:  make(chan bool, 1),
+	}
+	select {
+	case m.cancel <- request:
+		return <-request.reply
+	case <-m.done:
+		return len(ticket.matched) == 0
+	}
+}
+
+// Stop stops matching and returns the clients still waiting
+func (m *Matchmaker) Stop() []*Client {
+	reply := make(chan []*Client, 1)
+	select {
+	case m.stop <- reply:
+		return <-reply
+	case <-m.done:
+		return nil
+	}
+}
+
+func (m *Matchmaker) run() {
+	defer close(m.done)
+	ticker := time.NewTicker(MATCHMAKING_TICK)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case ticket := <-m.enqueue:
+			m.queues[ticket.key] = append(m.queues[ticket.key], ticket)
+			m.match(ticket.key)
+
+		case request := <-m.cancel:
+			queue := m.queues[request.ticket.key]
+			i := slices.Index(queue, request.ticket)
+			if i >= 0 {
+				m.queues[request.ticket.key] = slices.Delete(queue, i, i+1)
+				m.sendPositions(request.ticket.key)
+			}
+			request.reply <- i >= 0
+
+		case <-ticker.C:
+			for key := range m.queues {
+				m.match(key)
+			}
+
+		case reply := <-m.stop:
+			waiting := []*Client{}
+			for _, queue := range m.queues {
+				for _, ticket := range queue {
+					waiting = append(waiting, ticket.client)
+				}
+			}
+			reply <- waiting
+			return
+		}
+	}
+}
+
+// match starts a game for every group of the queue close enough in rating.
+// The longest waiting clients are served first. Disconnected clients are
+// dropped first, so every game starts with all its players connected.
+func (m *Matchmaker) match(key QueueKey) {
+	queue := slices.DeleteFunc(m.queues[key], func(ticket *Ticket) bool {
+		if ticket.client.IsConnected() {
+			return false
+		}
+		m.logger.Infof("Dropping disconnected client %s from the %s queue", ticket.client.UUID, key.Mode)
+		ticket.matched <- nil
+		return true
+	})
+	now := time.Now()
+	for anchor := 0; anchor < len(queue); anchor++ {
+		group := []int{anchor}
+		for i := anchor + 1; i < len(queue) && len(group) < key.Players; i++ {
+			if m.fitsGroup(queue, group, i, now) {
+				group = append(group, i)
+			}
+		}
+		if len(group) < key.Players {
+			continue
+		}
+
+		clients := make([]*Client, len(group))
+		matched := make(map[*Ticket]bool, len(group))
+		for i, index := range group {
+			clients[i] = queue[index].client
+			matched[queue[index]] = true
+		}
+		room := m.start(key, clients)
+		for ticket := range matched {
+			ticket.matched <- room
+		}
+		queue = slices.DeleteFunc(queue, func(ticket *Ticket) bool {
+			return matched[ticket]
+		})
+		anchor--
+	}
+
+	if len(queue) == 0 {
+		delete(m.queues, key)
+		return
+	}
+	m.queues[key] = queue
+	m.sendPositions(key)
+}
+
+// fitsGroup tells if the ticket at index candidate is close enough in rating
+// to every ticket of the group. Each pair uses the window of the one of them
+// who waited the longest.
+func (m *Matchmaker) fitsGroup(queue []*Ticket, group []int, candidate int, now time.Time) bool {
+	for _, index := range group {
+		earliest := queue[index].enqueued
+		if queue[candidate].enqueued.Before(earliest) {
+			earliest = queue[candidate].enqueued
+		}
+		waited := now.Sub(earliest)
+		if !m.window.Accepts(queue[index].client.Rating, queue[candidate].client.Rating, waited) {
+			return false
+		}
+	}
+	return true
+}
+
+// sendPositions tells the clients of the queue whose position changed where they stand
+func (m *Matchmaker) sendPositions(key QueueKey) {
+	queue := m.queues[key]
+	for i, ticket := range queue {
+		if ticket.position == i+1 {
+			continue
+		}
+		ticket.position = i + 1
+		update := QueueUpdateMessage{
+			Mode:     key.Mode,
+			Players:  key.Players,
+			Position: ticket.position,
+			Queued:   len(queue),
+		}
+		err := ticket.client.Conn.Send(protocol.QUEUE_UPDATE, update)
+		if err != nil {
+			m.logger.Errorf("error sending queue position to %s: %v", ticket.client.Username, err)
+		}
+	}
+}
+
+// queueKey returns the queue asked for by a start game message
+func (s *Server) queueKey(startMsg StartGameMessage) (QueueKey, error) {
+	key := QueueKey{
+		Mode:    startMsg.Mode,
+		Players: startMsg.Players,
+	}
+	if key.Mode == "" {
+		key.Mode = MODE_CLASSIC
+	}
+	if key.Players == 0 {
+		key.Players = engine.NUM_PLAYERS
+	}
+
+	if !slices.Contains(MODES, key.Mode) {
+		return key, fmt.Errorf("unknown game mode %q, the modes are %v", key.Mode, MODES)
+	}
+	if key.Players < engine.NUM_PLAYERS || key.Players > MAX_PLAYERS {
+		return key, fmt.Errorf("games have %d to %d players", engine.NUM_PLAYERS, MAX_PLAYERS)
+	}
+	if key.Players*s.config.Game.NumCards >= int(engine.TOTAL_DECK_SIZE) {
+		return key, fmt.Errorf("this server deals %d cards, too many for %d players", s.config.Game.NumCards, key.Players)
+	}
+	return key, nil
+}
+
+// startMatch puts a matched group in a new room, sealed until its game
+// starts. The game starts in its own goroutine, for the matchmaker to go on
+// pairing while it is set up.
+func (s *Server) startMatch(key QueueKey, clients []*Client) *GameRoom {
+	room := NewGameRoom(s.config.logLevel())
+	room.Capacity = uint8(key.Players)
+	room.Mode = key.Mode
+	for _, client := range clients {
+		room.AddClient(client)
+	}
+	room.sealed = true
+	s.AddRoom(room)
+	s.logger.Infof("Matched %v in room %s", room.GetClientsUsername(), room.UUID)
+	go s.startGameInRoom(room)
+	return room
+}
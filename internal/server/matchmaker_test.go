@@ -0,0 +1,258 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"mexemexe/internal/protocol"
+	"mexemexe/internal/rating"
+	"mexemexe/internal/service"
+
+	"github.com/gorilla/websocket"
+)
+
+// discardConn returns a connection to a peer that reads nothing back
+func discardConn(t *testing.T) *protocol.Conn {
+	t.Helper()
+	upgrader := websocket.Upgrader{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(ts.Close)
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	conn := protocol.NewConn(ws)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestMatchmakerRatingWindow(t *testing.T) {
+	var started [][]*Client
+	m := &Matchmaker{
+		window: rating.Window{Initial: 100, Growth: 5, Max: 400},
+		start: func(key QueueKey, clients []*Client) *GameRoom {
+			started = append(started, clients)
+			return NewGameRoom(service.LEVEL_ERROR)
+		},
+		queues: make(map[QueueKey][]*Ticket),
+		logger: service.NewLogger(service.LEVEL_ERROR, "test"),
+	}
+	key := QueueKey{Mode: MODE_CLASSIC, Players: 2}
+	queueAt := func(username string, clientRating float64, enqueued time.Time) *Ticket {
+		ticket := &Ticket{
+			client:   &Client{UUID: username, Username: username, Rating: clientRating, Conn: discardConn(t)},
+			key:      key,
+			enqueued: enqueued,
+			matched:  make(chan *GameRoom, 1),
+		}
+		m.queues[key] = append(m.queues[key], ticket)
+		m.match(key)
+		return ticket
+	}
+
+	now := time.Now()
+	carol := queueAt("carol", 1800, now)
+	queueAt("alice", 1500, now)
+	if len(started) != 0 {
+		t.Fatal("players 300 points apart were matched at once")
+	}
+	if carol.position != 1 || len(m.queues[key]) != 2 {
+		t.Errorf("carol is told position %d, queue holds %d", carol.position, len(m.queues[key]))
+	}
+
+	// A close rating is matched with the longest waiting player it fits
+	queueAt("dave", 1750, now)
+	if len(started) != 1 || started[0][0].Username != "carol" || started[0][1].Username != "dave" {
+		t.Fatalf("matched %v, want carol and dave", started)
+	}
+	if alice := m.queues[key][0]; alice.client.Username != "alice" || alice.position != 1 {
+		t.Errorf("alice is at position %d after the match", alice.position)
+	}
+
+	// The window widens as the players wait, up to its max
+	queueAt("erin", 1000, now)
+	if len(started) != 1 {
+		t.Fatal("players 500 points apart were matched at once")
+	}
+	m.queues[key][0].enqueued = now.Add(-time.Hour)
+	m.match(key)
+	if len(started) != 1 {
+		t.Error("players 500 points apart were matched beyond the max window")
+	}
+	queueAt("frank", 1250, now)
+	if len(started) != 2 || started[1][0].Username != "alice" || started[1][1].Username != "frank" {
+		t.Errorf("matched %v, want alice and frank after alice waited", started)
+	}
+}
+
+func TestQueueKeyValidation(t *testing.T) {
+	s, _ := newTestServer(t)
+	if key, err := s.queueKey(StartGameMessage{}); err != nil || key != (QueueKey{Mode: MODE_CLASSIC, Players: 2}) {
+		t.Errorf("default queue = %+v, %v", key, err)
+	}
+	for _, startMsg := range []StartGameMessage{{Mode: "speed"}, {Players: 1}, {Players: MAX_PLAYERS + 1}} {
+		if _, err := s.queueKey(startMsg); err == nil {
+			t.Errorf("queueKey(%+v) accepted", startMsg)
+		}
+	}
+}
+
+func TestQueuePositionsAndCancelOnDisconnect(t *testing.T) {
+	s, url := newTestServer(t)
+	threePlayers := StartGameMessage{Action: "start", Players: 3}
+
+	join := func(username string) *fakeClient {
+		client := dialFakeClient(t, url, username)
+		client.write(protocol.JOIN, JoinServerMessage{Username: username})
+		var welcomeMsg WelcomeMessage
+		client.read(protocol.WELCOME, &welcomeMsg)
+		client.uuid = welcomeMsg.PlayerUUID
+		client.queue(threePlayers)
+		return client
+	}
+	position := func(client *fakeClient) QueueUpdateMessage {
+		t.Helper()
+		var update QueueUpdateMessage
+		client.read(protocol.QUEUE_UPDATE, &update)
+		return update
+	}
+
+	alice := join("alice")
+	if update := position(alice); update.Position != 1 || update.Queued != 1 || update.Players != 3 {
+		t.Errorf("alice's first update: %+v", update)
+	}
+	bob := join("bob")
+	if update := position(bob); update.Position != 2 || update.Queued != 2 {
+		t.Errorf("bob's first update: %+v", update)
+	}
+
+	// Alice drops: bob moves up, and the next players are not matched with her
+	alice.ws.Close()
+	if update := position(bob); update.Position != 1 || update.Queued != 1 {
+		t.Errorf("bob's update after alice left: %+v", update)
+	}
+	waitFor(t, "alice to be removed", func() bool {
+		return s.GetCurrentCapacity() == 1
+	})
+	join("carol")
+	join("dave")
+	room := startedRooms(t, s, 1)[0]
+	if usernames := strings.Join(room.GetClientsUsername(), ","); usernames != "bob,carol,dave" {
+		t.Errorf("matched %s", usernames)
+	}
+	if room.NumPlayers != 3 || len(room.Game.Players) != 3 {
+		t.Errorf("the room started with %d players", room.NumPlayers)
+	}
+}
+
+func TestMatchmakerDropsDisconnectedClients(t *testing.T) {
+	var started [][]*Client
+	m := &Matchmaker{
+		window: rating.Window{Initial: 100},
+		start: func(key QueueKey, clients []*Client) *GameRoom {
+			started = append(started, clients)
+			return NewGameRoom(service.LEVEL_ERROR)
+		},
+		queues: make(map[QueueKey][]*Ticket),
+		logger: service.NewLogger(service.LEVEL_ERROR, "test"),
+	}
+	key := QueueKey{Mode: MODE_CLASSIC, Players: 2}
+	tickets := []*Ticket{}
+	for _, username := range []string{"alice", "bob", "carol"} {
+		ticket := &Ticket{
+			client:   &Client{UUID: username, Username: username, Rating: rating.DEFAULT_RATING, Conn: discardConn(t)},
+			key:      key,
+			enqueued: time.Now(),
+			matched:  make(chan *GameRoom, 1),
+		}
+		tickets = append(tickets, ticket)
+	}
+
+	// Alice dropped while bob was joining: bob must not start a game with her
+	m.queues[key] = []*Ticket{tickets[0]}
+	tickets[0].client.Conn.Close()
+	m.queues[key] = append(m.queues[key], tickets[1])
+	m.match(key)
+	if len(started) != 0 {
+		t.Fatalf("started a game with a disconnected client")
+	}
+	if room := <-tickets[0].Matched(); room != nil {
+		t.Error("the disconnected client was given a room")
+	}
+
+	m.queues[key] = append(m.queues[key], tickets[2])
+	m.match(key)
+	if len(started) != 1 || started[0][0].Username != "bob" || started[0][1].Username != "carol" {
+		t.Errorf("matched %v, want bob and carol", started)
+	}
+}
+
+func TestNoGameWithClientDroppedAfterMatch(t *testing.T) {
+	s := NewServer(NewServerConfig(service.LEVEL_ERROR))
+	alice := &Client{UUID: "alice", Username: "alice", Conn: discardConn(t)}
+	bob := &Client{UUID: "bob", Username: "bob", Conn: discardConn(t)}
+	room := NewGameRoom(service.LEVEL_ERROR)
+	room.AddClient(alice)
+	room.AddClient(bob)
+	room.sealed = true
+	s.AddRoom(room)
+
+	// Alice drops before the deal: bob goes back to the lobby and nothing is recorded
+	alice.Conn.Close()
+	s.startGameInRoom(room)
+	select {
+	case <-room.Finished():
+	case <-time.After(TEST_TIMEOUT):
+		t.Fatal("the room of a dropped client was not closed")
+	}
+	if _, err := s.findRoom(room.UUID); err == nil {
+		t.Error("the room is still listed")
+	}
+	if _, err := s.Store().GetGame(room.UUID); err == nil {
+		t.Error("a game was recorded")
+	}
+}
+
+func TestCancelSearch(t *testing.T) {
+	s, url := newTestServer(t)
+	alice := dialFakeClient(t, url, "alice")
+	alice.join()
+
+	// Cancelling twice: the second time there is nothing to cancel
+	alice.write(protocol.START_GAME, StartGameMessage{Action: "cancel"})
+	var cancelledMsg SearchCancelledMessage
+	alice.readUntil(protocol.SEARCH_CANCELLED, &cancelledMsg)
+	alice.write(protocol.START_GAME, StartGameMessage{Action: "cancel"})
+	var errorMsg ErrorMessage
+	alice.read(protocol.ERROR, &errorMsg)
+
+	// Bob waits alone, then alice searches again from the same connection
+	bob := dialFakeClient(t, url, "bob")
+	bob.join()
+	var update QueueUpdateMessage
+	bob.read(protocol.QUEUE_UPDATE, &update)
+	if update.Position != 1 || update.Queued != 1 {
+		t.Errorf("bob was queued with the cancelled search: %+v", update)
+	}
+	alice.queue(StartGameMessage{Action: "start"})
+	room := startedRooms(t, s, 1)[0]
+	if usernames := strings.Join(room.GetClientsUsername(), ","); usernames != "bob,alice" {
+		t.Errorf("matched %s", usernames)
+	}
+	var state GameStateMessage
+	alice.readUntil(protocol.GAME_STATE, &state)
+}
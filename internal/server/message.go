@@ -1,9 +1,17 @@
 package server
 
-import "mexemexe/internal/engine"
+import (
+	"mexemexe/internal/engine"
+	"time"
+)
 
 type JoinServerMessage struct {
 	Username string `json:"username"`
+	// Password logs in to an account, or sets its password with Register
+	Password string `json:"password,omitempty"`
+	Register bool   `json:"register,omitempty"`
+	// SessionToken from an earlier WelcomeMessage logs in without username and password
+	SessionToken string `json:"session_token,omitempty"`
 }
 
 type MaxCapacityMessage struct {
@@ -13,6 +21,12 @@ type MaxCapacityMessage struct {
 type WelcomeMessage struct {
 	Message    string `json:"message"`
 	PlayerUUID string `json:"player_uuid"`
+	// Username is the name the player was logged in as
+	Username string `json:"username"`
+	// RejoinToken lets the player take its seat back in a game restored after a server restart
+	RejoinToken string `json:"rejoin_token"`
+	// SessionToken logs the player in again, e.g. after losing the connection, until it expires
+	SessionToken string `json:"session_token"`
 }
 
 type ErrorMessage struct {
@@ -20,19 +34,78 @@ type ErrorMessage struct {
 }
 
 type StartGameMessage struct {
+	// Action is "start" to search for a game, "cancel" to stop searching or
+	// leave an open room, "create" to open a room in the lobby, "join" or
+	// "spectate" to enter the room RoomUUID of the lobby, or "rejoin"
 	Action string `json:"action"`
+	// Mode and Players choose the game the "start" action searches for. They
+	// default to the classic mode and two players.
+	Mode    string `json:"mode,omitempty"`
+	Players int    `json:"players,omitempty"`
+	// PlayerUUID and RejoinToken identify the seat to take back with the "rejoin" action
+	PlayerUUID  string `json:"player_uuid,omitempty"`
+	RejoinToken string `json:"rejoin_token,omitempty"`
+	// RoomUUID is the room of the lobby to join or spectate
+	RoomUUID string `json:"room_uuid,omitempty"`
 }
 
-type WaitingRoomMessage struct {
+// RatingRequestMessage asks for the rating of the player, or of another account by Username
+type RatingRequestMessage struct {
+	Username string `json:"username,omitempty"`
+}
+
+type RatingMessage struct {
+	Username string `json:"username"`
+	// Rated is false for guests, who play at the default rating
+	Rated  bool    `json:"rated"`
+	Rating float64 `json:"rating"`
+	// Position is the rank among the Of accounts that finished a game, 0 before the first game
+	Position int `json:"position"`
+	Of       int `json:"of"`
+	Played   int `json:"played"`
+	Won      int `json:"won"`
+	Lost     int `json:"lost"`
+	// Left counts the games the player resigned or lost their connection to
+	Left int `json:"left"`
+}
+
+// QueueUpdateMessage tells a client searching for a game where it stands in the queue
+type QueueUpdateMessage struct {
+	Mode    string `json:"mode"`
+	Players int    `json:"players"`
+	// Position is 1 for the client waiting the longest
+	Position int `json:"position"`
+	Queued   int `json:"queued"`
+}
+
+// ChatMessage says something to everyone in the game room: a Text, or one of the engine.EMOTES by its code
+type ChatMessage struct {
+	Text  string `json:"text,omitempty"`
+	Emote string `json:"emote,omitempty"`
+}
+
+// ChatPostedMessage is a chat message sent in the game room, as everyone sees it
+type ChatPostedMessage struct {
+	PlayerUUID string    `json:"player_uuid"`
+	Username   string    `json:"username"`
+	Text       string    `json:"text"`
+	Emote      string    `json:"emote,omitempty"`
+	Time       time.Time `json:"time"`
+}
+
+// SearchCancelledMessage confirms a client left the queue, free to search again
+type SearchCancelledMessage struct {
 	Message string `json:"message"`
 }
 
-type JoinedGameRoomMessage struct {
+type WaitingRoomMessage struct {
 	Message string `json:"message"`
 }
 
-type GameStartedMessage struct {
+type JoinedGameRoomMessage struct {
 	Message string `json:"message"`
+	// RoomUUID is the room of the lobby the client created, joined or watches
+	RoomUUID string `json:"room_uuid,omitempty"`
 }
 
 type GameStateMessage struct {
@@ -48,3 +121,65 @@ type GamePlayMessage struct {
 type GameMessage struct {
 	Message string `json:"message"`
 }
+
+type ServerNoticeMessage struct {
+	Message string `json:"message"`
+}
+
+// LobbySubscribeMessage asks for the lobby, then for every change to it
+type LobbySubscribeMessage struct{}
+
+// LobbyUnsubscribeMessage stops the lobby updates
+type LobbyUnsubscribeMessage struct{}
+
+// LobbyRoom is a room as the lobby lists it
+type LobbyRoom struct {
+	UUID string `json:"uuid"`
+	Mode string `json:"mode"`
+	// Status is "open", "running" or "restoring"
+	Status string `json:"status"`
+	// Players are the usernames of the players in the room
+	Players    []string `json:"players"`
+	Capacity   int      `json:"capacity"`
+	Spectators int      `json:"spectators"`
+}
+
+// LobbyPlayer is a player online as the lobby lists it
+type LobbyPlayer struct {
+	Username string `json:"username"`
+	// Status is "idle", "searching", "waiting", "playing" or "spectating"
+	Status string `json:"status"`
+}
+
+// LobbyMessage lists the rooms and players online
+type LobbyMessage struct {
+	Rooms   []LobbyRoom   `json:"rooms"`
+	Players []LobbyPlayer `json:"players"`
+}
+
+// LobbyUpdateMessage is a change to the lobby pushed to its subscribers
+type LobbyUpdateMessage struct {
+	// Event is "room_updated", "room_removed", "player_updated" or "player_offline"
+	Event  string       `json:"event"`
+	Room   *LobbyRoom   `json:"room,omitempty"`
+	Player *LobbyPlayer `json:"player,omitempty"`
+}
+
+// GameOverMessage tells how the game ended. Players may be offered a rematch,
+// to accept within RematchSeconds.
+type GameOverMessage struct {
+	Result         engine.GameResult `json:"result"`
+	Rematch        bool              `json:"rematch"`
+	RematchSeconds int               `json:"rematch_seconds,omitempty"`
+}
+
+// RematchMessage answers the rematch offer
+type RematchMessage struct {
+	Accept bool `json:"accept"`
+}
+
+// BackToLobbyMessage tells the room is over, and why. The client is back in
+// the lobby, free to search for another game.
+type BackToLobbyMessage struct {
+	Message string `json:"message"`
+}
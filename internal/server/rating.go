@@ -0,0 +1,113 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"mexemexe/internal/auth"
+	"mexemexe/internal/protocol"
+	"mexemexe/internal/rating"
+	"mexemexe/internal/store"
+)
+
+// Defaults of the rating window of the matchmaking
+const (
+	DEFAULT_RATING_WINDOW        = 100
+	DEFAULT_RATING_WINDOW_GROWTH = 5
+)
+
+// RATING_UNAVAILABLE_MESSAGE tells a client its rating request failed on the server side
+const RATING_UNAVAILABLE_MESSAGE = "Can't read that rating right now, please try again later."
+
+// MatchmakingSettings choose how close in rating the players of a game must be
+type MatchmakingSettings struct {
+	// RatingWindow is how far apart in rating players may be as soon as they wait
+	RatingWindow float64 `yaml:"rating_window"`
+	// RatingWindowGrowth widens the window by that many points every second a player waits
+	RatingWindowGrowth float64 `yaml:"rating_window_growth"`
+	// MaxRatingWindow stops the window from widening further. Zero lets it widen without limit.
+	MaxRatingWindow float64 `yaml:"max_rating_window"`
+}
+
+// validate reports every matchmaking setting out of range
+func (m MatchmakingSettings) validate() []error {
+	var errs []error
+	if m.RatingWindow < 0 {
+		errs = append(errs, fmt.Errorf("rating window cannot be negative, got %v", m.RatingWindow))
+	}
+	if m.RatingWindowGrowth < 0 {
+		errs = append(errs, fmt.Errorf("rating window growth cannot be negative, got %v", m.RatingWindowGrowth))
+	}
+	if m.MaxRatingWindow != 0 && m.MaxRatingWindow < m.RatingWindow {
+		errs = append(errs, fmt.Errorf("max rating window %v is narrower than the rating window %v", m.MaxRatingWindow, m.RatingWindow))
+	}
+	return errs
+}
+
+func (m MatchmakingSettings) window() rating.Window {
+	return rating.Window{
+		Initial: m.RatingWindow,
+		Growth:  m.RatingWindowGrowth,
+		Max:     m.MaxRatingWindow,
+	}
+}
+
+// playerRating returns the current rating of a client. Guests have the default rating.
+func (s *Server) playerRating(client *Client) float64 {
+	if client.UserID == "" {
+		return rating.DEFAULT_RATING
+	}
+	stats, err := s.store.GetStats(client.UserID)
+	if err != nil {
+		s.logger.Errorf("error reading stats of %s: %v", client.Username, err)
+		return rating.DEFAULT_RATING
+	}
+	return stats.Rating
+}
+
+// handleRatingRequest answers a client asking for its rating, or the rating of another account
+func (s *Server) handleRatingRequest(client *Client, request RatingRequestMessage) error {
+	userID, username := client.UserID, client.Username
+	if request.Username != "" {
+		account, err := s.store.GetAccount(request.Username)
+		if errors.Is(err, auth.ErrAccountNotFound) {
+			s.sendError(client.Conn, fmt.Sprintf("There is no account named %s.", request.Username))
+			return nil
+		}
+		if err != nil {
+			s.logger.Errorf("error reading the account of %s: %v", request.Username, err)
+			s.sendError(client.Conn, RATING_UNAVAILABLE_MESSAGE)
+			return nil
+		}
+		userID, username = account.ID, account.Username
+	}
+
+	ratingMsg := RatingMessage{
+		Username: username,
+		Rating:   rating.DEFAULT_RATING,
+	}
+	if userID != "" {
+		stats, err := s.store.GetStats(userID)
+		rank := store.Rank{}
+		if err == nil {
+			rank, err = s.store.GetRank(userID)
+		}
+		// The client stays connected, it may ask again later
+		if err != nil {
+			s.logger.Errorf("error reading the rating of %s: %v", username, err)
+			s.sendError(client.Conn, RATING_UNAVAILABLE_MESSAGE)
+			return nil
+		}
+		ratingMsg = RatingMessage{
+			Username: username,
+			Rated:    true,
+			Rating:   stats.Rating,
+			Position: rank.Position,
+			Of:       rank.Of,
+			Played:   stats.Played,
+			Won:      stats.Won,
+			Lost:     stats.Lost,
+			Left:     stats.Left,
+		}
+	}
+	return client.Conn.Send(protocol.RATING, ratingMsg)
+}
@@ -0,0 +1,271 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"mexemexe/internal/engine"
+	"mexemexe/internal/protocol"
+	"mexemexe/internal/service"
+	"sync"
+	"time"
+)
+
+// DEFAULT_RECONNECT_GRACE is how long a player who lost their connection
+// during a game has to come back before leaving it
+const DEFAULT_RECONNECT_GRACE = 60 * time.Second
+
+// seat is the place of a player in the running game of a room. It outlives
+// the connection of the player, who may take it back after losing it: the
+// plays keep going through the same channel, and the game messages to the
+// connection the player has now.
+type seat struct {
+	uuid string
+	// plays carries the plays of the player to the game. It is closed once the
+	// player is gone for good, which makes them leave the game.
+	plays  chan protocol.Envelope
+	mu     sync.Mutex
+	client *Client
+	// state is the last state sent, sent again when the player comes back
+	state *GameStateMessage
+	// grace runs while the player is away, nil otherwise
+	grace  *time.Timer
+	closed bool
+	logger *service.GameLogger
+}
+
+func newSeat(client *Client, logger *service.GameLogger) *seat {
+	return &seat{
+		uuid:   client.UUID,
+		plays:  make(chan protocol.Envelope, PLAY_QUEUE_SIZE),
+		client: client,
+		logger: logger,
+	}
+}
+
+func (s *seat) GetUUID() string {
+	return s.uuid
+}
+
+// conn returns the connection the player has now
+func (s *seat) conn() *protocol.Conn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.client.Conn
+}
+
+func (s *seat) Write(messageType string, data interface{}) {
+	err := s.conn().Send(protocol.GAME_MESSAGE, GameMessage{Message: fmt.Sprint(data)})
+	if err != nil {
+		s.logger.Errorf("error writing to websocket: %v", err)
+	}
+}
+
+func (s *seat) SendState(table engine.Table, hand engine.Hand, turnState engine.TurnState) {
+	// The engine keeps mutating its own hand and table, so the seat keeps copies
+	s.mu.Lock()
+	s.state = &GameStateMessage{
+		Table: table.Clone(),
+		Hand:  hand.Clone(),
+		Turn:  turnState,
+	}
+	conn := s.client.Conn
+	s.mu.Unlock()
+
+	err := conn.Send(protocol.GAME_STATE, GameStateMessage{Table: table, Hand: hand, Turn: turnState})
+	if err != nil {
+		s.logger.Errorf("error writing to websocket: %v", err)
+	}
+}
+
+// away keeps the seat for a player who lost their connection until the grace
+// period is over, then closes it. A grace of zero closes it right away.
+func (s *seat) away(grace time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed || s.grace != nil {
+		return
+	}
+	if grace <= 0 {
+		s.closeLocked()
+		return
+	}
+	s.grace = time.AfterFunc(grace, func() {
+		s.logger.Infof("Player %s did not come back in time", s.uuid)
+		s.close()
+	})
+}
+
+// isAway tells if the seat waits for its player to come back
+func (s *seat) isAway() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.grace != nil && !s.closed
+}
+
+// takeBack gives the seat to the new connection of its player, away and still
+// in time, sending them the last state of the game
+func (s *seat) takeBack(client *Client) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed || s.grace == nil || !s.grace.Stop() {
+		return errors.New("the seat is not waiting for its player")
+	}
+	s.grace = nil
+	s.client = client
+
+	// Sent before any newer state can be
+	if s.state == nil {
+		return nil
+	}
+	return client.Conn.Send(protocol.GAME_STATE, *s.state)
+}
+
+// close makes the player leave the game, unless they already did
+func (s *seat) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closeLocked()
+}
+
+func (s *seat) closeLocked() {
+	if s.closed {
+		return
+	}
+	s.closed = true
+	if s.grace != nil {
+		s.grace.Stop()
+	}
+	close(s.plays)
+}
+
+// playerAway keeps the seat of a player who lost their connection during the
+// game for the reconnect grace period, after which the player leaves the
+// game. Players leave right away from a game cut short.
+func (g *GameRoom) playerAway(seat *seat, done <-chan struct{}) {
+	select {
+	case <-done:
+		return
+	default:
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	seat.away(g.graceLocked())
+}
+
+// graceLocked returns how long the players of the room have to come back
+// after losing their connection. g.mu must be held.
+func (g *GameRoom) graceLocked() time.Duration {
+	if g.abandoned {
+		return 0
+	}
+	return g.reconnectGrace
+}
+
+// SetReconnectGrace sets how long the players have to come back after losing
+// their connection during the game
+func (g *GameRoom) SetReconnectGrace(grace time.Duration) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.reconnectGrace = grace
+}
+
+// awaits tells if the running game of the room waits for the player with the
+// given UUID and rejoin token to come back, logged in to the given account if
+// they played with one
+func (g *GameRoom) awaits(playerUUID string, rejoinToken string, userID string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	seat, ok := g.seats[playerUUID]
+	if !ok || !seat.isAway() {
+		return false
+	}
+	i := g.clientIndexLocked(playerUUID)
+	return i >= 0 && g.Clients[i].RejoinToken == rejoinToken && ownsSeat(g.Clients[i].UserID, userID)
+}
+
+// ownsSeat tells if a client logged in to the account userID may take the
+// seat of a player who had the account seatUserID. The rejoin token alone
+// gives back the seat of a guest.
+func ownsSeat(seatUserID string, userID string) bool {
+	return seatUserID == "" || seatUserID == userID
+}
+
+// reconnect gives a player who lost their connection their seat back in the
+// running game, on the new connection of client
+func (g *GameRoom) reconnect(client *Client) error {
+	g.mu.Lock()
+	// Once the game is over its routers may be waited for, so none may start
+	select {
+	case <-g.done:
+		g.mu.Unlock()
+		return errors.New("the game is over")
+	default:
+	}
+	seat, ok := g.seats[client.UUID]
+	if !ok {
+		g.mu.Unlock()
+		return errors.New("not a player of the game")
+	}
+	err := seat.takeBack(client)
+	if err != nil {
+		g.mu.Unlock()
+		return err
+	}
+	if i := g.clientIndexLocked(client.UUID); i >= 0 {
+		g.Clients[i] = client
+	}
+	g.startRouterLocked(client, seat)
+	game := g.Game
+	g.mu.Unlock()
+
+	game.NotifyReconnected(client.UUID)
+	return nil
+}
+
+// clientIndexLocked returns the index in Clients of the player with the given
+// UUID, or -1. g.mu must be held.
+func (g *GameRoom) clientIndexLocked(playerUUID string) int {
+	for i, client := range g.Clients {
+		if client.UUID == playerUUID {
+			return i
+		}
+	}
+	return -1
+}
+
+// abandon cuts the game of the room short, as the server stops: players who
+// lose their connection leave the game at once, which ends it without a winner
+func (g *GameRoom) abandon() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.abandoned = true
+	if g.Game != nil {
+		g.Game.Abandon()
+	}
+	for _, seat := range g.seats {
+		if seat.isAway() {
+			seat.close()
+		}
+	}
+}
+
+// reconnectPlayer gives a client its seat back in the running game of the
+// room it lost its connection to
+func (s *Server) reconnectPlayer(room *GameRoom, client *Client) (*GameRoom, error) {
+	err := client.Conn.Send(protocol.JOINED_GAME_ROOM, JoinedGameRoomMessage{
+		Message:  "Rejoined your game.",
+		RoomUUID: room.UUID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = room.reconnect(client)
+	if err != nil {
+		s.sendError(client.Conn, "There is no game to rejoin.")
+		return nil, fmt.Errorf("player %s can't rejoin room %s: %w", client.UUID, room.UUID, err)
+	}
+	s.logger.Infof("Player %s reconnected to room %s", client.UUID, room.UUID)
+	s.lobby.Unsubscribe(client)
+	s.setStatus(client, STATUS_PLAYING)
+	return room, nil
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"mexemexe/internal/engine"
+	"mexemexe/internal/protocol"
+	"slices"
+	"time"
+)
+
+// DEFAULT_REMATCH_TIMEOUT is how long the players have to accept a rematch
+const DEFAULT_REMATCH_TIMEOUT = 30 * time.Second
+
+// rematchOffer collects the answers of the players to a rematch
+type rematchOffer struct {
+	players  []*Client
+	answers  map[*Client]bool
+	decliner *Client
+	// answered gets a signal after every answer
+	answered chan struct{}
+}
+
+// offerRematch opens the rematch offer to the players of the finished game
+func (g *GameRoom) offerRematch() *rematchOffer {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.offer = &rematchOffer{
+		players:  append([]*Client{}, g.Clients...),
+		answers:  make(map[*Client]bool),
+		answered: make(chan struct{}, 1),
+	}
+	return g.offer
+}
+
+// answerRematch records the answer of a client to the rematch offer. The
+// first decline settles it.
+func (g *GameRoom) answerRematch(client *Client, accept bool) error {
+	g.mu.Lock()
+	offer := g.offer
+	if offer == nil || !slices.Contains(offer.players, client) {
+		g.mu.Unlock()
+		return errors.New("no rematch is offered to this client")
+	}
+	if _, answered := offer.answers[client]; answered {
+		g.mu.Unlock()
+		return nil
+	}
+	offer.answers[client] = accept
+	if !accept && offer.decliner == nil {
+		offer.decliner = client
+	}
+	g.mu.Unlock()
+
+	select {
+	case offer.answered <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// rematchDecision tells if every player accepted the rematch, or who declined it
+func (g *GameRoom) rematchDecision(offer *rematchOffer) (accepted bool, decliner *Client) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if offer.decliner != nil {
+		return false, offer.decliner
+	}
+	return len(offer.answers) == len(offer.players), nil
+}
+
+// afterGame runs the post-game phase of the room once its game is over: the
+// result goes to everyone in the room and the players are offered a rematch,
+// which starts once all of them accept. There is none after a player left.
+// Otherwise the room closes and its clients go back to the lobby.
+func (s *Server) afterGame(room *GameRoom, game *engine.Game, done <-chan struct{}) {
+	<-done
+	result := game.Result()
+	timeout := s.config.RematchTimeout
+	offered := result.Finished() && result.Outcome != engine.OUTCOME_ABANDONED && !result.AnyoneLeft() && timeout > 0 && !s.IsDraining()
+
+	var offer *rematchOffer
+	if offered {
+		offer = room.offerRematch()
+	}
+	gameOverMsg := GameOverMessage{Result: result}
+	room.sendSpectators(protocol.GAME_OVER, gameOverMsg)
+	if offered {
+		gameOverMsg.Rematch = true
+		gameOverMsg.RematchSeconds = int(timeout.Seconds())
+	}
+	room.sendPlayers(protocol.GAME_OVER, gameOverMsg)
+
+	reason := "The game is over."
+	rematch := false
+	if offered {
+		rematch, reason = s.awaitRematch(room, offer, timeout)
+	}
+	room.endPostGame()
+
+	if rematch && s.IsDraining() {
+		rematch, reason = false, "No rematch: the server is restarting."
+	}
+	if rematch {
+		s.startRematch(room, game)
+		return
+	}
+	s.logger.Infof("Room %s is over: %s", room.UUID, reason)
+	s.RemoveRoom(room)
+	room.Broadcast(protocol.BACK_TO_LOBBY, BackToLobbyMessage{Message: reason + " Back to the lobby."})
+	room.finish()
+}
+
+// awaitRematch waits for the answers of the players to the rematch offer,
+// telling if all of them accepted it in time, or why not
+func (s *Server) awaitRematch(room *GameRoom, offer *rematchOffer, timeout time.Duration) (bool, string) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-offer.answered:
+			accepted, decliner := room.rematchDecision(offer)
+			if decliner != nil {
+				return false, fmt.Sprintf("No rematch: %s declined.", decliner.Username)
+			}
+			if accepted {
+				return true, ""
+			}
+			room.Broadcast(protocol.GAME_MESSAGE, GameMessage{Message: room.rematchProgress(offer)})
+
+		case <-timer.C:
+			return false, "No rematch: not every player accepted in time."
+		}
+	}
+}
+
+// rematchProgress tells how many players accepted the rematch so far
+func (g *GameRoom) rematchProgress(offer *rematchOffer) string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return fmt.Sprintf("Rematch: %d of %d players accepted.", len(offer.answers), len(offer.players))
+}
+
+// startRematch deals a new game to the players of the room, the next player
+// after the first one of the finished game starting
+func (s *Server) startRematch(room *GameRoom, finished *engine.Game) {
+	players := slices.Concat(finished.Players[1:], finished.Players[:1])
+	names := make([]string, len(players))
+	uuids := make([]string, len(players))
+	for i, player := range players {
+		names[i] = player.Name
+		uuids[i] = player.UUID
+	}
+	config := s.config.newGameConfig(names, uuids)
+	config.RandomPlayerOrder = false
+	room.newRound(engine.NewGame(config, room.logger))
+	s.logger.Infof("Rematch in room %s, %s starts", room.UUID, names[0])
+	s.runGame(room)
+}
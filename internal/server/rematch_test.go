@@ -0,0 +1,102 @@
+package server
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"mexemexe/internal/protocol"
+	"mexemexe/internal/service"
+)
+
+// playAll plays the game of the clients until it is over
+func playAll(clients []*fakeClient) {
+	var wg sync.WaitGroup
+	for _, client := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client.play()
+		}()
+	}
+	wg.Wait()
+}
+
+func TestRematchRotatesFirstPlayer(t *testing.T) {
+	s, url := newTestServer(t)
+	clients := []*fakeClient{dialFakeClient(t, url, "alice"), dialFakeClient(t, url, "bob")}
+	for _, client := range clients {
+		client.join()
+	}
+	room := startedRooms(t, s, 1)[0]
+
+	playAll(clients)
+	first := clients[0].states[0].Turn.PlayerUUID
+	for _, client := range clients {
+		if client.gameOver == nil || !client.gameOver.Rematch || client.gameOver.RematchSeconds != int(DEFAULT_REMATCH_TIMEOUT.Seconds()) {
+			t.Fatalf("%s: game over = %+v", client.username, client.gameOver)
+		}
+		client.states = nil
+		client.write(protocol.REMATCH, RematchMessage{Accept: true})
+	}
+
+	// Everyone accepted: the other player starts the new game, in the same room
+	playAll(clients)
+	if rematchFirst := clients[0].states[0].Turn.PlayerUUID; rematchFirst == first {
+		t.Errorf("%s started both games", rematchFirst)
+	}
+	if rooms := startedRooms(t, s, 1); rooms[0] != room {
+		t.Errorf("rematch in room %s, want %s", rooms[0].UUID, room.UUID)
+	}
+	waitFor(t, "both games to be saved", func() bool {
+		_, firstErr := s.Store().GetGame(room.UUID)
+		_, rematchErr := s.Store().GetGame(room.UUID + "-2")
+		return firstErr == nil && rematchErr == nil
+	})
+
+	// Alice declines the next one: both players are back in the lobby
+	clients[0].write(protocol.REMATCH, RematchMessage{Accept: false})
+	for _, client := range clients {
+		var lobbyMsg BackToLobbyMessage
+		client.readUntil(protocol.BACK_TO_LOBBY, &lobbyMsg)
+		if !strings.Contains(lobbyMsg.Message, "alice declined") {
+			t.Errorf("%s was told %q", client.username, lobbyMsg.Message)
+		}
+	}
+	waitFor(t, "the room to be removed", func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return len(s.Rooms) == 0 && len(s.Clients) == 2
+	})
+
+	// From the lobby they can search for a game again
+	for _, client := range clients {
+		client.queue(StartGameMessage{Action: "start"})
+	}
+	startedRooms(t, s, 1)
+}
+
+func TestRematchTimesOut(t *testing.T) {
+	config := NewServerConfig(service.LEVEL_ERROR)
+	config.RematchTimeout = 200 * time.Millisecond
+	s, url := newTestServerWithConfig(t, config)
+	clients := []*fakeClient{dialFakeClient(t, url, "alice"), dialFakeClient(t, url, "bob")}
+	for _, client := range clients {
+		client.join()
+	}
+	startedRooms(t, s, 1)
+
+	playAll(clients)
+	clients[1].write(protocol.REMATCH, RematchMessage{Accept: true})
+	var gameMsg GameMessage
+	clients[0].readUntil(protocol.GAME_MESSAGE, &gameMsg)
+	if gameMsg.Message != "Rematch: 1 of 2 players accepted." {
+		t.Errorf("alice was told %q", gameMsg.Message)
+	}
+	var lobbyMsg BackToLobbyMessage
+	clients[1].readUntil(protocol.BACK_TO_LOBBY, &lobbyMsg)
+	if !strings.Contains(lobbyMsg.Message, "in time") {
+		t.Errorf("bob was told %q", lobbyMsg.Message)
+	}
+}
@@ -1,32 +1,98 @@
 package server
 
 import (
+	"errors"
+	"fmt"
 	"mexemexe/internal/engine"
+	"mexemexe/internal/protocol"
 	"mexemexe/internal/service"
+	"slices"
 	"sync"
+	"time"
 )
 
+// PLAY_QUEUE_SIZE is how many plays of a client wait for its turn
+const PLAY_QUEUE_SIZE = 4
+
 type GameRoom struct {
-	UUID        string
-	Game        *engine.Game
-	Clients     []*Client
-	NumPlayers  uint8
-	GameStarted bool
-	RoomChannel chan string
-	mu          sync.Mutex
-	logger      *service.GameLogger
+	UUID       string
+	Game       *engine.Game
+	Clients    []*Client
+	NumPlayers uint8
+	// Capacity is how many players the game of the room is for
+	Capacity uint8
+	Mode     string
+	// Spectators watch the game without playing
+	Spectators []*Client
+	// spectatorState is the last table and turn shown to the spectators, nil before the first one
+	spectatorState *GameStateMessage
+	GameStarted    bool
+	RoomChannel    chan string
+	// expected lists the players of a restored game. Only they may join the room.
+	expected []RoomPlayer
+	// open rooms were created from the lobby, for players to join. Once sealed
+	// the room is full and its game about to start: nobody may leave or join.
+	// Rooms of matched players are sealed from the start.
+	open   bool
+	sealed bool
+	// recorder records the plays of the game for its replay. Nil when not recorded.
+	recorder *engine.ReplayRecorder
+	// onChat handles the chat messages of the clients. Nil ignores them.
+	onChat  func(client *Client, chatMsg ChatMessage)
+	started chan struct{}
+	// done is closed once the current game is over, and postGame once its
+	// post-game phase is over too. A rematch replaces both.
+	done     chan struct{}
+	postGame chan struct{}
+	// offer collects the answers of the players to a rematch, nil when none is offered
+	offer *rematchOffer
+	// rematches counts the games played in the room after the first one
+	rematches int
+	// seats of the players in the current game, by player UUID
+	seats map[string]*seat
+	// reconnectGrace is how long players have to come back after losing their connection during the game
+	reconnectGrace time.Duration
+	// abandoned is set once the game is cut short
+	abandoned bool
+	// routers counts the goroutines reading the messages of the clients until the end of the post-game phase
+	routers sync.WaitGroup
+	// handOffs are closed once nothing but the room reads the messages of each client
+	handOffs map[*Client]chan struct{}
+	// finished is closed once the room is over, and its clients back in the lobby
+	finished chan struct{}
+	mu       sync.Mutex
+	logger   *service.GameLogger
 }
 
 func NewGameRoom(debugLevel int) *GameRoom {
-	uuid := GenerateUniqueID()
+	return newGameRoom(GenerateUniqueID(), debugLevel)
+}
+
+// NewRestoredGameRoom creates a room for a game restored from a snapshot. The
+// game resumes once all its players have rejoined.
+func NewRestoredGameRoom(snapshot RoomSnapshot, game *engine.Game, debugLevel int) *GameRoom {
+	room := newGameRoom(snapshot.RoomUUID, debugLevel)
+	room.Game = game
+	room.expected = snapshot.Players
+	return room
+}
+
+func newGameRoom(uuid string, debugLevel int) *GameRoom {
 	logger := service.NewLogger(debugLevel, uuid)
 	gameRoom := GameRoom{
 		UUID:        uuid,
 		Game:        nil,
 		Clients:     []*Client{},
+		Capacity:    engine.NUM_PLAYERS,
+		Mode:        MODE_CLASSIC,
+		Spectators:  []*Client{},
 		NumPlayers:  0,
 		GameStarted: false,
 		RoomChannel: make(chan string),
+		started:     make(chan struct{}),
+		done:        make(chan struct{}),
+		postGame:    make(chan struct{}),
+		finished:    make(chan struct{}),
 		logger:      logger,
 	}
 	logger.Debugf("New game room created with UUID: %s", uuid)
@@ -66,6 +132,176 @@ func (g *GameRoom) RemoveClient(Client *Client) {
 	}
 }
 
+// join seats a client in an open room, sealing the room once it is full.
+// Disconnected clients lose their seat first, so the game starts with everyone there.
+func (g *GameRoom) join(client *Client) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.open {
+		return errors.New("it is not open to players")
+	}
+	if g.sealed || g.GameStarted {
+		return errors.New("its game has started")
+	}
+	connected := g.Clients[:0]
+	for _, seated := range g.Clients {
+		if seated.IsConnected() {
+			connected = append(connected, seated)
+		}
+	}
+	g.Clients = connected
+	if g.isFullLocked() {
+		return errors.New("it is full")
+	}
+	g.Clients = append(g.Clients, client)
+	g.NumPlayers = uint8(len(g.Clients))
+	g.sealed = g.isFullLocked()
+	return nil
+}
+
+// isSealed tells if the room is full and its game about to start
+func (g *GameRoom) isSealed() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.sealed
+}
+
+// leave takes a client out of an open room, telling if it left and if the
+// room is empty now. Nobody leaves a sealed room.
+func (g *GameRoom) leave(client *Client) (left bool, empty bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.sealed || g.GameStarted {
+		return false, false
+	}
+	g.Clients = slices.DeleteFunc(g.Clients, func(seated *Client) bool {
+		return seated == client
+	})
+	g.NumPlayers = uint8(len(g.Clients))
+	return true, len(g.Clients) == 0
+}
+
+// AddSpectator lets a client watch the game of the room, reading its chat
+// messages until the end of the game
+func (g *GameRoom) AddSpectator(client *Client) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.GameStarted {
+		return errors.New("its game has not started")
+	}
+	select {
+	case <-g.done:
+		return errors.New("its game is over")
+	default:
+	}
+	g.Spectators = append(g.Spectators, client)
+	g.startRouterLocked(client, nil)
+	return nil
+}
+
+// RemoveSpectator stops sending the game to a client, telling if it was watching
+func (g *GameRoom) RemoveSpectator(client *Client) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	i := slices.Index(g.Spectators, client)
+	if i < 0 {
+		return false
+	}
+	g.Spectators = slices.Delete(g.Spectators, i, i+1)
+	return true
+}
+
+// isPlayer tells if the client plays in the room
+func (g *GameRoom) isPlayer(client *Client) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return slices.Contains(g.Clients, client)
+}
+
+// lobbyRoom describes the room for the lobby
+func (g *GameRoom) lobbyRoom() LobbyRoom {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	status := ROOM_OPEN
+	switch {
+	case g.GameStarted:
+		status = ROOM_RUNNING
+	case g.expected != nil:
+		status = ROOM_RESTORING
+	}
+	players := make([]string, len(g.Clients))
+	for i, client := range g.Clients {
+		players[i] = client.Username
+	}
+	capacity := int(g.Capacity)
+	if g.expected != nil {
+		capacity = len(g.expected)
+	}
+	return LobbyRoom{
+		UUID:       g.UUID,
+		Mode:       g.Mode,
+		Status:     status,
+		Players:    players,
+		Capacity:   capacity,
+		Spectators: len(g.Spectators),
+	}
+}
+
+// IsRestored tells if the room holds a game restored from a snapshot
+func (g *GameRoom) IsRestored() bool {
+	return g.expected != nil
+}
+
+// Expects tells if the room waits for the player with the given UUID and
+// rejoin token, logged in to the given account if they played with one
+func (g *GameRoom) Expects(playerUUID string, rejoinToken string, userID string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.GameStarted {
+		return false
+	}
+	for _, client := range g.Clients {
+		if client.UUID == playerUUID {
+			return false
+		}
+	}
+	for _, player := range g.expected {
+		if player.UUID == playerUUID && player.RejoinToken == rejoinToken {
+			return ownsSeat(player.UserID, userID)
+		}
+	}
+	return false
+}
+
+// Players lists the players in the room, to be saved with its game
+func (g *GameRoom) Players() []RoomPlayer {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	players := make([]RoomPlayer, len(g.Clients))
+	for i, client := range g.Clients {
+		players[i] = RoomPlayer{
+			UUID:        client.UUID,
+			Username:    client.Username,
+			RejoinToken: client.RejoinToken,
+			UserID:      client.UserID,
+		}
+	}
+	return players
+}
+
+// disconnectedClients returns the players of the room who lost their connection
+func (g *GameRoom) disconnectedClients() []*Client {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	dropped := []*Client{}
+	for _, client := range g.Clients {
+		if !client.IsConnected() {
+			dropped = append(dropped, client)
+		}
+	}
+	return dropped
+}
+
 func (g *GameRoom) GetClientsUsername() []string {
 	g.mu.Lock()
 	defer g.mu.Unlock()
@@ -89,30 +325,142 @@ func (g *GameRoom) GetClientsUUID() []string {
 func (g *GameRoom) IsFull() bool {
 	g.mu.Lock()
 	defer g.mu.Unlock()
-	if g.NumPlayers > 2 {
-		// At some point just log this error on the server
-		g.logger.Fatalf("ERROR: Game room is full. Cannot add more clients. Num players: %d", g.NumPlayers)
-	}
-	return g.NumPlayers == 2
+	return g.isFullLocked()
 }
 
 func (g *GameRoom) isFullLocked() bool {
-	if g.NumPlayers > 2 {
-		g.logger.Errorf("Game room is full. Cannot add more clients. Num players: %d", g.NumPlayers)
-		return true
+	if g.expected != nil {
+		return len(g.Clients) >= len(g.expected)
+	}
+	return len(g.Clients) >= int(g.Capacity)
+}
+
+// SetChatHandler sets what happens to the chat messages sent during the game
+func (g *GameRoom) SetChatHandler(handler func(client *Client, chatMsg ChatMessage)) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.onChat = handler
+}
+
+// Broadcast sends a message to everyone in the room, players and spectators
+func (g *GameRoom) Broadcast(messageType protocol.MessageType, payload interface{}) {
+	g.mu.Lock()
+	clients := append(append([]*Client{}, g.Clients...), g.Spectators...)
+	g.mu.Unlock()
+	g.send(clients, messageType, payload)
+}
+
+// sendPlayers sends a message to the players of the room
+func (g *GameRoom) sendPlayers(messageType protocol.MessageType, payload interface{}) {
+	g.mu.Lock()
+	players := append([]*Client{}, g.Clients...)
+	g.mu.Unlock()
+	g.send(players, messageType, payload)
+}
+
+// sendSpectators sends a message to the spectators of the room
+func (g *GameRoom) sendSpectators(messageType protocol.MessageType, payload interface{}) {
+	g.mu.Lock()
+	spectators := append([]*Client{}, g.Spectators...)
+	g.mu.Unlock()
+	g.send(spectators, messageType, payload)
+}
+
+func (g *GameRoom) send(clients []*Client, messageType protocol.MessageType, payload interface{}) {
+	for _, client := range clients {
+		err := client.Conn.Send(messageType, payload)
+		if err != nil {
+			g.logger.Errorf("error sending %s to %s: %v", messageType, client.Username, err)
+		}
+	}
+}
+
+// startRouterLocked reads the messages of a client until the end of the
+// post-game phase of the current game. g.mu must be held.
+func (g *GameRoom) startRouterLocked(client *Client, seat *seat) {
+	g.routers.Add(1)
+	done, postGame := g.done, g.postGame
+	go func() {
+		defer g.routers.Done()
+		g.routeMessages(client, seat, done, postGame)
+	}()
+}
+
+// routeMessages reads the messages of a client while its game runs and after:
+// plays go to the game through the seat of the player, chat to the chat
+// handler and rematch answers to the rematch offer. Once the connection
+// breaks the seat waits for the player to come back, and the rematch is
+// declined. Spectators have no seat.
+func (g *GameRoom) routeMessages(client *Client, seat *seat, done <-chan struct{}, postGame <-chan struct{}) {
+	dispatcher := protocol.NewDispatcher()
+	dispatcher.Handle(protocol.GAME_PLAY, func(envelope protocol.Envelope) error {
+		if seat == nil {
+			return errors.New("spectators can't play")
+		}
+		select {
+		case seat.plays <- envelope:
+		case <-done:
+		}
+		return nil
+	})
+	dispatcher.Handle(protocol.REMATCH, func(envelope protocol.Envelope) error {
+		var rematchMsg RematchMessage
+		err := envelope.Decode(&rematchMsg)
+		if err != nil {
+			return err
+		}
+		return g.answerRematch(client, rematchMsg.Accept)
+	})
+	dispatcher.Handle(protocol.CHAT, func(envelope protocol.Envelope) error {
+		var chatMsg ChatMessage
+		err := envelope.Decode(&chatMsg)
+		if err != nil {
+			return err
+		}
+		g.mu.Lock()
+		onChat := g.onChat
+		g.mu.Unlock()
+		if onChat != nil {
+			onChat(client, chatMsg)
+		}
+		return nil
+	})
+
+	for {
+		select {
+		case envelope, ok := <-client.Conn.Messages():
+			if !ok {
+				if seat != nil {
+					g.playerAway(seat, done)
+				}
+				g.answerRematch(client, false)
+				return
+			}
+			err := dispatcher.Dispatch(envelope)
+			if err != nil {
+				g.logger.Errorf("ignoring message of %s: %v", client.Username, err)
+			}
+		case <-postGame:
+			return
+		}
 	}
-	return g.NumPlayers == 2
 }
 
 func (g *GameRoom) StartGame() {
 	g.logger.Infof("Game on room %s started!\n", g.UUID)
 	g.mu.Lock()
 	defer g.mu.Unlock()
+	if !g.GameStarted {
+		close(g.started)
+	}
 	g.GameStarted = true
 
 	inputProvider := make([]engine.InputProvider, len(g.Game.Players))
 	outputProvider := make([]engine.OutputProvider, len(g.Game.Players))
 
+	clients := make([]*Client, len(g.Game.Players))
+	g.seats = make(map[string]*seat, len(g.Game.Players))
+
 	firstPlayer := g.Game.Players[0]
 
 	for i, player := range g.Game.Players {
@@ -126,14 +474,197 @@ func (g *GameRoom) StartGame() {
 		if matchingClient == nil {
 			g.logger.Errorf("No matching client found for player %s (UUID: %s)",
 				player.Name, player.UUID)
+			// The game can't be played: it is over before it began
+			close(g.done)
 			return
 		}
 
-		inputProvider[i] = engine.NewWebsocketInputProvider(matchingClient.Conn, player.UUID, g.logger)
-		outputProvider[i] = engine.NewWebsocketOutputProvider(matchingClient.Conn, player.UUID, g.logger)
+		seat := newSeat(matchingClient, g.logger)
+		g.seats[player.UUID] = seat
+		clients[i] = matchingClient
+		input := engine.NewWebsocketInputProvider(matchingClient.Conn, player.UUID, g.logger)
+		input.SetSource(seat.plays)
+		inputProvider[i] = input
+		outputProvider[i] = seat
+
+	}
+
+	if g.recorder != nil {
+		inputProvider = g.recorder.Wrap(inputProvider)
+	}
+	// Every player is sent the same table and turn: the spectators get them along with the first one
+	outputProvider[0] = spectatorOutputProvider{OutputProvider: outputProvider[0], room: g}
+	for _, spectator := range g.Spectators {
+		g.startRouterLocked(spectator, nil)
+	}
+
+	// Start the game engine in a separate goroutine, once the room alone
+	// reads the messages of the players: no play may be read elsewhere
+	game, done := g.Game, g.done
+	go func() {
+		defer close(done)
+		g.awaitHandOffs(clients)
+		g.mu.Lock()
+		for _, client := range clients {
+			g.startRouterLocked(client, g.seats[client.UUID])
+		}
+		g.mu.Unlock()
+		game.Start(inputProvider, outputProvider, firstPlayer.UUID)
+	}()
+}
+
+// HandOff tells the room that nothing else reads the messages of the client
+// anymore, so its game may start reading them
+func (g *GameRoom) HandOff(client *Client) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	handedOff := g.handOffLocked(client)
+	select {
+	case <-handedOff:
+	default:
+		close(handedOff)
+	}
+}
+
+// handOffLocked returns the channel closed once the client is handed off to
+// the room. g.mu must be held.
+func (g *GameRoom) handOffLocked(client *Client) chan struct{} {
+	if g.handOffs == nil {
+		g.handOffs = make(map[*Client]chan struct{})
+	}
+	handedOff, ok := g.handOffs[client]
+	if !ok {
+		handedOff = make(chan struct{})
+		g.handOffs[client] = handedOff
+	}
+	return handedOff
+}
+
+// awaitHandOffs waits until every client is handed off to the room, or has
+// lost its connection
+func (g *GameRoom) awaitHandOffs(clients []*Client) {
+	for _, client := range clients {
+		g.mu.Lock()
+		handedOff := g.handOffLocked(client)
+		g.mu.Unlock()
+		select {
+		case <-handedOff:
+		case <-client.Conn.Done():
+		}
+	}
+}
+
+// newRound replaces the game of the room by the game of a rematch, ready to start
+func (g *GameRoom) newRound(game *engine.Game) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.Game = game
+	g.done = make(chan struct{})
+	g.postGame = make(chan struct{})
+	g.offer = nil
+	g.spectatorState = nil
+	g.rematches++
+}
 
+// gameIDLocked identifies the current game of the room: the first one after
+// the room, the rematches after the room and their number. g.mu must be held.
+func (g *GameRoom) gameIDLocked() string {
+	if g.rematches == 0 {
+		return g.UUID
 	}
+	return fmt.Sprintf("%s-%d", g.UUID, g.rematches+1)
+}
 
-	// Start the game engine in a separate goroutine
-	go g.Game.Start(inputProvider, outputProvider, firstPlayer.UUID)
+// endPostGame ends the post-game phase of the current game, once the routers
+// of its clients have stopped reading their messages
+func (g *GameRoom) endPostGame() {
+	g.mu.Lock()
+	g.offer = nil
+	close(g.postGame)
+	g.mu.Unlock()
+	g.routers.Wait()
+}
+
+// finish closes the room: its clients go back to the lobby
+func (g *GameRoom) finish() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	select {
+	case <-g.finished:
+	default:
+		close(g.finished)
+	}
+}
+
+// NotifyDisconnected tells the game in the room, if it is running, that a client dropped
+func (g *GameRoom) NotifyDisconnected(client *Client) {
+	g.mu.Lock()
+	game := g.Game
+	started := g.GameStarted
+	grace := g.graceLocked()
+	g.mu.Unlock()
+
+	if !started || game == nil || !g.isPlayer(client) {
+		return
+	}
+	select {
+	case <-g.Done():
+		return
+	default:
+		game.NotifyDisconnected(client.UUID, grace)
+	}
+}
+
+// Started returns a channel that is closed once the game in the room starts
+func (g *GameRoom) Started() <-chan struct{} {
+	return g.started
+}
+
+// Done returns a channel that is closed once the current game in the room is over
+func (g *GameRoom) Done() <-chan struct{} {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.done
+}
+
+// Finished returns a channel that is closed once the room is over, after the
+// post-game phase of its last game
+func (g *GameRoom) Finished() <-chan struct{} {
+	return g.finished
+}
+
+// spectatorOutputProvider shows the spectators of the room the public part of
+// the states sent to a player: the table and the turn, without any hand
+type spectatorOutputProvider struct {
+	engine.OutputProvider
+	room *GameRoom
+}
+
+func (p spectatorOutputProvider) SendState(table engine.Table, hand engine.Hand, turnState engine.TurnState) {
+	p.OutputProvider.SendState(table, hand, turnState)
+
+	// The engine keeps mutating its table, so the room keeps a copy for the spectators to come
+	state := GameStateMessage{
+		Table: table.Clone(),
+		Hand:  engine.Hand{Cards: []*engine.Card{}},
+		Turn:  turnState,
+	}
+	p.room.mu.Lock()
+	p.room.spectatorState = &state
+	spectators := append([]*Client{}, p.room.Spectators...)
+	p.room.mu.Unlock()
+	p.room.send(spectators, protocol.GAME_STATE, state)
+}
+
+// sendSpectatorState shows a new spectator the last table and turn of the game
+func (g *GameRoom) sendSpectatorState(client *Client) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.spectatorState == nil {
+		return
+	}
+	err := client.Conn.Send(protocol.GAME_STATE, *g.spectatorState)
+	if err != nil {
+		g.logger.Errorf("error sending %s to %s: %v", protocol.GAME_STATE, client.Username, err)
+	}
 }
@@ -1,49 +1,34 @@
 package server
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"mexemexe/internal/auth"
 	"mexemexe/internal/engine"
+	"mexemexe/internal/protocol"
 	"mexemexe/internal/service"
+	"mexemexe/internal/store"
 	"net"
 	"net/http"
-	"regexp"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 )
 
-// SERVER_CAPACITY defines the maximum number of clients that can connect to the server
+// SERVER_CAPACITY is the default maximum number of clients that can connect to the server
 const SERVER_CAPACITY = 20000
 
-// Upgrader defines the websocket upgrader
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		origin := r.Header.Get("Origin")
+// SHUTDOWN_DRAIN_TIMEOUT is the default of how long a shutting down server waits for games in progress
+const SHUTDOWN_DRAIN_TIMEOUT = 2 * time.Minute
 
-		if origin == "" {
-			return true
-		}
-
-		allowedOrigins := []string{
-			"https://mexe-mexe.online",
-			"https://www.mexe-mexe.online",
-		}
-
-		if strings.Contains(origin, "localhost") {
-			return true
-		}
+// RESTORED_ROOM_TIMEOUT is the default of how long a game restored from a snapshot waits for its players
+const RESTORED_ROOM_TIMEOUT = 10 * time.Minute
 
-		for _, allowed := range allowedOrigins {
-			if origin == allowed {
-				return true
-			}
-		}
-		return false
-	},
-}
+const SERVER_RESTARTING_MESSAGE = "The server is restarting. Please try again in a moment."
 
 // GenerateUniqueID generates a unique ID
 func GenerateUniqueID() string {
@@ -55,23 +40,78 @@ type Server struct {
 	Clients  map[string]*Client
 	Rooms    map[string]*GameRoom
 	Capacity int
+	draining bool
 	mu       sync.Mutex
 	config   *ServerConfig
-	uuid     string
-	logger   *service.GameLogger
+	upgrader websocket.Upgrader
+	// authenticator checks the credentials of joining clients, sessions their session tokens
+	authenticator auth.Authenticator
+	sessions      *auth.SessionSigner
+	// snapshots saves the games in progress. Nil when snapshots are disabled.
+	snapshots *SnapshotStore
+	// store keeps the accounts and the finished games
+	store store.Store
+	// matchmaker groups the clients looking for a game
+	matchmaker *Matchmaker
+	// chatFilter checks every chat message
+	chatFilter ChatFilter
+	// lobby pushes the changes of the rooms and players to its subscribers
+	lobby  *Lobby
+	uuid   string
+	logger *service.GameLogger
 }
 
 // Server constructor
 func NewServer(serverConfig *ServerConfig) *Server {
 	uuid := GenerateUniqueID()
-	return &Server{
+	logger := service.NewLogger(serverConfig.logLevel(), uuid)
+
+	err := serverConfig.Validate()
+	if err != nil {
+		logger.Fatalf("%v", err)
+	}
+
+	var snapshots *SnapshotStore
+	if serverConfig.SnapshotDir != "" {
+		snapshots, err = NewSnapshotStore(serverConfig.SnapshotDir)
+		if err != nil {
+			logger.Fatalf("error opening snapshot store: %v", err)
+		}
+	}
+
+	storage, err := serverConfig.openStore()
+	if err != nil {
+		logger.Fatalf("error opening storage: %v", err)
+	}
+
+	authenticator, sessions, err := serverConfig.Auth.newAuthenticator(storage)
+	if err != nil {
+		logger.Fatalf("error setting up authentication: %v", err)
+	}
+
+	s := &Server{
 		Clients:  make(map[string]*Client),
-		Rooms:    make(map[string]*GameRoom, SERVER_CAPACITY),
-		Capacity: SERVER_CAPACITY,
+		Rooms:    make(map[string]*GameRoom, serverConfig.Capacity),
+		Capacity: serverConfig.Capacity,
 		config:   serverConfig,
-		uuid:     uuid,
-		logger:   service.NewLogger(serverConfig.logLevel, uuid),
+		upgrader: websocket.Upgrader{
+			ReadBufferSize:  serverConfig.ReadBufferSize,
+			WriteBufferSize: serverConfig.WriteBufferSize,
+			CheckOrigin: func(r *http.Request) bool {
+				return serverConfig.allowsOrigin(r.Header.Get("Origin"))
+			},
+		},
+		snapshots:     snapshots,
+		store:         storage,
+		authenticator: authenticator,
+		sessions:      sessions,
+		chatFilter:    NewWordFilter(serverConfig.Chat.BlockedWords),
+		lobby:         NewLobby(logger),
+		uuid:          uuid,
+		logger:        logger,
 	}
+	s.matchmaker = NewMatchmaker(serverConfig.Matchmaking.window(), s.startMatch, logger)
+	return s
 }
 
 // AddClient adds a new client to the server
@@ -82,20 +122,43 @@ func (s *Server) AddClient(newClient *Client) {
 	s.Clients[newClient.UUID] = newClient
 }
 
-// RemoveClient removes a client from the server
-func (s *Server) RemoveClient(uuid string) {
-	s.logger.Debugf("Removing client with uuid %s from server", uuid)
+// RemoveClient removes a client from the server, telling the lobby it went
+// offline unless it is still connected from elsewhere. A player who came back
+// on a new connection keeps it.
+func (s *Server) RemoveClient(client *Client) {
+	s.logger.Debugf("Removing client with uuid %s from server", client.UUID)
 	s.mu.Lock()
-	defer s.mu.Unlock()
-	delete(s.Clients, uuid)
+	ok := s.Clients[client.UUID] == client
+	if ok {
+		delete(s.Clients, client.UUID)
+	}
+	online := false
+	for _, other := range s.Clients {
+		if ok && strings.EqualFold(other.Username, client.Username) {
+			online = true
+		}
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		return
+	}
+	s.lobby.Unsubscribe(client)
+	if !online {
+		s.lobby.Publish(LobbyUpdateMessage{
+			Event:  LOBBY_PLAYER_OFFLINE,
+			Player: &LobbyPlayer{Username: client.Username},
+		})
+	}
 }
 
 // AddRoom adds a new room to the server
 func (s *Server) AddRoom(room *GameRoom) {
 	s.logger.Debugf("Adding room %s to server", room.UUID)
 	s.mu.Lock()
-	defer s.mu.Unlock()
 	s.Rooms[room.UUID] = room
+	s.mu.Unlock()
+	s.publishRoom(room)
 }
 
 // RemoveClientFromRoom removes a client from a room
@@ -109,73 +172,120 @@ func (s *Server) RemoveClientFromRoom(room *GameRoom, client *Client) {
 func (s *Server) RemoveRoom(room *GameRoom) {
 	s.logger.Debugf("Removing room %s from server", room.UUID)
 	s.mu.Lock()
-	defer s.mu.Unlock()
+	_, ok := s.Rooms[room.UUID]
 	delete(s.Rooms, room.UUID)
+	s.mu.Unlock()
+
+	if ok {
+		s.lobby.Publish(LobbyUpdateMessage{
+			Event: LOBBY_ROOM_REMOVED,
+			Room:  &LobbyRoom{UUID: room.UUID},
+		})
+	}
+}
+
+// Store returns the storage of the accounts and finished games
+func (s *Server) Store() store.Store {
+	return s.store
 }
 
-// SearchAvailableGameRoom searches for a game room with the specified number of players
-func (s *Server) SearchAvailableGameRoom(numPlayers uint8) (*GameRoom, error) {
+// Close releases the storage. It is called once the server is shut down.
+func (s *Server) Close() error {
+	return s.store.Close()
+}
+
+// IsDraining returns true once the server is shutting down and takes no new games
+func (s *Server) IsDraining() bool {
 	s.mu.Lock()
-	s.logger.Debugf("Searching among %d rooms", len(s.Rooms))
+	defer s.mu.Unlock()
+	return s.draining
+}
 
-	candidateRooms := make([]*GameRoom, 0, len(s.Rooms))
+// Shutdown stops the server from starting new games, warns the connected
+// clients and waits for the games in progress to finish until ctx is done.
+// Clients still connected are then disconnected. It returns ctx.Err() if some
+// games had to be cut short.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.draining = true
+	clients := make([]*Client, 0, len(s.Clients))
+	for _, client := range s.Clients {
+		clients = append(clients, client)
+	}
+	rooms := make([]*GameRoom, 0, len(s.Rooms))
+	for _, room := range s.Rooms {
+		rooms = append(rooms, room)
+	}
+	s.mu.Unlock()
 
-	for id, room := range s.Rooms {
-		s.logger.Debugf("Examining room %s", id)
+	s.logger.Infof("Shutting down with %d clients in %d rooms", len(clients), len(rooms))
+	for _, client := range clients {
+		s.sendNotice(client.Conn, "The server is restarting. Games in progress can finish, but no new game can start.")
+	}
 
-		if room == nil {
-			continue
+	// Clients waiting for an opponent won't get one
+	closeClients(s.matchmaker.Stop())
+	for _, room := range rooms {
+		room.mu.Lock()
+		started := room.GameStarted
+		waiting := append([]*Client{}, room.Clients...)
+		room.mu.Unlock()
+		if !started {
+			closeClients(waiting)
 		}
+	}
 
+	var err error
+	for _, room := range rooms {
 		room.mu.Lock()
-		clientCount := len(room.Clients)
-		gameStarted := room.GameStarted
-
-		// Check if client list is nil
-		if room.Clients == nil {
-			s.logger.Debugf("Room %s has nil Clients slice!", id)
+		started := room.GameStarted
+		room.mu.Unlock()
+		if !started {
+			continue
 		}
-
-		// Check individual clients
-		for i, client := range room.Clients {
-			if client == nil {
-				s.logger.Debugf("Room %s has nil client at index %d!", id, i)
-			} else {
-				s.logger.Debugf("Room %s has nil client at index %d!", id, i)
-
-			}
+		select {
+		case <-room.Done():
+		case <-ctx.Done():
+			err = ctx.Err()
 		}
-		room.mu.Unlock()
-
-		s.logger.Debugf("Room %s has %d clients, started: %v", id, clientCount, gameStarted)
+		if err != nil {
+			s.logger.Infof("Shutdown deadline reached, cutting games short")
+			break
+		}
+	}
+	// Players dropped from games cut short end them without a winner, rather
+	// than leaving them to the others
+	if err != nil {
+		for _, room := range rooms {
+			room.abandon()
+		}
+	}
 
-		candidateRooms = append(candidateRooms, room)
+	s.mu.Lock()
+	clients = clients[:0]
+	for _, client := range s.Clients {
+		clients = append(clients, client)
 	}
 	s.mu.Unlock()
-
-	var bestRoom *GameRoom
-	var bestPlayerCount int = -1
-
-	for _, room := range candidateRooms {
-		room.mu.Lock()
-		clientCount := len(room.Clients)
-		isAvailable := !room.GameStarted &&
-			clientCount < int(numPlayers) &&
-			clientCount > 0
-		room.mu.Unlock()
-
-		if isAvailable && clientCount > bestPlayerCount {
-			bestRoom = room
-			bestPlayerCount = clientCount
-		}
+	for _, client := range clients {
+		s.sendNotice(client.Conn, "The server is shutting down.")
 	}
+	closeClients(clients)
+	return err
+}
 
-	if bestRoom != nil {
-		s.logger.Debugf("Found available game room: %s with %d/%d players",
-			bestRoom.UUID, bestPlayerCount, numPlayers)
-		return bestRoom, nil
+// closeClients closes the connections of the clients in parallel, as each
+// close may wait for the messages still queued to be written
+func closeClients(clients []*Client) {
+	var wg sync.WaitGroup
+	for _, client := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client.Conn.Close()
+		}()
 	}
-	return nil, nil
+	wg.Wait()
 }
 
 // GetCurrentCapacity returns the current number of connected clients
@@ -192,18 +302,6 @@ func (s *Server) IsAtMaximumCapacity() bool {
 	return len(s.Clients) >= s.Capacity
 }
 
-// AuthenticateUser checks if the user is authenticated
-func (s *Server) AuthenticateUser(username string, ws *websocket.Conn) bool {
-	if len(strings.TrimSpace(username)) < 2 {
-		return false
-	}
-	if len(username) > 30 {
-		return false
-	}
-	matched, _ := regexp.MatchString("^[a-zA-Z0-9_]+$", username)
-	return matched
-}
-
 // parseRemoteAddr parses the remote address of a websocket connection into an IP and port
 func parseRemoteAddr(addr string) (string, string) {
 	host, port, err := net.SplitHostPort(addr)
@@ -216,20 +314,46 @@ func parseRemoteAddr(addr string) (string, string) {
 // HandleConnections handles incoming websocket connections to the server
 func (s *Server) HandleConnections(w http.ResponseWriter, r *http.Request) {
 	// Establish a websocket connection
-	ws, err := upgrader.Upgrade(w, r, nil)
+	ws, err := s.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		s.logger.Errorf("error upgrading connection: %v", err)
 		return
 	}
-	defer ws.Close()
+	conn := protocol.NewConnWithOptions(ws, s.config.connOptions())
+	defer conn.Close()
 
 	s.logger.Info("New connection established. Client connecting Address: " + r.RemoteAddr)
 
 	// Read join message from client
+	envelope, err := conn.Receive()
+	if err != nil {
+		s.logger.Errorf("error reading join message: %v", err)
+		return
+	}
+	if envelope.Type != protocol.JOIN {
+		s.logger.Errorf("expected join message, got %s", envelope.Type)
+		s.sendError(conn, "The first message must be a join message.")
+		return
+	}
+
+	// Check the client speaks a protocol version this server understands
+	if !protocol.IsCompatibleVersion(envelope.Version) {
+		s.logger.Infof("Client from %s uses incompatible protocol version %d", r.RemoteAddr, envelope.Version)
+		s.sendError(conn, fmt.Sprintf("Protocol version %d is not supported. The server accepts versions %d to %d, please update your client.",
+			envelope.Version, protocol.MIN_PROTOCOL_VERSION, protocol.PROTOCOL_VERSION))
+		return
+	}
+
 	var joinMsg JoinServerMessage
-	err = ws.ReadJSON(&joinMsg)
+	err = envelope.Decode(&joinMsg)
 	if err != nil {
 		s.logger.Errorf("error reading join message: %v", err)
+		s.sendError(conn, "Malformed join message.")
+		return
+	}
+
+	if s.IsDraining() {
+		s.sendError(conn, SERVER_RESTARTING_MESSAGE)
 		return
 	}
 
@@ -238,7 +362,7 @@ func (s *Server) HandleConnections(w http.ResponseWriter, r *http.Request) {
 		maxMsg := MaxCapacityMessage{
 			Message: "Server is at maximum capacity. Please try again later.",
 		}
-		err = ws.WriteJSON(maxMsg)
+		err = conn.Send(protocol.MAX_CAPACITY, maxMsg)
 		if err != nil {
 			s.logger.Errorf("error writing max capacity message: %v", err)
 		}
@@ -247,191 +371,562 @@ func (s *Server) HandleConnections(w http.ResponseWriter, r *http.Request) {
 
 	// Authenticate user
 	s.logger.Infof("Authenticating client from %s", r.RemoteAddr)
-	if !s.AuthenticateUser(joinMsg.Username, ws) {
-		s.logger.Infof("Authentication failed for client from %s", r.RemoteAddr)
-		errorMsg := ErrorMessage{
-			Message: "Authentication failed. Please create an account and try again.",
-		}
-		err = ws.WriteJSON(errorMsg)
-		if err != nil {
-			s.logger.Errorf("error writing auth error message: %v", err)
-		}
+	identity, err := s.authenticate(joinMsg)
+	if err != nil {
+		s.logger.Infof("Authentication failed for client from %s: %v", r.RemoteAddr, err)
+		s.sendError(conn, authErrorMessage(err))
 		return
 	}
 
 	// Create a new client and register it in the server
 	ip, port := parseRemoteAddr(r.RemoteAddr)
 	uuid := GenerateUniqueID()
-	newClient := NewClient(ip, port, joinMsg.Username, uuid, ws)
-	s.AddClient(newClient)
+	newClient := NewClient(ip, port, identity.Username, uuid, conn)
+	newClient.UserID = identity.UserID
+	newClient.RejoinToken = GenerateUniqueID()
+	err = s.addUniqueClient(newClient)
+	if err != nil {
+		s.logger.Infof("Refusing client from %s: %v", r.RemoteAddr, err)
+		s.sendError(conn, fmt.Sprintf("The username %s is already playing. Please choose another one.", identity.Username))
+		return
+	}
 
 	// Ensure client cleanup on function exit
 	defer func() {
-		s.RemoveClient(newClient.UUID)
+		s.RemoveClient(newClient)
 		s.logger.Infof("Client %s disconnected and removed", newClient.UUID)
 	}()
 
 	// Send welcome message to client
 	welcomeMsg := WelcomeMessage{
-		Message:    "Welcome to mexe-mexe.com!",
-		PlayerUUID: uuid,
+		Message:      "Welcome to mexe-mexe.com!",
+		PlayerUUID:   uuid,
+		Username:     identity.Username,
+		RejoinToken:  newClient.RejoinToken,
+		SessionToken: s.sessions.Issue(identity, time.Now()),
 	}
-	err = ws.WriteJSON(welcomeMsg)
+	err = conn.Send(protocol.WELCOME, welcomeMsg)
 	if err != nil {
 		s.logger.Errorf("error writing welcome message: %v", err)
 		return
 	}
 
-	// Wait for start game message from client
-	var startMsg StartGameMessage
-	err = ws.ReadJSON(&startMsg)
+	// Answer the lobby and rating requests until the client gets a game. A
+	// client that cancels its search, leaves its room or whose room is over is
+	// back here, free to search again.
+	var room *GameRoom
+	dispatcher := protocol.NewDispatcher()
+	dispatcher.Handle(protocol.START_GAME, func(envelope protocol.Envelope) error {
+		var startMsg StartGameMessage
+		err := envelope.Decode(&startMsg)
+		if err != nil {
+			return err
+		}
+		room, err = s.handleStartGameMessage(newClient, startMsg)
+		return err
+	})
+	s.handleLobbyMessages(dispatcher, newClient)
+
+	for {
+		for room == nil {
+			envelope, err = conn.Receive()
+			if err != nil {
+				s.logger.Errorf("error reading start message: %v", err)
+				return
+			}
+			err = dispatcher.Dispatch(envelope)
+			if err != nil {
+				s.logger.Errorf("error handling %s message: %v", envelope.Type, err)
+				return
+			}
+		}
+		if !s.stayInRoom(room, newClient) {
+			return
+		}
+		room = nil
+	}
+}
+
+// stayInRoom waits while the room reads the client messages, through its games
+// and their post-game phases. It returns false once the connection breaks, so
+// the cleanups run, and true once the room is over and the client back in the lobby.
+func (s *Server) stayInRoom(room *GameRoom, client *Client) bool {
+	room.HandOff(client)
+	s.logger.Infof("Client %s setup complete, waiting for disconnection or the end of room %s", client.UUID, room.UUID)
+	select {
+	case <-client.Conn.Done():
+		s.logger.Infof("Client %s connection lost: %v", client.UUID, client.Conn.Err())
+		room.NotifyDisconnected(client)
+		s.leaveRoom(room, client)
+		return false
+	case <-room.Finished():
+		s.logger.Infof("Room %s of client %s is over, back to the lobby", room.UUID, client.UUID)
+		s.setStatus(client, STATUS_IDLE)
+		return true
+	}
+}
+
+// sendError tells the client why its request was refused
+func (s *Server) sendError(conn *protocol.Conn, message string) {
+	err := conn.Send(protocol.ERROR, ErrorMessage{Message: message})
 	if err != nil {
-		s.logger.Errorf("error reading start message: %v", err)
-		return
+		s.logger.Errorf("error writing error message: %v", err)
+	}
+}
+
+// sendNotice sends a message from the server operators to the client
+func (s *Server) sendNotice(conn *protocol.Conn, message string) {
+	err := conn.Send(protocol.SERVER_NOTICE, ServerNoticeMessage{Message: message})
+	if err != nil {
+		s.logger.Errorf("error writing server notice: %v", err)
 	}
+}
 
-	// Handle the start message
+// handleStartGameMessage processes the action requested in a start game message
+func (s *Server) handleStartGameMessage(client *Client, startMsg StartGameMessage) (*GameRoom, error) {
 	switch startMsg.Action {
 	case "start":
-		room, err := s.handleStartGame(newClient, ws)
-		if err != nil {
-			s.logger.Errorf("error handling start game: %v", err)
-			return
-		}
-		if room != nil {
-			defer func() {
-				s.RemoveRoom(room)
-				s.logger.Infof("Room %s was removed", room.UUID)
-			}()
-		}
+		return s.handleStartGame(client, startMsg)
 
 	case "rejoin":
-		s.handleRejoin()
+		return s.handleRejoin(client, startMsg)
+
+	case "create":
+		return s.handleCreateRoom(client, startMsg)
+
+	case "join":
+		return s.handleJoinRoom(client, startMsg)
+
+	case "spectate":
+		return s.handleSpectate(client, startMsg)
+
+	case "cancel":
+		s.sendError(client.Conn, "You are not searching for a game.")
+		return nil, nil
 
 	default:
-		s.logger.Errorf("unknown action: %s", startMsg.Action)
-		errorMsg := ErrorMessage{
-			Message: "Unknown action. Please try again.",
-		}
-		err = ws.WriteJSON(errorMsg)
-		if err != nil {
-			s.logger.Errorf("error writing unknown action error: %v", err)
-		}
-		return
+		s.sendError(client.Conn, "Unknown action. Please try again.")
+		return nil, fmt.Errorf("unknown action: %s", startMsg.Action)
 	}
-
-	// After handling start game, just wait for the connection to close
-	s.logger.Infof("Client %s setup complete, waiting for natural disconnection", newClient.UUID)
-	select {}
 }
 
-// handleStartGame processes the start game request
-func (s *Server) handleStartGame(client *Client, ws *websocket.Conn) (*GameRoom, error) {
+// handleStartGame queues the client for a game and waits until it is matched,
+// returning its room. A client that cancels its search gets no room and no
+// error, and a client that disconnects gets an error.
+func (s *Server) handleStartGame(client *Client, startMsg StartGameMessage) (*GameRoom, error) {
+	if s.IsDraining() {
+		s.sendError(client.Conn, SERVER_RESTARTING_MESSAGE)
+		return nil, errors.New("server is shutting down")
+	}
+	key, err := s.queueKey(startMsg)
+	if err != nil {
+		s.sendError(client.Conn, "Can't search for that game: "+err.Error()+".")
+		return nil, err
+	}
+
 	waitingMsg := JoinedGameRoomMessage{
 		Message: "Searching for an available game room. Please wait ...",
 	}
-	err := ws.WriteJSON(waitingMsg)
+	err = client.Conn.Send(protocol.JOINED_GAME_ROOM, waitingMsg)
 	if err != nil {
 		return nil, err
 	}
 
-	s.logger.Infof("Searching for an available game room to place client %s", client.UUID)
-	room, err := s.SearchAvailableGameRoom(engine.NUM_PLAYERS)
+	client.Rating = s.playerRating(client)
+	s.logger.Infof("Queueing client %s, rated %.0f, for a %s game of %d players", client.UUID, client.Rating, key.Mode, key.Players)
+	ticket, err := s.matchmaker.Enqueue(client, key)
+	if err != nil {
+		s.sendError(client.Conn, SERVER_RESTARTING_MESSAGE)
+		return nil, err
+	}
+	s.setStatus(client, STATUS_SEARCHING)
+	joinedMsg := JoinedGameRoomMessage{
+		Message: fmt.Sprintf("Joined the queue. Waiting for %d more players to join ...", key.Players-1),
+	}
+	err = client.Conn.Send(protocol.JOINED_GAME_ROOM, joinedMsg)
 	if err != nil {
-		errorMsg := "Error finding game room: " + err.Error()
-		return nil, ws.WriteJSON(errorMsg)
+		s.matchmaker.Cancel(ticket)
+		return nil, err
 	}
 
-	s.logger.Debugf("Found room: %v", room)
+	// Keep answering the client while it waits, until it cancels
+	cancelled := false
+	dispatcher := protocol.NewDispatcher()
+	dispatcher.Handle(protocol.START_GAME, func(envelope protocol.Envelope) error {
+		var startMsg StartGameMessage
+		err := envelope.Decode(&startMsg)
+		if err != nil {
+			return err
+		}
+		if startMsg.Action != "cancel" {
+			s.sendError(client.Conn, "You are already searching for a game, cancel the search first.")
+			return nil
+		}
+		cancelled = true
+		return nil
+	})
+	s.handleLobbyMessages(dispatcher, client)
+
+	for !cancelled {
+		select {
+		case room := <-ticket.Matched():
+			return s.matchedRoom(client, room)
+
+		case envelope, ok := <-client.Conn.Messages():
+			if ok {
+				err = dispatcher.Dispatch(envelope)
+			}
+			if !ok || err != nil {
+				if s.matchmaker.Cancel(ticket) {
+					return nil, fmt.Errorf("client %s left the queue: %v", client.UUID, client.Conn.Err())
+				}
+				// Matched while leaving: the game finds out the client is gone
+				return s.matchedRoom(client, <-ticket.Matched())
+			}
+		}
+	}
 
-	// If room is available, add client to it
-	if room != nil {
-		return room, s.joinExistingRoom(client, room, ws)
+	if !s.matchmaker.Cancel(ticket) {
+		s.logger.Infof("Client %s cancelled its search too late, its game is starting", client.UUID)
+		return s.matchedRoom(client, <-ticket.Matched())
 	}
+	s.logger.Infof("Client %s cancelled its search", client.UUID)
+	s.setStatus(client, STATUS_IDLE)
+	err = client.Conn.Send(protocol.SEARCH_CANCELLED, SearchCancelledMessage{
+		Message: "Search cancelled. You left the queue.",
+	})
+	return nil, err
+}
 
-	// If no room is available, create a new one
-	room = s.createNewRoom()
-	s.AddRoom(room)
-	s.logger.Debugf("Adding client %s to room %s", client.UUID, room.UUID)
-	room.AddClient(client)
-	s.logger.Debugf("Room has %d clients", len(room.Clients))
-	s.logger.Debugf("Room clients usernames: %v", room.GetClientsUsername())
+// matchedRoom returns the room a ticket of the client was matched with. The
+// matchmaker sends no room for a client it found disconnected.
+func (s *Server) matchedRoom(client *Client, room *GameRoom) (*GameRoom, error) {
+	if room == nil {
+		return nil, fmt.Errorf("client %s disconnected while queued", client.UUID)
+	}
+	return room, nil
+}
 
-	joinedMsg := JoinedGameRoomMessage{
-		Message: "Joined game room. Waiting for an opponent to join ...",
+// startGameInRoom initializes and starts a game in the given room. A player
+// may drop between being seated and the deal: then no game is played, and
+// the others go back to the lobby.
+func (s *Server) startGameInRoom(room *GameRoom) {
+	if dropped := room.disconnectedClients(); len(dropped) > 0 {
+		s.logger.Infof("Client %s dropped before the game of room %s started, cancelling it", dropped[0].UUID, room.UUID)
+		s.RemoveRoom(room)
+		room.Broadcast(protocol.BACK_TO_LOBBY, BackToLobbyMessage{
+			Message: fmt.Sprintf("%s left before the game started. Back to the lobby.", dropped[0].Username),
+		})
+		room.finish()
+		return
 	}
-	s.logger.Infof("Joined game room: %s. Waiting for an opponent to join ...", room.UUID)
-	err = ws.WriteJSON(joinedMsg)
-	if err != nil {
-		return nil, err
+
+	playersUUIDs := room.GetClientsUUID()
+	playersUsernames := room.GetClientsUsername()
+	config := s.config.newGameConfig(playersUsernames, playersUUIDs)
+	newGame := engine.NewGame(config, room.logger)
+	room.AddGame(newGame)
+	s.runGame(room)
+}
+
+// runGame starts the game of the room, saved and recorded, and its post-game
+// phase once it is over
+func (s *Server) runGame(room *GameRoom) {
+	s.checkpointRoom(room)
+	s.recordGame(room)
+	room.SetChatHandler(s.chatHandler(room))
+	room.SetReconnectGrace(s.config.ReconnectGrace)
+
+	// Don't send separate "Game started!" message - the initial game state serves this purpose
+	room.mu.Lock()
+	game := room.Game
+	room.mu.Unlock()
+	done := room.Done()
+	room.StartGame()
+	s.logger.Infof("Game in room %s started!", room.UUID)
+	s.publishGameStarted(room)
+	go s.afterGame(room, game, done)
+}
+
+// publishGameStarted tells the lobby the game of the room is running and its
+// players busy. Playing clients get no lobby updates.
+func (s *Server) publishGameStarted(room *GameRoom) {
+	room.mu.Lock()
+	clients := append([]*Client{}, room.Clients...)
+	room.mu.Unlock()
+	for _, client := range clients {
+		s.lobby.Unsubscribe(client)
+		s.setStatus(client, STATUS_PLAYING)
 	}
-	return room, nil
+	s.publishRoom(room)
 }
 
-// joinExistingRoom adds client to an existing room
-func (s *Server) joinExistingRoom(client *Client, room *GameRoom, ws *websocket.Conn) error {
-	room.AddClient(client)
+// handleRejoin gives a client its seat back in a game restored from a
+// snapshot, or in a running game it lost its connection to
+func (s *Server) handleRejoin(client *Client, startMsg StartGameMessage) (*GameRoom, error) {
+	var room *GameRoom
+	running := false
+	s.mu.Lock()
+	for _, candidate := range s.Rooms {
+		if candidate.IsRestored() && candidate.Expects(startMsg.PlayerUUID, startMsg.RejoinToken, client.UserID) {
+			room = candidate
+			break
+		}
+		if candidate.awaits(startMsg.PlayerUUID, startMsg.RejoinToken, client.UserID) {
+			room, running = candidate, true
+			break
+		}
+	}
+	s.mu.Unlock()
+
+	if room == nil {
+		s.sendError(client.Conn, "There is no game to rejoin.")
+		return nil, fmt.Errorf("no game to rejoin for player %s", startMsg.PlayerUUID)
+	}
+
+	// The client plays as the player it was before the restart
+	s.mu.Lock()
+	delete(s.Clients, client.UUID)
+	client.UUID = startMsg.PlayerUUID
+	client.RejoinToken = startMsg.RejoinToken
+	s.Clients[client.UUID] = client
+	s.mu.Unlock()
 
+	if running {
+		return s.reconnectPlayer(room, client)
+	}
+	room.AddClient(client)
+	s.logger.Infof("Player %s rejoined room %s", client.UUID, room.UUID)
 	joinedMsg := JoinedGameRoomMessage{
-		Message: "Joined game room. Waiting for an opponent to join ...",
+		Message: "Rejoined your game. Waiting for the other players to come back ...",
 	}
-	s.logger.Infof("Client %s joined game room: %s.", client.UUID, room.UUID)
-	err := ws.WriteJSON(joinedMsg)
+	err := client.Conn.Send(protocol.JOINED_GAME_ROOM, joinedMsg)
 	if err != nil {
-		return err
+		return room, err
 	}
 
-	// If room is full, start the game
 	if room.IsFull() {
-		s.startGameInRoom(room)
+		s.logger.Infof("Game in room %s resumes", room.UUID)
+		s.runGame(room)
 	}
+	return room, nil
+}
+
+// leaveRoom cleans up after a client of the room disconnected. A restored room
+// keeps waiting for its other players until its game starts, a started or
+// sealed game keeps the seat of the player for them to come back, and
+// spectators leave without closing the room.
+func (s *Server) leaveRoom(room *GameRoom, client *Client) {
+	if room.RemoveSpectator(client) {
+		s.publishRoom(room)
+		return
+	}
+	room.mu.Lock()
+	started := room.GameStarted
+	room.mu.Unlock()
 
-	return nil
+	if room.IsRestored() && !started {
+		room.RemoveClient(client)
+		return
+	}
+	// The room closes once the game is over, with or without the player
+	if started || room.isSealed() {
+		return
+	}
+	s.RemoveRoom(room)
+	s.logger.Infof("Room %s was removed", room.UUID)
 }
 
-// createNewRoom creates a new game room and adds the client
-func (s *Server) createNewRoom() *GameRoom {
-	s.logger.Debugf("No room available. Creating a new room.")
-	room := NewGameRoom(s.config.logLevel)
-	s.logger.Debugf("New room created with UUID: %s", room.UUID)
-	return room
+// checkpointRoom saves the game of the room now and after every turn, and
+// deletes the snapshot once the game is over. Snapshots of games cut short
+// without a result are kept, to be restored when the server starts again.
+func (s *Server) checkpointRoom(room *GameRoom) {
+	if s.snapshots == nil {
+		return
+	}
+
+	players := room.Players()
+	room.mu.Lock()
+	game := room.Game
+	room.mu.Unlock()
+	done := room.Done()
+	save := func(game *engine.Game) {
+		snapshot := RoomSnapshot{
+			Version:  ROOM_SNAPSHOT_VERSION,
+			RoomUUID: room.UUID,
+			Players:  players,
+			Game:     game.Snapshot(),
+		}
+		err := s.snapshots.Save(snapshot)
+		if err != nil {
+			s.logger.Errorf("error saving snapshot of room %s: %v", room.UUID, err)
+		}
+	}
+	save(game)
+	game.SetTurnEndHook(save)
+
+	go func() {
+		<-done
+		result := game.Result()
+		if !result.Finished() || result.Outcome == engine.OUTCOME_ABANDONED {
+			return
+		}
+		err := s.snapshots.Remove(room.UUID)
+		if err != nil {
+			s.logger.Errorf("error removing snapshot of room %s: %v", room.UUID, err)
+		}
+	}()
 }
 
-// startGameInRoom initializes and starts a game in the given room
-func (s *Server) startGameInRoom(room *GameRoom) {
-	playersUUIDs := room.GetClientsUUID()
-	playersUsernames := room.GetClientsUsername()
-	config := engine.NewGameConfig(playersUsernames, playersUUIDs)
-	newGame := engine.NewGame(config, room.logger)
-	room.AddGame(newGame)
+// recordGame records the plays of the game in the room, and saves the game
+// with its result and replay once it is over. A restored game is replayed
+// from where it resumed. Games cut short without a winner, as by a shutdown,
+// are not saved: they have no result to rate, and resume from their snapshot
+// when the server starts again if snapshots are on.
+func (s *Server) recordGame(room *GameRoom) {
+	room.mu.Lock()
+	players := make([]store.PlayerRecord, len(room.Clients))
+	for i, client := range room.Clients {
+		players[i] = store.PlayerRecord{
+			PlayerUUID: client.UUID,
+			UserID:     client.UserID,
+			Username:   client.Username,
+		}
+	}
+	game := room.Game
+	recorder := engine.NewReplayRecorder(game)
+	room.recorder = recorder
+	done := room.done
+	gameID := room.gameIDLocked()
+	room.mu.Unlock()
+	startedAt := time.Now().UTC()
+
+	go func() {
+		<-done
+		result := game.Result()
+		if !result.Finished() {
+			return
+		}
+		if result.Outcome == engine.OUTCOME_ABANDONED {
+			return
+		}
 
-	// Don't send separate "Game started!" message - the initial game state serves this purpose
-	room.StartGame()
-	s.logger.Infof("Game in room %s started!", room.UUID)
+		replay, err := recorder.Replay().Marshal()
+		if err != nil {
+			s.logger.Errorf("error encoding replay of room %s: %v", room.UUID, err)
+		}
+		record := store.GameRecord{
+			ID:        gameID,
+			StartedAt: startedAt,
+			EndedAt:   time.Now().UTC(),
+			Players:   players,
+			Result:    result,
+			Replay:    replay,
+		}
+		err = s.store.SaveGame(record)
+		if err != nil {
+			s.logger.Errorf("error saving game %s of room %s: %v", gameID, room.UUID, err)
+			return
+		}
+		s.logger.Infof("Game %s of room %s saved: %s", gameID, room.UUID, result.Outcome)
+	}()
 }
 
-// handleRejoin processes rejoin requests (implement as needed)
-func (s *Server) handleRejoin() {
-	s.logger.Fatalf("Rejoin functionality not yet implemented.")
+// RestoreRooms loads the games saved in the snapshot directory. Each waits in
+// its own room for its players to rejoin, for up to the configured restored room timeout.
+// It returns how many games were restored.
+func (s *Server) RestoreRooms() (int, error) {
+	if s.snapshots == nil {
+		return 0, nil
+	}
+
+	snapshots, loadErr := s.snapshots.LoadAll()
+	restored := 0
+	for _, snapshot := range snapshots {
+		game, err := engine.RestoreGame(snapshot.Game, service.NewLogger(s.config.logLevel(), snapshot.RoomUUID))
+		if err != nil {
+			s.logger.Errorf("error restoring room %s: %v", snapshot.RoomUUID, err)
+			continue
+		}
+		room := NewRestoredGameRoom(snapshot, game, s.config.logLevel())
+		s.AddRoom(room)
+		restored++
+		s.logger.Infof("Restored room %s, waiting for its players", room.UUID)
+
+		time.AfterFunc(s.config.RestoredRoomTimeout, func() {
+			s.expireRestoredRoom(room)
+		})
+	}
+	return restored, loadErr
+}
+
+// expireRestoredRoom drops a restored game whose players did not all come back
+func (s *Server) expireRestoredRoom(room *GameRoom) {
+	room.mu.Lock()
+	started := room.GameStarted
+	waiting := append([]*Client{}, room.Clients...)
+	room.mu.Unlock()
+	if started {
+		return
+	}
+
+	s.logger.Infof("Players of restored room %s did not come back, dropping it", room.UUID)
+	for _, client := range waiting {
+		s.sendError(client.Conn, "The other players did not come back. The game was cancelled.")
+	}
+	closeClients(waiting)
+	s.RemoveRoom(room)
+	err := s.snapshots.Remove(room.UUID)
+	if err != nil {
+		s.logger.Errorf("error removing snapshot of room %s: %v", room.UUID, err)
+	}
 }
 
 // Client defines a connected client
 type Client struct {
 	IP       string
 	Port     string
-	Conn     *websocket.Conn
+	Conn     *protocol.Conn
 	UUID     string
 	Username string
+	// UserID is the account of the client, empty for guests
+	UserID      string
+	RejoinToken string
+	// Rating is the rating of the client when it started searching for a game
+	Rating float64
+	// chatLimiter slows down a client flooding the chat
+	chatLimiter *rateLimiter
+	// status is what the client is doing, as the lobby shows it
+	status string
+	mu     sync.Mutex
+}
+
+// lobbyPlayer describes the client for the lobby
+func (c *Client) lobbyPlayer() LobbyPlayer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return LobbyPlayer{Username: c.Username, Status: c.status}
+}
+
+// IsConnected tells if the connection of the client is still open
+func (c *Client) IsConnected() bool {
+	select {
+	case <-c.Conn.Done():
+		return false
+	default:
+		return true
+	}
 }
 
 // NewClient is Client constructor
-func NewClient(ip string, port string, username string, uuid string, conn *websocket.Conn) *Client {
+func NewClient(ip string, port string, username string, uuid string, conn *protocol.Conn) *Client {
 	client := Client{
 		IP:       ip,
 		Port:     port,
 		Conn:     conn,
 		UUID:     uuid,
 		Username: username,
+		status:   STATUS_IDLE,
 	}
 	return &client
 }
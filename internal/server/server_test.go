@@ -0,0 +1,987 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"mexemexe/internal/auth"
+	"mexemexe/internal/engine"
+	"mexemexe/internal/protocol"
+	"mexemexe/internal/rating"
+	"mexemexe/internal/service"
+	"mexemexe/internal/store"
+
+	"github.com/gorilla/websocket"
+)
+
+const TEST_TIMEOUT = 10 * time.Second
+
+// newTestServer runs a Server behind an httptest server and returns its websocket URL
+func newTestServer(t *testing.T) (*Server, string) {
+	t.Helper()
+	return newTestServerWithConfig(t, NewServerConfig(service.LEVEL_ERROR))
+}
+
+func newTestServerWithConfig(t *testing.T, config *ServerConfig) (*Server, string) {
+	t.Helper()
+	s := NewServer(config)
+	ts := httptest.NewServer(http.HandlerFunc(s.HandleConnections))
+	t.Cleanup(ts.Close)
+	return s, "ws" + strings.TrimPrefix(ts.URL, "http")
+}
+
+// fakeClient speaks the client side of the protocol over a real websocket
+type fakeClient struct {
+	t        *testing.T
+	username string
+	uuid     string
+	token    string
+	ws       *websocket.Conn
+	conn     *protocol.Conn
+	states   []GameStateMessage
+	notices  []string
+	// gameOver is the end of the last game played
+	gameOver *GameOverMessage
+}
+
+func dialFakeClient(t *testing.T, url string, username string) *fakeClient {
+	t.Helper()
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	ws.SetReadDeadline(time.Now().Add(TEST_TIMEOUT))
+
+	return &fakeClient{
+		t:        t,
+		username: username,
+		ws:       ws,
+		conn:     protocol.NewConn(ws),
+	}
+}
+
+// join goes through the join handshake and asks to be placed in a game room
+func (c *fakeClient) join() {
+	c.t.Helper()
+	c.welcome()
+	c.queue(StartGameMessage{Action: "start"})
+}
+
+// welcome goes through the join handshake only, staying in the lobby
+func (c *fakeClient) welcome() {
+	c.t.Helper()
+	c.write(protocol.JOIN, JoinServerMessage{Username: c.username})
+
+	var welcomeMsg WelcomeMessage
+	c.read(protocol.WELCOME, &welcomeMsg)
+	if welcomeMsg.PlayerUUID == "" {
+		c.t.Fatalf("%s: welcome message without player UUID: %+v", c.username, welcomeMsg)
+	}
+	c.uuid = welcomeMsg.PlayerUUID
+	c.token = welcomeMsg.RejoinToken
+}
+
+// queue asks to be matched for a game
+func (c *fakeClient) queue(startMsg StartGameMessage) {
+	c.t.Helper()
+	c.write(protocol.START_GAME, startMsg)
+
+	// "Searching for a room" followed by "Joined the queue"
+	var joinedMsg JoinedGameRoomMessage
+	c.read(protocol.JOINED_GAME_ROOM, &joinedMsg)
+	c.read(protocol.JOINED_GAME_ROOM, &joinedMsg)
+}
+
+// rejoin takes back the seat of a player in a restored game
+func (c *fakeClient) rejoin(uuid string, token string) {
+	c.t.Helper()
+	c.write(protocol.JOIN, JoinServerMessage{Username: c.username})
+	var welcomeMsg WelcomeMessage
+	c.read(protocol.WELCOME, &welcomeMsg)
+	c.uuid = uuid
+	c.token = token
+
+	c.write(protocol.START_GAME, StartGameMessage{Action: "rejoin", PlayerUUID: uuid, RejoinToken: token})
+	var joinedMsg JoinedGameRoomMessage
+	c.read(protocol.JOINED_GAME_ROOM, &joinedMsg)
+}
+
+// play draws a card and ends the turn every time it is its turn, until the
+// game is over or the connection is closed. It starts from the last game
+// state already read.
+func (c *fakeClient) play() {
+	endedTurn := false
+	// act plays on a game state, telling if the game is over
+	act := func(state GameStateMessage) bool {
+		if state.Turn.GameEnded {
+			return true
+		}
+		if state.Turn.PlayerUUID != c.uuid {
+			endedTurn = false
+			return false
+		}
+
+		switch {
+		case endedTurn:
+		case !state.Turn.HasDrawedCard:
+			c.write(protocol.GAME_PLAY, GamePlayMessage{Play: engine.NewDrawCardPlay()})
+		default:
+			c.write(protocol.GAME_PLAY, GamePlayMessage{Play: engine.NewEndTurnPlay()})
+			endedTurn = true
+		}
+		return false
+	}
+	if len(c.states) > 0 && act(c.states[len(c.states)-1]) {
+		return
+	}
+
+	for {
+		envelope, err := c.conn.Receive()
+		if err != nil {
+			return
+		}
+		if envelope.Type == protocol.SERVER_NOTICE {
+			var notice ServerNoticeMessage
+			if err := envelope.Decode(&notice); err == nil {
+				c.notices = append(c.notices, notice.Message)
+			}
+		}
+		if envelope.Type == protocol.GAME_OVER {
+			var gameOverMsg GameOverMessage
+			if err := envelope.Decode(&gameOverMsg); err == nil {
+				c.gameOver = &gameOverMsg
+			}
+			return
+		}
+		if envelope.Type != protocol.GAME_STATE {
+			continue
+		}
+		var state GameStateMessage
+		if err := envelope.Decode(&state); err != nil {
+			c.t.Errorf("%s: %v", c.username, err)
+			return
+		}
+		c.states = append(c.states, state)
+		if act(state) {
+			return
+		}
+	}
+}
+
+func (c *fakeClient) write(messageType protocol.MessageType, message interface{}) {
+	c.t.Helper()
+	if err := c.conn.Send(messageType, message); err != nil {
+		c.t.Errorf("%s: write: %v", c.username, err)
+	}
+}
+
+// read reads the next message, which must be of the given type
+func (c *fakeClient) read(messageType protocol.MessageType, message interface{}) {
+	c.t.Helper()
+	envelope, err := c.conn.Receive()
+	if err != nil {
+		c.t.Fatalf("%s: read: %v", c.username, err)
+	}
+	if envelope.Type != messageType {
+		c.t.Fatalf("%s: got %s message %s, want %s", c.username, envelope.Type, envelope.Payload, messageType)
+	}
+	if err := envelope.Decode(message); err != nil {
+		c.t.Fatalf("%s: %v", c.username, err)
+	}
+}
+
+// readUntil skips messages until one of the given type arrives. The game
+// states skipped are kept, for play to start from.
+func (c *fakeClient) readUntil(messageType protocol.MessageType, message interface{}) {
+	c.t.Helper()
+	for {
+		envelope, err := c.conn.Receive()
+		if err != nil {
+			c.t.Fatalf("%s: read: %v", c.username, err)
+		}
+		if envelope.Type == protocol.GAME_STATE && messageType != protocol.GAME_STATE {
+			var state GameStateMessage
+			if envelope.Decode(&state) == nil {
+				c.states = append(c.states, state)
+			}
+		}
+		if envelope.Type != messageType {
+			continue
+		}
+		if err := envelope.Decode(message); err != nil {
+			c.t.Fatalf("%s: %v", c.username, err)
+		}
+		return
+	}
+}
+
+// startedRooms waits until n rooms have started their game and returns them
+func startedRooms(t *testing.T, s *Server, n int) []*GameRoom {
+	t.Helper()
+	deadline := time.Now().Add(TEST_TIMEOUT)
+	for time.Now().Before(deadline) {
+		rooms := []*GameRoom{}
+		s.mu.Lock()
+		for _, room := range s.Rooms {
+			room.mu.Lock()
+			if room.GameStarted {
+				rooms = append(rooms, room)
+			}
+			room.mu.Unlock()
+		}
+		s.mu.Unlock()
+
+		if len(rooms) == n {
+			return rooms
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %d started rooms", n)
+	return nil
+}
+
+func TestFullGameOverWebsocket(t *testing.T) {
+	s, url := newTestServer(t)
+
+	clients := []*fakeClient{dialFakeClient(t, url, "alice"), dialFakeClient(t, url, "bob")}
+	for _, client := range clients {
+		client.join()
+	}
+	room := startedRooms(t, s, 1)[0]
+
+	var wg sync.WaitGroup
+	for _, client := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client.play()
+		}()
+	}
+
+	select {
+	case <-room.Done():
+	case <-time.After(TEST_TIMEOUT):
+		t.Fatal("timed out waiting for the game to finish")
+	}
+	for _, client := range clients {
+		client.ws.Close()
+	}
+	wg.Wait()
+
+	if room.Game.Deck.Size != 0 {
+		t.Errorf("game finished with %d cards in the deck", room.Game.Deck.Size)
+	}
+
+	totalCards := 0
+	for _, client := range clients {
+		if len(client.states) == 0 {
+			t.Fatalf("%s received no game state", client.username)
+		}
+		last := client.states[len(client.states)-1]
+		totalCards += last.Hand.Size
+	}
+	if totalCards != int(engine.TOTAL_DECK_SIZE) {
+		t.Errorf("players hold %d cards at the end, want %d", totalCards, engine.TOTAL_DECK_SIZE)
+	}
+
+	// The finished game is saved with a replay that plays it again
+	var record store.GameRecord
+	waitFor(t, "the game to be saved", func() bool {
+		var err error
+		record, err = s.Store().GetGame(room.UUID)
+		return err == nil
+	})
+	if record.Result.Outcome != engine.OUTCOME_DECK_EMPTY || len(record.Players) != 2 {
+		t.Errorf("saved game: %+v", record)
+	}
+	replay, err := engine.UnmarshalReplay(record.Replay)
+	if err != nil {
+		t.Fatalf("UnmarshalReplay() error: %v", err)
+	}
+	replayed, err := replay.Play(service.NewLogger(service.LEVEL_ERROR, "replay"))
+	if err != nil {
+		t.Fatalf("Play() error: %v", err)
+	}
+	if !reflect.DeepEqual(replayed.Snapshot(), room.Game.Snapshot()) {
+		t.Error("the replay ended differently from the game")
+	}
+}
+
+// firstPlayReachesGame checks that the player on turn has the first play
+// they send as soon as the game starts played, not read by the lobby
+func firstPlayReachesGame(t *testing.T, clients []*fakeClient) {
+	t.Helper()
+	var state GameStateMessage
+	clients[0].readUntil(protocol.GAME_STATE, &state)
+	current := clients[0]
+	if state.Turn.PlayerUUID != current.uuid {
+		current = clients[1]
+		current.readUntil(protocol.GAME_STATE, &state)
+	}
+	current.write(protocol.GAME_PLAY, GamePlayMessage{Play: engine.NewDrawCardPlay()})
+	current.readUntil(protocol.GAME_STATE, &state)
+	if state.Turn.PlayerUUID != current.uuid || !state.Turn.HasDrawedCard {
+		t.Errorf("after drawing the turn is %+v", state.Turn)
+	}
+}
+
+func TestFirstPlayOfMatchedGame(t *testing.T) {
+	for range 5 {
+		_, url := newTestServer(t)
+		clients := []*fakeClient{dialFakeClient(t, url, "alice"), dialFakeClient(t, url, "bob")}
+		for _, client := range clients {
+			client.join()
+		}
+		firstPlayReachesGame(t, clients)
+	}
+}
+
+func TestMatchmakingPairsClients(t *testing.T) {
+	s, url := newTestServer(t)
+
+	usernames := []string{"alice", "bob", "carol", "dave"}
+	for _, username := range usernames {
+		dialFakeClient(t, url, username).join()
+	}
+
+	rooms := startedRooms(t, s, 2)
+	seen := map[string]bool{}
+	for _, room := range rooms {
+		for _, username := range room.GetClientsUsername() {
+			if seen[username] {
+				t.Errorf("%s was placed in two rooms", username)
+			}
+			seen[username] = true
+		}
+		if room.NumPlayers != engine.NUM_PLAYERS {
+			t.Errorf("room %s started with %d players", room.UUID, room.NumPlayers)
+		}
+	}
+	if len(seen) != len(usernames) {
+		t.Errorf("%d of %d clients were placed in a room", len(seen), len(usernames))
+	}
+}
+
+func TestJoinRejectsInvalidUsername(t *testing.T) {
+	_, url := newTestServer(t)
+	client := dialFakeClient(t, url, "not a valid name!")
+
+	client.write(protocol.JOIN, JoinServerMessage{Username: client.username})
+	var errorMsg ErrorMessage
+	client.read(protocol.ERROR, &errorMsg)
+	if !strings.Contains(errorMsg.Message, "Authentication failed") {
+		t.Errorf("unexpected answer to an invalid username: %q", errorMsg.Message)
+	}
+}
+
+func TestJoinRejectsIncompatibleVersion(t *testing.T) {
+	_, url := newTestServer(t)
+	client := dialFakeClient(t, url, "alice")
+
+	// Hand craft the envelope, protocol.Conn always sends the current version
+	payload, _ := json.Marshal(JoinServerMessage{Username: client.username})
+	err := client.ws.WriteJSON(protocol.Envelope{
+		Type:    protocol.JOIN,
+		Version: protocol.PROTOCOL_VERSION + 1,
+		Seq:     1,
+		Payload: payload,
+	})
+	if err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	var errorMsg ErrorMessage
+	client.read(protocol.ERROR, &errorMsg)
+	if !strings.Contains(errorMsg.Message, "not supported") {
+		t.Errorf("unexpected answer to an incompatible version: %q", errorMsg.Message)
+	}
+	if _, err := client.conn.Receive(); err == nil {
+		t.Error("server kept the connection open after refusing the version")
+	}
+}
+
+func TestJoinMustComeFirst(t *testing.T) {
+	_, url := newTestServer(t)
+	client := dialFakeClient(t, url, "alice")
+
+	client.write(protocol.START_GAME, StartGameMessage{Action: "start"})
+	var errorMsg ErrorMessage
+	client.read(protocol.ERROR, &errorMsg)
+}
+
+// waitFor polls condition until it holds or the test times out
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(TEST_TIMEOUT)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// dropWaitingPlayer disconnects the player of the two clients whose turn it is not,
+// returning the player whose turn it is and the one dropped
+func dropWaitingPlayer(t *testing.T, s *Server, clients []*fakeClient) (current *fakeClient, waiting *fakeClient) {
+	t.Helper()
+	var state GameStateMessage
+	clients[0].readUntil(protocol.GAME_STATE, &state)
+	clients[0].states = append(clients[0].states, state)
+	current, waiting = clients[0], clients[1]
+	if state.Turn.PlayerUUID != current.uuid {
+		current, waiting = waiting, current
+	}
+	waiting.ws.Close()
+	waitFor(t, "the dropped client to be removed", func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return len(s.Clients) == 1
+	})
+	return current, waiting
+}
+
+func TestDisconnectedPlayerLeavesAfterGrace(t *testing.T) {
+	config := NewServerConfig(service.LEVEL_ERROR)
+	config.ReconnectGrace = 200 * time.Millisecond
+	s, url := newTestServerWithConfig(t, config)
+
+	clients := []*fakeClient{dialFakeClient(t, url, "alice"), dialFakeClient(t, url, "bob")}
+	for _, client := range clients {
+		client.join()
+	}
+	room := startedRooms(t, s, 1)[0]
+	current, waiting := dropWaitingPlayer(t, s, clients)
+
+	var gameMsg GameMessage
+	current.readUntil(protocol.GAME_MESSAGE, &gameMsg)
+	if gameMsg.Message != waiting.username+" disconnected and has 200ms to come back." {
+		t.Errorf("opponent was told %q", gameMsg.Message)
+	}
+
+	// Once their turn comes and the grace is over, they lose the game: no
+	// rematch with a player gone, the other one goes back to the lobby
+	current.write(protocol.GAME_PLAY, GamePlayMessage{Play: engine.NewDrawCardPlay()})
+	current.write(protocol.GAME_PLAY, GamePlayMessage{Play: engine.NewEndTurnPlay()})
+	var gameOverMsg GameOverMessage
+	current.readUntil(protocol.GAME_OVER, &gameOverMsg)
+	result := gameOverMsg.Result
+	if gameOverMsg.Rematch || result.Outcome != engine.OUTCOME_RESIGNED || result.WinnerUUID != current.uuid || result.QuitterUUID != waiting.uuid {
+		t.Errorf("game over = %+v", gameOverMsg)
+	}
+	var lobbyMsg BackToLobbyMessage
+	current.readUntil(protocol.BACK_TO_LOBBY, &lobbyMsg)
+	select {
+	case <-room.Done():
+	default:
+		t.Error("back to the lobby before the game was over")
+	}
+	waitFor(t, "the room to be removed", func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return len(s.Clients) == 1 && len(s.Rooms) == 0
+	})
+}
+
+func TestPlayerReconnectsWithinGrace(t *testing.T) {
+	s, url := newTestServer(t)
+
+	clients := []*fakeClient{dialFakeClient(t, url, "alice"), dialFakeClient(t, url, "bob")}
+	for _, client := range clients {
+		client.join()
+	}
+	room := startedRooms(t, s, 1)[0]
+	current, waiting := dropWaitingPlayer(t, s, clients)
+
+	// A stranger can't take the seat
+	stranger := dialFakeClient(t, url, "mallory")
+	stranger.write(protocol.JOIN, JoinServerMessage{Username: stranger.username})
+	var welcomeMsg WelcomeMessage
+	stranger.read(protocol.WELCOME, &welcomeMsg)
+	stranger.write(protocol.START_GAME, StartGameMessage{Action: "rejoin", PlayerUUID: waiting.uuid, RejoinToken: "guess"})
+	var errorMsg ErrorMessage
+	stranger.read(protocol.ERROR, &errorMsg)
+
+	again := dialFakeClient(t, url, waiting.username)
+	again.rejoin(waiting.uuid, waiting.token)
+	var gameMsg GameMessage
+	current.readUntil(protocol.GAME_MESSAGE, &gameMsg)
+	current.readUntil(protocol.GAME_MESSAGE, &gameMsg)
+	if gameMsg.Message != waiting.username+" is back." {
+		t.Errorf("opponent was told %q", gameMsg.Message)
+	}
+
+	// The game goes on from where it was, with everyone still in it
+	players := []*fakeClient{current, again}
+	playAll(players)
+	if first := again.states[0]; first.Turn.PlayerUUID != current.uuid || first.Hand.Size != engine.NUM_CARDS {
+		t.Errorf("came back to turn %+v with %d cards", first.Turn, first.Hand.Size)
+	}
+	for _, player := range players {
+		if player.gameOver == nil || !player.gameOver.Rematch || player.gameOver.Result.AnyoneLeft() {
+			t.Errorf("%s: game over = %+v", player.username, player.gameOver)
+		}
+	}
+	if rooms := startedRooms(t, s, 1); rooms[0] != room {
+		t.Errorf("game over in room %s, want %s", rooms[0].UUID, room.UUID)
+	}
+}
+
+func TestRejoinChecksTheAccount(t *testing.T) {
+	config := NewServerConfig(service.LEVEL_ERROR)
+	config.Auth.Accounts = true
+	s, url := newTestServerWithConfig(t, config)
+
+	sessions := map[string]string{}
+	register := func(username string) *fakeClient {
+		client := dialFakeClient(t, url, username)
+		client.write(protocol.JOIN, JoinServerMessage{Username: username, Password: "correct horse", Register: true})
+		var welcomeMsg WelcomeMessage
+		client.read(protocol.WELCOME, &welcomeMsg)
+		client.uuid, client.token = welcomeMsg.PlayerUUID, welcomeMsg.RejoinToken
+		sessions[username] = welcomeMsg.SessionToken
+		return client
+	}
+	clients := []*fakeClient{register("alice"), register("bob")}
+	for _, client := range clients {
+		client.queue(StartGameMessage{Action: "start"})
+	}
+	startedRooms(t, s, 1)
+	_, waiting := dropWaitingPlayer(t, s, clients)
+
+	// The rejoin token is not enough to take the seat of another account
+	mallory := register("mallory")
+	mallory.write(protocol.START_GAME, StartGameMessage{Action: "rejoin", PlayerUUID: waiting.uuid, RejoinToken: waiting.token})
+	var errorMsg ErrorMessage
+	mallory.read(protocol.ERROR, &errorMsg)
+
+	again := dialFakeClient(t, url, "")
+	again.write(protocol.JOIN, JoinServerMessage{SessionToken: sessions[waiting.username]})
+	var welcomeMsg WelcomeMessage
+	again.read(protocol.WELCOME, &welcomeMsg)
+	again.write(protocol.START_GAME, StartGameMessage{Action: "rejoin", PlayerUUID: waiting.uuid, RejoinToken: waiting.token})
+	var joinedMsg JoinedGameRoomMessage
+	again.read(protocol.JOINED_GAME_ROOM, &joinedMsg)
+}
+
+func TestTurnTimesOut(t *testing.T) {
+	config := NewServerConfig(service.LEVEL_ERROR)
+	config.Game.TurnTimeout = 200 * time.Millisecond
+	s, url := newTestServerWithConfig(t, config)
+
+	clients := []*fakeClient{dialFakeClient(t, url, "alice"), dialFakeClient(t, url, "bob")}
+	for _, client := range clients {
+		client.join()
+	}
+	startedRooms(t, s, 1)
+
+	var state GameStateMessage
+	clients[0].readUntil(protocol.GAME_STATE, &state)
+	current, next := clients[0], clients[1]
+	if state.Turn.PlayerUUID != current.uuid {
+		current, next = next, current
+	}
+
+	// The player on turn does nothing and the turn passes to the other one
+	var gameMsg GameMessage
+	current.readUntil(protocol.GAME_MESSAGE, &gameMsg)
+	if gameMsg.Message != "You ran out of time." {
+		t.Errorf("player on turn was told %q", gameMsg.Message)
+	}
+	next.readUntil(protocol.GAME_STATE, &state)
+	for state.Turn.PlayerUUID != next.uuid {
+		next.readUntil(protocol.GAME_STATE, &state)
+	}
+}
+
+func TestShutdownWaitsForGames(t *testing.T) {
+	s, url := newTestServer(t)
+
+	clients := []*fakeClient{dialFakeClient(t, url, "alice"), dialFakeClient(t, url, "bob")}
+	for _, client := range clients {
+		client.join()
+	}
+	room := startedRooms(t, s, 1)[0]
+
+	// A client still waiting for an opponent is let go
+	waiting := dialFakeClient(t, url, "carol")
+	waiting.join()
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), TEST_TIMEOUT)
+		defer cancel()
+		shutdownErr <- s.Shutdown(ctx)
+	}()
+
+	var notice ServerNoticeMessage
+	waiting.readUntil(protocol.SERVER_NOTICE, &notice)
+	if _, err := waiting.conn.Receive(); err == nil {
+		t.Error("client waiting for an opponent was not disconnected")
+	}
+
+	// New clients are turned away
+	late := dialFakeClient(t, url, "dave")
+	late.write(protocol.JOIN, JoinServerMessage{Username: late.username})
+	var errorMsg ErrorMessage
+	late.read(protocol.ERROR, &errorMsg)
+	if !strings.Contains(errorMsg.Message, "restarting") {
+		t.Errorf("late client was told %q", errorMsg.Message)
+	}
+
+	var wg sync.WaitGroup
+	for _, client := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client.play()
+		}()
+	}
+
+	select {
+	case err := <-shutdownErr:
+		if err != nil {
+			t.Errorf("Shutdown() error: %v", err)
+		}
+	case <-time.After(TEST_TIMEOUT):
+		t.Fatal("timed out waiting for the shutdown")
+	}
+	select {
+	case <-room.Done():
+	default:
+		t.Error("Shutdown() returned before the game was over")
+	}
+	wg.Wait()
+
+	for _, client := range clients {
+		if len(client.notices) == 0 {
+			t.Errorf("%s was not told the server is restarting", client.username)
+		}
+	}
+}
+
+func TestGameFinishedDuringShutdownIsNotRestored(t *testing.T) {
+	config := NewServerConfig(service.LEVEL_ERROR)
+	config.SnapshotDir = t.TempDir()
+	s, url := newTestServerWithConfig(t, config)
+
+	clients := []*fakeClient{dialFakeClient(t, url, "alice"), dialFakeClient(t, url, "bob")}
+	for _, client := range clients {
+		client.join()
+	}
+	room := startedRooms(t, s, 1)[0]
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), TEST_TIMEOUT)
+		defer cancel()
+		shutdownErr <- s.Shutdown(ctx)
+	}()
+	waitFor(t, "the server to drain", s.IsDraining)
+	playAll(clients)
+
+	if err := <-shutdownErr; err != nil {
+		t.Errorf("Shutdown() error: %v", err)
+	}
+	room.mu.Lock()
+	game := room.Game
+	room.mu.Unlock()
+	if result := game.Result(); !result.Finished() || result.Outcome == engine.OUTCOME_ABANDONED {
+		t.Fatalf("game ended with %+v", result)
+	}
+	waitFor(t, "the snapshot of the finished game to be removed", func() bool {
+		snapshots, err := s.snapshots.LoadAll()
+		return err == nil && len(snapshots) == 0
+	})
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	s, url := newTestServer(t)
+
+	// Nobody plays, so the game can't finish before the deadline
+	for _, username := range []string{"alice", "bob"} {
+		dialFakeClient(t, url, username).join()
+	}
+	room := startedRooms(t, s, 1)[0]
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown() = %v, want context.DeadlineExceeded", err)
+	}
+
+	// Disconnecting the players ends the game
+	select {
+	case <-room.Done():
+	case <-time.After(TEST_TIMEOUT):
+		t.Fatal("game still running after the shutdown")
+	}
+}
+
+func TestGameIsRestoredAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	config := NewServerConfig(service.LEVEL_ERROR)
+	config.SnapshotDir = dir
+	s, url := newTestServerWithConfig(t, config)
+
+	clients := []*fakeClient{dialFakeClient(t, url, "alice"), dialFakeClient(t, url, "bob")}
+	for _, client := range clients {
+		client.join()
+	}
+	room := startedRooms(t, s, 1)[0]
+
+	// Play one turn so the game is checkpointed after it
+	var state GameStateMessage
+	clients[0].readUntil(protocol.GAME_STATE, &state)
+	current := clients[0]
+	if state.Turn.PlayerUUID != current.uuid {
+		current = clients[1]
+	}
+	current.write(protocol.GAME_PLAY, GamePlayMessage{Play: engine.NewDrawCardPlay()})
+	current.write(protocol.GAME_PLAY, GamePlayMessage{Play: engine.NewEndTurnPlay()})
+	waitFor(t, "the turn to be checkpointed", func() bool {
+		snapshots, err := s.snapshots.LoadAll()
+		return err == nil && len(snapshots) == 1 && snapshots[0].Game.Players[snapshots[0].Game.CurrentPlayer].UUID != current.uuid
+	})
+
+	// The restart cuts the game short
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	s.Shutdown(ctx)
+	<-room.Done()
+	saved, err := s.snapshots.LoadAll()
+	if err != nil || len(saved) != 1 {
+		t.Fatalf("%d snapshots kept after the shutdown, error: %v", len(saved), err)
+	}
+
+	restarted, url := newTestServerWithConfig(t, config)
+	if n, err := restarted.RestoreRooms(); n != 1 || err != nil {
+		t.Fatalf("RestoreRooms() = %d, %v", n, err)
+	}
+
+	// Strangers can't take the seats, and new players are not matched into the room
+	stranger := dialFakeClient(t, url, "mallory")
+	stranger.write(protocol.JOIN, JoinServerMessage{Username: stranger.username})
+	var welcomeMsg WelcomeMessage
+	stranger.read(protocol.WELCOME, &welcomeMsg)
+	stranger.write(protocol.START_GAME, StartGameMessage{Action: "rejoin", PlayerUUID: clients[0].uuid, RejoinToken: "guess"})
+	var errorMsg ErrorMessage
+	stranger.read(protocol.ERROR, &errorMsg)
+
+	rejoined := []*fakeClient{}
+	for _, client := range clients {
+		again := dialFakeClient(t, url, client.username)
+		again.rejoin(client.uuid, client.token)
+		rejoined = append(rejoined, again)
+	}
+	resumed := startedRooms(t, restarted, 1)[0]
+	if resumed.UUID != room.UUID {
+		t.Errorf("resumed room %s, want %s", resumed.UUID, room.UUID)
+	}
+
+	var wg sync.WaitGroup
+	for _, client := range rejoined {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client.play()
+		}()
+	}
+	select {
+	case <-resumed.Done():
+	case <-time.After(TEST_TIMEOUT):
+		t.Fatal("timed out waiting for the resumed game to finish")
+	}
+	wg.Wait()
+
+	// The resumed game went on from the saved turn
+	for i, client := range rejoined {
+		first := client.states[0]
+		for _, player := range saved[0].Game.Players {
+			if player.UUID == client.uuid && first.Hand.Size != len(player.Hand) {
+				t.Errorf("%s resumed with %d cards, saved %d", clients[i].username, first.Hand.Size, len(player.Hand))
+			}
+		}
+	}
+	waitFor(t, "the snapshot of the finished game to be removed", func() bool {
+		snapshots, err := restarted.snapshots.LoadAll()
+		return err == nil && len(snapshots) == 0
+	})
+}
+
+func TestJoinRejectsConnectedUsername(t *testing.T) {
+	_, url := newTestServer(t)
+	first := dialFakeClient(t, url, "alice")
+	first.write(protocol.JOIN, JoinServerMessage{Username: first.username})
+	var welcomeMsg WelcomeMessage
+	first.read(protocol.WELCOME, &welcomeMsg)
+
+	// Names are unique regardless of case
+	second := dialFakeClient(t, url, "ALICE")
+	second.write(protocol.JOIN, JoinServerMessage{Username: second.username})
+	var errorMsg ErrorMessage
+	second.read(protocol.ERROR, &errorMsg)
+	if !strings.Contains(errorMsg.Message, "already playing") {
+		t.Errorf("unexpected answer to a connected username: %q", errorMsg.Message)
+	}
+}
+
+func TestAccountsAndSessionLogin(t *testing.T) {
+	config := NewServerConfig(service.LEVEL_ERROR)
+	config.Auth.Accounts = true
+	config.DataDir = t.TempDir()
+	_, url := newTestServerWithConfig(t, config)
+
+	refused := func(join JoinServerMessage, want string) {
+		t.Helper()
+		client := dialFakeClient(t, url, join.Username)
+		client.write(protocol.JOIN, join)
+		var errorMsg ErrorMessage
+		client.read(protocol.ERROR, &errorMsg)
+		if !strings.Contains(errorMsg.Message, want) {
+			t.Errorf("join %+v answered %q, want it to mention %q", join, errorMsg.Message, want)
+		}
+	}
+	refused(JoinServerMessage{Username: "alice"}, "requires an account")
+
+	registering := dialFakeClient(t, url, "alice")
+	registering.write(protocol.JOIN, JoinServerMessage{Username: "alice", Password: "correct horse", Register: true})
+	var welcomeMsg WelcomeMessage
+	registering.read(protocol.WELCOME, &welcomeMsg)
+	if welcomeMsg.Username != "alice" || welcomeMsg.SessionToken == "" {
+		t.Fatalf("welcome after registering: %+v", welcomeMsg)
+	}
+	registering.ws.Close()
+
+	refused(JoinServerMessage{Username: "alice", Password: "battery staple"}, "Wrong username or password")
+	refused(JoinServerMessage{Username: "Alice", Password: "other password", Register: true}, "already registered")
+	refused(JoinServerMessage{SessionToken: welcomeMsg.SessionToken + "x"}, "session is no longer valid")
+
+	loggedIn := dialFakeClient(t, url, "alice")
+	loggedIn.write(protocol.JOIN, JoinServerMessage{Username: "ALICE", Password: "correct horse"})
+	var loginWelcome WelcomeMessage
+	loggedIn.read(protocol.WELCOME, &loginWelcome)
+	if loginWelcome.Username != "alice" {
+		t.Errorf("logged in as %q, want the registered name alice", loginWelcome.Username)
+	}
+
+	// Logging in again with the session takes over the older connection
+	reconnected := dialFakeClient(t, url, "")
+	reconnected.write(protocol.JOIN, JoinServerMessage{SessionToken: loginWelcome.SessionToken})
+	var sessionWelcome WelcomeMessage
+	reconnected.read(protocol.WELCOME, &sessionWelcome)
+	if sessionWelcome.Username != "alice" {
+		t.Errorf("session login as %q, want alice", sessionWelcome.Username)
+	}
+	var notice ServerNoticeMessage
+	loggedIn.read(protocol.SERVER_NOTICE, &notice)
+	select {
+	case <-loggedIn.conn.Done():
+	case <-time.After(TEST_TIMEOUT):
+		t.Error("the older connection was not closed")
+	}
+}
+
+func TestRatingRequest(t *testing.T) {
+	config := NewServerConfig(service.LEVEL_ERROR)
+	config.Auth.Accounts = true
+	config.ReconnectGrace = 0
+	s, url := newTestServerWithConfig(t, config)
+
+	register := func(username string) (*fakeClient, WelcomeMessage) {
+		client := dialFakeClient(t, url, username)
+		client.write(protocol.JOIN, JoinServerMessage{Username: username, Password: "correct horse", Register: true})
+		var welcomeMsg WelcomeMessage
+		client.read(protocol.WELCOME, &welcomeMsg)
+		client.uuid = welcomeMsg.PlayerUUID
+		return client, welcomeMsg
+	}
+	alice, _ := register("alice")
+	bob, bobWelcome := register("bob")
+
+	alice.write(protocol.RATING_REQUEST, RatingRequestMessage{})
+	var ratingMsg RatingMessage
+	alice.read(protocol.RATING, &ratingMsg)
+	if !ratingMsg.Rated || ratingMsg.Rating != rating.DEFAULT_RATING || ratingMsg.Position != 0 {
+		t.Errorf("rating of a new account: %+v", ratingMsg)
+	}
+	alice.write(protocol.RATING_REQUEST, RatingRequestMessage{Username: "nobody"})
+	var errorMsg ErrorMessage
+	alice.read(protocol.ERROR, &errorMsg)
+
+	// Alice leaves the game, losing it to bob
+	for _, client := range []*fakeClient{alice, bob} {
+		client.queue(StartGameMessage{Action: "start"})
+	}
+	room := startedRooms(t, s, 1)[0]
+	go bob.play()
+	alice.ws.Close()
+	waitFor(t, "the game to be saved", func() bool {
+		_, err := s.Store().GetGame(room.UUID)
+		return err == nil
+	})
+
+	again := dialFakeClient(t, url, "")
+	again.write(protocol.JOIN, JoinServerMessage{SessionToken: bobWelcome.SessionToken})
+	var welcomeMsg WelcomeMessage
+	again.read(protocol.WELCOME, &welcomeMsg)
+	again.write(protocol.RATING_REQUEST, RatingRequestMessage{})
+	again.read(protocol.RATING, &ratingMsg)
+	if ratingMsg.Rating <= rating.DEFAULT_RATING || ratingMsg.Position != 1 || ratingMsg.Of != 2 || ratingMsg.Played != 1 {
+		t.Errorf("rating of the player who stayed: %+v", ratingMsg)
+	}
+	again.write(protocol.RATING_REQUEST, RatingRequestMessage{Username: "Alice"})
+	again.read(protocol.RATING, &ratingMsg)
+	if ratingMsg.Username != "alice" || ratingMsg.Rating >= rating.DEFAULT_RATING || ratingMsg.Left != 1 || ratingMsg.Position != 2 {
+		t.Errorf("rating of the player who left: %+v", ratingMsg)
+	}
+}
+
+// brokenStore fails to read the accounts and their stats
+type brokenStore struct {
+	store.Store
+}
+
+func (brokenStore) GetAccount(username string) (auth.Account, error) {
+	return auth.Account{}, errors.New("disk on fire")
+}
+
+func (brokenStore) GetStats(userID string) (store.PlayerStats, error) {
+	return store.PlayerStats{}, errors.New("disk on fire")
+}
+
+func TestRatingRequestStoreError(t *testing.T) {
+	config := NewServerConfig(service.LEVEL_ERROR)
+	config.Auth.Accounts = true
+	s := NewServer(config)
+	s.store = brokenStore{s.store}
+	ts := httptest.NewServer(http.HandlerFunc(s.HandleConnections))
+	t.Cleanup(ts.Close)
+
+	alice := dialFakeClient(t, "ws"+strings.TrimPrefix(ts.URL, "http"), "alice")
+	alice.write(protocol.JOIN, JoinServerMessage{Username: "alice", Password: "correct horse", Register: true})
+	var welcomeMsg WelcomeMessage
+	alice.read(protocol.WELCOME, &welcomeMsg)
+
+	// The errors are reported, not mistaken for a missing account, and the connection stays open
+	for _, request := range []RatingRequestMessage{{}, {Username: "bob"}} {
+		alice.write(protocol.RATING_REQUEST, request)
+		var errorMsg ErrorMessage
+		alice.read(protocol.ERROR, &errorMsg)
+		if errorMsg.Message != RATING_UNAVAILABLE_MESSAGE {
+			t.Errorf("rating request %+v answered %q", request, errorMsg.Message)
+		}
+	}
+	alice.write(protocol.LOBBY_SUBSCRIBE, LobbySubscribeMessage{})
+	var lobby LobbyMessage
+	alice.read(protocol.LOBBY, &lobby)
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"mexemexe/internal/engine"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ROOM_SNAPSHOT_VERSION is the version of the room snapshot file format
+const ROOM_SNAPSHOT_VERSION = 1
+
+const SNAPSHOT_EXTENSION = ".json"
+
+// RoomPlayer is a player of a saved room, with the secret it must show to take its seat back
+type RoomPlayer struct {
+	UUID        string `json:"uuid"`
+	Username    string `json:"username"`
+	RejoinToken string `json:"rejoin_token"`
+	// UserID is the account of the player, empty for guests
+	UserID string `json:"user_id,omitempty"`
+}
+
+// RoomSnapshot is a game in progress as saved to disk between two turns
+type RoomSnapshot struct {
+	Version  int                 `json:"version"`
+	RoomUUID string              `json:"room_uuid"`
+	Players  []RoomPlayer        `json:"players"`
+	Game     engine.GameSnapshot `json:"game"`
+}
+
+// SnapshotStore keeps one snapshot file per room in a directory
+type SnapshotStore struct {
+	dir string
+}
+
+func NewSnapshotStore(dir string) (*SnapshotStore, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, fmt.Errorf("creating snapshot directory: %w", err)
+	}
+	return &SnapshotStore{
+		dir: dir,
+	}, nil
+}
+
+func (s *SnapshotStore) path(roomUUID string) string {
+	return filepath.Join(s.dir, roomUUID+SNAPSHOT_EXTENSION)
+}
+
+// Save writes the snapshot of a room, replacing the previous one atomically
+func (s *SnapshotStore) Save(snapshot RoomSnapshot) error {
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(s.dir, snapshot.RoomUUID+"-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path(snapshot.RoomUUID))
+}
+
+// Remove deletes the snapshot of a room, if there is one
+func (s *SnapshotStore) Remove(roomUUID string) error {
+	err := os.Remove(s.path(roomUUID))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// LoadAll reads every snapshot in the directory. Files that can't be read are
+// reported in the returned error but don't stop the others from loading.
+func (s *SnapshotStore) LoadAll() ([]RoomSnapshot, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := []RoomSnapshot{}
+	failed := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), SNAPSHOT_EXTENSION) {
+			continue
+		}
+		snapshot, err := s.load(filepath.Join(s.dir, entry.Name()))
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", entry.Name(), err))
+			continue
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+
+	if len(failed) > 0 {
+		return snapshots, fmt.Errorf("could not load %d snapshots: %s", len(failed), strings.Join(failed, "; "))
+	}
+	return snapshots, nil
+}
+
+func (s *SnapshotStore) load(path string) (RoomSnapshot, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return RoomSnapshot{}, err
+	}
+	var snapshot RoomSnapshot
+	err = json.Unmarshal(data, &snapshot)
+	if err != nil {
+		return RoomSnapshot{}, err
+	}
+	if snapshot.Version != ROOM_SNAPSHOT_VERSION {
+		return RoomSnapshot{}, fmt.Errorf("room snapshot version %d is not supported, expected %d", snapshot.Version, ROOM_SNAPSHOT_VERSION)
+	}
+	if snapshot.Game.Version != engine.SNAPSHOT_VERSION {
+		return RoomSnapshot{}, fmt.Errorf("game snapshot version %d is not supported, expected %d", snapshot.Game.Version, engine.SNAPSHOT_VERSION)
+	}
+	return snapshot, nil
+}
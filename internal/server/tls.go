@@ -0,0 +1,174 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// DEFAULT_HSTS_MAX_AGE is how long browsers keep to HTTPS once they saw the server over TLS
+const DEFAULT_HSTS_MAX_AGE = 365 * 24 * time.Hour
+
+// SELF_SIGNED_VALIDITY is how long a generated development certificate is valid
+const SELF_SIGNED_VALIDITY = 30 * 24 * time.Hour
+
+// TLSSettings turn on TLS termination in the server itself
+type TLSSettings struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// SelfSigned generates a throwaway certificate at startup, for development only
+	SelfSigned bool `yaml:"self_signed"`
+	// RedirectPort is a plain HTTP port redirecting every request to HTTPS. Zero disables it.
+	RedirectPort int `yaml:"redirect_port"`
+	// HSTSMaxAge is sent in the Strict-Transport-Security header. Zero disables the header.
+	HSTSMaxAge time.Duration `yaml:"hsts_max_age"`
+}
+
+// Enabled tells whether the server serves HTTPS
+func (t TLSSettings) Enabled() bool {
+	return t.SelfSigned || t.CertFile != ""
+}
+
+// validate reports every TLS setting that can't work together
+func (t TLSSettings) validate(port int) []error {
+	var errs []error
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		errs = append(errs, fmt.Errorf("TLS needs both a certificate and a key file"))
+	}
+	if t.SelfSigned && t.CertFile != "" {
+		errs = append(errs, fmt.Errorf("a self-signed certificate can't be used with certificate files"))
+	}
+	if t.RedirectPort != 0 {
+		if !t.Enabled() {
+			errs = append(errs, fmt.Errorf("the HTTP redirect port needs TLS enabled"))
+		}
+		if t.RedirectPort < 0 || t.RedirectPort > 65535 || t.RedirectPort == port {
+			errs = append(errs, fmt.Errorf("HTTP redirect port %d is out of range or the same as the server port", t.RedirectPort))
+		}
+	}
+	if t.HSTSMaxAge < 0 {
+		errs = append(errs, fmt.Errorf("HSTS max age cannot be negative, got %v", t.HSTSMaxAge))
+	}
+	return errs
+}
+
+// NewTLSConfig loads the certificate of the server, or generates one in
+// self-signed mode for the given host names
+func NewTLSConfig(settings TLSSettings, hosts []string) (*tls.Config, error) {
+	var certificate tls.Certificate
+	var err error
+	if settings.SelfSigned {
+		certificate, err = selfSignedCertificate(hosts, time.Now())
+	} else {
+		certificate, err = tls.LoadX509KeyPair(settings.CertFile, settings.KeyFile)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("loading TLS certificate: %w", err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// CertificateFingerprint is the SHA-256 of the first certificate, as shown by browsers
+func CertificateFingerprint(config *tls.Config) string {
+	if len(config.Certificates) == 0 || len(config.Certificates[0].Certificate) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(config.Certificates[0].Certificate[0])
+	return hex.EncodeToString(sum[:])
+}
+
+// CertificatePEM encodes the first certificate, to be trusted by clients with -ca
+func CertificatePEM(config *tls.Config) []byte {
+	if len(config.Certificates) == 0 || len(config.Certificates[0].Certificate) == 0 {
+		return nil
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: config.Certificates[0].Certificate[0]})
+}
+
+// selfSignedCertificate generates a certificate for localhost and the given hosts
+func selfSignedCertificate(hosts []string, now time.Time) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"mexe-mexe development"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(SELF_SIGNED_VALIDITY),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	for _, host := range hosts {
+		if host == "" {
+			continue
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}, nil
+}
+
+// WithHSTS makes browsers that reached the server over HTTPS stick to it
+func WithHSTS(handler http.Handler, maxAge time.Duration) http.Handler {
+	if maxAge <= 0 {
+		return handler
+	}
+	value := "max-age=" + strconv.Itoa(int(maxAge.Seconds()))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Strict-Transport-Security", value)
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// RedirectToHTTPS sends every plain HTTP request to the same URL on the HTTPS port
+func RedirectToHTTPS(httpsPort int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+		if httpsPort != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(httpsPort))
+		} else if net.ParseIP(host) != nil && net.ParseIP(host).To4() == nil {
+			host = "[" + host + "]"
+		}
+		target := "https://" + host + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusPermanentRedirect)
+	})
+}
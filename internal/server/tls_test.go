@@ -0,0 +1,85 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"mexemexe/internal/service"
+)
+
+func TestSelfSignedServerAcceptsClientsTrustingIt(t *testing.T) {
+	tlsConfig, err := NewTLSConfig(TLSSettings{SelfSigned: true}, []string{"mexe.test"})
+	if err != nil {
+		t.Fatalf("NewTLSConfig() error: %v", err)
+	}
+	if len(CertificateFingerprint(tlsConfig)) != 64 {
+		t.Errorf("fingerprint %q is not a SHA-256", CertificateFingerprint(tlsConfig))
+	}
+
+	s := NewServer(NewServerConfig(service.LEVEL_ERROR))
+	ts := httptest.NewUnstartedServer(WithHSTS(http.HandlerFunc(s.HandleConnections), time.Hour))
+	ts.TLS = tlsConfig
+	ts.StartTLS()
+	defer ts.Close()
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(CertificatePEM(tlsConfig)) {
+		t.Fatal("CertificatePEM() is not a PEM certificate")
+	}
+	clientTLS := &tls.Config{RootCAs: roots, ServerName: "mexe.test"}
+	dialer := websocket.Dialer{TLSClientConfig: clientTLS}
+	ws, _, err := dialer.Dial("wss"+strings.TrimPrefix(ts.URL, "https")+"/ws", nil)
+	if err != nil {
+		t.Fatalf("dial over TLS: %v", err)
+	}
+	ws.Close()
+
+	// The upgrade response is written by the websocket library, plain responses carry HSTS
+	httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: clientTLS}}
+	resp, err := httpClient.Get(ts.URL + "/ws")
+	if err != nil {
+		t.Fatalf("GET over TLS: %v", err)
+	}
+	resp.Body.Close()
+	if got := resp.Header.Get("Strict-Transport-Security"); got != "max-age=3600" {
+		t.Errorf("Strict-Transport-Security = %q, want max-age=3600", got)
+	}
+}
+
+func TestWithHSTSDisabled(t *testing.T) {
+	handler := WithHSTS(http.NotFoundHandler(), 0)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+	if recorder.Header().Get("Strict-Transport-Security") != "" {
+		t.Error("HSTS header sent with a zero max age")
+	}
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	tests := []struct {
+		port int
+		host string
+		want string
+	}{
+		{443, "mexe-mexe.online", "https://mexe-mexe.online/ws?x=1"},
+		{443, "mexe-mexe.online:80", "https://mexe-mexe.online/ws?x=1"},
+		{8443, "localhost:8080", "https://localhost:8443/ws?x=1"},
+		{443, "[::1]:80", "https://[::1]/ws?x=1"},
+	}
+	for _, tt := range tests {
+		request := httptest.NewRequest(http.MethodGet, "/ws?x=1", nil)
+		request.Host = tt.host
+		recorder := httptest.NewRecorder()
+		RedirectToHTTPS(tt.port).ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusPermanentRedirect || recorder.Header().Get("Location") != tt.want {
+			t.Errorf("redirect of %s to port %d = %d %s, want %s", tt.host, tt.port, recorder.Code, recorder.Header().Get("Location"), tt.want)
+		}
+	}
+}
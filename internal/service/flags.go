@@ -0,0 +1,31 @@
+package service
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// EnvName returns the environment variable of a flag: with prefix MEXE_, -log-level is MEXE_LOG_LEVEL
+func EnvName(prefix string, flagName string) string {
+	return prefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// SetFlagsFromEnv sets every flag of fs whose environment variable is defined,
+// and reports all the values that could not be parsed
+func SetFlagsFromEnv(fs *flag.FlagSet, prefix string, lookupEnv func(string) (string, bool)) error {
+	var errs []error
+	fs.VisitAll(func(f *flag.Flag) {
+		name := EnvName(prefix, f.Name)
+		value, ok := lookupEnv(name)
+		if !ok {
+			return
+		}
+		err := fs.Set(f.Name, value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s=%q: invalid value for -%s", name, value, f.Name))
+		}
+	})
+	return errors.Join(errs...)
+}
@@ -7,6 +7,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"time"
 )
 
@@ -17,6 +18,27 @@ const (
 	LEVEL_ERROR
 )
 
+// LEVEL_NAMES are the names of the log levels, as used in configuration
+var LEVEL_NAMES = []string{"debug", "info", "warning", "error"}
+
+// ParseLevel returns the log level with the given name
+func ParseLevel(name string) (int, error) {
+	for level, levelName := range LEVEL_NAMES {
+		if strings.EqualFold(name, levelName) {
+			return level, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q, expected one of %s", name, strings.Join(LEVEL_NAMES, ", "))
+}
+
+// LevelName returns the name of a log level
+func LevelName(level int) string {
+	if level < 0 || level >= len(LEVEL_NAMES) {
+		return fmt.Sprintf("level(%d)", level)
+	}
+	return LEVEL_NAMES[level]
+}
+
 type GameLogger struct {
 	debugLogger   *log.Logger
 	infoLogger    *log.Logger
@@ -0,0 +1,281 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"mexemexe/internal/auth"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ACCOUNTS_FILE_VERSION is the version of the accounts file format
+const ACCOUNTS_FILE_VERSION = 1
+
+// GAME_RECORD_VERSION is the version of the game files format
+const GAME_RECORD_VERSION = 1
+
+const (
+	ACCOUNTS_FILE   = "accounts.json"
+	GAMES_DIR       = "games"
+	GAME_EXTENSION  = ".json"
+	DATA_DIR_MODE   = 0o700
+	DATA_FILES_MODE = 0o600
+)
+
+var _ Store = (*FileStore)(nil)
+
+// accountsFile is the content of the accounts file of a FileStore
+type accountsFile struct {
+	Version  int            `json:"version"`
+	Accounts []auth.Account `json:"accounts"`
+}
+
+// gameFile is the content of the file of a saved game
+type gameFile struct {
+	Version int        `json:"version"`
+	Game    GameRecord `json:"game"`
+}
+
+// FileStore keeps its data as JSON files in a directory: the accounts in one
+// file rewritten on every new account, and each game in a file of its own.
+// The games are indexed in memory when the store opens and the stats are
+// computed from them, so it suits servers with a few thousand accounts and
+// some hundred thousand games.
+type FileStore struct {
+	dir      string
+	accounts map[string]auth.Account
+	// games indexes the saved games, without their replays
+	games map[string]GameRecord
+	order []string
+	stats map[string]PlayerStats
+	mu    sync.Mutex
+}
+
+// NewFileStore opens the store in dir, creating the directory if needed
+func NewFileStore(dir string) (*FileStore, error) {
+	err := os.MkdirAll(filepath.Join(dir, GAMES_DIR), DATA_DIR_MODE)
+	if err != nil {
+		return nil, fmt.Errorf("creating data directory: %w", err)
+	}
+	s := &FileStore{
+		dir:      dir,
+		accounts: make(map[string]auth.Account),
+		games:    make(map[string]GameRecord),
+		stats:    make(map[string]PlayerStats),
+	}
+	err = s.loadAccounts()
+	if err != nil {
+		return nil, err
+	}
+	err = s.loadGames()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileStore) loadAccounts() error {
+	path := filepath.Join(s.dir, ACCOUNTS_FILE)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading accounts file: %w", err)
+	}
+	var file accountsFile
+	err = json.Unmarshal(data, &file)
+	if err != nil {
+		return fmt.Errorf("decoding accounts file %s: %w", path, err)
+	}
+	if file.Version != ACCOUNTS_FILE_VERSION {
+		return fmt.Errorf("accounts file version %d is not supported, expected %d", file.Version, ACCOUNTS_FILE_VERSION)
+	}
+	for _, account := range file.Accounts {
+		s.accounts[accountKey(account.Username)] = account
+	}
+	return nil
+}
+
+// loadGames indexes the saved games and adds up the stats of their players
+func (s *FileStore) loadGames() error {
+	entries, err := os.ReadDir(filepath.Join(s.dir, GAMES_DIR))
+	if err != nil {
+		return fmt.Errorf("reading games directory: %w", err)
+	}
+	records := []GameRecord{}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), GAME_EXTENSION) {
+			continue
+		}
+		record, err := s.readGame(strings.TrimSuffix(entry.Name(), GAME_EXTENSION))
+		if err != nil {
+			return err
+		}
+		record.Replay = nil
+		records = append(records, record)
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].EndedAt.Before(records[j].EndedAt)
+	})
+	for _, record := range records {
+		s.games[record.ID] = record
+		s.order = append(s.order, record.ID)
+		applyResult(s.stats, record)
+	}
+	return nil
+}
+
+func (s *FileStore) gamePath(id string) string {
+	return filepath.Join(s.dir, GAMES_DIR, id+GAME_EXTENSION)
+}
+
+func (s *FileStore) readGame(id string) (GameRecord, error) {
+	data, err := os.ReadFile(s.gamePath(id))
+	if err != nil {
+		return GameRecord{}, fmt.Errorf("reading game %s: %w", id, err)
+	}
+	var file gameFile
+	err = json.Unmarshal(data, &file)
+	if err != nil {
+		return GameRecord{}, fmt.Errorf("decoding game %s: %w", id, err)
+	}
+	if file.Version != GAME_RECORD_VERSION {
+		return GameRecord{}, fmt.Errorf("game %s has version %d, expected %d", id, file.Version, GAME_RECORD_VERSION)
+	}
+	return file.Game, nil
+}
+
+func (s *FileStore) GetAccount(username string) (auth.Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	account, ok := s.accounts[accountKey(username)]
+	if !ok {
+		return auth.Account{}, auth.ErrAccountNotFound
+	}
+	return account, nil
+}
+
+func (s *FileStore) CreateAccount(account auth.Account) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := accountKey(account.Username)
+	if _, ok := s.accounts[key]; ok {
+		return auth.ErrUsernameTaken
+	}
+	s.accounts[key] = account
+	err := s.saveAccountsLocked()
+	if err != nil {
+		delete(s.accounts, key)
+		return fmt.Errorf("saving accounts file: %w", err)
+	}
+	return nil
+}
+
+func (s *FileStore) saveAccountsLocked() error {
+	file := accountsFile{
+		Version:  ACCOUNTS_FILE_VERSION,
+		Accounts: make([]auth.Account, 0, len(s.accounts)),
+	}
+	for _, account := range s.accounts {
+		file.Accounts = append(file.Accounts, account)
+	}
+	sort.Slice(file.Accounts, func(i, j int) bool {
+		return accountKey(file.Accounts[i].Username) < accountKey(file.Accounts[j].Username)
+	})
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(s.dir, ACCOUNTS_FILE), data)
+}
+
+func (s *FileStore) SaveGame(record GameRecord) error {
+	if record.ID == "" || strings.ContainsAny(record.ID, `/\.`) {
+		return fmt.Errorf("invalid game ID %q", record.ID)
+	}
+	data, err := json.Marshal(gameFile{Version: GAME_RECORD_VERSION, Game: record})
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.games[record.ID]; ok {
+		return fmt.Errorf("game %s is already saved", record.ID)
+	}
+	err = writeFileAtomic(s.gamePath(record.ID), data)
+	if err != nil {
+		return fmt.Errorf("saving game %s: %w", record.ID, err)
+	}
+	record.Replay = nil
+	s.games[record.ID] = record
+	s.order = append(s.order, record.ID)
+	applyResult(s.stats, record)
+	return nil
+}
+
+func (s *FileStore) GetGame(id string) (GameRecord, error) {
+	s.mu.Lock()
+	_, ok := s.games[id]
+	s.mu.Unlock()
+	if !ok {
+		return GameRecord{}, ErrGameNotFound
+	}
+	return s.readGame(id)
+}
+
+func (s *FileStore) ListGames(userID string, limit int) ([]GameRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	records := make([]GameRecord, len(s.order))
+	for i, id := range s.order {
+		records[i] = s.games[id]
+	}
+	return listGames(records, userID, limit), nil
+}
+
+func (s *FileStore) GetStats(userID string) (PlayerStats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return statsOf(s.stats, userID), nil
+}
+
+func (s *FileStore) GetRank(userID string) (Rank, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return rankOf(s.stats, userID), nil
+}
+
+// Close does nothing: every change is written as it is made
+func (s *FileStore) Close() error {
+	return nil
+}
+
+// writeFileAtomic replaces the file at path, so readers never see it half written
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+"-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(DATA_FILES_MODE)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
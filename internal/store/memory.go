@@ -0,0 +1,97 @@
+package store
+
+import (
+	"fmt"
+	"mexemexe/internal/auth"
+	"sync"
+)
+
+// MemoryStore keeps everything in memory, to be lost when the server stops.
+// It suits development servers and tests.
+type MemoryStore struct {
+	accounts map[string]auth.Account
+	games    map[string]GameRecord
+	// order lists the IDs of the games in the order they were saved
+	order []string
+	stats map[string]PlayerStats
+	mu    sync.Mutex
+}
+
+var _ Store = (*MemoryStore)(nil)
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		accounts: make(map[string]auth.Account),
+		games:    make(map[string]GameRecord),
+		stats:    make(map[string]PlayerStats),
+	}
+}
+
+func (s *MemoryStore) GetAccount(username string) (auth.Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	account, ok := s.accounts[accountKey(username)]
+	if !ok {
+		return auth.Account{}, auth.ErrAccountNotFound
+	}
+	return account, nil
+}
+
+func (s *MemoryStore) CreateAccount(account auth.Account) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := accountKey(account.Username)
+	if _, ok := s.accounts[key]; ok {
+		return auth.ErrUsernameTaken
+	}
+	s.accounts[key] = account
+	return nil
+}
+
+func (s *MemoryStore) SaveGame(record GameRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.games[record.ID]; ok {
+		return fmt.Errorf("game %s is already saved", record.ID)
+	}
+	s.games[record.ID] = record
+	s.order = append(s.order, record.ID)
+	applyResult(s.stats, record)
+	return nil
+}
+
+func (s *MemoryStore) GetGame(id string) (GameRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record, ok := s.games[id]
+	if !ok {
+		return GameRecord{}, ErrGameNotFound
+	}
+	return record, nil
+}
+
+func (s *MemoryStore) ListGames(userID string, limit int) ([]GameRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	records := make([]GameRecord, len(s.order))
+	for i, id := range s.order {
+		records[i] = s.games[id]
+	}
+	return listGames(records, userID, limit), nil
+}
+
+func (s *MemoryStore) GetStats(userID string) (PlayerStats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return statsOf(s.stats, userID), nil
+}
+
+func (s *MemoryStore) GetRank(userID string) (Rank, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return rankOf(s.stats, userID), nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
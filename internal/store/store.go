@@ -0,0 +1,181 @@
+// Package store keeps what outlives a game: the user accounts, the finished
+// games with their replays, and the statistics of every account.
+package store
+
+import (
+	"errors"
+	"mexemexe/internal/auth"
+	"mexemexe/internal/engine"
+	"mexemexe/internal/rating"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrGameNotFound is returned when no game was saved under an ID
+var ErrGameNotFound = errors.New("game not found")
+
+// PlayerRecord is a player of a saved game. UserID is empty for guests.
+type PlayerRecord struct {
+	PlayerUUID string `json:"player_uuid"`
+	UserID     string `json:"user_id,omitempty"`
+	Username   string `json:"username"`
+}
+
+// GameRecord is a finished game. Replay holds the engine.Replay of the game,
+// as encoded by its Marshal method.
+type GameRecord struct {
+	ID        string            `json:"id"`
+	StartedAt time.Time         `json:"started_at"`
+	EndedAt   time.Time         `json:"ended_at"`
+	Players   []PlayerRecord    `json:"players"`
+	Result    engine.GameResult `json:"result"`
+	Replay    []byte            `json:"replay,omitempty"`
+}
+
+// HasUser tells if the user with the given ID played the game
+func (r GameRecord) HasUser(userID string) bool {
+	for _, player := range r.Players {
+		if player.UserID != "" && player.UserID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// PlayerStats sums up the finished games of an account. A game that ended in
+// a tie counts as played only, and an abandoned game does not count at all.
+type PlayerStats struct {
+	Played int `json:"played"`
+	Won    int `json:"won"`
+	Lost   int `json:"lost"`
+	// Left counts the games the player resigned or lost their connection to
+	Left int `json:"left"`
+	// Rating is the Elo rating of the account, rating.DEFAULT_RATING before its first game
+	Rating float64 `json:"rating"`
+}
+
+// Rank is the position of an account among the rated ones, by decreasing rating
+type Rank struct {
+	// Position is 1 for the best rated account, 0 for an account that never finished a game
+	Position int `json:"position"`
+	Of       int `json:"of"`
+}
+
+// Store is the storage of the server. Implementations are safe for concurrent use.
+type Store interface {
+	// The accounts of the local authenticator
+	auth.AccountStore
+
+	// SaveGame records a finished game and updates the stats of its players
+	SaveGame(record GameRecord) error
+	// GetGame returns a saved game with its replay, or ErrGameNotFound
+	GetGame(id string) (GameRecord, error)
+	// ListGames returns the games played by a user, newest first and without
+	// their replays. A limit of zero lists them all.
+	ListGames(userID string, limit int) ([]GameRecord, error)
+	// GetStats returns the stats of a user. A user who never finished a game
+	// has no games and the default rating.
+	GetStats(userID string) (PlayerStats, error)
+	// GetRank returns the position of a user among the accounts that finished a game
+	GetRank(userID string) (Rank, error)
+
+	Close() error
+}
+
+// applyResult counts a finished game in the stats of its account players and
+// updates their ratings. Guests count as players of the default rating.
+// Abandoned games have no result to count.
+func applyResult(stats map[string]PlayerStats, record GameRecord) {
+	if record.Result.Outcome == engine.OUTCOME_ABANDONED {
+		return
+	}
+
+	ratings := make([]float64, len(record.Players))
+	scores := make([]float64, len(record.Players))
+	for i, player := range record.Players {
+		ratings[i] = rating.DEFAULT_RATING
+		if player.UserID != "" {
+			ratings[i] = statsOf(stats, player.UserID).Rating
+		}
+		scores[i] = score(record.Result, player.PlayerUUID)
+	}
+	updated := rating.Update(ratings, scores)
+
+	for i, player := range record.Players {
+		if player.UserID == "" {
+			continue
+		}
+		playerStats := statsOf(stats, player.UserID)
+		playerStats.Played++
+		switch {
+		case record.Result.HasLeft(player.PlayerUUID):
+			playerStats.Left++
+		case record.Result.WinnerUUID == player.PlayerUUID:
+			playerStats.Won++
+		case record.Result.WinnerUUID != "":
+			playerStats.Lost++
+		}
+		playerStats.Rating = updated[i]
+		stats[player.UserID] = playerStats
+	}
+}
+
+// score is how well a player did in a game
+func score(result engine.GameResult, playerUUID string) float64 {
+	switch {
+	case result.WinnerUUID == playerUUID:
+		return rating.WIN
+	case result.WinnerUUID != "":
+		return rating.LOSS
+	}
+	return rating.TIE
+}
+
+// statsOf returns the stats of a user, with the default rating if they have none yet
+func statsOf(stats map[string]PlayerStats, userID string) PlayerStats {
+	playerStats, ok := stats[userID]
+	if !ok {
+		playerStats.Rating = rating.DEFAULT_RATING
+	}
+	return playerStats
+}
+
+// rankOf returns the position of a user among the users in stats
+func rankOf(stats map[string]PlayerStats, userID string) Rank {
+	rank := Rank{Of: len(stats)}
+	playerStats, ok := stats[userID]
+	if !ok {
+		return rank
+	}
+	rank.Position = 1
+	for _, other := range stats {
+		if other.Rating > playerStats.Rating {
+			rank.Position++
+		}
+	}
+	return rank
+}
+
+// listGames filters the games of a user out of records, newest first
+func listGames(records []GameRecord, userID string, limit int) []GameRecord {
+	games := []GameRecord{}
+	for _, record := range records {
+		if record.HasUser(userID) {
+			record.Replay = nil
+			games = append(games, record)
+		}
+	}
+	sort.SliceStable(games, func(i, j int) bool {
+		return games[i].EndedAt.After(games[j].EndedAt)
+	})
+	if limit > 0 && len(games) > limit {
+		games = games[:limit]
+	}
+	return games
+}
+
+// accountKey is the key of an account, so usernames are unique regardless of case
+func accountKey(username string) string {
+	return strings.ToLower(username)
+}
@@ -0,0 +1,141 @@
+package store
+
+import (
+	"errors"
+	"mexemexe/internal/auth"
+	"mexemexe/internal/engine"
+	"mexemexe/internal/rating"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testGame returns a finished game between alice (an account) and a guest
+func testGame(id string, endedAt time.Time, result engine.GameResult) GameRecord {
+	return GameRecord{
+		ID:        id,
+		StartedAt: endedAt.Add(-10 * time.Minute),
+		EndedAt:   endedAt,
+		Players: []PlayerRecord{
+			{PlayerUUID: "p-alice", UserID: "user-alice", Username: "alice"},
+			{PlayerUUID: "p-guest", Username: "guest"},
+		},
+		Result: result,
+		Replay: []byte("replay of " + id),
+	}
+}
+
+// testStore runs the checks every Store implementation must pass. reopen
+// returns the store as it is after a restart.
+func testStore(t *testing.T, s Store, reopen func() Store) {
+	account := auth.Account{ID: "user-alice", Username: "Alice", PasswordHash: []byte("hash"), CreatedAt: time.Now().UTC().Truncate(time.Second)}
+	if err := s.CreateAccount(account); err != nil {
+		t.Fatalf("CreateAccount() error: %v", err)
+	}
+	if err := s.CreateAccount(auth.Account{ID: "other", Username: "ALICE"}); !errors.Is(err, auth.ErrUsernameTaken) {
+		t.Errorf("CreateAccount() of a taken username in another case: %v", err)
+	}
+	if _, err := s.GetAccount("bob"); !errors.Is(err, auth.ErrAccountNotFound) {
+		t.Errorf("GetAccount() of an unknown username: %v", err)
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	won := testGame("game-1", now.Add(-2*time.Hour), engine.GameResult{Outcome: engine.OUTCOME_WON, WinnerUUID: "p-alice"})
+	lost := testGame("game-2", now.Add(-time.Hour), engine.GameResult{Outcome: engine.OUTCOME_DECK_EMPTY, WinnerUUID: "p-guest"})
+	tied := testGame("game-3", now.Add(-30*time.Minute), engine.GameResult{Outcome: engine.OUTCOME_DECK_EMPTY})
+	quit := testGame("game-4", now, engine.GameResult{
+		Outcome:     engine.OUTCOME_RESIGNED,
+		WinnerUUID:  "p-guest",
+		QuitterUUID: "p-alice",
+		Players:     []engine.PlayerResult{{UUID: "p-alice", Left: true}, {UUID: "p-guest"}},
+	})
+	// A game cut short by a shutdown is neither rated nor counted
+	abandoned := testGame("game-0", now.Add(-3*time.Hour), engine.GameResult{Outcome: engine.OUTCOME_ABANDONED, QuitterUUID: "p-alice"})
+	for _, record := range []GameRecord{abandoned, won, lost, tied, quit} {
+		if err := s.SaveGame(record); err != nil {
+			t.Fatalf("SaveGame(%s) error: %v", record.ID, err)
+		}
+	}
+	if err := s.SaveGame(won); err == nil {
+		t.Error("SaveGame() saved the same game twice")
+	}
+
+	// Alice plays a guest of the default rating every time
+	wantRating := rating.DEFAULT_RATING
+	for _, score := range []float64{rating.WIN, rating.LOSS, rating.TIE, rating.LOSS} {
+		wantRating = rating.Update([]float64{wantRating, rating.DEFAULT_RATING}, []float64{score, rating.TIE})[0]
+	}
+
+	check := func(s Store) {
+		t.Helper()
+		if got, err := s.GetAccount("alice"); err != nil || !reflect.DeepEqual(got, account) {
+			t.Errorf("GetAccount() = %+v, %v, want %+v", got, err, account)
+		}
+		if got, err := s.GetGame("game-2"); err != nil || !reflect.DeepEqual(got, lost) {
+			t.Errorf("GetGame() = %+v, %v, want %+v", got, err, lost)
+		}
+		if _, err := s.GetGame("game-9"); !errors.Is(err, ErrGameNotFound) {
+			t.Errorf("GetGame() of an unknown game: %v", err)
+		}
+
+		games, err := s.ListGames("user-alice", 3)
+		if err != nil {
+			t.Fatalf("ListGames() error: %v", err)
+		}
+		ids := []string{}
+		for _, game := range games {
+			ids = append(ids, game.ID)
+			if game.Replay != nil {
+				t.Errorf("ListGames() returned the replay of %s", game.ID)
+			}
+		}
+		if !reflect.DeepEqual(ids, []string{"game-4", "game-3", "game-2"}) {
+			t.Errorf("ListGames() = %v, want the 3 newest games", ids)
+		}
+		if games, _ := s.ListGames("", 0); len(games) != 0 {
+			t.Errorf("ListGames() of guests = %d games, want none", len(games))
+		}
+
+		want := PlayerStats{Played: 4, Won: 1, Lost: 1, Left: 1, Rating: wantRating}
+		if stats, err := s.GetStats("user-alice"); err != nil || stats != want {
+			t.Errorf("GetStats() = %+v, %v, want %+v", stats, err, want)
+		}
+		if stats, err := s.GetStats("user-bob"); err != nil || stats != (PlayerStats{Rating: rating.DEFAULT_RATING}) {
+			t.Errorf("GetStats() of a new account = %+v, %v", stats, err)
+		}
+		if rank, err := s.GetRank("user-alice"); err != nil || rank != (Rank{Position: 1, Of: 1}) {
+			t.Errorf("GetRank() = %+v, %v", rank, err)
+		}
+		if rank, _ := s.GetRank("user-bob"); rank != (Rank{Position: 0, Of: 1}) {
+			t.Errorf("GetRank() of an unrated account = %+v", rank)
+		}
+	}
+	check(s)
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close() error: %v", err)
+	}
+	if reopen != nil {
+		check(reopen())
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore(), nil)
+}
+
+func TestFileStore(t *testing.T) {
+	dir := t.TempDir()
+	open := func() Store {
+		s, err := NewFileStore(dir)
+		if err != nil {
+			t.Fatalf("NewFileStore() error: %v", err)
+		}
+		return s
+	}
+	testStore(t, open(), open)
+
+	s := open()
+	if err := s.SaveGame(GameRecord{ID: "../escape"}); err == nil {
+		t.Error("SaveGame() accepted an ID with a path in it")
+	}
+}